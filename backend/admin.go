@@ -5,12 +5,14 @@ import (
 	"crypto/rand"
 	"encoding/base64"
 	"encoding/json"
-	"log"
+	"log/slog"
 	"strings"
 	"time"
+	"zaps/api"
 	"zaps/services"
 
 	"github.com/gofiber/fiber/v2"
+	"github.com/google/uuid"
 	"github.com/redis/go-redis/v9"
 	"golang.org/x/crypto/bcrypt"
 )
@@ -49,14 +51,14 @@ func InitAdmin(rdb *redis.Client) {
 	if err != nil || count == 0 {
 		rdb.HSet(ctx, AdminWhitelistKey, "68.58.169.45", "Phi's IP")
 		rdb.HSet(ctx, AdminWhitelistKey, "127.0.0.1", "Localhost") // Often needed for internal health checks if on same net
-		log.Println("Admin: Initialized whitelist with 68.58.169.45")
+		slog.Info("admin whitelist initialized")
 	}
 
 	// 2. Ensure Default User
 	defaultUser := "philportman"
 	exists, err := rdb.Exists(ctx, AdminUserPrefix+defaultUser).Result()
 	if err != nil {
-		log.Printf("Admin: Error checking default user: %v", err)
+		slog.Error("admin: failed to check default user", "error", err)
 	}
 
 	if exists == 0 {
@@ -68,7 +70,7 @@ func InitAdmin(rdb *redis.Client) {
 			Role:         "superadmin",
 		}
 		SaveAdminUser(rdb, &user)
-		log.Printf("Admin: Created default user '%s'", defaultUser)
+		slog.Info("admin: created default user", "username", defaultUser)
 	}
 }
 
@@ -77,23 +79,9 @@ func InitAdmin(rdb *redis.Client) {
 // IPWhitelistMiddleware restricts access to allowed IPs
 func IPWhitelistMiddleware(rdb *redis.Client) fiber.Handler {
 	return func(c *fiber.Ctx) error {
-		// Check headers for real IP (Cloudflare/Caddy/Docker chain)
-		// Priority: CF-Connecting-IP > X-Forwarded-For > RemoteIP
-		clientIP := c.Get("CF-Connecting-IP")
-
-		if clientIP == "" {
-			// X-Forwarded-For can be a comma-separated list: "client, proxy1, proxy2"
-			forwarded := c.Get("X-Forwarded-For")
-			if forwarded != "" {
-				ips := strings.Split(forwarded, ",")
-				// The first IP is the true client IP
-				clientIP = strings.TrimSpace(ips[0])
-			}
-		}
-
-		if clientIP == "" {
-			clientIP = c.Context().RemoteIP().String()
-		}
+		// Socket address, or the client behind trusted proxies (Caddy/Docker chain).
+		// Client-supplied X-Forwarded-For entries are never used.
+		clientIP := api.ClientIP(c)
 
 		// Normalize IPv6 localhost
 		if clientIP == "::1" {
@@ -107,30 +95,24 @@ func IPWhitelistMiddleware(rdb *redis.Client) fiber.Handler {
 			return c.Next()
 		}
 
-		// Log for debugging (remove in prod if noisy)
-		// log.Printf("Admin Check: IP='%s' XFF='%s'", clientIP, xff)
-
 		if clientIP == "" {
 			// If we STILL can't determine IP, block it safe?
 			// Or allow 127.0.0.1 if really local?
-			log.Println("Admin Check: Empty IP detected, blocking.")
-			return c.Status(403).JSON(fiber.Map{"error": "Access Denied: Set X-Forwarded-For"})
+			slog.Warn("admin access blocked: empty client IP")
+			return c.Status(403).JSON(fiber.Map{"error": "Access Denied: Unknown client address"})
 		}
 
 		// Check Whitelist (Redis Hash: IP -> Label)
 		allowed, err := rdb.HExists(context.Background(), AdminWhitelistKey, clientIP).Result()
 		if err != nil {
-			log.Printf("Admin IP Check Error: %v", err)
+			slog.ErrorContext(c.UserContext(), "admin IP check failed", "error", err)
 			return c.SendStatus(500)
 		}
 
 		if !allowed {
-			// Debug: Log headers to see what we are missing
-			headers := ""
-			c.Request().Header.VisitAll(func(key, value []byte) {
-				headers += string(key) + "=" + string(value) + "; "
-			})
-			log.Printf("Admin Access Blocked: '%s' | Headers: %s", clientIP, headers)
+			// Only the addressing headers: the rest may carry credentials
+			slog.WarnContext(c.UserContext(), "admin access blocked: IP not whitelisted",
+				"ip", clientIP, "x_forwarded_for", c.Get(fiber.HeaderXForwardedFor))
 			return c.Status(403).JSON(fiber.Map{"error": "Access Denied: IP not whitelisted"})
 		}
 
@@ -260,9 +242,9 @@ func HandleListKeys(rdb *redis.Client) fiber.Handler {
 		var response []map[string]interface{}
 		for _, k := range keys {
 			// Prefix logic
-			displayPrefix := "gk_???..."
-			if len(k.Key) > 12 {
-				displayPrefix = k.Key[:12] + "..."
+			displayPrefix := k.Prefix
+			if displayPrefix == "" {
+				displayPrefix = "gk_???..."
 			}
 
 			response = append(response, map[string]interface{}{
@@ -270,7 +252,7 @@ func HandleListKeys(rdb *redis.Client) fiber.Handler {
 				"name":    k.Name,
 				"created": k.CreatedAt,
 				"enabled": k.Enabled,
-				"key_id":  services.RedisKeyPrefix + k.Key, // Internal Redis key for Deletion
+				"key_id":  services.RedisKeyPrefix + k.KeyHash, // Internal Redis key for Deletion
 			})
 		}
 
@@ -284,63 +266,61 @@ func HandleGenerateKey(rdb *redis.Client) fiber.Handler {
 		username := c.Locals("admin_user").(string)
 
 		var req struct {
-			Name string `json:"name"`
+			Name     string `json:"name"`
+			TenantID string `json:"tenant_id"` // Optional: create a tenant key instead of an admin-owned one
 		}
 		if err := c.BodyParser(&req); err != nil || req.Name == "" {
 			return c.Status(400).JSON(fiber.Map{"error": "Name required"})
 		}
 
-		key, err := services.GenerateAPIKey()
-		if err != nil {
-			return c.Status(500).JSON(fiber.Map{"error": "Failed to generate key"})
-		}
-
-		now := time.Now()
-		meta := &services.APIKey{
-			Key:       key,
-			Name:      req.Name,
-			CreatedAt: now,
-			Enabled:   true,
-			OwnerID:   username, // Assign to current admin user
+		var key *services.APIKey
+		var err error
+		if req.TenantID != "" {
+			if _, perr := uuid.Parse(req.TenantID); perr != nil {
+				return c.Status(400).JSON(fiber.Map{"error": "Invalid tenant_id"})
+			}
+			key, err = services.CreateTenantAPIKey(rdb, &services.NewTenantAPIKey{
+				TenantID: req.TenantID,
+				Name:     req.Name,
+			})
+		} else {
+			key, err = services.CreateAdminAPIKey(rdb, username, req.Name) // Assign to current admin user
 		}
-
-		if err := services.StoreAPIKey(rdb, meta); err != nil {
+		if err != nil {
 			return c.Status(500).JSON(fiber.Map{"error": "Failed to save key"})
 		}
 
 		return c.JSON(fiber.Map{
 			"status":  "created",
-			"key":     key,
-			"name":    req.Name,
-			"created": now.Format(time.RFC3339),
+			"key":     key.Key,
+			"name":    key.Name,
+			"created": key.CreatedAt.Format(time.RFC3339),
 		})
 	}
 }
 
-// HandleDeleteKey deletes an API key (disable or hard delete?)
+// HandleDeleteKey permanently revokes an API key on every replica
 func HandleDeleteKey(rdb *redis.Client) fiber.Handler {
 	return func(c *fiber.Ctx) error {
 		var req struct {
-			Key string `json:"key"` // internal redis key 'apikey:gk_...'
+			Key string `json:"key"` // internal redis key 'apikey:<hash>'
 		}
 		if err := c.BodyParser(&req); err != nil {
 			return c.Status(400).JSON(fiber.Map{"error": "Invalid request"})
 		}
 
-		// Ensure we are deleting correct keys
-		if !strings.HasPrefix(req.Key, "apikey:gk_") && !strings.HasPrefix(req.Key, "gk_") {
-			// Handle migration: if passed raw gk_, prepend.
-			// But UI sends what ListKeys sent as 'key_id'.
-			// If ListKeys sent 'apikey:gk_', then we are good.
-		}
-
-		// Safety:
+		// UI sends what ListKeys sent as 'key_id' ('apikey:<hash>'); a raw gk_ key is hashed first
 		targetKey := req.Key
-		if strings.HasPrefix(targetKey, "gk_") {
-			targetKey = "apikey:" + targetKey
+		if strings.HasPrefix(targetKey, services.ApiKeyPrefix) {
+			targetKey = services.RedisKeyPrefix + services.HashAPIKey(targetKey)
+		}
+		if !strings.HasPrefix(targetKey, services.RedisKeyPrefix) {
+			return c.Status(400).JSON(fiber.Map{"error": "Invalid key"})
 		}
 
-		rdb.Del(context.Background(), targetKey)
+		if err := services.RevokeAPIKeyHash(rdb, strings.TrimPrefix(targetKey, services.RedisKeyPrefix)); err != nil {
+			return c.Status(500).JSON(fiber.Map{"error": "Failed to delete key"})
+		}
 		return c.JSON(fiber.Map{"status": "deleted"})
 	}
 }
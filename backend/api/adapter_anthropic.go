@@ -38,8 +38,10 @@ type Content struct {
 }
 
 type Usage struct {
-	InputTokens  int `json:"input_tokens"`
-	OutputTokens int `json:"output_tokens"`
+	InputTokens              int `json:"input_tokens"`
+	OutputTokens             int `json:"output_tokens"`
+	CacheCreationInputTokens int `json:"cache_creation_input_tokens"`
+	CacheReadInputTokens     int `json:"cache_read_input_tokens"`
 }
 
 // OpenAI Response Structure (Partial, for mapping)
@@ -64,9 +66,14 @@ type OpenAIMessage struct {
 }
 
 type OpenAIUsage struct {
-	PromptTokens     int `json:"prompt_tokens"`
-	CompletionTokens int `json:"completion_tokens"`
-	TotalTokens      int `json:"total_tokens"`
+	PromptTokens        int                        `json:"prompt_tokens"`
+	CompletionTokens    int                        `json:"completion_tokens"`
+	TotalTokens         int                        `json:"total_tokens"`
+	PromptTokensDetails *OpenAIPromptTokensDetails `json:"prompt_tokens_details,omitempty"`
+}
+
+type OpenAIPromptTokensDetails struct {
+	CachedTokens int `json:"cached_tokens"`
 }
 
 // ConvertOpenAIToAnthropic converts an OpenAI-style request body to Anthropic format
@@ -153,6 +160,9 @@ func ConvertAnthropicToOpenAI(anthropicBody []byte) ([]byte, error) {
 		finishReason = "length"
 	}
 
+	// Anthropic reports cache reads/writes separately from input_tokens
+	promptTokens := antResp.Usage.InputTokens + antResp.Usage.CacheCreationInputTokens + antResp.Usage.CacheReadInputTokens
+
 	// Construct OpenAI Response
 	oaiResp := OpenAIResponse{
 		ID:      antResp.ID,
@@ -170,11 +180,14 @@ func ConvertAnthropicToOpenAI(anthropicBody []byte) ([]byte, error) {
 			},
 		},
 		Usage: OpenAIUsage{
-			PromptTokens:     antResp.Usage.InputTokens,
+			PromptTokens:     promptTokens,
 			CompletionTokens: antResp.Usage.OutputTokens,
-			TotalTokens:      antResp.Usage.InputTokens + antResp.Usage.OutputTokens,
+			TotalTokens:      promptTokens + antResp.Usage.OutputTokens,
 		},
 	}
+	if antResp.Usage.CacheReadInputTokens > 0 {
+		oaiResp.Usage.PromptTokensDetails = &OpenAIPromptTokensDetails{CachedTokens: antResp.Usage.CacheReadInputTokens}
+	}
 
 	return json.Marshal(oaiResp)
 }
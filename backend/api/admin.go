@@ -3,6 +3,7 @@ package api
 import (
 	"database/sql"
 	"zaps/db"
+	"zaps/services"
 
 	"github.com/gofiber/fiber/v2"
 )
@@ -71,7 +72,8 @@ func HandleListTenants(c *fiber.Ctx) error {
 func HandleUpdateTenant(c *fiber.Ctx) error {
 	id := c.Params("id")
 	var req struct {
-		MonthlyQuota int `json:"monthly_quota"`
+		MonthlyQuota int                  `json:"monthly_quota"`
+		RateLimits   *services.RateLimits `json:"rate_limits,omitempty"` // Tenant-wide RPM/TPM (0 = unlimited)
 	}
 	if err := c.BodyParser(&req); err != nil {
 		return c.Status(400).JSON(fiber.Map{"error": "Invalid request"})
@@ -82,5 +84,11 @@ func HandleUpdateTenant(c *fiber.Ctx) error {
 		return c.Status(500).JSON(fiber.Map{"error": "Failed to update tenant"})
 	}
 
+	if req.RateLimits != nil {
+		if err := services.SetTenantRateLimits(id, *req.RateLimits); err != nil {
+			return c.Status(400).JSON(fiber.Map{"error": err.Error()})
+		}
+	}
+
 	return c.JSON(fiber.Map{"status": "updated"})
 }
@@ -0,0 +1,202 @@
+package api
+
+import (
+	"fmt"
+	"time"
+
+	"zaps/db"
+	"zaps/services"
+
+	"github.com/gofiber/fiber/v2"
+	"github.com/google/uuid"
+)
+
+// Bucket sizes accepted by ?granularity, mapped to date_trunc units
+var granularities = map[string]time.Duration{
+	"hour":  time.Hour,
+	"day":   24 * time.Hour,
+	"week":  7 * 24 * time.Hour,
+	"month": 31 * 24 * time.Hour,
+}
+
+// maxBuckets caps the number of points a single time series query may return
+const maxBuckets = 2000
+
+// timeRange is a parsed ?from=&to=&granularity= query
+type timeRange struct {
+	From        time.Time
+	To          time.Time
+	Granularity string
+}
+
+// parseTimeRange reads from/to (RFC 3339 or YYYY-MM-DD, default the last 7 days) and
+// granularity (hour, day, week, month; default hour for ranges up to 2 days, else day)
+func parseTimeRange(c *fiber.Ctx) (*timeRange, error) {
+	now := time.Now()
+	to, err := parseTimeQuery(c, "to", now)
+	if err != nil {
+		return nil, err
+	}
+	from, err := parseTimeQuery(c, "from", to.Add(-7*24*time.Hour))
+	if err != nil {
+		return nil, err
+	}
+	if !from.Before(to) {
+		return nil, fmt.Errorf("from must be before to")
+	}
+
+	g := c.Query("granularity")
+	if g == "" {
+		g = "day"
+		if to.Sub(from) <= 48*time.Hour {
+			g = "hour"
+		}
+	}
+	step, ok := granularities[g]
+	if !ok {
+		return nil, fmt.Errorf("granularity must be hour, day, week or month")
+	}
+	if to.Sub(from)/step > maxBuckets {
+		return nil, fmt.Errorf("range too large for %s granularity (max %d buckets)", g, maxBuckets)
+	}
+
+	return &timeRange{From: from, To: to, Granularity: g}, nil
+}
+
+// parseTimeQuery reads a query parameter as RFC 3339 or YYYY-MM-DD, returning def when it is absent
+func parseTimeQuery(c *fiber.Ctx, name string, def time.Time) (time.Time, error) {
+	if c.Query(name) == "" {
+		return def, nil
+	}
+	return parseTimeValue(name, c.Query(name))
+}
+
+func parseTimeValue(name, v string) (time.Time, error) {
+	if t, err := time.Parse(time.RFC3339, v); err == nil {
+		return t, nil
+	}
+	if t, err := time.Parse("2006-01-02", v); err == nil {
+		return t, nil
+	}
+	return time.Time{}, fmt.Errorf("%s must be RFC 3339 or YYYY-MM-DD", name)
+}
+
+// GetPIITrends returns PII detections per entity type over time.
+// Optional ?type= limits the series to one entity type.
+func GetPIITrends(c *fiber.Ctx) error {
+	tenantID, _ := uuid.Parse(c.Locals("tenant_id").(string))
+
+	tr, err := parseTimeRange(c)
+	if err != nil {
+		return c.Status(400).JSON(fiber.Map{"error": err.Error()})
+	}
+	entityType := c.Query("type")
+
+	rows, err := db.DB.Query(`
+		SELECT date_trunc($4, u.hour_bucket) AS bucket, e.key, SUM(e.value::bigint)
+		FROM usage_logs u, jsonb_each_text(u.pii_events) e
+		WHERE u.tenant_id = $1 AND u.hour_bucket >= $2 AND u.hour_bucket < $3
+			AND ($5 = '' OR e.key = $5)
+		GROUP BY bucket, e.key
+		ORDER BY bucket ASC
+	`, tenantID, tr.From, tr.To, tr.Granularity, entityType)
+	if err != nil {
+		return c.Status(500).JSON(fiber.Map{"error": "Failed to fetch PII trends"})
+	}
+	defer rows.Close()
+
+	type point struct {
+		Bucket time.Time        `json:"bucket"`
+		Total  int64            `json:"total"`
+		Counts map[string]int64 `json:"counts"`
+	}
+	series := []*point{}
+	totals := map[string]int64{}
+	for rows.Next() {
+		var bucket time.Time
+		var typ string
+		var count int64
+		if err := rows.Scan(&bucket, &typ, &count); err != nil {
+			continue
+		}
+		if len(series) == 0 || !series[len(series)-1].Bucket.Equal(bucket) {
+			series = append(series, &point{Bucket: bucket, Counts: map[string]int64{}})
+		}
+		p := series[len(series)-1]
+		p.Counts[typ] = count
+		p.Total += count
+		totals[typ] += count
+	}
+
+	return c.JSON(fiber.Map{
+		"from":        tr.From,
+		"to":          tr.To,
+		"granularity": tr.Granularity,
+		"series":      series,
+		"totals":      totals,
+	})
+}
+
+// GetAnalytics returns request counts, error rates, p50/p95/p99 latency, tokens and cost
+// over ?from=&to= per ?granularity bucket, optionally split by ?group_by=model|provider|key|status
+func GetAnalytics(c *fiber.Ctx) error {
+	tenantID := c.Locals("tenant_id").(string)
+
+	tr, err := parseTimeRange(c)
+	if err != nil {
+		return c.Status(400).JSON(fiber.Map{"error": err.Error()})
+	}
+	groupBy := c.Query("group_by")
+	if groupBy != "" && !isAnalyticsGroup(groupBy) {
+		return c.Status(400).JSON(fiber.Map{"error": "group_by must be model, provider, key or status"})
+	}
+
+	res, err := services.QueryAnalytics(services.AnalyticsQuery{
+		TenantID:    tenantID,
+		From:        tr.From,
+		To:          tr.To,
+		Granularity: tr.Granularity,
+		GroupBy:     groupBy,
+	})
+	if err != nil {
+		return c.Status(500).JSON(fiber.Map{"error": "Failed to fetch analytics"})
+	}
+
+	response := fiber.Map{
+		"from":        tr.From,
+		"to":          tr.To,
+		"granularity": tr.Granularity,
+		"group_by":    groupBy,
+		"series":      res.Series,
+		"summary":     res.Summary,
+	}
+	if groupBy != "" {
+		response["groups"] = res.Groups
+	}
+
+	// Label key groups with their names (revoked keys and sessions have none)
+	if groupBy == services.GroupByKey {
+		names := map[string]string{}
+		rows, err := db.DB.Query("SELECT id, name FROM api_keys WHERE tenant_id = $1", tenantID)
+		if err == nil {
+			defer rows.Close()
+			for rows.Next() {
+				var id, name string
+				if rows.Scan(&id, &name) == nil {
+					names[id] = name
+				}
+			}
+		}
+		response["key_names"] = names
+	}
+
+	return c.JSON(response)
+}
+
+func isAnalyticsGroup(g string) bool {
+	switch g {
+	case services.GroupByModel, services.GroupByProvider, services.GroupByKey, services.GroupByStatus:
+		return true
+	}
+	return false
+}
@@ -0,0 +1,278 @@
+package api
+
+import (
+	"database/sql"
+	"fmt"
+	"os"
+	"strings"
+	"time"
+
+	"zaps/services"
+
+	"github.com/gofiber/fiber/v2"
+	"github.com/google/uuid"
+)
+
+// VerifyAuditChain walks the tenant's audit hash chain and reports the first broken
+// link, if any, along with how many signed checkpoints were verified
+func VerifyAuditChain(c *fiber.Ctx) error {
+	tenantID := c.Locals("tenant_id").(string)
+
+	report, err := services.VerifyAuditChain(c.UserContext(), tenantID)
+	if err != nil {
+		return c.Status(500).JSON(fiber.Map{"error": "Failed to verify audit log"})
+	}
+	return c.JSON(report)
+}
+
+// GetAuditSinks lists the tenant's audit sinks with their delivery state
+func GetAuditSinks(c *fiber.Ctx) error {
+	tenantID, _ := uuid.Parse(c.Locals("tenant_id").(string))
+
+	sinks, err := services.ListAuditSinks(c.UserContext(), tenantID)
+	if err != nil {
+		return c.Status(500).JSON(fiber.Map{"error": "Failed to fetch audit sinks"})
+	}
+	return c.JSON(sinks)
+}
+
+// SaveAuditSink creates an audit sink (POST) or updates one (PUT /:id)
+func SaveAuditSink(c *fiber.Ctx) error {
+	tenantID, _ := uuid.Parse(c.Locals("tenant_id").(string))
+
+	req := services.AuditSink{Enabled: true}
+	if err := c.BodyParser(&req); err != nil {
+		return c.Status(400).JSON(fiber.Map{"error": "Invalid request"})
+	}
+
+	eventType := "AUDIT_SINK_CREATED"
+	if id := c.Params("id"); id != "" {
+		parsed, err := uuid.Parse(id)
+		if err != nil {
+			return c.Status(400).JSON(fiber.Map{"error": "Invalid sink ID"})
+		}
+		req.ID = parsed
+		eventType = "AUDIT_SINK_UPDATED"
+	} else {
+		req.ID = uuid.Nil
+	}
+
+	err := services.SaveAuditSink(c.UserContext(), tenantID, &req)
+	if err == sql.ErrNoRows {
+		return c.Status(404).JSON(fiber.Map{"error": "Audit sink not found"})
+	}
+	if err != nil {
+		return c.Status(400).JSON(fiber.Map{"error": err.Error()})
+	}
+
+	services.LogAuditAsync(tenantID.String(), nil, eventType, map[string]interface{}{
+		"sink_id":  req.ID.String(),
+		"type":     req.Type,
+		"format":   req.Format,
+		"endpoint": req.Endpoint,
+		"enabled":  req.Enabled,
+	}, c.IP(), c.Get("User-Agent"))
+
+	sink, err := services.GetAuditSink(c.UserContext(), tenantID, req.ID.String())
+	if err != nil {
+		return c.Status(500).JSON(fiber.Map{"error": "Failed to fetch audit sink"})
+	}
+	sink.Secret = req.Secret // Generated webhook secret, shown once
+	return c.JSON(sink)
+}
+
+// DeleteAuditSink removes an audit sink and its dead letters
+func DeleteAuditSink(c *fiber.Ctx) error {
+	tenantID, _ := uuid.Parse(c.Locals("tenant_id").(string))
+
+	found, err := services.DeleteAuditSink(c.UserContext(), tenantID, c.Params("id"))
+	if err != nil {
+		return c.Status(500).JSON(fiber.Map{"error": "Failed to delete audit sink"})
+	}
+	if !found {
+		return c.Status(404).JSON(fiber.Map{"error": "Audit sink not found"})
+	}
+
+	services.LogAuditAsync(tenantID.String(), nil, "AUDIT_SINK_DELETED", map[string]interface{}{
+		"sink_id": c.Params("id"),
+	}, c.IP(), c.Get("User-Agent"))
+
+	return c.JSON(fiber.Map{"status": "deleted"})
+}
+
+// TestAuditSink sends a synthetic event to the sink and reports the outcome
+func TestAuditSink(c *fiber.Ctx) error {
+	sink, err := tenantAuditSink(c)
+	if sink == nil {
+		return err
+	}
+
+	latency, err := services.TestAuditSink(c.UserContext(), sink)
+	if err != nil {
+		return c.Status(502).JSON(fiber.Map{
+			"delivered":  false,
+			"error":      err.Error(),
+			"latency_ms": latency.Milliseconds(),
+		})
+	}
+	return c.JSON(fiber.Map{"delivered": true, "latency_ms": latency.Milliseconds()})
+}
+
+// GetAuditSinkDeadLetters lists batches the sink gave up on
+func GetAuditSinkDeadLetters(c *fiber.Ctx) error {
+	sink, err := tenantAuditSink(c)
+	if sink == nil {
+		return err
+	}
+
+	letters, err := services.ListAuditSinkDeadLetters(c.UserContext(), sink.ID)
+	if err != nil {
+		return c.Status(500).JSON(fiber.Map{"error": "Failed to fetch dead letters"})
+	}
+	return c.JSON(letters)
+}
+
+// RetryAuditSinkDeadLetters resends dead-lettered batches, stopping at the first failure
+func RetryAuditSinkDeadLetters(c *fiber.Ctx) error {
+	sink, err := tenantAuditSink(c)
+	if sink == nil {
+		return err
+	}
+
+	delivered, err := services.RetryAuditSinkDeadLetters(c.UserContext(), sink)
+	if err != nil {
+		return c.Status(502).JSON(fiber.Map{"delivered": delivered, "error": err.Error()})
+	}
+	return c.JSON(fiber.Map{"delivered": delivered})
+}
+
+// tenantAuditSink loads the :id sink. When it returns nil it has already written the
+// 404/500 response, and err is the result of writing it.
+func tenantAuditSink(c *fiber.Ctx) (*services.AuditSink, error) {
+	tenantID, _ := uuid.Parse(c.Locals("tenant_id").(string))
+
+	sink, err := services.GetAuditSink(c.UserContext(), tenantID, c.Params("id"))
+	if err == sql.ErrNoRows {
+		return nil, c.Status(404).JSON(fiber.Map{"error": "Audit sink not found"})
+	}
+	if err != nil {
+		return nil, c.Status(500).JSON(fiber.Map{"error": "Failed to fetch audit sink"})
+	}
+	return sink, nil
+}
+
+// auditExportRequest is the body of POST /reports/exports
+type auditExportRequest struct {
+	Format     string   `json:"format"`
+	From       string   `json:"from"`
+	To         string   `json:"to"`
+	EventTypes []string `json:"event_types"`
+	APIKeyID   string   `json:"api_key_id"`
+	UserID     string   `json:"user_id"`
+}
+
+// CreateAuditExport queues an export job for ranges too large to stream directly
+func CreateAuditExport(c *fiber.Ctx) error {
+	tenantID, _ := uuid.Parse(c.Locals("tenant_id").(string))
+
+	var req auditExportRequest
+	if err := c.BodyParser(&req); err != nil {
+		return c.Status(400).JSON(fiber.Map{"error": "Invalid request"})
+	}
+	if req.Format == "" {
+		req.Format = services.AuditExportCSV
+	}
+
+	// Same filters as the synchronous export, given in the body
+	body := map[string]string{"from": req.From, "to": req.To, "type": strings.Join(req.EventTypes, ","),
+		"api_key_id": req.APIKeyID, "user_id": req.UserID}
+	filter, err := parseAuditFilter(func(key string, _ ...string) string { return body[key] })
+	if err != nil {
+		return c.Status(400).JSON(fiber.Map{"error": err.Error()})
+	}
+
+	var requestedBy *uuid.UUID
+	if id, err := uuid.Parse(fmt.Sprint(c.Locals("user_id"))); err == nil {
+		requestedBy = &id
+	}
+	export, err := services.CreateAuditExport(c.UserContext(), tenantID, requestedBy, req.Format, filter)
+	if err != nil {
+		return c.Status(400).JSON(fiber.Map{"error": err.Error()})
+	}
+
+	services.LogAuditAsync(tenantID.String(), nil, "AUDIT_EXPORT_REQUESTED", map[string]interface{}{
+		"export_id": export.ID.String(),
+		"format":    export.Format,
+	}, c.IP(), c.Get("User-Agent"))
+
+	return c.Status(202).JSON(withDownloadURL(export))
+}
+
+// GetAuditExports lists the tenant's recent export jobs
+func GetAuditExports(c *fiber.Ctx) error {
+	tenantID, _ := uuid.Parse(c.Locals("tenant_id").(string))
+
+	exports, err := services.ListAuditExports(c.UserContext(), tenantID)
+	if err != nil {
+		return c.Status(500).JSON(fiber.Map{"error": "Failed to fetch exports"})
+	}
+	for _, e := range exports {
+		withDownloadURL(e)
+	}
+	return c.JSON(exports)
+}
+
+// GetAuditExport returns one export job's status
+func GetAuditExport(c *fiber.Ctx) error {
+	tenantID, _ := uuid.Parse(c.Locals("tenant_id").(string))
+
+	export, err := services.GetAuditExport(c.UserContext(), tenantID, c.Params("id"))
+	if err == sql.ErrNoRows {
+		return c.Status(404).JSON(fiber.Map{"error": "Export not found"})
+	}
+	if err != nil {
+		return c.Status(500).JSON(fiber.Map{"error": "Failed to fetch export"})
+	}
+	return c.JSON(withDownloadURL(export))
+}
+
+// DownloadAuditExport sends a completed export's file
+func DownloadAuditExport(c *fiber.Ctx) error {
+	tenantID, _ := uuid.Parse(c.Locals("tenant_id").(string))
+
+	export, err := services.GetAuditExport(c.UserContext(), tenantID, c.Params("id"))
+	if err == sql.ErrNoRows {
+		return c.Status(404).JSON(fiber.Map{"error": "Export not found"})
+	}
+	if err != nil {
+		return c.Status(500).JSON(fiber.Map{"error": "Failed to fetch export"})
+	}
+	if export.Status != services.AuditExportCompleted {
+		return c.Status(409).JSON(fiber.Map{"error": "Export is " + export.Status})
+	}
+	if export.ExpiresAt != nil && time.Now().After(*export.ExpiresAt) {
+		return c.Status(410).JSON(fiber.Map{"error": "Export has expired"})
+	}
+	if _, err := os.Stat(export.FilePath); err != nil {
+		return c.Status(410).JSON(fiber.Map{"error": "Export file is no longer available"})
+	}
+
+	services.LogAuditAsync(tenantID.String(), nil, "AUDIT_EXPORT_DOWNLOADED", map[string]interface{}{
+		"export_id": export.ID.String(),
+	}, c.IP(), c.Get("User-Agent"))
+
+	contentType, ext := services.AuditExportContentType(export.Format)
+	c.Set("Content-Type", contentType)
+	if export.SHA256 != nil {
+		c.Set("X-Content-SHA256", *export.SHA256)
+	}
+	return c.Download(export.FilePath, fmt.Sprintf("audit_log_%s.%s", export.ID, ext))
+}
+
+// withDownloadURL sets the download link on completed exports
+func withDownloadURL(e *services.AuditExport) *services.AuditExport {
+	if e.Status == services.AuditExportCompleted {
+		e.DownloadURL = "/api/dashboard/reports/exports/" + e.ID.String() + "/download"
+	}
+	return e
+}
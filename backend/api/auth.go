@@ -3,7 +3,7 @@ package api
 import (
 	"database/sql"
 	"fmt"
-	"log"
+	"log/slog"
 	"os"
 	"strings"
 	"time"
@@ -502,7 +502,7 @@ func HandleResetPassword(rdb *redis.Client) fiber.Handler {
 		err = rdb.Set(c.Context(), fmt.Sprintf("user:%s:min_iat", userID), minIAT, 24*time.Hour).Err()
 		if err != nil {
 			// Non-fatal, but log it
-			fmt.Printf("⚠️ Failed to set min_iat for user %s: %v\n", userID, err)
+			slog.WarnContext(c.UserContext(), "failed to set min_iat", "user_id", userID, "error", err)
 		}
 
 		return c.JSON(fiber.Map{"message": "Password reset successfully. You can now log in."})
@@ -600,7 +600,7 @@ func LoginWithProvider(c *fiber.Ctx, email, provider, providerID, picture string
 			query := fmt.Sprintf("UPDATE users SET %s = $1, avatar_url = $2, email_verified = TRUE WHERE id = $3", providerColumn)
 			_, err = db.DB.Exec(query, providerID, picture, user.ID)
 			if err != nil {
-				log.Printf("Failed to link provider ID: %v\n", err)
+				slog.WarnContext(c.UserContext(), "failed to link OAuth provider ID", "error", err)
 			}
 		}
 	}
@@ -3,7 +3,7 @@ package api
 import (
 	"encoding/json"
 	"fmt"
-	"log"
+	"log/slog"
 	"os"
 	"time"
 
@@ -18,7 +18,6 @@ import (
 
 // HandleCreateCheckoutSession creates a Stripe Checkout session
 func HandleCreateCheckoutSession(c *fiber.Ctx) error {
-	log.Println("💰 Starting Checkout Session Creation...")
 	tenantID, _ := uuid.Parse(c.Locals("tenant_id").(string))
 	userID, _ := uuid.Parse(c.Locals("user_id").(string))
 
@@ -26,12 +25,10 @@ func HandleCreateCheckoutSession(c *fiber.Ctx) error {
 		PriceID string `json:"priceID"`
 	}
 	if err := c.BodyParser(&req); err != nil {
-		log.Printf("❌ Invalid request body: %v", err)
+		slog.WarnContext(c.UserContext(), "checkout: invalid request body", "error", err)
 		return c.Status(400).JSON(fiber.Map{"error": "Invalid request"})
 	}
 
-	log.Printf("🔍 Requested Price ID: %s", req.PriceID)
-
 	// 1. Get Tenant details
 	var stripeCustomerID string
 	var tenantName string
@@ -39,36 +36,33 @@ func HandleCreateCheckoutSession(c *fiber.Ctx) error {
 
 	err := db.DB.QueryRow("SELECT name, COALESCE(stripe_customer_id, '') FROM tenants WHERE id = $1", tenantID).Scan(&tenantName, &stripeCustomerID)
 	if err != nil {
-		log.Printf("❌ Failed to fetch tenant details: %v", err)
+		slog.ErrorContext(c.UserContext(), "checkout: failed to fetch tenant", "error", err)
 		return c.Status(500).JSON(fiber.Map{"error": "Failed to fetch tenant"})
 	}
 
 	// Get user email for customer creation
 	err = db.DB.QueryRow("SELECT email FROM users WHERE id = $1", userID).Scan(&email)
 	if err != nil {
-		log.Printf("❌ Failed to fetch user email: %v", err)
+		slog.ErrorContext(c.UserContext(), "checkout: failed to fetch user email", "error", err)
 		return c.Status(500).JSON(fiber.Map{"error": "Failed to fetch user email"})
 	}
 
-	log.Printf("👤 Tenant: %s, Customer ID: %s, Email: %s", tenantName, stripeCustomerID, email)
-
 	// 2. Create Customer if missing
 	if stripeCustomerID == "" {
-		log.Println("🆕 Creating new Stripe Customer...")
 		newCustID, err := services.CreateStripeCustomer(email, tenantName, map[string]string{
 			"tenant_id": tenantID.String(),
 		})
 		if err != nil {
-			log.Printf("❌ Failed to create Stripe customer: %v", err)
+			slog.ErrorContext(c.UserContext(), "checkout: failed to create Stripe customer", "error", err)
 			return c.Status(500).JSON(fiber.Map{"error": "Failed to create Stripe customer: " + err.Error()})
 		}
 		stripeCustomerID = newCustID
-		log.Printf("✅ Created Customer: %s", stripeCustomerID)
+		slog.InfoContext(c.UserContext(), "checkout: created Stripe customer", "customer_id", stripeCustomerID)
 
 		// Save to DB
 		_, err = db.DB.Exec("UPDATE tenants SET stripe_customer_id = $1 WHERE id = $2", stripeCustomerID, tenantID)
 		if err != nil {
-			log.Printf("⚠️ Failed to save stripe_customer_id to DB (non-fatal): %v", err)
+			slog.WarnContext(c.UserContext(), "checkout: failed to save stripe_customer_id", "error", err)
 		}
 	}
 
@@ -79,19 +73,16 @@ func HandleCreateCheckoutSession(c *fiber.Ctx) error {
 		baseURL = "https://zaps.ai" // Default prod
 	}
 
-	log.Printf("🔗 Base URL: %s", baseURL)
-
 	successURL := fmt.Sprintf("%s/dashboard/billing?success=true", baseURL)
 	cancelURL := fmt.Sprintf("%s/dashboard/billing?canceled=true", baseURL)
 
-	log.Println("🚀 Creating Checkout Session...")
 	url, err := services.CreateCheckoutSession(stripeCustomerID, req.PriceID, successURL, cancelURL)
 	if err != nil {
-		log.Printf("❌ Failed to create checkout session: %v", err)
+		slog.ErrorContext(c.UserContext(), "checkout: failed to create session", "price_id", req.PriceID, "error", err)
 		return c.Status(500).JSON(fiber.Map{"error": "Failed to create checkout session: " + err.Error()})
 	}
 
-	log.Printf("✅ Session Created: %s", url)
+	slog.InfoContext(c.UserContext(), "checkout session created", "price_id", req.PriceID)
 	return c.JSON(fiber.Map{"url": url})
 }
 
@@ -133,7 +124,7 @@ func HandleStripeWebhook(c *fiber.Ctx) error {
 	if err != nil {
 		// If secret is not set (dev mode), try parsing without verification or just log warning
 		if endpointSecret == "" {
-			log.Println("⚠️ STRIPE_WEBHOOK_SECRET not set, skipping signature verification (DEV MODE)")
+			slog.Warn("STRIPE_WEBHOOK_SECRET not set, skipping signature verification (dev mode)")
 			e, err := UnsafeParseEvent(payload)
 			if err != nil {
 				return c.Status(400).SendString("Invalid payload")
@@ -188,12 +179,12 @@ func handleCheckoutCompleted(session *stripe.CheckoutSession) {
 	customerID := session.Customer.ID
 	subscriptionID := session.Subscription.ID
 
-	log.Printf("💰 Checkout Completed: Customer %s, Sub %s", customerID, subscriptionID)
+	slog.Info("stripe checkout completed", "customer_id", customerID, "subscription_id", subscriptionID)
 
 	// Fetch Subscription details to get status and plan
 	sub, err := services.GetStripeSubscription(subscriptionID)
 	if err != nil {
-		log.Printf("❌ Failed to fetch subscription details: %v", err)
+		slog.Error("stripe: failed to fetch subscription", "subscription_id", subscriptionID, "error", err)
 		return
 	}
 
@@ -217,7 +208,7 @@ func handleSubscriptionUpdated(sub *stripe.Subscription) {
 	}
 	// Enterprise handled manually via sales for now
 
-	log.Printf("🔄 Syncing Subscription: %s is %s (%s) - Quota: %d", customerID, status, tier, quota)
+	slog.Info("stripe subscription sync", "customer_id", customerID, "status", status, "tier", tier, "quota", quota)
 
 	// Update Tenants Table
 	_, err := db.DB.Exec(`
@@ -229,7 +220,7 @@ func handleSubscriptionUpdated(sub *stripe.Subscription) {
 	`, tier, quota, customerID)
 
 	if err != nil {
-		log.Printf("❌ Failed to update tenant tier: %v", err)
+		slog.Error("stripe: failed to update tenant tier", "customer_id", customerID, "error", err)
 	}
 
 	// Update/Insert Subscriptions Table
@@ -237,7 +228,7 @@ func handleSubscriptionUpdated(sub *stripe.Subscription) {
 	var tenantID string
 	err = db.DB.QueryRow("SELECT id FROM tenants WHERE stripe_customer_id = $1", customerID).Scan(&tenantID)
 	if err != nil {
-		log.Printf("❌ Tenant not found for customer %s", customerID)
+		slog.Error("stripe: tenant not found for customer", "customer_id", customerID)
 		return
 	}
 
@@ -261,14 +252,14 @@ func handleSubscriptionUpdated(sub *stripe.Subscription) {
 	`, tenantID, sub.ID, priceID, tier, status, currentStart, currentEnd)
 
 	if err != nil {
-		log.Printf("❌ Failed to upsert subscription: %v", err)
+		slog.Error("stripe: failed to upsert subscription", "customer_id", customerID, "error", err)
 	}
 }
 
 // handleSubscriptionDeleted downgrades tenant to free
 func handleSubscriptionDeleted(sub *stripe.Subscription) {
 	customerID := sub.Customer.ID
-	log.Printf("🚫 Subscription Deleted: %s", customerID)
+	slog.Info("stripe subscription deleted", "customer_id", customerID)
 
 	// Downgrade Tenant
 	_, err := db.DB.Exec(`
@@ -280,7 +271,7 @@ func handleSubscriptionDeleted(sub *stripe.Subscription) {
 	`, customerID)
 
 	if err != nil {
-		log.Printf("❌ Failed to downgrade tenant: %v", err)
+		slog.Error("stripe: failed to downgrade tenant", "customer_id", customerID, "error", err)
 	}
 
 	// Update Subscription Status
@@ -293,6 +284,6 @@ func handleSubscriptionDeleted(sub *stripe.Subscription) {
 	`, sub.ID)
 
 	if err != nil {
-		log.Printf("❌ Failed to cancel subscription record: %v", err)
+		slog.Error("stripe: failed to cancel subscription record", "customer_id", customerID, "error", err)
 	}
 }
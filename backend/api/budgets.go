@@ -0,0 +1,91 @@
+package api
+
+import (
+	"context"
+	"database/sql"
+
+	"zaps/services"
+
+	"github.com/gofiber/fiber/v2"
+	"github.com/google/uuid"
+	"github.com/redis/go-redis/v9"
+)
+
+// GetBudgets lists the tenant's budgets with their usage in the current window
+func GetBudgets(rdb *redis.Client) fiber.Handler {
+	return func(c *fiber.Ctx) error {
+		tenantID := c.Locals("tenant_id").(string)
+
+		budgets, err := services.ListBudgets(tenantID)
+		if err != nil {
+			return c.Status(500).JSON(fiber.Map{"error": "Failed to fetch budgets"})
+		}
+
+		result := []fiber.Map{}
+		for _, b := range budgets {
+			used, err := services.BudgetUsage(context.Background(), rdb, b)
+			entry := fiber.Map{"budget": b, "used": used}
+			if err != nil {
+				entry["used"] = nil
+			}
+			result = append(result, entry)
+		}
+
+		return c.JSON(result)
+	}
+}
+
+// SaveBudget creates a budget (POST) or updates one (PUT /:id)
+func SaveBudget(c *fiber.Ctx) error {
+	tenantID, _ := uuid.Parse(c.Locals("tenant_id").(string))
+
+	req := services.Budget{Enabled: true}
+	if err := c.BodyParser(&req); err != nil {
+		return c.Status(400).JSON(fiber.Map{"error": "Invalid request"})
+	}
+
+	if id := c.Params("id"); id != "" {
+		parsed, err := uuid.Parse(id)
+		if err != nil {
+			return c.Status(400).JSON(fiber.Map{"error": "Invalid budget ID"})
+		}
+		req.ID = parsed
+	} else {
+		req.ID = uuid.Nil
+	}
+
+	err := services.SaveBudget(tenantID, &req)
+	if err == sql.ErrNoRows {
+		return c.Status(404).JSON(fiber.Map{"error": "Budget not found"})
+	}
+	if err != nil {
+		return c.Status(400).JSON(fiber.Map{"error": err.Error()})
+	}
+
+	services.LogAuditAsync(tenantID.String(), nil, "BUDGET_SAVED", map[string]interface{}{
+		"budget_id":  req.ID.String(),
+		"scope":      req.Scope,
+		"scope_id":   req.ScopeID,
+		"metric":     req.Metric,
+		"hard_limit": req.HardLimit,
+	}, c.IP(), c.Get("User-Agent"))
+
+	return c.JSON(req)
+}
+
+// DeleteBudget removes a budget
+func DeleteBudget(rdb *redis.Client) fiber.Handler {
+	return func(c *fiber.Ctx) error {
+		tenantID, _ := uuid.Parse(c.Locals("tenant_id").(string))
+
+		found, err := services.DeleteBudget(context.Background(), rdb, tenantID, c.Params("id"))
+		if err != nil {
+			return c.Status(500).JSON(fiber.Map{"error": "Failed to delete budget"})
+		}
+		if !found {
+			return c.Status(404).JSON(fiber.Map{"error": "Budget not found"})
+		}
+
+		return c.JSON(fiber.Map{"status": "deleted"})
+	}
+}
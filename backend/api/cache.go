@@ -0,0 +1,70 @@
+package api
+
+import (
+	"context"
+
+	"zaps/services"
+
+	"github.com/gofiber/fiber/v2"
+	"github.com/google/uuid"
+	"github.com/redis/go-redis/v9"
+)
+
+// GetSemanticCache returns the tenant's semantic cache settings and hit-rate metrics
+func GetSemanticCache(rdb *redis.Client) fiber.Handler {
+	return func(c *fiber.Ctx) error {
+		tenantID := c.Locals("tenant_id").(string)
+
+		settings, err := services.GetSemanticCacheSettings(tenantID)
+		if err != nil {
+			return c.Status(500).JSON(fiber.Map{"error": "Failed to fetch cache settings"})
+		}
+
+		stats, err := services.SemanticCacheStats(context.Background(), rdb, tenantID)
+		if err != nil {
+			stats = map[string]map[string]interface{}{}
+		}
+
+		return c.JSON(fiber.Map{
+			"settings": settings,
+			"stats":    stats,
+		})
+	}
+}
+
+// UpdateSemanticCache saves the tenant's semantic cache settings
+func UpdateSemanticCache(c *fiber.Ctx) error {
+	tenantID, _ := uuid.Parse(c.Locals("tenant_id").(string))
+
+	var req services.SemanticCacheSettings
+	if err := c.BodyParser(&req); err != nil {
+		return c.Status(400).JSON(fiber.Map{"error": "Invalid request"})
+	}
+
+	if err := services.SaveSemanticCacheSettings(tenantID, &req); err != nil {
+		return c.Status(400).JSON(fiber.Map{"error": err.Error()})
+	}
+
+	services.LogAuditAsync(tenantID.String(), nil, "CACHE_SETTINGS_UPDATED", map[string]interface{}{
+		"enabled":              req.Enabled,
+		"similarity_threshold": req.SimilarityThreshold,
+		"enabled_models":       req.EnabledModels,
+	}, c.IP(), c.Get("User-Agent"))
+
+	return c.JSON(fiber.Map{"status": "updated", "settings": req})
+}
+
+// InvalidateSemanticCache drops cached answers (optionally for a single ?model=)
+func InvalidateSemanticCache(rdb *redis.Client) fiber.Handler {
+	return func(c *fiber.Ctx) error {
+		tenantID := c.Locals("tenant_id").(string)
+		model := c.Query("model")
+
+		removed, err := services.InvalidateSemanticCache(context.Background(), rdb, tenantID, model)
+		if err != nil {
+			return c.Status(500).JSON(fiber.Map{"error": "Failed to invalidate cache"})
+		}
+
+		return c.JSON(fiber.Map{"status": "invalidated", "model": model, "removed": removed})
+	}
+}
@@ -0,0 +1,220 @@
+package api
+
+import (
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log/slog"
+	"time"
+
+	"zaps/services"
+
+	"github.com/gofiber/fiber/v2"
+	"github.com/google/uuid"
+	"github.com/redis/go-redis/v9"
+)
+
+// GetPromptCaptures lists the tenant's captures (metadata only), newest first
+func GetPromptCaptures(c *fiber.Ctx) error {
+	tenantID, _ := uuid.Parse(c.Locals("tenant_id").(string))
+
+	limit := c.QueryInt("limit", 50)
+	if limit < 1 || limit > 200 {
+		limit = 50
+	}
+	captures, err := services.ListPromptCaptures(c.UserContext(), tenantID, services.PromptCaptureFilter{
+		APIKeyID:  c.Query("api_key_id"),
+		RequestID: c.Query("request_id"),
+	}, limit)
+	if err != nil {
+		return c.Status(500).JSON(fiber.Map{"error": "Failed to fetch captures"})
+	}
+	return c.JSON(captures)
+}
+
+// GetPromptCapture decrypts one capture. Viewing is an audit event.
+func GetPromptCapture(c *fiber.Ctx) error {
+	tenantID, _ := uuid.Parse(c.Locals("tenant_id").(string))
+
+	capture, err := services.OpenPromptCapture(c.UserContext(), tenantID, c.Params("id"))
+	if err == sql.ErrNoRows {
+		return c.Status(404).JSON(fiber.Map{"error": "Capture not found"})
+	}
+	if err != nil {
+		slog.ErrorContext(c.UserContext(), "failed to open prompt capture", "capture_id", c.Params("id"), "error", err)
+		return c.Status(500).JSON(fiber.Map{"error": "Failed to open capture"})
+	}
+
+	services.LogAuditAsync(tenantID.String(), nil, "PROMPT_CAPTURE_VIEWED", map[string]interface{}{
+		"capture_id": capture.ID.String(),
+	}, c.IP(), c.Get("User-Agent"))
+
+	return c.JSON(capture)
+}
+
+// ReplayPromptCapture re-sends a captured request to the same model, or to the model
+// named in the body ({"model": "..."}), and stores the result as a new capture. Replays
+// go through model routing, PII routing policies, token rate limits and budgets like
+// live traffic, and use the tenant's provider keys.
+func ReplayPromptCapture(rdb *redis.Client) fiber.Handler {
+	return func(c *fiber.Ctx) error {
+		tenantID, _ := uuid.Parse(c.Locals("tenant_id").(string))
+		ctx := c.UserContext()
+
+		var req struct {
+			Model string `json:"model"`
+		}
+		if len(c.Body()) > 0 {
+			if err := c.BodyParser(&req); err != nil {
+				return c.Status(400).JSON(fiber.Map{"error": "Invalid request"})
+			}
+		}
+
+		original, err := services.OpenPromptCapture(ctx, tenantID, c.Params("id"))
+		if err == sql.ErrNoRows {
+			return c.Status(404).JSON(fiber.Map{"error": "Capture not found"})
+		}
+		if err != nil {
+			slog.ErrorContext(ctx, "failed to open prompt capture", "capture_id", c.Params("id"), "error", err)
+			return c.Status(500).JSON(fiber.Map{"error": "Failed to open capture"})
+		}
+
+		var body map[string]interface{}
+		if err := json.Unmarshal(original.Request, &body); err != nil {
+			return c.Status(422).JSON(fiber.Map{"error": "Captured request is not a JSON object"})
+		}
+
+		if err := CheckQuota(tenantID.String()); err != nil {
+			services.ObserveQuotaRejection(services.RejectQuota)
+			return c.Status(402).JSON(fiber.Map{"error": "Quota Exceeded"})
+		}
+
+		provider, model := original.Provider, original.Model
+		requestedModel := original.RequestedModel
+		if req.Model != "" && req.Model != original.Model {
+			requestedModel = req.Model
+			route, err := services.ResolveModel(tenantID.String(), services.RoutingInput{
+				Model:    req.Model,
+				PIITypes: original.PIITypes,
+			})
+			if err != nil {
+				return c.Status(503).JSON(fiber.Map{"error": "Unable to evaluate model routing rules"})
+			}
+			model, provider = route.Model, route.Provider
+			if provider == "" {
+				provider = GetProviderForModel(model)
+			}
+			if provider == "" {
+				return c.Status(400).JSON(fiber.Map{"error": fmt.Sprintf("Unknown model %q", req.Model)})
+			}
+		}
+
+		// The captured prompt is redacted, but routing policies still decide where it may go
+		decision, err := services.EvaluatePIIRouting(tenantID.String(), original.PIITypes)
+		if err != nil {
+			return c.Status(503).JSON(fiber.Map{"error": "Unable to evaluate PII routing policy"})
+		}
+		if decision != nil {
+			policy := decision.Policy
+			if policy.Action == services.PIIActionReject ||
+				provider != policy.TargetProvider || model != policy.TargetModel {
+				return c.Status(403).JSON(fiber.Map{
+					"error":        "PII policy violation",
+					"message":      fmt.Sprintf("PII routing policy %q does not allow this capture to be sent to %s.", policy.Name, model),
+					"entity_types": decision.Matched,
+				})
+			}
+		}
+		body["model"] = model
+
+		apiKey := resolveProviderKey(rdb, tenantID.String(), provider)
+		if apiKey == "" && !providerKeyOptional(provider) {
+			return c.Status(402).JSON(fiber.Map{
+				"error":   "Provider not configured",
+				"message": fmt.Sprintf("Please configure an API Key for %s in your Dashboard", provider),
+			})
+		}
+
+		var settledTokens int
+		var settledCost float64
+		reservation, ok := reserveUsage(c, rdb, tenantID.String(), "", provider, model, estimateUsage(body))
+		if !ok {
+			return nil
+		}
+		defer func() { reservation.settle(settledTokens, settledCost) }()
+
+		replayRequest, _ := json.Marshal(body)
+		targetURL, payload, err := encodeUpstreamBody(provider, body)
+		if err != nil {
+			return c.Status(400).JSON(fiber.Map{"error": err.Error()})
+		}
+		upstreamReq, err := newUpstreamRequest(ctx, provider, apiKey, targetURL, payload)
+		if err != nil {
+			return c.Status(500).JSON(fiber.Map{"error": "Failed to create request"})
+		}
+
+		start := time.Now()
+		resp, err := upstreamClient.Do(upstreamReq)
+		if err != nil {
+			slog.ErrorContext(ctx, "replay upstream request failed", "error", err)
+			return c.Status(502).JSON(fiber.Map{"error": "Upstream provider unreachable"})
+		}
+		defer resp.Body.Close()
+		responseBody, err := io.ReadAll(resp.Body)
+		if err != nil {
+			return c.Status(502).JSON(fiber.Map{"error": "Failed to read response"})
+		}
+		responseBody = decodeUpstreamResponse(ctx, provider, resp.StatusCode, responseBody)
+		latency := time.Since(start)
+
+		var tokenUsage services.TokenUsage
+		var costUSD float64
+		if resp.StatusCode == 200 {
+			messages, _ := body["messages"].([]interface{})
+			tokenUsage = extractTokenUsage(responseBody, messages)
+			costUSD = services.CalculateCost(provider, model, tokenUsage)
+		}
+		settledTokens, settledCost = tokenUsage.Total(), costUSD
+		services.LogRequestUsage(services.RequestUsage{
+			Ctx:        ctx,
+			TenantID:   tenantID.String(),
+			Provider:   provider,
+			Model:      model,
+			StatusCode: resp.StatusCode,
+			LatencyMs:  latency.Milliseconds(),
+			IsError:    resp.StatusCode >= 400,
+			Tokens:     tokenUsage,
+			CostUSD:    costUSD,
+		})
+
+		replay := &services.PromptCapture{
+			TenantID:       tenantID,
+			RequestID:      services.LogFieldsFrom(ctx).RequestID,
+			ReplayOf:       &original.ID,
+			Provider:       provider,
+			Model:          model,
+			RequestedModel: requestedModel,
+			StatusCode:     resp.StatusCode,
+			LatencyMs:      latency.Milliseconds(),
+			PIITypes:       original.PIITypes,
+		}
+		if err := services.SavePromptCapture(ctx, replay, replayRequest, responseBody); err != nil {
+			slog.ErrorContext(ctx, "failed to store replay capture", "error", err)
+			return c.Status(500).JSON(fiber.Map{"error": "Failed to store replay"})
+		}
+
+		services.LogAuditAsync(tenantID.String(), nil, "PROMPT_CAPTURE_REPLAYED", map[string]interface{}{
+			"capture_id": original.ID.String(),
+			"replay_id":  replay.ID.String(),
+			"provider":   provider,
+			"model":      model,
+			"status":     resp.StatusCode,
+			"cost_usd":   costUSD,
+		}, c.IP(), c.Get("User-Agent"))
+
+		replay.Request = services.PromptCaptureJSON(replayRequest)
+		replay.Response = services.PromptCaptureJSON(responseBody)
+		return c.JSON(replay)
+	}
+}
@@ -0,0 +1,93 @@
+package api
+
+import (
+	"net"
+	"os"
+	"strings"
+	"sync"
+
+	"github.com/gofiber/fiber/v2"
+)
+
+// defaultTrustedProxies covers the reverse proxy in front of the gateway on a private
+// network (Caddy in Docker, a load balancer in a VPC)
+var defaultTrustedProxies = []string{
+	"127.0.0.0/8", "::1/128",
+	"10.0.0.0/8", "172.16.0.0/12", "192.168.0.0/16", "fc00::/7",
+}
+
+var (
+	trustedProxiesOnce sync.Once
+	trustedProxyList   []string
+	trustedProxyNets   []*net.IPNet
+)
+
+// TrustedProxies returns the addresses allowed to set X-Forwarded-For, from
+// TRUSTED_PROXIES (comma-separated IPs or CIDRs) or loopback and private networks
+func TrustedProxies() []string {
+	trustedProxiesOnce.Do(func() {
+		trustedProxyList = defaultTrustedProxies
+		if env := os.Getenv("TRUSTED_PROXIES"); env != "" {
+			trustedProxyList = nil
+			for _, p := range strings.Split(env, ",") {
+				if p = strings.TrimSpace(p); p != "" {
+					trustedProxyList = append(trustedProxyList, p)
+				}
+			}
+		}
+		trustedProxyNets = parseProxyNets(trustedProxyList)
+	})
+	return trustedProxyList
+}
+
+func parseProxyNets(proxies []string) []*net.IPNet {
+	var nets []*net.IPNet
+	for _, p := range proxies {
+		if !strings.Contains(p, "/") {
+			if ip := net.ParseIP(p); ip != nil && ip.To4() != nil {
+				p += "/32"
+			} else {
+				p += "/128"
+			}
+		}
+		if _, n, err := net.ParseCIDR(p); err == nil {
+			nets = append(nets, n)
+		}
+	}
+	return nets
+}
+
+// ClientIP returns the address of the client that reached the first trusted proxy.
+// It starts at the socket address and walks X-Forwarded-For from the right while the
+// hop is a trusted proxy, so entries a client prepends itself are never used.
+func ClientIP(c *fiber.Ctx) string {
+	TrustedProxies()
+	return clientIPFrom(c.Context().RemoteIP(), c.Get(fiber.HeaderXForwardedFor), trustedProxyNets)
+}
+
+func clientIPFrom(remote net.IP, forwardedFor string, trusted []*net.IPNet) string {
+	isTrusted := func(ip net.IP) bool {
+		for _, n := range trusted {
+			if n.Contains(ip) {
+				return true
+			}
+		}
+		return false
+	}
+
+	client := remote
+	if forwardedFor != "" {
+		hops := strings.Split(forwardedFor, ",")
+		for i := len(hops) - 1; i >= 0 && isTrusted(client); i-- {
+			hop := net.ParseIP(strings.TrimSpace(hops[i]))
+			if hop == nil {
+				break
+			}
+			client = hop
+		}
+	}
+	if client == nil {
+		return ""
+	}
+	return client.String()
+}
@@ -0,0 +1,35 @@
+package api
+
+import (
+	"net"
+	"testing"
+)
+
+func TestClientIPFrom(t *testing.T) {
+	trusted := parseProxyNets([]string{"10.0.0.0/8", "127.0.0.1"})
+
+	tests := []struct {
+		name         string
+		remote       string
+		forwardedFor string
+		want         string
+	}{
+		{"direct client ignores header", "203.0.113.7", "198.51.100.1", "203.0.113.7"},
+		{"behind trusted proxy", "10.0.0.2", "203.0.113.7", "203.0.113.7"},
+		{"spoofed entry before proxy hop", "10.0.0.2", "198.51.100.1, 203.0.113.7", "203.0.113.7"},
+		{"chain of trusted proxies", "127.0.0.1", "203.0.113.7, 10.0.0.9", "203.0.113.7"},
+		{"all hops trusted", "10.0.0.2", "127.0.0.1", "127.0.0.1"},
+		{"spoofed loopback through proxy", "10.0.0.2", "127.0.0.1, 203.0.113.7", "203.0.113.7"},
+		{"spoofed loopback from outside", "203.0.113.7", "127.0.0.1", "203.0.113.7"},
+		{"garbage hop stops the walk", "10.0.0.2", "nonsense", "10.0.0.2"},
+		{"no header", "10.0.0.2", "", "10.0.0.2"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got := clientIPFrom(net.ParseIP(tt.remote), tt.forwardedFor, trusted)
+			if got != tt.want {
+				t.Errorf("clientIPFrom(%s, %q) = %s, want %s", tt.remote, tt.forwardedFor, got, tt.want)
+			}
+		})
+	}
+}
@@ -1,18 +1,21 @@
 package api
 
 import (
+	"bufio"
 	"context"
-	"crypto/rand"
-	"encoding/hex"
-	"encoding/json"
+	"database/sql"
+	"errors"
 	"fmt"
+	"log/slog"
 	"strings"
 	"time"
 
 	"zaps/db"
+	"zaps/services"
 
 	"github.com/gofiber/fiber/v2"
 	"github.com/google/uuid"
+	"github.com/lib/pq"
 	"github.com/redis/go-redis/v9"
 )
 
@@ -35,12 +38,14 @@ func GetDashboardStats(c *fiber.Ctx) error {
 		subscriptionTier = "free"
 	}
 
-	// Calculate usage (requests today)
+	// Calculate usage (requests, tokens and cost today)
+	var tokensToday int64
+	var costToday float64
 	err = db.DB.QueryRow(`
-		SELECT COALESCE(SUM(request_count), 0)
+		SELECT COALESCE(SUM(request_count), 0), COALESCE(SUM(total_tokens_processed), 0), COALESCE(SUM(cost_usd), 0)
 		FROM usage_logs
 		WHERE tenant_id = $1 AND hour_bucket >= $2
-	`, tenantID, today).Scan(&requestsToday)
+	`, tenantID, today).Scan(&requestsToday, &tokensToday, &costToday)
 
 	if err != nil {
 		return c.Status(500).JSON(fiber.Map{"error": "Failed to fetch stats"})
@@ -50,12 +55,12 @@ func GetDashboardStats(c *fiber.Ctx) error {
 	var activeKeys int64
 	db.DB.QueryRow("SELECT COUNT(*) FROM api_keys WHERE tenant_id = $1 AND enabled = true", tenantID).Scan(&activeKeys)
 
-	// Mock PII redacted count (since we store it in JSONB, simpler query for now)
+	// PII detections today, summed across entity types in pii_events
 	var piiRedacted int64
 	db.DB.QueryRow(`
-		SELECT COALESCE(SUM((pii_events->>'redacted_count')::int), 0)
-		FROM usage_logs
-		WHERE tenant_id = $1 AND hour_bucket >= $2
+		SELECT COALESCE(SUM(e.value::bigint), 0)
+		FROM usage_logs u, jsonb_each_text(u.pii_events) e
+		WHERE u.tenant_id = $1 AND u.hour_bucket >= $2
 	`, tenantID, today).Scan(&piiRedacted)
 
 	// Get 24h usage history
@@ -94,6 +99,8 @@ func GetDashboardStats(c *fiber.Ctx) error {
 
 	return c.JSON(fiber.Map{
 		"requests_today":    requestsToday,
+		"tokens_today":      tokensToday,
+		"cost_today_usd":    costToday,
 		"monthly_usage":     requestsToday, // Mapping for frontend
 		"monthly_quota":     monthlyQuota,
 		"subscription_tier": subscriptionTier,
@@ -103,12 +110,72 @@ func GetDashboardStats(c *fiber.Ctx) error {
 	})
 }
 
+// GetKeyUsage breaks usage, errors, tokens and cost down by API key over the last
+// ?days (default 30). Dashboard sessions and legacy keys are grouped under a null key.
+func GetKeyUsage(c *fiber.Ctx) error {
+	tenantID, _ := uuid.Parse(c.Locals("tenant_id").(string))
+	days := c.QueryInt("days", 30)
+	if days < 1 || days > 366 {
+		return c.Status(400).JSON(fiber.Map{"error": "days must be between 1 and 366"})
+	}
+
+	rows, err := db.DB.Query(`
+		SELECT u.api_key_id, k.name, k.key_prefix, k.last_used,
+			SUM(u.request_count), SUM(u.error_count),
+			COALESCE(SUM(u.total_tokens_processed), 0), COALESCE(SUM(u.prompt_tokens), 0),
+			COALESCE(SUM(u.completion_tokens), 0), COALESCE(SUM(u.cost_usd), 0)
+		FROM usage_logs u
+		LEFT JOIN api_keys k ON k.id = u.api_key_id
+		WHERE u.tenant_id = $1 AND u.hour_bucket >= NOW() - make_interval(days => $2)
+		GROUP BY u.api_key_id, k.name, k.key_prefix, k.last_used
+		ORDER BY SUM(u.request_count) DESC
+	`, tenantID, days)
+	if err != nil {
+		return c.Status(500).JSON(fiber.Map{"error": "Failed to fetch key usage"})
+	}
+	defer rows.Close()
+
+	keys := []fiber.Map{}
+	for rows.Next() {
+		var keyID *uuid.UUID
+		var name, prefix *string
+		var lastUsed *time.Time
+		var requests, errs, tokens, promptTokens, completionTokens int64
+		var cost float64
+		if err := rows.Scan(&keyID, &name, &prefix, &lastUsed, &requests, &errs,
+			&tokens, &promptTokens, &completionTokens, &cost); err != nil {
+			continue
+		}
+
+		errorRate := 0.0
+		if requests > 0 {
+			errorRate = float64(errs) / float64(requests)
+		}
+		keys = append(keys, fiber.Map{
+			"api_key_id":        keyID, // null = dashboard sessions / legacy keys
+			"name":              name,  // null = key since revoked
+			"prefix":            prefix,
+			"last_used":         lastUsed,
+			"requests":          requests,
+			"errors":            errs,
+			"error_rate":        errorRate,
+			"total_tokens":      tokens,
+			"prompt_tokens":     promptTokens,
+			"completion_tokens": completionTokens,
+			"cost_usd":          cost,
+		})
+	}
+
+	return c.JSON(fiber.Map{"days": days, "keys": keys})
+}
+
 // GetAPIKeys lists all API keys for the tenant
 func GetAPIKeys(c *fiber.Ctx) error {
 	tenantID, _ := uuid.Parse(c.Locals("tenant_id").(string))
 
 	rows, err := db.DB.Query(`
-		SELECT id, name, key_prefix, created_at, last_used, enabled 
+		SELECT id, name, key_prefix, created_at, last_used, COALESCE(request_count, 0), enabled, rate_limit_rpm, rate_limit_tpm, expires_at,
+			scopes, allowed_models, allowed_providers, allowed_cidrs, max_tokens_per_request, capture_bodies
 		FROM api_keys 
 		WHERE tenant_id = $1 
 		ORDER BY created_at DESC
@@ -121,16 +188,33 @@ func GetAPIKeys(c *fiber.Ctx) error {
 	var keys []fiber.Map
 	for rows.Next() {
 		var k db.APIKey
-		if err := rows.Scan(&k.ID, &k.Name, &k.KeyPrefix, &k.CreatedAt, &k.LastUsed, &k.Enabled); err != nil {
+		var policy services.APIKeyPolicy
+		var maxTokens *int
+		var expiresAt *time.Time
+		if err := rows.Scan(&k.ID, &k.Name, &k.KeyPrefix, &k.CreatedAt, &k.LastUsed, &k.RequestCount, &k.Enabled, &k.RateLimitRPM, &k.RateLimitTPM, &expiresAt,
+			pq.Array(&policy.Scopes), pq.Array(&policy.AllowedModels), pq.Array(&policy.AllowedProviders),
+			pq.Array(&policy.AllowedCIDRs), &maxTokens, &policy.CaptureBodies); err != nil {
 			continue
 		}
+		if maxTokens != nil {
+			policy.MaxTokensPerRequest = *maxTokens
+		}
+		rpm := services.DefaultKeyRPM
+		if k.RateLimitRPM != nil {
+			rpm = *k.RateLimitRPM
+		}
 		keys = append(keys, fiber.Map{
-			"id":         k.ID,
-			"name":       k.Name,
-			"prefix":     k.KeyPrefix,
-			"created_at": k.CreatedAt,
-			"last_used":  k.LastUsed,
-			"enabled":    k.Enabled,
+			"id":             k.ID,
+			"name":           k.Name,
+			"prefix":         k.KeyPrefix,
+			"created_at":     k.CreatedAt,
+			"last_used":      k.LastUsed,
+			"request_count":  k.RequestCount,
+			"enabled":        k.Enabled,
+			"rate_limit_rpm": rpm,
+			"rate_limit_tpm": k.RateLimitTPM, // null = unlimited
+			"policy":         policy,
+			"expires_at":     expiresAt,
 		})
 	}
 
@@ -145,78 +229,184 @@ func CreateAPIKey(rdb *redis.Client) fiber.Handler {
 
 		var req struct {
 			Name string `json:"name"`
+			services.RateLimits
+			Policy        services.APIKeyPolicy `json:"policy"`
+			ExpiresAt     *time.Time            `json:"expires_at"`
+			ExpiresInDays int                   `json:"expires_in_days"`
 		}
 		if err := c.BodyParser(&req); err != nil {
 			return c.Status(400).JSON(fiber.Map{"error": "Invalid request"})
 		}
+		for _, p := range req.Policy.AllowedProviders {
+			if !isSupportedProvider(p) {
+				return c.Status(400).JSON(fiber.Map{"error": fmt.Sprintf("Unsupported provider %q", p)})
+			}
+		}
+		if req.ExpiresInDays < 0 {
+			return c.Status(400).JSON(fiber.Map{"error": "expires_in_days must not be negative"})
+		}
+		if req.ExpiresAt == nil && req.ExpiresInDays > 0 {
+			expiresAt := time.Now().AddDate(0, 0, req.ExpiresInDays)
+			req.ExpiresAt = &expiresAt
+		}
 
-		// Generate Key (gk_ + 32 random chars)
-		bytes := make([]byte, 16)
-		rand.Read(bytes)
-		rawKey := "gk_" + hex.EncodeToString(bytes)
-
-		// Create DB Entry
-		apiKey := db.APIKey{
-			ID:        uuid.New(),
-			TenantID:  tenantID,
+		apiKey, err := services.CreateTenantAPIKey(rdb, &services.NewTenantAPIKey{
+			TenantID:  tenantID.String(),
+			CreatedBy: userID.String(),
 			Name:      req.Name,
-			KeyPrefix: rawKey[:7] + "...", // Store simplified prefix for display
-			KeyHash:   rawKey,             // In real prod, this should be bcrypt hashed! keeping raw for MVP/Dev ease
-			Enabled:   true,
-			CreatedAt: time.Now(),
-			CreatedBy: &userID,
+			Limits:    req.RateLimits,
+			Policy:    req.Policy,
+			ExpiresAt: req.ExpiresAt,
+		})
+		if errors.Is(err, services.ErrAPIKeyStore) {
+			return c.Status(500).JSON(fiber.Map{"error": "Failed to create key"})
+		}
+		if err != nil {
+			return c.Status(400).JSON(fiber.Map{"error": err.Error()})
 		}
 
-		_, err := db.DB.Exec(`
-			INSERT INTO api_keys (id, tenant_id, name, key_prefix, key_hash, enabled, created_at, created_by)
-			VALUES ($1, $2, $3, $4, $5, $6, $7, $8)
-		`, apiKey.ID, apiKey.TenantID, apiKey.Name, apiKey.KeyPrefix, apiKey.KeyHash, apiKey.Enabled, apiKey.CreatedAt, apiKey.CreatedBy)
+		// Return the FULL key only once
+		return c.Status(201).JSON(fiber.Map{
+			"key":        apiKey.Key,
+			"id":         apiKey.ID,
+			"name":       apiKey.Name,
+			"prefix":     apiKey.Prefix,
+			"expires_at": apiKey.ExpiresAt,
+		})
+	}
+}
 
+// UpdateAPIKey changes a key's per-minute request and token limits
+func UpdateAPIKey(rdb *redis.Client) fiber.Handler {
+	return func(c *fiber.Ctx) error {
+		tenantID := c.Locals("tenant_id").(string)
+		keyID := c.Params("id")
+
+		var req services.RateLimits
+		if err := c.BodyParser(&req); err != nil {
+			return c.Status(400).JSON(fiber.Map{"error": "Invalid request"})
+		}
+
+		found, err := services.SetAPIKeyRateLimits(rdb, tenantID, keyID, req)
 		if err != nil {
-			return c.Status(500).JSON(fiber.Map{"error": "Failed to create key"})
+			return c.Status(400).JSON(fiber.Map{"error": err.Error()})
+		}
+		if !found {
+			return c.Status(404).JSON(fiber.Map{"error": "Key not found"})
 		}
 
-		// Sync to Redis for AuthMiddleware
-		// Note: We are constructing the JSON manually to match what main.AuthMiddleware expects
-		// Ideally we should share the struct definition
-		redisKey := "apikey:" + rawKey
-		redisData := map[string]interface{}{
-			"key":        rawKey,
-			"name":       apiKey.Name,
-			"created_at": apiKey.CreatedAt,
-			"enabled":    apiKey.Enabled,
-			"owner_id":   tenantID.String(), // AuthMiddleware uses this as tenant_id
+		if req.RPM == 0 {
+			req.RPM = services.DefaultKeyRPM
 		}
+		services.LogAuditAsync(tenantID, nil, "API_KEY_LIMITS_UPDATED", map[string]interface{}{
+			"key_id":         keyID,
+			"rate_limit_rpm": req.RPM,
+			"rate_limit_tpm": req.TPM,
+		}, c.IP(), c.Get("User-Agent"))
+
+		return c.JSON(fiber.Map{"id": keyID, "rate_limit_rpm": req.RPM, "rate_limit_tpm": req.TPM})
+	}
+}
 
-		val, _ := json.Marshal(redisData)
-		rdb.Set(context.Background(), redisKey, val, 0)
+// RotateAPIKey issues a replacement key; the old key keeps working for a grace period
+func RotateAPIKey(rdb *redis.Client) fiber.Handler {
+	return func(c *fiber.Ctx) error {
+		tenantID := c.Locals("tenant_id").(string)
+		userID, _ := c.Locals("user_id").(string)
+		keyID := c.Params("id")
+
+		var req struct {
+			GracePeriodHours *int `json:"grace_period_hours"`
+		}
+		if len(c.Body()) > 0 {
+			if err := c.BodyParser(&req); err != nil {
+				return c.Status(400).JSON(fiber.Map{"error": "Invalid request"})
+			}
+		}
+		grace := services.KeyRotationGrace()
+		if req.GracePeriodHours != nil {
+			if *req.GracePeriodHours < 0 {
+				return c.Status(400).JSON(fiber.Map{"error": "grace_period_hours must not be negative"})
+			}
+			grace = time.Duration(*req.GracePeriodHours) * time.Hour
+		}
+
+		newKey, oldExpiresAt, err := services.RotateAPIKey(rdb, tenantID, keyID, userID, grace)
+		if err == sql.ErrNoRows && newKey == nil {
+			return c.Status(404).JSON(fiber.Map{"error": "Key not found"})
+		}
+		if errors.Is(err, services.ErrAPIKeyInactive) {
+			return c.Status(400).JSON(fiber.Map{"error": err.Error()})
+		}
+		if err != nil {
+			return c.Status(500).JSON(fiber.Map{"error": "Failed to rotate key"})
+		}
+
+		services.LogAuditAsync(tenantID, nil, "API_KEY_ROTATED", map[string]interface{}{
+			"key_id":             keyID,
+			"new_key_id":         newKey.ID,
+			"old_key_expires_at": oldExpiresAt,
+		}, c.IP(), c.Get("User-Agent"))
 
 		// Return the FULL key only once
 		return c.Status(201).JSON(fiber.Map{
-			"key":    rawKey,
-			"id":     apiKey.ID,
-			"name":   apiKey.Name,
-			"prefix": apiKey.KeyPrefix,
+			"key":                newKey.Key,
+			"id":                 newKey.ID,
+			"name":               newKey.Name,
+			"prefix":             newKey.Prefix,
+			"expires_at":         newKey.ExpiresAt,
+			"rotated_from":       keyID,
+			"old_key_expires_at": oldExpiresAt,
 		})
 	}
 }
 
-// RevokeAPIKey deletes an API key
-func RevokeAPIKey(c *fiber.Ctx) error {
-	tenantID, _ := uuid.Parse(c.Locals("tenant_id").(string))
-	keyID := c.Params("id")
+// SetAPIKeyEnabled disables or re-enables an API key
+func SetAPIKeyEnabled(rdb *redis.Client, enabled bool) fiber.Handler {
+	return func(c *fiber.Ctx) error {
+		tenantID := c.Locals("tenant_id").(string)
+		keyID := c.Params("id")
 
-	result, err := db.DB.Exec("DELETE FROM api_keys WHERE id = $1 AND tenant_id = $2", keyID, tenantID)
-	if err != nil {
-		return c.Status(500).JSON(fiber.Map{"error": "Failed to revoke key"})
-	}
+		action, event := services.EnableAPIKey, "API_KEY_ENABLED"
+		if !enabled {
+			action, event = services.DisableAPIKey, "API_KEY_DISABLED"
+		}
+		err := action(rdb, tenantID, keyID)
+		if errors.Is(err, services.ErrAPIKeyNotFound) {
+			return c.Status(404).JSON(fiber.Map{"error": "Key not found"})
+		}
+		if err != nil {
+			return c.Status(500).JSON(fiber.Map{"error": "Failed to update key"})
+		}
 
-	rowsAffected, _ := result.RowsAffected()
-	if rowsAffected == 0 {
-		return c.Status(404).JSON(fiber.Map{"error": "Key not found"})
+		services.LogAuditAsync(tenantID, nil, event, map[string]interface{}{
+			"key_id": keyID,
+		}, c.IP(), c.Get("User-Agent"))
+
+		return c.JSON(fiber.Map{"id": keyID, "enabled": enabled})
 	}
+}
+
+// RevokeAPIKey deletes an API key and drops it from every gateway replica
+func RevokeAPIKey(rdb *redis.Client) fiber.Handler {
+	return func(c *fiber.Ctx) error {
+		tenantID := c.Locals("tenant_id").(string)
+		keyID := c.Params("id")
+
+		err := services.RevokeAPIKey(rdb, tenantID, keyID)
+		if errors.Is(err, services.ErrAPIKeyNotFound) {
+			return c.Status(404).JSON(fiber.Map{"error": "Key not found"})
+		}
+		if err != nil {
+			return c.Status(500).JSON(fiber.Map{"error": "Failed to revoke key"})
+		}
+
+		services.LogAuditAsync(tenantID, nil, "API_KEY_REVOKED", map[string]interface{}{
+			"key_id": keyID,
+		}, c.IP(), c.Get("User-Agent"))
 
-	return c.SendStatus(204)
+		return c.SendStatus(204)
+	}
 }
 
 // GetAuditLogs returns recent audit logs with pagination and filtering
@@ -229,21 +419,17 @@ func GetAuditLogs(c *fiber.Ctx) error {
 	offset := (page - 1) * limit
 
 	// Filtering
-	eventType := c.Query("type")
+	filter, err := parseAuditFilter(c.Query)
+	if err != nil {
+		return c.Status(400).JSON(fiber.Map{"error": err.Error()})
+	}
+	where, args := filter.Where(tenantID)
 
 	query := `
-		SELECT id, event_type, event_data, created_at, ip_address 
+		SELECT id, api_key_id, event_type, event_data, created_at, ip_address, seq
 		FROM audit_logs 
-		WHERE tenant_id = $1
-	`
-	args := []interface{}{tenantID}
-	argIdx := 2
-
-	if eventType != "" {
-		query += fmt.Sprintf(" AND event_type = $%d", argIdx)
-		args = append(args, eventType)
-		argIdx++
-	}
+		WHERE ` + where
+	argIdx := len(args) + 1
 
 	query += fmt.Sprintf(" ORDER BY created_at DESC LIMIT $%d OFFSET $%d", argIdx, argIdx+1)
 	args = append(args, limit, offset)
@@ -259,7 +445,7 @@ func GetAuditLogs(c *fiber.Ctx) error {
 		var l db.AuditLog
 		// Note: We need to handle JSONB scanning properly if strict type scanning fails
 		// But assuming db driver handles JSONB -> JSONBMap (map[string]interface{})
-		if err := rows.Scan(&l.ID, &l.EventType, &l.EventData, &l.CreatedAt, &l.IPAddress); err != nil {
+		if err := rows.Scan(&l.ID, &l.APIKeyID, &l.EventType, &l.EventData, &l.CreatedAt, &l.IPAddress, &l.Seq); err != nil {
 			continue // Skip malformed rows
 		}
 		logs = append(logs, l)
@@ -272,53 +458,91 @@ func GetAuditLogs(c *fiber.Ctx) error {
 	})
 }
 
-// ExportAuditLogs streams audit logs as a CSV file
-func ExportAuditLogs(c *fiber.Ctx) error {
-	tenantID, _ := uuid.Parse(c.Locals("tenant_id").(string))
-
-	c.Set("Content-Type", "text/csv")
-	c.Set("Content-Disposition", `attachment; filename="compliance_report.csv"`)
-
-	// Write CSV Header
-	c.Write([]byte("Timestamp,Event Type,IP Address,Details\n"))
-
-	// Stream rows
-	rows, err := db.DB.Query(`
-		SELECT created_at, event_type, ip_address, event_data
-		FROM audit_logs 
-		WHERE tenant_id = $1 
-		ORDER BY created_at DESC
-		LIMIT 1000
-	`, tenantID)
-
-	if err != nil {
-		return c.Status(500).SendString("Failed to fetch logs")
+// parseAuditFilter reads from/to (RFC 3339 or YYYY-MM-DD), type (comma-separated),
+// api_key_id and user_id through get, e.g. c.Query
+func parseAuditFilter(get func(key string, def ...string) string) (services.AuditLogFilter, error) {
+	var f services.AuditLogFilter
+	for _, p := range []struct {
+		name string
+		dst  **time.Time
+	}{{"from", &f.From}, {"to", &f.To}} {
+		if v := get(p.name); v != "" {
+			t, err := parseTimeValue(p.name, v)
+			if err != nil {
+				return f, err
+			}
+			*p.dst = &t
+		}
+	}
+	if f.From != nil && f.To != nil && !f.From.Before(*f.To) {
+		return f, fmt.Errorf("from must be before to")
 	}
-	defer rows.Close()
-
-	for rows.Next() {
-		var createdAt time.Time
-		var eventType string
-		var ipAddress string
-		var eventData []byte // JSONB raw bytes
 
-		if err := rows.Scan(&createdAt, &eventType, &ipAddress, &eventData); err != nil {
-			continue
+	for _, t := range strings.Split(get("type"), ",") {
+		if t = strings.TrimSpace(t); t != "" {
+			f.EventTypes = append(f.EventTypes, t)
 		}
+	}
+	for _, p := range []struct {
+		name string
+		dst  **uuid.UUID
+	}{{"api_key_id", &f.APIKeyID}, {"user_id", &f.UserID}} {
+		if v := get(p.name); v != "" {
+			id, err := uuid.Parse(v)
+			if err != nil {
+				return f, fmt.Errorf("Invalid %s", p.name)
+			}
+			*p.dst = &id
+		}
+	}
+	return f, nil
+}
 
-		// Simple CSV escaping (replace " with "")
-		details := string(eventData)
-		details = strings.ReplaceAll(details, "\"", "\"\"")
+// ExportAuditLogs streams the filtered audit log as CSV, JSON lines or Parquet
+// (?format=csv|jsonl|parquet). Exports above services.AuditExportSyncMaxRows must be
+// created as export jobs instead.
+func ExportAuditLogs(c *fiber.Ctx) error {
+	tenantID, _ := uuid.Parse(c.Locals("tenant_id").(string))
 
-		line := fmt.Sprintf("%s,%s,%s,\"%s\"\n",
-			createdAt.Format(time.RFC3339),
-			eventType,
-			ipAddress,
-			details,
-		)
+	format := c.Query("format", services.AuditExportCSV)
+	if !services.ValidAuditExportFormat(format) {
+		return c.Status(400).JSON(fiber.Map{"error": "format must be csv, jsonl or parquet"})
+	}
+	filter, err := parseAuditFilter(c.Query)
+	if err != nil {
+		return c.Status(400).JSON(fiber.Map{"error": err.Error()})
+	}
 
-		c.Write([]byte(line))
+	count, err := services.CountAuditLogs(c.UserContext(), tenantID, filter)
+	if err != nil {
+		return c.Status(500).JSON(fiber.Map{"error": "Failed to fetch logs"})
+	}
+	if count > services.AuditExportSyncMaxRows {
+		return c.Status(400).JSON(fiber.Map{
+			"error":    fmt.Sprintf("Export has %d rows; use POST /api/dashboard/reports/exports for more than %d", count, services.AuditExportSyncMaxRows),
+			"rows":     count,
+			"max_rows": services.AuditExportSyncMaxRows,
+		})
 	}
 
+	services.LogAuditAsync(tenantID.String(), nil, "AUDIT_LOG_EXPORTED", map[string]interface{}{
+		"format": format,
+		"rows":   count,
+	}, c.IP(), c.Get("User-Agent"))
+
+	contentType, ext := services.AuditExportContentType(format)
+	c.Set("Content-Type", contentType)
+	c.Set("Content-Disposition", fmt.Sprintf(`attachment; filename="audit_log.%s"`, ext))
+
+	// The body is written after the handler returns, so it cannot use the request context
+	logFields := services.LogFieldsFrom(c.UserContext())
+	c.Context().SetBodyStreamWriter(func(w *bufio.Writer) {
+		ctx, cancel := context.WithTimeout(services.WithLogFields(context.Background(), logFields), 10*time.Minute)
+		defer cancel()
+		if _, err := services.WriteAuditExport(ctx, w, tenantID, filter, format, nil); err != nil {
+			slog.ErrorContext(ctx, "audit export stream failed", "error", err)
+		}
+		w.Flush()
+	})
 	return nil
 }
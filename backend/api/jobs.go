@@ -0,0 +1,42 @@
+package api
+
+import (
+	"zaps/services"
+
+	"github.com/gofiber/fiber/v2"
+)
+
+// HandleListJobRuns returns recent background job runs (Super Admin)
+func HandleListJobRuns(sched *services.Scheduler) fiber.Handler {
+	return func(c *fiber.Ctx) error {
+		limit := c.QueryInt("limit", 100)
+		if limit <= 0 || limit > 1000 {
+			limit = 100
+		}
+
+		runs, err := services.ListJobRuns(c.Query("job"), limit)
+		if err != nil {
+			return c.Status(500).JSON(fiber.Map{"error": "Failed to fetch job runs"})
+		}
+
+		return c.JSON(fiber.Map{
+			"jobs": sched.JobNames(),
+			"runs": runs,
+		})
+	}
+}
+
+// HandleRunJob triggers a job immediately (Super Admin)
+func HandleRunJob(sched *services.Scheduler) fiber.Handler {
+	return func(c *fiber.Ctx) error {
+		ran, err := sched.Trigger(c.Context(), c.Params("name"))
+		if err != nil {
+			return c.Status(404).JSON(fiber.Map{"error": err.Error()})
+		}
+		if !ran {
+			return c.Status(409).JSON(fiber.Map{"error": "Job is already running"})
+		}
+
+		return c.JSON(fiber.Map{"status": "completed"})
+	}
+}
@@ -0,0 +1,121 @@
+package api
+
+import (
+	"fmt"
+	"strings"
+
+	"zaps/services"
+
+	"github.com/gofiber/fiber/v2"
+	"github.com/redis/go-redis/v9"
+)
+
+// KeySourceMiddleware rejects API-key requests from addresses outside the key's
+// allowed CIDRs, using the client address behind trusted proxies only. Session-
+// authenticated requests pass through. Runs after AuthMiddleware.
+func KeySourceMiddleware() fiber.Handler {
+	return func(c *fiber.Ctx) error {
+		keyData, ok := c.Locals("api_key_data").(*services.APIKey)
+		if ok && !keyData.AllowsIP(ClientIP(c)) {
+			return c.Status(403).JSON(fiber.Map{
+				"error":   "Source IP not allowed",
+				"message": "This API key may not be used from your network address.",
+			})
+		}
+		return c.Next()
+	}
+}
+
+// RequireScope rejects API keys that were not granted the given scope
+func RequireScope(scope string) fiber.Handler {
+	return func(c *fiber.Ctx) error {
+		keyData, ok := c.Locals("api_key_data").(*services.APIKey)
+		if ok && !keyData.HasScope(scope) {
+			return c.Status(403).JSON(fiber.Map{
+				"error":   "Insufficient scope",
+				"message": fmt.Sprintf("This API key does not have the %q scope.", scope),
+			})
+		}
+		return c.Next()
+	}
+}
+
+// SessionOnlyMiddleware keeps gateway API keys out of dashboard, billing and admin routes
+func SessionOnlyMiddleware() fiber.Handler {
+	return func(c *fiber.Ctx) error {
+		if _, ok := c.Locals("api_key_data").(*services.APIKey); ok {
+			return c.Status(403).JSON(fiber.Map{
+				"error":   "Forbidden",
+				"message": "API keys can only be used with /v1 gateway routes. Sign in to access the dashboard.",
+			})
+		}
+		return c.Next()
+	}
+}
+
+// checkKeyModelPolicy enforces the key's model/provider allowlists and per-request token cap
+// on the final routing decision, so an allowlisted alias is only accepted when the model it
+// resolves to is allowed too. It returns a non-empty message when the request is denied.
+// When the key caps tokens and the request sets no max_tokens, the cap is injected.
+func checkKeyModelPolicy(c *fiber.Ctx, body map[string]interface{}, model, provider string) (string, string) {
+	keyData, ok := c.Locals("api_key_data").(*services.APIKey)
+	if !ok {
+		return "", ""
+	}
+
+	if !keyData.AllowsModel(model) {
+		return "Model not allowed", fmt.Sprintf("This API key may only use: %s.", strings.Join(keyData.AllowedModels, ", "))
+	}
+	if !keyData.AllowsProvider(provider) {
+		return "Provider not allowed", fmt.Sprintf("This API key may not send requests to %s (allowed: %s).", provider, strings.Join(keyData.AllowedProviders, ", "))
+	}
+
+	if limit := keyData.MaxTokensPerRequest; limit > 0 {
+		if mt, ok := body["max_tokens"].(float64); ok && mt > 0 {
+			if int(mt) > limit {
+				return "max_tokens too large", fmt.Sprintf("This API key allows at most %d max_tokens per request.", limit)
+			}
+		} else {
+			body["max_tokens"] = float64(limit)
+		}
+	}
+	return "", ""
+}
+
+// UpdateAPIKeyPolicy replaces a key's scopes, allowlists, CIDRs and token cap
+func UpdateAPIKeyPolicy(rdb *redis.Client) fiber.Handler {
+	return func(c *fiber.Ctx) error {
+		tenantID := c.Locals("tenant_id").(string)
+		keyID := c.Params("id")
+
+		var req services.APIKeyPolicy
+		if err := c.BodyParser(&req); err != nil {
+			return c.Status(400).JSON(fiber.Map{"error": "Invalid request"})
+		}
+		for _, p := range req.AllowedProviders {
+			if !isSupportedProvider(p) {
+				return c.Status(400).JSON(fiber.Map{"error": fmt.Sprintf("Unsupported provider %q", p)})
+			}
+		}
+
+		found, err := services.SetAPIKeyPolicy(rdb, tenantID, keyID, &req)
+		if err != nil {
+			return c.Status(400).JSON(fiber.Map{"error": err.Error()})
+		}
+		if !found {
+			return c.Status(404).JSON(fiber.Map{"error": "Key not found"})
+		}
+
+		services.LogAuditAsync(tenantID, nil, "API_KEY_POLICY_UPDATED", map[string]interface{}{
+			"key_id":                 keyID,
+			"scopes":                 req.Scopes,
+			"allowed_models":         req.AllowedModels,
+			"allowed_providers":      req.AllowedProviders,
+			"allowed_cidrs":          req.AllowedCIDRs,
+			"max_tokens_per_request": req.MaxTokensPerRequest,
+			"capture_bodies":         req.CaptureBodies,
+		}, c.IP(), c.Get("User-Agent"))
+
+		return c.JSON(fiber.Map{"id": keyID, "policy": req})
+	}
+}
@@ -0,0 +1,45 @@
+package api
+
+import (
+	"io"
+	"net/http/httptest"
+	"testing"
+
+	"zaps/services"
+
+	"github.com/gofiber/fiber/v2"
+)
+
+func TestCheckKeyModelPolicyUsesResolvedModel(t *testing.T) {
+	tests := []struct {
+		name     string
+		allowed  []string
+		model    string // After aliases and routing rules
+		provider string
+		want     string
+	}{
+		{"allowlisted alias resolving elsewhere", []string{"zaps-fast"}, "gpt-4o", "openai", "Model not allowed"},
+		{"alias and target allowlisted", []string{"zaps-fast", "gpt-4o-mini"}, "gpt-4o-mini", "openai", ""},
+		{"routing rule to a model off the list", []string{"gpt-4o-mini"}, "claude-3-5-sonnet-20241022", "anthropic", "Model not allowed"},
+		{"gemini resource name", []string{"gemini-1.5-pro"}, "models/gemini-1.5-pro", "gemini", ""},
+		{"unrestricted key", nil, "gpt-4o", "openai", ""},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			app := fiber.New()
+			app.Post("/", func(c *fiber.Ctx) error {
+				c.Locals("api_key_data", &services.APIKey{APIKeyPolicy: services.APIKeyPolicy{AllowedModels: tt.allowed}})
+				denied, _ := checkKeyModelPolicy(c, map[string]interface{}{}, tt.model, tt.provider)
+				return c.SendString(denied)
+			})
+			resp, err := app.Test(httptest.NewRequest("POST", "/", nil))
+			if err != nil {
+				t.Fatal(err)
+			}
+			got, _ := io.ReadAll(resp.Body)
+			if string(got) != tt.want {
+				t.Errorf("checkKeyModelPolicy(%q) denied = %q, want %q", tt.model, got, tt.want)
+			}
+		})
+	}
+}
@@ -0,0 +1,90 @@
+package api
+
+import (
+	"encoding/json"
+	"log/slog"
+	"regexp"
+	"strings"
+	"time"
+
+	"zaps/services"
+
+	"github.com/gofiber/fiber/v2"
+	"github.com/google/uuid"
+)
+
+// HeaderRequestID carries the request ID in both directions
+const HeaderRequestID = "X-Request-ID"
+
+// Client-supplied request IDs are reused only when they are short and plain
+var validRequestID = regexp.MustCompile(`^[A-Za-z0-9._:-]{1,128}$`)
+
+// RequestLogMiddleware assigns every request an ID (reusing a valid incoming
+// X-Request-ID), returns it in the response header and in JSON error bodies, and
+// writes one structured access log line per request. Handlers log with
+// slog.*Context(c.UserContext(), ...) to carry the request's fields.
+func RequestLogMiddleware() fiber.Handler {
+	return func(c *fiber.Ctx) error {
+		start := time.Now()
+
+		requestID := c.Get(HeaderRequestID)
+		if !validRequestID.MatchString(requestID) {
+			requestID = uuid.NewString()
+		}
+		c.Locals("request_id", requestID)
+		c.Set(HeaderRequestID, requestID)
+
+		ctx := services.WithLogFields(c.UserContext(), &services.LogFields{RequestID: requestID})
+		c.SetUserContext(ctx)
+
+		// Render errors here, as the logger middleware does, so the log and body see the final status
+		if err := c.Next(); err != nil {
+			if herr := c.App().ErrorHandler(c, err); herr != nil {
+				_ = c.SendStatus(fiber.StatusInternalServerError)
+			}
+		}
+
+		status := c.Response().StatusCode()
+		if status >= 400 {
+			addRequestIDToError(c, requestID)
+		}
+
+		level := slog.LevelInfo
+		switch {
+		case status >= 500:
+			level = slog.LevelError
+		case status >= 400:
+			level = slog.LevelWarn
+		}
+		// The path is logged without its query string, which may carry tokens
+		slog.Log(ctx, level, "request",
+			"method", c.Method(),
+			"path", c.Path(),
+			"route", c.Route().Path,
+			"status", status,
+			"latency_ms", time.Since(start).Milliseconds(),
+			"ip", c.IP(),
+		)
+		return nil
+	}
+}
+
+// addRequestIDToError adds "request_id" to a JSON object error body
+func addRequestIDToError(c *fiber.Ctx, requestID string) {
+	resp := c.Response()
+	if resp.IsBodyStream() || !strings.HasPrefix(string(resp.Header.ContentType()), fiber.MIMEApplicationJSON) {
+		return
+	}
+
+	var body map[string]json.RawMessage
+	if err := json.Unmarshal(resp.Body(), &body); err != nil {
+		return
+	}
+	if _, ok := body["request_id"]; ok {
+		return
+	}
+	body["request_id"], _ = json.Marshal(requestID)
+	if out, err := json.Marshal(body); err == nil {
+		resp.SetBody(out)
+	}
+}
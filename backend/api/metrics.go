@@ -0,0 +1,53 @@
+package api
+
+import (
+	"crypto/subtle"
+	"os"
+	"strings"
+
+	"zaps/services"
+
+	"github.com/gofiber/fiber/v2"
+	"github.com/gofiber/fiber/v2/middleware/adaptor"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+)
+
+// MetricsHandler serves Prometheus metrics. When METRICS_TOKEN is set, scrapers
+// must send it as a bearer token; it is separate from API keys and sessions.
+func MetricsHandler() fiber.Handler {
+	token := os.Getenv("METRICS_TOKEN")
+	handler := adaptor.HTTPHandler(promhttp.HandlerFor(services.MetricsRegistry, promhttp.HandlerOpts{}))
+
+	return func(c *fiber.Ctx) error {
+		if token != "" {
+			got := c.Get("Authorization")
+			if subtle.ConstantTimeCompare([]byte(got), []byte("Bearer "+token)) != 1 {
+				return c.Status(401).JSON(fiber.Map{"error": "Unauthorized"})
+			}
+		}
+		return handler(c)
+	}
+}
+
+// InflightMiddleware tracks gateway requests currently being served
+func InflightMiddleware() fiber.Handler {
+	return func(c *fiber.Ctx) error {
+		services.InflightRequests.Inc()
+		defer services.InflightRequests.Dec()
+		return c.Next()
+	}
+}
+
+// metricLabels bounds provider and model label values to the supported catalogue
+func metricLabels(provider, model string) (string, string) {
+	if !isSupportedProvider(provider) {
+		return "other", "other"
+	}
+	model = strings.TrimPrefix(model, "models/")
+	for _, m := range ProviderModels[provider] {
+		if m == model {
+			return provider, model
+		}
+	}
+	return provider, "other"
+}
@@ -0,0 +1,131 @@
+package api
+
+import (
+	"database/sql"
+
+	"zaps/services"
+
+	"github.com/gofiber/fiber/v2"
+	"github.com/google/uuid"
+)
+
+// GetCustomEntities lists the tenant's custom PII entity detectors
+func GetCustomEntities(c *fiber.Ctx) error {
+	tenantID := c.Locals("tenant_id").(string)
+
+	entities, err := services.ListCustomEntities(tenantID)
+	if err != nil {
+		return c.Status(500).JSON(fiber.Map{"error": "Failed to fetch custom entities"})
+	}
+
+	return c.JSON(entities)
+}
+
+// SaveCustomEntity creates or updates a custom PII entity detector
+func SaveCustomEntity(c *fiber.Ctx) error {
+	tenantID, _ := uuid.Parse(c.Locals("tenant_id").(string))
+
+	var req services.CustomEntity
+	if err := c.BodyParser(&req); err != nil {
+		return c.Status(400).JSON(fiber.Map{"error": "Invalid request"})
+	}
+
+	if err := services.SaveCustomEntity(tenantID, &req); err != nil {
+		return c.Status(400).JSON(fiber.Map{"error": err.Error()})
+	}
+
+	services.LogAuditAsync(tenantID.String(), nil, "PII_ENTITY_SAVED", map[string]interface{}{
+		"entity_type": req.EntityType,
+	}, c.IP(), c.Get("User-Agent"))
+
+	return c.JSON(req)
+}
+
+// DeleteCustomEntity removes a custom PII entity detector
+func DeleteCustomEntity(c *fiber.Ctx) error {
+	tenantID, _ := uuid.Parse(c.Locals("tenant_id").(string))
+
+	found, err := services.DeleteCustomEntity(tenantID, c.Params("type"))
+	if err != nil {
+		return c.Status(500).JSON(fiber.Map{"error": "Failed to delete entity"})
+	}
+	if !found {
+		return c.Status(404).JSON(fiber.Map{"error": "Entity not found"})
+	}
+
+	return c.JSON(fiber.Map{"status": "deleted"})
+}
+
+// GetPIIRoutingPolicies lists the tenant's PII routing policies
+func GetPIIRoutingPolicies(c *fiber.Ctx) error {
+	tenantID := c.Locals("tenant_id").(string)
+
+	policies, err := services.ListPIIRoutingPolicies(tenantID)
+	if err != nil {
+		return c.Status(500).JSON(fiber.Map{"error": "Failed to fetch policies"})
+	}
+
+	return c.JSON(policies)
+}
+
+// SavePIIRoutingPolicy creates a policy (POST) or updates one (PUT /:id)
+func SavePIIRoutingPolicy(c *fiber.Ctx) error {
+	tenantID, _ := uuid.Parse(c.Locals("tenant_id").(string))
+
+	req := services.PIIRoutingPolicy{Enabled: true, Priority: 100}
+	if err := c.BodyParser(&req); err != nil {
+		return c.Status(400).JSON(fiber.Map{"error": "Invalid request"})
+	}
+
+	if id := c.Params("id"); id != "" {
+		parsed, err := uuid.Parse(id)
+		if err != nil {
+			return c.Status(400).JSON(fiber.Map{"error": "Invalid policy ID"})
+		}
+		req.ID = parsed
+	} else {
+		req.ID = uuid.Nil
+	}
+
+	if req.Action == services.PIIActionRoute && !isSupportedProvider(req.TargetProvider) {
+		return c.Status(400).JSON(fiber.Map{"error": "Unsupported provider"})
+	}
+
+	err := services.SavePIIRoutingPolicy(tenantID, &req)
+	if err == sql.ErrNoRows {
+		return c.Status(404).JSON(fiber.Map{"error": "Policy not found"})
+	}
+	if err != nil {
+		return c.Status(400).JSON(fiber.Map{"error": err.Error()})
+	}
+
+	services.LogAuditAsync(tenantID.String(), nil, "PII_POLICY_SAVED", map[string]interface{}{
+		"policy_id":       req.ID.String(),
+		"name":            req.Name,
+		"action":          req.Action,
+		"entity_types":    req.EntityTypes,
+		"target_provider": req.TargetProvider,
+		"target_model":    req.TargetModel,
+	}, c.IP(), c.Get("User-Agent"))
+
+	return c.JSON(req)
+}
+
+// DeletePIIRoutingPolicy removes a PII routing policy
+func DeletePIIRoutingPolicy(c *fiber.Ctx) error {
+	tenantID, _ := uuid.Parse(c.Locals("tenant_id").(string))
+
+	found, err := services.DeletePIIRoutingPolicy(tenantID, c.Params("id"))
+	if err != nil {
+		return c.Status(500).JSON(fiber.Map{"error": "Failed to delete policy"})
+	}
+	if !found {
+		return c.Status(404).JSON(fiber.Map{"error": "Policy not found"})
+	}
+
+	services.LogAuditAsync(tenantID.String(), nil, "PII_POLICY_DELETED", map[string]interface{}{
+		"policy_id": c.Params("id"),
+	}, c.IP(), c.Get("User-Agent"))
+
+	return c.JSON(fiber.Map{"status": "deleted"})
+}
@@ -2,7 +2,7 @@ package api
 
 import (
 	"fmt"
-	"log"
+	"log/slog"
 	"math/rand"
 	"time"
 
@@ -40,7 +40,7 @@ func SimulateRedaction(rdb *redis.Client) fiber.Handler {
 		// Check Speed Limit
 		speedCount, err := rdb.Incr(ctx, speedKey).Result()
 		if err != nil {
-			log.Printf("Redis error: %v", err) // Fail open if Redis down
+			slog.WarnContext(c.UserContext(), "playground rate limit check failed", "error", err) // Fail open if Redis down
 		} else {
 			if speedCount == 1 {
 				rdb.Expire(ctx, speedKey, 60*time.Second)
@@ -0,0 +1,30 @@
+package api
+
+import (
+	"zaps/services"
+
+	"github.com/gofiber/fiber/v2"
+)
+
+// GetModelPricing returns the per-model token price table (USD per 1M tokens)
+func GetModelPricing(c *fiber.Ctx) error {
+	prices, err := services.ListModelPrices()
+	if err != nil {
+		return c.Status(500).JSON(fiber.Map{"error": "Failed to fetch pricing"})
+	}
+	return c.JSON(prices)
+}
+
+// HandleUpdateModelPricing upserts a price row (Super Admin)
+func HandleUpdateModelPricing(c *fiber.Ctx) error {
+	var req services.ModelPrice
+	if err := c.BodyParser(&req); err != nil {
+		return c.Status(400).JSON(fiber.Map{"error": "Invalid request"})
+	}
+
+	if err := services.SaveModelPrice(&req); err != nil {
+		return c.Status(400).JSON(fiber.Map{"error": err.Error()})
+	}
+
+	return c.JSON(fiber.Map{"status": "updated", "price": req})
+}
@@ -1,14 +1,18 @@
 package api
 
 import (
-	"crypto/aes"
-	"crypto/cipher"
-	"crypto/rand"
-	"encoding/hex"
+	"context"
+	"encoding/json"
 	"fmt"
 	"io"
-	"os"
+	"log/slog"
+	"net/http"
+	"sort"
+	"strings"
+	"time"
+
 	"zaps/db"
+	"zaps/services"
 
 	"github.com/gofiber/fiber/v2"
 	"github.com/google/uuid"
@@ -22,49 +26,230 @@ type ProviderConfig struct {
 	Enabled  bool   `json:"enabled"`
 }
 
+// Provider key validation states
+const (
+	ProviderKeyUnchecked = "unchecked" // Not checked yet, or the provider has no model listing
+	ProviderKeyValid     = "valid"
+	ProviderKeyInvalid   = "invalid" // The provider rejected the key
+	ProviderKeyError     = "error"   // The check failed for another reason; the key may still work
+)
+
+const (
+	providerValidationTimeout = 10 * time.Second
+	// providerRevalidateAfter is how old a check must be before the job repeats it
+	providerRevalidateAfter = 24 * time.Hour
+)
+
+var providerCheckClient = &http.Client{Timeout: providerValidationTimeout}
+
+// ProviderKeyValidation is the result of checking a key against its provider
+type ProviderKeyValidation struct {
+	Status    string    `json:"status"`
+	Error     string    `json:"error,omitempty"`
+	CheckedAt time.Time `json:"last_checked_at"`
+	Models    []string  `json:"models"`
+}
+
+// validateProviderKey lists the provider's models with apiKey. Only an authentication
+// failure marks the key invalid; outages and rate limits leave it in the error state.
+func validateProviderKey(ctx context.Context, provider, apiKey string) ProviderKeyValidation {
+	v := ProviderKeyValidation{Status: ProviderKeyUnchecked, CheckedAt: time.Now(), Models: []string{}}
+	modelsURL := providerModelsURL(provider)
+	if modelsURL == "" {
+		v.Error = "provider cannot be checked"
+		return v
+	}
+
+	ctx, cancel := context.WithTimeout(ctx, providerValidationTimeout)
+	defer cancel()
+	req, err := http.NewRequestWithContext(ctx, "GET", modelsURL, nil)
+	if err != nil {
+		v.Status, v.Error = ProviderKeyError, "invalid provider URL"
+		return v
+	}
+	setProviderAuth(req, provider, apiKey)
+
+	resp, err := providerCheckClient.Do(req)
+	if err != nil {
+		v.Status, v.Error = ProviderKeyError, "provider unreachable"
+		return v
+	}
+	defer resp.Body.Close()
+	body, _ := io.ReadAll(io.LimitReader(resp.Body, 4<<20))
+
+	switch {
+	case resp.StatusCode == 401 || resp.StatusCode == 403,
+		// Gemini answers a malformed key with 400 API_KEY_INVALID
+		provider == ProviderGemini && resp.StatusCode == 400 && strings.Contains(string(body), "API_KEY_INVALID"):
+		v.Status, v.Error = ProviderKeyInvalid, fmt.Sprintf("provider rejected the key (HTTP %d)", resp.StatusCode)
+		return v
+	case resp.StatusCode != 200:
+		v.Status, v.Error = ProviderKeyError, fmt.Sprintf("provider returned HTTP %d", resp.StatusCode)
+		return v
+	}
+
+	var list struct {
+		Data []struct {
+			ID string `json:"id"`
+		} `json:"data"`
+	}
+	if err := json.Unmarshal(body, &list); err != nil {
+		v.Status, v.Error = ProviderKeyError, "unexpected model list response"
+		return v
+	}
+	v.Status = ProviderKeyValid
+	for _, m := range list.Data {
+		v.Models = append(v.Models, strings.TrimPrefix(m.ID, "models/"))
+	}
+	sort.Strings(v.Models)
+	return v
+}
+
+// saveProviderKeyValidation records a check of the stored key encryptedKey; false when
+// the key was replaced since. Models from the last successful check are kept on failure.
+func saveProviderKeyValidation(ctx context.Context, id uuid.UUID, encryptedKey string, v ProviderKeyValidation) (bool, error) {
+	models, _ := json.Marshal(v.Models)
+	res, err := db.DB.ExecContext(ctx, `
+		UPDATE provider_keys
+		SET validation_status = $3, validation_error = NULLIF($4, ''), last_checked_at = $5,
+			models = CASE WHEN $3 = 'valid' THEN $6::jsonb ELSE models END
+		WHERE id = $1 AND encrypted_key = $2
+	`, id, encryptedKey, v.Status, v.Error, v.CheckedAt, models)
+	if err != nil {
+		return false, err
+	}
+	n, _ := res.RowsAffected()
+	return n > 0, nil
+}
+
+// ProviderValidationJob re-checks stored provider keys whose last check is over a day old
+func ProviderValidationJob() services.Job {
+	return services.Job{
+		Name:     services.JobProviderValidation,
+		Interval: time.Hour,
+		Timeout:  30 * time.Minute,
+		Run:      revalidateProviderKeys,
+	}
+}
+
+func revalidateProviderKeys(ctx context.Context) (map[string]interface{}, error) {
+	rows, err := db.DB.QueryContext(ctx, `
+		SELECT id, tenant_id, provider, encrypted_key, validation_status FROM provider_keys
+		WHERE enabled = true AND (last_checked_at IS NULL OR last_checked_at < $1)
+		ORDER BY last_checked_at NULLS FIRST
+		LIMIT 500
+	`, time.Now().Add(-providerRevalidateAfter))
+	if err != nil {
+		return nil, err
+	}
+	type storedKey struct {
+		id, tenantID                    uuid.UUID
+		provider, encryptedKey, current string
+	}
+	var keys []storedKey
+	for rows.Next() {
+		var k storedKey
+		if err := rows.Scan(&k.id, &k.tenantID, &k.provider, &k.encryptedKey, &k.current); err != nil {
+			rows.Close()
+			return nil, err
+		}
+		keys = append(keys, k)
+	}
+	rows.Close()
+
+	counts := map[string]int{}
+	for _, k := range keys {
+		if ctx.Err() != nil {
+			break
+		}
+		apiKey, err := services.DecryptTenantSecret(ctx, k.tenantID, k.encryptedKey)
+		if err != nil {
+			slog.WarnContext(ctx, "failed to decrypt provider key", "tenant_id", k.tenantID, "provider", k.provider, "error", err)
+			counts["undecryptable"]++
+			continue
+		}
+		v := validateProviderKey(ctx, k.provider, apiKey)
+		saved, err := saveProviderKeyValidation(ctx, k.id, k.encryptedKey, v)
+		if err != nil {
+			return map[string]interface{}{"checked": counts}, err
+		}
+		if !saved {
+			continue
+		}
+		counts[v.Status]++
+		if v.Status == ProviderKeyInvalid && k.current != ProviderKeyInvalid {
+			services.LogAuditAsync(k.tenantID.String(), nil, "PROVIDER_KEY_INVALID", map[string]interface{}{
+				"provider": k.provider,
+				"error":    v.Error,
+			}, "", "scheduler")
+		}
+	}
+	return map[string]interface{}{"checked": counts}, ctx.Err()
+}
+
 // -- Handlers --
 
-// GetProviders returns a list of configured providers (with masked keys)
+// GetProviders returns a list of configured providers (with masked keys) and the
+// result of the last key validation
 func GetProviders(c *fiber.Ctx) error {
 	tenantID, _ := uuid.Parse(c.Locals("tenant_id").(string))
 
 	// List of supported providers to check
-	supported := []string{"deepseek", "openai", "anthropic", "gemini"}
+	supported := []string{"deepseek", "openai", "anthropic", "gemini", "ollama"}
 
 	// Query DB for existing keys
-	rows, err := db.DB.Query("SELECT provider FROM provider_keys WHERE tenant_id = $1 AND enabled = true", tenantID)
+	rows, err := db.DB.Query(`
+		SELECT provider, validation_status, COALESCE(validation_error, ''), last_checked_at, models
+		FROM provider_keys WHERE tenant_id = $1 AND enabled = true
+	`, tenantID)
 	if err != nil {
 		return c.Status(500).JSON(fiber.Map{"error": "Failed to fetch providers"})
 	}
 	defer rows.Close()
 
-	configured := make(map[string]bool)
+	configured := make(map[string]*ProviderKeyValidation)
 	for rows.Next() {
 		var provider string
-		if err := rows.Scan(&provider); err == nil {
-			configured[provider] = true
+		var v ProviderKeyValidation
+		var checkedAt *time.Time
+		var models []byte
+		if err := rows.Scan(&provider, &v.Status, &v.Error, &checkedAt, &models); err == nil {
+			if checkedAt != nil {
+				v.CheckedAt = *checkedAt
+			}
+			json.Unmarshal(models, &v.Models)
+			configured[provider] = &v
 		}
 	}
 
 	configs := []map[string]interface{}{}
 	for _, p := range supported {
-		isConfigured := configured[p]
-		mask := ""
-		if isConfigured {
-			mask = "********"
+		v := configured[p]
+		config := map[string]interface{}{
+			"provider":   p,
+			"configured": v != nil,
+			"key_masked": "",
+		}
+		if v != nil {
+			config["key_masked"] = "********"
+			config["validation_status"] = v.Status
+			config["validation_error"] = v.Error
+			config["last_checked_at"] = nil
+			if !v.CheckedAt.IsZero() {
+				config["last_checked_at"] = v.CheckedAt
+			}
+			config["models"] = v.Models
 		}
 
-		configs = append(configs, map[string]interface{}{
-			"provider":   p,
-			"configured": isConfigured,
-			"key_masked": mask,
-		})
+		configs = append(configs, config)
 	}
 
 	return c.JSON(configs)
 }
 
-// UpdateProvider saves (encrypts) a provider key to the database
+// UpdateProvider checks a provider key by listing the provider's models, then saves
+// (encrypts) it with the result. Keys the provider rejects are still saved; the
+// response and GetProviders report them as invalid.
 func UpdateProvider(rdb *redis.Client) fiber.Handler {
 	return func(c *fiber.Ctx) error {
 		tenantID, _ := uuid.Parse(c.Locals("tenant_id").(string))
@@ -77,26 +262,35 @@ func UpdateProvider(rdb *redis.Client) fiber.Handler {
 		if req.Provider == "" || req.Key == "" {
 			return c.Status(400).JSON(fiber.Map{"error": "Provider and Key are required"})
 		}
+		if !isSupportedProvider(req.Provider) {
+			return c.Status(400).JSON(fiber.Map{"error": fmt.Sprintf("Unsupported provider %q", req.Provider)})
+		}
+
+		validation := validateProviderKey(c.UserContext(), req.Provider, req.Key)
+		models, _ := json.Marshal(validation.Models)
 
 		// Encrypt
-		encrypted, err := Encrypt(req.Key)
+		encrypted, err := services.EncryptTenantSecret(c.UserContext(), tenantID, req.Key)
 		if err != nil {
 			return c.Status(500).JSON(fiber.Map{"error": "Encryption failed"})
 		}
 
 		// Upsert into DB
 		_, err = db.DB.Exec(`
-			INSERT INTO provider_keys (tenant_id, provider, encrypted_key, enabled, updated_at)
-			VALUES ($1, $2, $3, true, NOW())
+			INSERT INTO provider_keys (tenant_id, provider, encrypted_key, enabled, updated_at,
+				validation_status, validation_error, last_checked_at, models)
+			VALUES ($1, $2, $3, true, NOW(), $4, NULLIF($5, ''), $6, $7)
 			ON CONFLICT (tenant_id, provider) 
-			DO UPDATE SET encrypted_key = EXCLUDED.encrypted_key, enabled = true, updated_at = NOW()
-		`, tenantID, req.Provider, encrypted)
+			DO UPDATE SET encrypted_key = EXCLUDED.encrypted_key, enabled = true, updated_at = NOW(),
+				validation_status = EXCLUDED.validation_status, validation_error = EXCLUDED.validation_error,
+				last_checked_at = EXCLUDED.last_checked_at, models = EXCLUDED.models
+		`, tenantID, req.Provider, encrypted, validation.Status, validation.Error, validation.CheckedAt, models)
 
 		if err != nil {
 			return c.Status(500).JSON(fiber.Map{"error": "Failed to save configuration"})
 		}
 
-		return c.JSON(fiber.Map{"status": "updated", "provider": req.Provider})
+		return c.JSON(fiber.Map{"status": "updated", "provider": req.Provider, "validation": validation})
 	}
 }
 
@@ -117,75 +311,6 @@ func DeleteProvider(c *fiber.Ctx) error {
 	return c.JSON(fiber.Map{"status": "deleted"})
 }
 
-// -- Crypto Helpers --
-
-func getEncryptionKey() ([]byte, error) {
-	keyHex := os.Getenv("ENCRYPTION_KEY")
-	if keyHex == "" {
-		return nil, fmt.Errorf("ENCRYPTION_KEY not set")
-	}
-	return hex.DecodeString(keyHex)
-}
-
-func Encrypt(plaintext string) (string, error) {
-	key, err := getEncryptionKey()
-	if err != nil {
-		return "", err
-	}
-
-	block, err := aes.NewCipher(key)
-	if err != nil {
-		return "", err
-	}
-
-	gcm, err := cipher.NewGCM(block)
-	if err != nil {
-		return "", err
-	}
-
-	nonce := make([]byte, gcm.NonceSize())
-	if _, err := io.ReadFull(rand.Reader, nonce); err != nil {
-		return "", err
-	}
-
-	ciphertext := gcm.Seal(nonce, nonce, []byte(plaintext), nil)
-	return hex.EncodeToString(ciphertext), nil
-}
-
-func Decrypt(ciphertextHex string) (string, error) {
-	key, err := getEncryptionKey()
-	if err != nil {
-		return "", err
-	}
-
-	data, err := hex.DecodeString(ciphertextHex)
-	if err != nil {
-		return "", err
-	}
-
-	block, err := aes.NewCipher(key)
-	if err != nil {
-		return "", err
-	}
-
-	gcm, err := cipher.NewGCM(block)
-	if err != nil {
-		return "", err
-	}
-
-	if len(data) < gcm.NonceSize() {
-		return "", fmt.Errorf("malformed ciphertext")
-	}
-
-	nonce, ciphertext := data[:gcm.NonceSize()], data[gcm.NonceSize():]
-	plaintext, err := gcm.Open(nil, nonce, ciphertext, nil)
-	if err != nil {
-		return "", err
-	}
-
-	return string(plaintext), nil
-}
-
 // Helper for Proxy Logic
 func GetProviderKey(tenantID string, provider string) (string, error) {
 	var encryptedKey string
@@ -197,5 +322,9 @@ func GetProviderKey(tenantID string, provider string) (string, error) {
 	}
 
 	// Decrypt
-	return Decrypt(encryptedKey)
+	tenantUUID, err := uuid.Parse(tenantID)
+	if err != nil {
+		return "", err
+	}
+	return services.DecryptTenantSecret(context.Background(), tenantUUID, encryptedKey)
 }
@@ -3,19 +3,28 @@ package api
 import (
 	"bytes"
 	"context"
+	"database/sql"
 	"encoding/json"
+	"errors"
 	"fmt"
 	"io"
-	"log"
+	"log/slog"
 	"net/http"
 	"os"
+	"strings"
 	"time"
 
 	"zaps/db"
 	"zaps/services"
 
 	"github.com/gofiber/fiber/v2"
+	"github.com/google/uuid"
 	"github.com/redis/go-redis/v9"
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel/propagation"
+	"go.opentelemetry.io/otel/trace"
 )
 
 var ProviderModels = map[string][]string{
@@ -27,6 +36,8 @@ var ProviderModels = map[string][]string{
 		"gemini-2.5-flash", "gemini-2.5-pro",
 		"gemini-pro",
 	},
+	// Self-hosted (OpenAI-compatible) endpoint, used as an approved target for sensitive prompts
+	"ollama": {"llama3.1", "llama3.2", "mistral", "qwen2.5"},
 }
 
 const (
@@ -34,6 +45,7 @@ const (
 	ProviderAnthropic = "anthropic"
 	ProviderDeepSeek  = "deepseek"
 	ProviderGemini    = "gemini"
+	ProviderOllama    = "ollama"
 )
 
 func GetProviderForModel(model string) string {
@@ -62,11 +74,222 @@ func GetProviderURL(provider string) string {
 			return "https://api.deepseek.com"
 		}
 		return url
+	case ProviderOllama:
+		// Only available when explicitly configured
+		return os.Getenv("OLLAMA_API_URL")
 	default:
 		return ""
 	}
 }
 
+// providerModelsURL returns the provider's authenticated model listing endpoint
+func providerModelsURL(provider string) string {
+	base := GetProviderURL(provider)
+	if base == "" {
+		return ""
+	}
+	if provider == ProviderAnthropic {
+		return base + "/models?limit=1000"
+	}
+	return base + "/models"
+}
+
+// upstreamClient forwards chat completions; generations can take minutes
+var upstreamClient = &http.Client{Timeout: 300 * time.Second}
+
+// resolveProviderKey returns the tenant's key for a provider, falling back to the
+// global DeepSeek key. Empty when none is configured.
+func resolveProviderKey(rdb *redis.Client, tenantID, provider string) string {
+	apiKey, err := GetProviderKey(tenantID, provider)
+	if (err != nil || apiKey == "") && provider == ProviderDeepSeek {
+		apiKey, _ = rdb.HGet(context.Background(), "config:gateway", "deepseek_api_key").Result()
+		if apiKey == "" {
+			apiKey = os.Getenv("DEEPSEEK_API_KEY")
+		}
+	}
+	return apiKey
+}
+
+// providerKeyOptional reports whether a provider may be called without a key
+// (self-hosted endpoints may run without authentication)
+func providerKeyOptional(provider string) bool {
+	return provider == ProviderOllama && GetProviderURL(provider) != ""
+}
+
+// encodeUpstreamBody converts an OpenAI-format request to the provider's format and
+// returns the URL to send it to. body may be modified.
+func encodeUpstreamBody(provider string, body map[string]interface{}) (string, []byte, error) {
+	targetURL := GetProviderURL(provider) + "/chat/completions"
+
+	switch provider {
+	case ProviderAnthropic:
+		// Transform request for Anthropic (OpenAI -> Anthropic)
+		anthropicBody, err := ConvertOpenAIToAnthropic(body)
+		if err != nil {
+			return "", nil, fmt.Errorf("Failed to convert request for Anthropic")
+		}
+		payload, _ := json.Marshal(anthropicBody)
+		return "https://api.anthropic.com/v1/messages", payload, nil
+	case ProviderGemini:
+		// Remap deprecated Gemini model aliases
+		if model, ok := body["model"].(string); ok {
+			switch model {
+			case "gemini-pro":
+				model = "gemini-2.0-flash"
+			}
+			// Gemini API requires models/ prefix
+			if len(model) < 7 || model[:7] != "models/" {
+				model = "models/" + model
+			}
+			body["model"] = model
+		}
+	}
+	payload, _ := json.Marshal(body)
+	return targetURL, payload, nil
+}
+
+// newUpstreamRequest builds the POST to a provider with its authentication headers
+func newUpstreamRequest(ctx context.Context, provider, apiKey, targetURL string, payload []byte) (*http.Request, error) {
+	req, err := http.NewRequestWithContext(ctx, "POST", targetURL, bytes.NewReader(payload))
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	setProviderAuth(req, provider, apiKey)
+	return req, nil
+}
+
+// setProviderAuth adds the provider's authentication headers
+func setProviderAuth(req *http.Request, provider, apiKey string) {
+	if provider == ProviderAnthropic {
+		req.Header.Set("x-api-key", apiKey)
+		req.Header.Set("anthropic-version", "2023-06-01")
+	} else if apiKey != "" {
+		req.Header.Set("Authorization", "Bearer "+apiKey)
+	}
+}
+
+// decodeUpstreamResponse converts a successful provider response back to OpenAI format
+func decodeUpstreamResponse(ctx context.Context, provider string, status int, body []byte) []byte {
+	if provider != ProviderAnthropic || status != 200 {
+		return body
+	}
+	converted, err := ConvertAnthropicToOpenAI(body)
+	if err != nil {
+		slog.ErrorContext(ctx, "failed to convert Anthropic response", "error", err)
+		return body
+	}
+	return converted
+}
+
+// estimateUsage is an upper bound of a request's usage for rate limits and budgets,
+// corrected once the real usage is known
+func estimateUsage(body map[string]interface{}) services.TokenUsage {
+	messages, _ := body["messages"].([]interface{})
+	estimate := services.TokenUsage{
+		PromptTokens:     services.EstimateMessageTokens(messages),
+		CompletionTokens: services.DefaultCompletionReserve,
+	}
+	if mt, ok := body["max_tokens"].(float64); ok && mt > 0 {
+		estimate.CompletionTokens = int(mt)
+	}
+	return estimate
+}
+
+// usageReservation holds an upstream call's estimated usage against token rate limits
+// and budgets until the real usage is known
+type usageReservation struct {
+	rdb      *redis.Client
+	estimate int
+	tpm      []services.RateLimitCheck
+	budgets  *services.BudgetReservation
+}
+
+// reserveUsage counts an upstream call's estimated usage against the key and tenant TPM
+// limits and reserves it against the applicable budgets. When it returns false the
+// rejection (429 or 402) has been written to c. Both checks fail open if Redis is
+// unavailable. settle must be called once the real usage is known.
+func reserveUsage(c *fiber.Ctx, rdb *redis.Client, tenantID, apiKeyID, provider, model string, estimate services.TokenUsage) (*usageReservation, bool) {
+	ctx := c.UserContext()
+	r := &usageReservation{rdb: rdb, estimate: estimate.Total()}
+
+	// Tokens-per-minute limits (requests-per-minute is enforced by RateLimitMiddleware)
+	if tpm, err := checkTokenRateLimit(c, rdb, tenantID, estimate.Total()); err != nil {
+		slog.WarnContext(ctx, "token rate limit check failed", "error", err)
+	} else {
+		setRateLimitHeaders(c, tpm)
+		if !tpm.Allowed {
+			rateLimitExceeded(c, tpm)
+			return nil, false
+		}
+		r.tpm = tpm.Counted
+	}
+
+	budgetUserID, _ := c.Locals("user_id").(string)
+	if budgetUserID == "" {
+		budgetUserID, _ = c.Locals("api_key_user_id").(string)
+	}
+	budgets, err := services.ApplicableBudgets(tenantID, apiKeyID, budgetUserID)
+	if err != nil {
+		slog.WarnContext(ctx, "failed to load budgets", "error", err)
+		return r, true
+	}
+	if len(budgets) == 0 {
+		return r, true
+	}
+
+	reservation, err := services.ReserveBudgets(context.Background(), rdb, budgets, estimate.Total(), services.CalculateCost(provider, model, estimate))
+	var exceeded *services.BudgetExceededError
+	if errors.As(err, &exceeded) {
+		r.settle(0, 0) // Release the TPM reservation
+		services.LogKeyAuditAsync(tenantID, apiKeyID, "BUDGET_EXCEEDED", map[string]interface{}{
+			"budget_id": exceeded.Budget.ID.String(),
+			"scope":     exceeded.Budget.Scope,
+			"metric":    exceeded.Budget.Metric,
+			"limit":     exceeded.Budget.HardLimit,
+			"used":      exceeded.Used,
+			"model":     model,
+		}, c.IP(), c.Get("User-Agent"))
+		services.ObserveQuotaRejection(services.RejectBudget)
+		c.Status(402).JSON(fiber.Map{
+			"error":     "Budget Exceeded",
+			"message":   fmt.Sprintf("This request would exceed the %s %s budget for the current %s.", exceeded.Budget.Scope, exceeded.Budget.Metric, exceeded.Budget.Period),
+			"budget_id": exceeded.Budget.ID,
+		})
+		return nil, false
+	}
+	if err != nil {
+		slog.WarnContext(ctx, "budget reservation failed", "error", err)
+		return r, true
+	}
+	r.budgets = reservation
+
+	var warned []string
+	for _, b := range reservation.Warnings {
+		warned = append(warned, b.ID.String())
+		if services.ShouldNotifyBudgetWarning(context.Background(), rdb, b) {
+			services.LogKeyAuditAsync(tenantID, apiKeyID, "BUDGET_SOFT_LIMIT_REACHED", map[string]interface{}{
+				"budget_id":  b.ID.String(),
+				"scope":      b.Scope,
+				"metric":     b.Metric,
+				"soft_limit": *b.SoftLimit,
+			}, c.IP(), c.Get("User-Agent"))
+		}
+	}
+	if len(warned) > 0 {
+		c.Set("X-Zaps-Budget-Warning", strings.Join(warned, ","))
+	}
+	return r, true
+}
+
+// settle corrects the reservations to the real usage
+func (r *usageReservation) settle(tokens int, cost float64) {
+	if len(r.tpm) > 0 {
+		services.AdjustRateLimit(context.Background(), r.rdb, r.tpm, int64(tokens-r.estimate))
+	}
+	services.SettleBudgets(context.Background(), r.rdb, r.budgets, tokens, cost)
+}
+
 // CheckQuota checks if the tenant has sufficient quota
 func CheckQuota(tenantID string) error {
 	var current, monthly int
@@ -79,6 +302,9 @@ func CheckQuota(tenantID string) error {
 	`, tenantID).Scan(&current, &monthly, &overageAllowed)
 
 	if err != nil {
+		if err != sql.ErrNoRows {
+			services.ObserveBackendError(services.BackendPostgres, "quota_check")
+		}
 		return err
 	}
 
@@ -97,7 +323,8 @@ func IncrementUsage(tenantID string) {
 		WHERE id = $1
 	`, tenantID)
 	if err != nil {
-		log.Printf("Failed to increment usage for tenant %s: %v", tenantID, err)
+		slog.Error("failed to increment usage", "tenant_id", tenantID, "error", err)
+		services.ObserveBackendError(services.BackendPostgres, "increment_usage")
 	}
 }
 
@@ -107,9 +334,11 @@ func HandleChatCompletion(rdb *redis.Client) fiber.Handler {
 		clientID := c.Get("x-client-id", "unknown")
 		tenantID, _ := c.Locals("tenant_id").(string) // Ensure AuthMiddleware sets this
 		startTime := time.Now()
+		ctx := c.UserContext() // Carries the request span (TracingMiddleware)
 
 		// 0. Check Quota
 		if err := CheckQuota(tenantID); err != nil {
+			services.ObserveQuotaRejection(services.RejectQuota)
 			return c.Status(402).JSON(fiber.Map{
 				"error":   "Quota Exceeded",
 				"message": "You have reached your monthly limit. Please upgrade your plan.",
@@ -119,46 +348,28 @@ func HandleChatCompletion(rdb *redis.Client) fiber.Handler {
 		// Parse request body
 		var body map[string]interface{}
 		if err := c.BodyParser(&body); err != nil {
-			log.Printf("[%s] Invalid JSON: %v", clientID, err)
+			slog.WarnContext(ctx, "invalid JSON body", "client_id", clientID, "error", err)
 			return c.Status(400).JSON(fiber.Map{"error": "Invalid JSON"})
 		}
 
-		// 1. Determine Provider
-		var model string
-		if m, ok := body["model"].(string); ok {
-			model = m
-		}
-		provider := GetProviderForModel(model)
-		if provider == "" {
-			provider = ProviderDeepSeek
-		}
-
-		// 2. Resolve Credentials
-		apiKey, err := GetProviderKey(tenantID, provider)
+		// Track secrets for rehydration
+		secretMap := make(map[string]string)
+		promptChars := 0
 
-		// Fallback to Global Config for DeepSeek
-		if (err != nil || apiKey == "") && provider == ProviderDeepSeek {
-			apiKey, _ = rdb.HGet(context.Background(), "config:gateway", "deepseek_api_key").Result()
-			if apiKey == "" {
-				apiKey = os.Getenv("DEEPSEEK_API_KEY")
-			}
+		// Keep original contents in case a PII policy allows sending them to an approved target
+		type originalContent struct {
+			msg     map[string]interface{}
+			content string
 		}
+		var originals []originalContent
 
-		if apiKey == "" {
-			return c.Status(402).JSON(fiber.Map{
-				"error":   "Provider not configured",
-				"message": fmt.Sprintf("Please configure an API Key for %s in your Dashboard", provider),
-			})
+		customPatterns, err := services.LoadCustomPatterns(tenantID)
+		if err != nil {
+			slog.WarnContext(ctx, "failed to load custom PII patterns", "error", err)
 		}
 
-		// 3. Resolve Target Endpoint
-		baseURL := GetProviderURL(provider)
-		targetURL := baseURL + "/chat/completions"
-
-		// Track secrets for rehydration
-		secretMap := make(map[string]string)
-
 		// Sanitize messages
+		_, redactSpan := services.StartSpan(ctx, "pii.redact")
 		if messages, ok := body["messages"].([]interface{}); ok {
 			// INJECTION: Add System Prompt to prevent hallucinations
 			antiHallucinationMsg := map[string]interface{}{
@@ -173,7 +384,9 @@ func HandleChatCompletion(rdb *redis.Client) fiber.Handler {
 			for _, msg := range messages {
 				if m, ok := msg.(map[string]interface{}); ok {
 					if content, ok := m["content"].(string); ok {
-						cleanContent, secrets := services.RedactSecrets(context.Background(), content, clientID, rdb)
+						promptChars += len(content)
+						originals = append(originals, originalContent{msg: m, content: content})
+						cleanContent, secrets := services.RedactSecretsWithPatterns(ctx, content, clientID, rdb, customPatterns)
 						m["content"] = cleanContent
 
 						// Store secrets for rehydration
@@ -189,73 +402,224 @@ func HandleChatCompletion(rdb *redis.Client) fiber.Handler {
 			body["messages"] = newMessages
 		}
 
-		// Forward to Upstream
-		var reqBodyBytes []byte
+		// 1. Resolve Model (aliases & routing rules), then Provider
+		var model string
+		if m, ok := body["model"].(string); ok {
+			model = m
+		}
+		requestedModel := model
+		apiKeyID, _ := c.Locals("api_key_id").(string)
+		piiTypes := services.SecretTypes(secretMap)
+		redactCount := len(secretMap)
+		services.ObserveRedactions(piiTypes)
+		redactSpan.SetAttributes(services.PIITypeAttributes(piiTypes)...)
+		redactSpan.End()
+
+		_, routeSpan := services.StartSpan(ctx, "route.resolve")
+		route, err := services.ResolveModel(tenantID, services.RoutingInput{
+			Model:       model,
+			PromptChars: promptChars,
+			PIITypes:    piiTypes,
+			APIKeyID:    apiKeyID,
+		})
+		if err != nil {
+			slog.WarnContext(ctx, "model routing failed, using requested model", "error", err)
+			route = &services.RouteResolution{Model: model}
+		}
+		model = route.Model
+		routeSpan.SetAttributes(attribute.String("route.model", model), attribute.String("route.provider", route.Provider))
+		routeSpan.End()
 
-		// Transform request for Anthropic (OpenAI -> Anthropic)
-		if provider == ProviderAnthropic {
-			anthropicBody, convertErr := ConvertOpenAIToAnthropic(body)
-			if convertErr != nil {
-				return c.Status(400).JSON(fiber.Map{"error": "Failed to convert request for Anthropic"})
+		provider := route.Provider
+		if provider == "" {
+			provider = GetProviderForModel(model)
+		}
+		if provider == "" {
+			provider = ProviderDeepSeek
+		}
+
+		// 1b. PII-aware routing: sensitive prompts may only reach approved targets
+		piiDecision, err := services.EvaluatePIIRouting(tenantID, piiTypes)
+		if err != nil {
+			// Fail closed: we cannot prove the prompt is allowed to leave
+			slog.WarnContext(ctx, "PII policy evaluation failed", "error", err)
+			return c.Status(503).JSON(fiber.Map{"error": "Unable to evaluate PII routing policy"})
+		}
+		unredacted := false
+		if piiDecision != nil {
+			policy := piiDecision.Policy
+			decisionData := map[string]interface{}{
+				"policy_id":         policy.ID.String(),
+				"policy":            policy.Name,
+				"action":            policy.Action,
+				"entity_types":      piiDecision.Matched,
+				"requested_model":   requestedModel,
+				"resolved_provider": provider,
+				"resolved_model":    model,
+			}
+
+			if policy.Action == services.PIIActionReject {
+				slog.InfoContext(ctx, "PII policy rejected request", "policy", policy.Name, "entity_types", piiDecision.Matched)
+				services.LogKeyAuditAsync(tenantID, apiKeyID, "PII_ROUTING_DECISION", decisionData, c.IP(), c.Get("User-Agent"))
+				return c.Status(403).JSON(fiber.Map{
+					"error":        "PII policy violation",
+					"message":      fmt.Sprintf("This prompt contains data (%s) that your organization does not allow to be sent to external models.", strings.Join(piiDecision.Matched, ", ")),
+					"entity_types": piiDecision.Matched,
+				})
 			}
-			reqBodyBytes, _ = json.Marshal(anthropicBody)
-			targetURL = "https://api.anthropic.com/v1/messages" // Override URL
-		} else if provider == ProviderGemini {
-			// Remap deprecated Gemini model aliases
-			if model, ok := body["model"].(string); ok {
-				switch model {
-				case "gemini-pro":
-					model = "gemini-2.0-flash"
+
+			provider = policy.TargetProvider
+			model = policy.TargetModel
+			decisionData["target_provider"] = provider
+			decisionData["target_model"] = model
+			// Approved targets may process the original values directly; policies saved
+			// before the provider allowlist existed are redacted as usual
+			sendUnredacted := policy.SendUnredacted && services.UnredactedProviderAllowed(provider)
+			decisionData["send_unredacted"] = sendUnredacted
+
+			if sendUnredacted {
+				for _, o := range originals {
+					o.msg["content"] = o.content
 				}
-				// Gemini API requires models/ prefix
-				if len(model) < 7 || model[:7] != "models/" {
-					model = "models/" + model
+				secretMap = make(map[string]string)
+				unredacted = true
+			}
+
+			slog.InfoContext(ctx, "PII policy routed request", "policy", policy.Name, "target_provider", provider, "model", model, "entity_types", piiDecision.Matched)
+			services.LogKeyAuditAsync(tenantID, apiKeyID, "PII_ROUTING_DECISION", decisionData, c.IP(), c.Get("User-Agent"))
+		}
+		body["model"] = model
+
+		c.Set("X-Zaps-Model", model)
+		c.Set("X-Zaps-Provider", provider)
+		services.LogFieldsFrom(ctx).Set(func(f *services.LogFields) { f.Provider = provider })
+
+		// API key restrictions apply to the final routing decision
+		if denied, msg := checkKeyModelPolicy(c, body, model, provider); denied != "" {
+			return c.Status(403).JSON(fiber.Map{"error": denied, "message": msg})
+		}
+
+		// 2. Resolve Credentials
+		apiKey := resolveProviderKey(rdb, tenantID, provider)
+		if apiKey == "" && !providerKeyOptional(provider) {
+			return c.Status(402).JSON(fiber.Map{
+				"error":   "Provider not configured",
+				"message": fmt.Sprintf("Please configure an API Key for %s in your Dashboard", provider),
+			})
+		}
+		metricProvider, metricModel := metricLabels(provider, model)
+
+		// Semantic Cache: serve near-duplicate prompts without calling upstream
+		// (never for unredacted prompts, which must not be persisted)
+		var cacheSettings *services.SemanticCacheSettings
+		var cachePrompt string
+		if stream, _ := body["stream"].(bool); !stream && !unredacted {
+			if s, err := services.GetSemanticCacheSettings(tenantID); err == nil && s.ModelEnabled(model) {
+				cacheSettings = s
+				messages, _ := body["messages"].([]interface{})
+				cachePrompt = services.SemanticCachePrompt(messages)
+
+				cacheCtx, cacheSpan := services.StartSpan(ctx, "cache.semantic_lookup")
+				hit, err := services.LookupSemanticCache(cacheCtx, rdb, tenantID, model, cachePrompt, s.SimilarityThreshold)
+				cacheSpan.SetAttributes(attribute.Bool("cache.hit", hit != nil))
+				cacheSpan.End()
+				if err != nil {
+					slog.WarnContext(ctx, "semantic cache lookup failed", "error", err)
+				} else if hit != nil {
+					latency := time.Since(startTime)
+					services.LogRequestUsage(services.RequestUsage{
+						Ctx:        ctx,
+						TenantID:   tenantID,
+						APIKeyID:   apiKeyID,
+						Provider:   provider,
+						Model:      model,
+						StatusCode: 200,
+						LatencyMs:  latency.Milliseconds(),
+						PIIEvents:  piiTypes,
+					})
+					services.LogKeyAuditAsync(tenantID, apiKeyID, "PROXY_REQUEST", map[string]interface{}{
+						"provider":     provider,
+						"model":        model,
+						"status":       200,
+						"latency_ms":   latency.Milliseconds(),
+						"cache":        "semantic_hit",
+						"similarity":   hit.Similarity,
+						"redacted":     redactCount > 0,
+						"redact_count": redactCount,
+					}, c.IP(), c.Get("User-Agent"))
+
+					services.ObserveProxyRequest(metricProvider, metricModel, 200)
+					c.Set("X-Zaps-Cache", "semantic-hit")
+					c.Set("Content-Type", "application/json")
+					return c.Status(200).SendString(hit.Response)
 				}
-				body["model"] = model
+				c.Set("X-Zaps-Cache", "miss")
 			}
-			reqBodyBytes, _ = json.Marshal(body)
-		} else {
-			reqBodyBytes, _ = json.Marshal(body)
 		}
 
-		req, reqErr := http.NewRequest("POST", targetURL, bytes.NewReader(reqBodyBytes))
-		if reqErr != nil {
-			return c.Status(500).JSON(fiber.Map{"error": "Failed to create request"})
+		estimate := estimateUsage(body)
+		var settledTokens int
+		var settledCost float64
+
+		// Reserve the estimate against token rate limits and budgets
+		reservation, ok := reserveUsage(c, rdb, tenantID, apiKeyID, provider, model, estimate)
+		if !ok {
+			return nil
 		}
+		defer func() { reservation.settle(settledTokens, settledCost) }()
 
-		req.Header.Set("Content-Type", "application/json")
+		// Opt-in capture of the redacted request as forwarded (never of unredacted prompts)
+		var captureRequest []byte
+		if keyData, ok := c.Locals("api_key_data").(*services.APIKey); ok && keyData.CaptureBodies && !unredacted {
+			captureRequest, _ = json.Marshal(body)
+		}
 
-		if provider == "anthropic" {
-			req.Header.Set("x-api-key", apiKey)
-			req.Header.Set("anthropic-version", "2023-06-01")
-		} else {
-			req.Header.Set("Authorization", "Bearer "+apiKey)
+		// Forward to Upstream
+		targetURL, reqBodyBytes, err := encodeUpstreamBody(provider, body)
+		if err != nil {
+			return c.Status(400).JSON(fiber.Map{"error": err.Error()})
+		}
+
+		upstreamCtx, upstreamSpan := services.StartSpan(ctx, "upstream.chat_completion",
+			trace.WithSpanKind(trace.SpanKindClient),
+			trace.WithAttributes(
+				attribute.String("gen_ai.system", provider),
+				attribute.String("gen_ai.request.model", model),
+			),
+		)
+		defer upstreamSpan.End()
+
+		req, reqErr := newUpstreamRequest(upstreamCtx, provider, apiKey, targetURL, reqBodyBytes)
+		if reqErr != nil {
+			return c.Status(500).JSON(fiber.Map{"error": "Failed to create request"})
 		}
+		otel.GetTextMapPropagator().Inject(upstreamCtx, propagation.HeaderCarrier(req.Header))
 
-		// Increase timeout to 5 minutes
-		client := &http.Client{Timeout: 300 * time.Second}
-		resp, err := client.Do(req)
+		upstreamStart := time.Now()
+		resp, err := upstreamClient.Do(req)
 		if err != nil {
-			log.Printf("[%s] Upstream error (%s): %v", clientID, provider, err)
+			slog.ErrorContext(ctx, "upstream request failed", "error", err)
+			services.ObserveUpstreamLatency(metricProvider, metricModel, time.Since(upstreamStart))
+			services.ObserveProxyRequest(metricProvider, metricModel, 502)
+			upstreamSpan.SetStatus(codes.Error, "upstream unreachable")
 			return c.Status(502).JSON(fiber.Map{"error": "Upstream provider unreachable"})
 		}
 		defer resp.Body.Close()
 
 		// Read response
 		responseBody, err := io.ReadAll(resp.Body)
+		services.ObserveUpstreamLatency(metricProvider, metricModel, time.Since(upstreamStart))
+		services.ObserveProxyRequest(metricProvider, metricModel, resp.StatusCode)
+		upstreamSpan.SetAttributes(attribute.Int("http.response.status_code", resp.StatusCode))
+		if resp.StatusCode >= 500 {
+			upstreamSpan.SetStatus(codes.Error, fmt.Sprintf("HTTP %d", resp.StatusCode))
+		}
+		upstreamSpan.End()
 		if err != nil {
 			return c.Status(500).JSON(fiber.Map{"error": "Failed to read response"})
 		}
 
-		// If Anthropic and Success, Convert back to OpenAI format
-		if provider == "anthropic" && resp.StatusCode == 200 {
-			convertedResp, err := ConvertAnthropicToOpenAI(responseBody)
-			if err == nil {
-				responseBody = convertedResp
-			} else {
-				log.Printf("Failed to convert Anthropic response: %v", err)
-			}
-		}
+		responseBody = decodeUpstreamResponse(ctx, provider, resp.StatusCode, responseBody)
 
 		// FRICTION REDUCTION: Enhance Error Messages
 		if resp.StatusCode >= 400 {
@@ -286,24 +650,55 @@ func HandleChatCompletion(rdb *redis.Client) fiber.Handler {
 			}
 		}
 
+		if captureRequest != nil {
+			capture := &services.PromptCapture{
+				RequestID:      services.LogFieldsFrom(ctx).RequestID,
+				Provider:       provider,
+				Model:          model,
+				RequestedModel: requestedModel,
+				StatusCode:     resp.StatusCode,
+				LatencyMs:      time.Since(startTime).Milliseconds(),
+				PIITypes:       piiTypes,
+			}
+			capture.TenantID, _ = uuid.Parse(tenantID)
+			if apiKeyID != "" {
+				capture.APIKeyID = &apiKeyID
+			}
+			if captureID := services.CapturePromptAsync(ctx, capture, captureRequest, responseBody); captureID != uuid.Nil {
+				c.Set("X-Zaps-Capture-Id", captureID.String())
+			}
+		}
+
+		// Populate semantic cache with the redacted (pre-rehydration) answer
+		if cacheSettings != nil && resp.StatusCode == 200 {
+			cachedBody := string(responseBody)
+			go func() {
+				ttl := time.Duration(cacheSettings.TTLSeconds) * time.Second
+				if err := services.StoreSemanticCache(context.Background(), rdb, tenantID, model, cachePrompt, cachedBody, ttl); err != nil {
+					slog.WarnContext(ctx, "semantic cache store failed", "error", err)
+				}
+			}()
+		}
+
 		// Rehydrate secrets in response
-		rehydratedResponse := services.RehydrateSecrets(context.Background(), string(responseBody), secretMap, rdb)
+		rehydrateCtx, rehydrateSpan := services.StartSpan(ctx, "pii.rehydrate")
+		rehydratedResponse := services.RehydrateSecrets(rehydrateCtx, string(responseBody), secretMap, rdb)
+		rehydrateSpan.SetAttributes(attribute.Int("pii.tokens", len(secretMap)))
+		rehydrateSpan.End()
 
 		// ASYNC AUDIT LOGGING & USAGE TRACKING
 		latency := time.Since(startTime)
 
-		// Extract token count from upstream response
-		totalTokens := 0
+		// Token usage & cost (estimated locally when the upstream omits usage)
+		var tokenUsage services.TokenUsage
+		var costUSD float64
 		if resp.StatusCode == 200 {
-			var respJSON map[string]interface{}
-			if err := json.Unmarshal(responseBody, &respJSON); err == nil {
-				if usage, ok := respJSON["usage"].(map[string]interface{}); ok {
-					if tt, ok := usage["total_tokens"].(float64); ok {
-						totalTokens = int(tt)
-					}
-				}
-			}
+			messages, _ := body["messages"].([]interface{})
+			tokenUsage = extractTokenUsage(responseBody, messages)
+			costUSD = services.CalculateCost(provider, model, tokenUsage)
 		}
+		totalTokens := tokenUsage.Total()
+		settledTokens, settledCost = totalTokens, costUSD
 
 		// Increment Usage if successful (Total Tenant Usage)
 		if resp.StatusCode == 200 {
@@ -312,25 +707,46 @@ func HandleChatCompletion(rdb *redis.Client) fiber.Handler {
 
 		// Log Hourly Usage Stats (Async)
 		isError := resp.StatusCode >= 400
-		services.LogRequestUsage(tenantID, latency.Milliseconds(), isError, totalTokens)
+		services.LogRequestUsage(services.RequestUsage{
+			Ctx:        ctx,
+			TenantID:   tenantID,
+			APIKeyID:   apiKeyID,
+			Provider:   provider,
+			Model:      model,
+			StatusCode: resp.StatusCode,
+			LatencyMs:  latency.Milliseconds(),
+			IsError:    isError,
+			Tokens:     tokenUsage,
+			CostUSD:    costUSD,
+			PIIEvents:  piiTypes,
+		})
 
 		// Create sanitized event data
 		eventData := map[string]interface{}{
-			"provider":     provider,
-			"model":        model,
-			"status":       resp.StatusCode,
-			"latency_ms":   latency.Milliseconds(),
-			"total_tokens": totalTokens,
-			"redacted":     len(secretMap) > 0,
-			"redact_count": len(secretMap),
-			"request_len":  len(reqBodyBytes),
-			"response_len": len(responseBody),
+			"provider":         provider,
+			"model":            model,
+			"requested_model":  requestedModel,
+			"route_alias":      route.Alias,
+			"route_rule":       route.Rule,
+			"status":           resp.StatusCode,
+			"latency_ms":       latency.Milliseconds(),
+			"total_tokens":     totalTokens,
+			"prompt_tokens":    tokenUsage.PromptTokens,
+			"output_tokens":    tokenUsage.CompletionTokens,
+			"cached_tokens":    tokenUsage.CachedTokens,
+			"tokens_estimated": tokenUsage.Estimated,
+			"cost_usd":         costUSD,
+			"redacted":         redactCount > 0,
+			"redact_count":     redactCount,
+			"pii_types":        piiTypes,
+			"request_len":      len(reqBodyBytes),
+			"response_len":     len(responseBody),
 			// Store sanitized secrets for debugging (Masked)
 			"pii_details": services.SanitizeMap(secretMap),
 		}
 
 		// FIX: Use tenantID (not ownerID) so audit logs match dashboard queries
-		services.LogAuditAsync(tenantID, nil, "PROXY_REQUEST", eventData, c.IP(), c.Get("User-Agent"))
+		services.LogKeyAuditAsync(tenantID, apiKeyID, "PROXY_REQUEST", eventData, c.IP(), c.Get("User-Agent"))
 
 		// PLAYGROUND DEBUG SUPPORT
 		if c.Get("X-Zaps-Debug") == "true" {
@@ -355,22 +771,19 @@ func HandleListModels(rdb *redis.Client) fiber.Handler {
 		}
 
 		var availableModels []Model
+		keyData, _ := c.Locals("api_key_data").(*services.APIKey)
+		visible := func(provider, model string) bool {
+			return keyData == nil || (keyData.AllowsProvider(provider) && keyData.AllowsModel(model))
+		}
 
 		// Iterate over all supported providers
 		for provider, models := range ProviderModels {
-			apiKey, err := GetProviderKey(tenantID, provider)
-
-			// Special check for DeepSeek global config fallback
-			if (err != nil || apiKey == "") && provider == ProviderDeepSeek {
-				apiKey, _ = rdb.HGet(context.Background(), "config:gateway", "deepseek_api_key").Result()
-				if apiKey == "" {
-					apiKey = os.Getenv("DEEPSEEK_API_KEY")
-				}
-			}
-
 			// If we found a valid key string, add models
-			if apiKey != "" {
+			if resolveProviderKey(rdb, tenantID, provider) != "" || providerKeyOptional(provider) {
 				for _, m := range models {
+					if !visible(provider, m) {
+						continue
+					}
 					availableModels = append(availableModels, Model{
 						ID:      m,
 						Object:  "model",
@@ -380,9 +793,65 @@ func HandleListModels(rdb *redis.Client) fiber.Handler {
 			}
 		}
 
+		// Tenant-defined aliases are addressable like any other model
+		if aliases, err := services.ListModelAliases(tenantID); err == nil {
+			for _, a := range aliases {
+				if !visible(a.Provider, a.Alias) && !visible(a.Provider, a.Model) {
+					continue
+				}
+				availableModels = append(availableModels, Model{
+					ID:      a.Alias,
+					Object:  "model",
+					OwnedBy: "zaps-alias:" + a.Provider,
+				})
+			}
+		}
+
 		return c.JSON(fiber.Map{
 			"object": "list",
 			"data":   availableModels,
 		})
 	}
 }
+
+// extractTokenUsage reads usage from an OpenAI-format response body, falling back to a
+// local estimate of the prompt and completion when the upstream did not report it.
+func extractTokenUsage(responseBody []byte, messages []interface{}) services.TokenUsage {
+	var parsed struct {
+		Choices []struct {
+			Message struct {
+				Content string `json:"content"`
+			} `json:"message"`
+		} `json:"choices"`
+		Usage *struct {
+			PromptTokens        int `json:"prompt_tokens"`
+			CompletionTokens    int `json:"completion_tokens"`
+			PromptTokensDetails *struct {
+				CachedTokens int `json:"cached_tokens"`
+			} `json:"prompt_tokens_details"`
+			PromptCacheHitTokens int `json:"prompt_cache_hit_tokens"` // DeepSeek
+		} `json:"usage"`
+	}
+	json.Unmarshal(responseBody, &parsed)
+
+	if u := parsed.Usage; u != nil && (u.PromptTokens > 0 || u.CompletionTokens > 0) {
+		usage := services.TokenUsage{
+			PromptTokens:     u.PromptTokens,
+			CompletionTokens: u.CompletionTokens,
+			CachedTokens:     u.PromptCacheHitTokens,
+		}
+		if u.PromptTokensDetails != nil && u.PromptTokensDetails.CachedTokens > 0 {
+			usage.CachedTokens = u.PromptTokensDetails.CachedTokens
+		}
+		return usage
+	}
+
+	usage := services.TokenUsage{
+		PromptTokens: services.EstimateMessageTokens(messages),
+		Estimated:    true,
+	}
+	for _, choice := range parsed.Choices {
+		usage.CompletionTokens += services.EstimateTokens(choice.Message.Content)
+	}
+	return usage
+}
@@ -0,0 +1,124 @@
+package api
+
+import (
+	"context"
+	"fmt"
+	"log/slog"
+	"math"
+	"strconv"
+	"time"
+
+	"zaps/services"
+
+	"github.com/gofiber/fiber/v2"
+	"github.com/redis/go-redis/v9"
+)
+
+// RateLimitMiddleware enforces requests-per-minute limits for the API key and its
+// tenant. It must run after AuthMiddleware. Token limits are enforced in the proxy
+// once the prompt size is known (see checkTokenRateLimit).
+func RateLimitMiddleware(rdb *redis.Client) fiber.Handler {
+	return func(c *fiber.Ctx) error {
+		tenantID, _ := c.Locals("tenant_id").(string)
+
+		var checks []services.RateLimitCheck
+		if keyData, ok := c.Locals("api_key_data").(*services.APIKey); ok {
+			checks = append(checks, services.RateLimitCheck{
+				Key:    services.KeyRateLimitKey(keyData, services.RateLimitRequests),
+				Kind:   services.RateLimitRequests,
+				Limit:  int64(keyData.Limits().RPM),
+				Amount: 1,
+			})
+		}
+		if tenantID != "" {
+			if limits, err := services.GetTenantRateLimits(tenantID); err != nil {
+				slog.WarnContext(c.UserContext(), "failed to load tenant rate limits", "error", err)
+			} else {
+				checks = append(checks, services.RateLimitCheck{
+					Key:    services.TenantRateLimitKey(tenantID, services.RateLimitRequests),
+					Kind:   services.RateLimitRequests,
+					Limit:  int64(limits.RPM),
+					Amount: 1,
+				})
+			}
+		}
+
+		res, err := services.CheckRateLimits(context.Background(), rdb, checks)
+		if err != nil {
+			// Fail open if Redis is unavailable
+			slog.WarnContext(c.UserContext(), "rate limit check failed", "error", err)
+			return c.Next()
+		}
+
+		setRateLimitHeaders(c, res)
+		if !res.Allowed {
+			return rateLimitExceeded(c, res)
+		}
+		return c.Next()
+	}
+}
+
+// checkTokenRateLimit reserves estimated tokens against the key and tenant TPM limits.
+// The counted checks in the result must be corrected with AdjustRateLimit once the real usage is known.
+func checkTokenRateLimit(c *fiber.Ctx, rdb *redis.Client, tenantID string, estimate int) (*services.RateLimitResult, error) {
+	var checks []services.RateLimitCheck
+	if keyData, ok := c.Locals("api_key_data").(*services.APIKey); ok {
+		checks = append(checks, services.RateLimitCheck{
+			Key:    services.KeyRateLimitKey(keyData, services.RateLimitTokens),
+			Kind:   services.RateLimitTokens,
+			Limit:  int64(keyData.Limits().TPM),
+			Amount: int64(estimate),
+		})
+	}
+	if limits, err := services.GetTenantRateLimits(tenantID); err == nil {
+		checks = append(checks, services.RateLimitCheck{
+			Key:    services.TenantRateLimitKey(tenantID, services.RateLimitTokens),
+			Kind:   services.RateLimitTokens,
+			Limit:  int64(limits.TPM),
+			Amount: int64(estimate),
+		})
+	}
+
+	return services.CheckRateLimits(context.Background(), rdb, checks)
+}
+
+// setRateLimitHeaders writes OpenAI-style x-ratelimit-* headers
+func setRateLimitHeaders(c *fiber.Ctx, res *services.RateLimitResult) {
+	for kind, st := range res.Status {
+		c.Set("x-ratelimit-limit-"+kind, strconv.FormatInt(st.Limit, 10))
+		c.Set("x-ratelimit-remaining-"+kind, strconv.FormatInt(st.Remaining, 10))
+		c.Set("x-ratelimit-reset-"+kind, st.Reset.Round(time.Millisecond).String())
+	}
+}
+
+// rateLimitExceeded writes an OpenAI-compatible 429 response
+func rateLimitExceeded(c *fiber.Ctx, res *services.RateLimitResult) error {
+	exceeded := res.Exceeded
+	st := res.Status[exceeded.Kind]
+
+	if exceeded.Kind == services.RateLimitTokens {
+		services.ObserveQuotaRejection(services.RejectRateTokens)
+	} else {
+		services.ObserveQuotaRejection(services.RejectRateRequests)
+	}
+
+	unit := "RPM"
+	if exceeded.Kind == services.RateLimitTokens {
+		unit = "TPM"
+	}
+	scope := "api key"
+	if exceeded.Key == services.TenantRateLimitKey(c.Locals("tenant_id").(string), exceeded.Kind) {
+		scope = "organization"
+	}
+
+	c.Set("Retry-After", strconv.Itoa(int(math.Ceil(st.Reset.Seconds()))))
+	return c.Status(429).JSON(fiber.Map{
+		"error": fiber.Map{
+			"message": fmt.Sprintf("Rate limit reached for %s per min (%s) on %s: Limit %d, Requested %d. Please try again in %s.",
+				exceeded.Kind, unit, scope, exceeded.Limit, exceeded.Amount, st.Reset.Round(time.Millisecond)),
+			"type":  exceeded.Kind,
+			"param": nil,
+			"code":  "rate_limit_exceeded",
+		},
+	})
+}
@@ -0,0 +1,47 @@
+package api
+
+import (
+	"zaps/services"
+
+	"github.com/gofiber/fiber/v2"
+	"github.com/google/uuid"
+)
+
+// GetRetentionPolicy returns the tenant's data retention policy
+func GetRetentionPolicy(c *fiber.Ctx) error {
+	tenantID, _ := uuid.Parse(c.Locals("tenant_id").(string))
+
+	policy, err := services.GetRetentionPolicy(c.UserContext(), tenantID)
+	if err != nil {
+		return c.Status(500).JSON(fiber.Map{"error": "Failed to fetch retention policy"})
+	}
+
+	return c.JSON(policy)
+}
+
+// UpdateRetentionPolicy replaces the tenant's data retention policy
+func UpdateRetentionPolicy(c *fiber.Ctx) error {
+	tenantID, _ := uuid.Parse(c.Locals("tenant_id").(string))
+
+	req := services.RetentionPolicy{Archive: true}
+	if err := c.BodyParser(&req); err != nil {
+		return c.Status(400).JSON(fiber.Map{"error": "Invalid request"})
+	}
+
+	if err := services.SaveRetentionPolicy(c.UserContext(), tenantID, &req); err != nil {
+		return c.Status(400).JSON(fiber.Map{"error": err.Error()})
+	}
+
+	services.LogAuditAsync(tenantID.String(), nil, "RETENTION_POLICY_UPDATED", map[string]interface{}{
+		"audit_days":  req.AuditDays,
+		"usage_days":  req.UsageDays,
+		"prompt_days": req.PromptDays,
+		"archive":     req.Archive,
+	}, c.IP(), c.Get("User-Agent"))
+
+	policy, err := services.GetRetentionPolicy(c.UserContext(), tenantID)
+	if err != nil {
+		return c.Status(500).JSON(fiber.Map{"error": "Failed to fetch retention policy"})
+	}
+	return c.JSON(policy)
+}
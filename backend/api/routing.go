@@ -0,0 +1,136 @@
+package api
+
+import (
+	"database/sql"
+
+	"zaps/services"
+
+	"github.com/gofiber/fiber/v2"
+	"github.com/google/uuid"
+)
+
+func isSupportedProvider(provider string) bool {
+	_, ok := ProviderModels[provider]
+	return ok
+}
+
+// GetModelAliases lists the tenant's model aliases
+func GetModelAliases(c *fiber.Ctx) error {
+	tenantID := c.Locals("tenant_id").(string)
+
+	aliases, err := services.ListModelAliases(tenantID)
+	if err != nil {
+		return c.Status(500).JSON(fiber.Map{"error": "Failed to fetch aliases"})
+	}
+
+	return c.JSON(aliases)
+}
+
+// SaveModelAlias creates or updates a model alias
+func SaveModelAlias(c *fiber.Ctx) error {
+	tenantID, _ := uuid.Parse(c.Locals("tenant_id").(string))
+
+	var req services.ModelAlias
+	if err := c.BodyParser(&req); err != nil {
+		return c.Status(400).JSON(fiber.Map{"error": "Invalid request"})
+	}
+
+	if !isSupportedProvider(req.Provider) {
+		return c.Status(400).JSON(fiber.Map{"error": "Unsupported provider"})
+	}
+
+	if err := services.SaveModelAlias(tenantID, &req); err != nil {
+		return c.Status(400).JSON(fiber.Map{"error": err.Error()})
+	}
+
+	services.LogAuditAsync(tenantID.String(), nil, "MODEL_ALIAS_SAVED", map[string]interface{}{
+		"alias":    req.Alias,
+		"provider": req.Provider,
+		"model":    req.Model,
+	}, c.IP(), c.Get("User-Agent"))
+
+	return c.JSON(req)
+}
+
+// DeleteModelAlias removes a model alias
+func DeleteModelAlias(c *fiber.Ctx) error {
+	tenantID, _ := uuid.Parse(c.Locals("tenant_id").(string))
+	alias := c.Params("alias")
+
+	found, err := services.DeleteModelAlias(tenantID, alias)
+	if err != nil {
+		return c.Status(500).JSON(fiber.Map{"error": "Failed to delete alias"})
+	}
+	if !found {
+		return c.Status(404).JSON(fiber.Map{"error": "Alias not found"})
+	}
+
+	return c.JSON(fiber.Map{"status": "deleted"})
+}
+
+// GetRoutingRules lists the tenant's routing rules in evaluation order
+func GetRoutingRules(c *fiber.Ctx) error {
+	tenantID := c.Locals("tenant_id").(string)
+
+	rules, err := services.ListRoutingRules(tenantID)
+	if err != nil {
+		return c.Status(500).JSON(fiber.Map{"error": "Failed to fetch routing rules"})
+	}
+
+	return c.JSON(rules)
+}
+
+// SaveRoutingRule creates a rule (POST) or updates one (PUT /:id)
+func SaveRoutingRule(c *fiber.Ctx) error {
+	tenantID, _ := uuid.Parse(c.Locals("tenant_id").(string))
+
+	req := services.RoutingRule{Enabled: true, Priority: 100}
+	if err := c.BodyParser(&req); err != nil {
+		return c.Status(400).JSON(fiber.Map{"error": "Invalid request"})
+	}
+
+	if id := c.Params("id"); id != "" {
+		parsed, err := uuid.Parse(id)
+		if err != nil {
+			return c.Status(400).JSON(fiber.Map{"error": "Invalid rule ID"})
+		}
+		req.ID = parsed
+	} else {
+		req.ID = uuid.Nil
+	}
+
+	if req.TargetProvider != "" && !isSupportedProvider(req.TargetProvider) {
+		return c.Status(400).JSON(fiber.Map{"error": "Unsupported provider"})
+	}
+
+	err := services.SaveRoutingRule(tenantID, &req)
+	if err == sql.ErrNoRows {
+		return c.Status(404).JSON(fiber.Map{"error": "Rule not found"})
+	}
+	if err != nil {
+		return c.Status(400).JSON(fiber.Map{"error": err.Error()})
+	}
+
+	services.LogAuditAsync(tenantID.String(), nil, "ROUTING_RULE_SAVED", map[string]interface{}{
+		"rule_id":      req.ID.String(),
+		"name":         req.Name,
+		"target_model": req.TargetModel,
+	}, c.IP(), c.Get("User-Agent"))
+
+	return c.JSON(req)
+}
+
+// DeleteRoutingRule removes a routing rule
+func DeleteRoutingRule(c *fiber.Ctx) error {
+	tenantID, _ := uuid.Parse(c.Locals("tenant_id").(string))
+
+	found, err := services.DeleteRoutingRule(tenantID, c.Params("id"))
+	if err != nil {
+		return c.Status(500).JSON(fiber.Map{"error": "Failed to delete rule"})
+	}
+	if !found {
+		return c.Status(404).JSON(fiber.Map{"error": "Rule not found"})
+	}
+
+	return c.JSON(fiber.Map{"status": "deleted"})
+}
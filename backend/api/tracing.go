@@ -0,0 +1,70 @@
+package api
+
+import (
+	"fmt"
+
+	"zaps/services"
+
+	"github.com/gofiber/fiber/v2"
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel/trace"
+)
+
+// fiberCarrier reads trace headers from the request and writes them to the response
+type fiberCarrier struct{ c *fiber.Ctx }
+
+func (fc fiberCarrier) Get(key string) string { return fc.c.Get(key) }
+
+func (fc fiberCarrier) Set(key, value string) { fc.c.Set(key, value) }
+
+func (fc fiberCarrier) Keys() []string {
+	var keys []string
+	fc.c.Request().Header.VisitAll(func(k, _ []byte) {
+		keys = append(keys, string(k))
+	})
+	return keys
+}
+
+// TracingMiddleware starts a server span for each request, continuing an incoming
+// W3C traceparent, and returns the span's traceparent to the client. Handlers reach
+// the span through c.UserContext().
+func TracingMiddleware() fiber.Handler {
+	return func(c *fiber.Ctx) error {
+		propagator := otel.GetTextMapPropagator()
+		ctx := propagator.Extract(c.UserContext(), fiberCarrier{c})
+
+		// Renamed to the matched route pattern once known, so raw paths never become span names
+		ctx, span := services.StartSpan(ctx, c.Method(),
+			trace.WithSpanKind(trace.SpanKindServer),
+			trace.WithAttributes(attribute.String("http.request.method", c.Method())),
+		)
+		defer span.End()
+
+		c.SetUserContext(ctx)
+		propagator.Inject(ctx, fiberCarrier{c})
+		if sc := span.SpanContext(); sc.HasTraceID() {
+			services.LogFieldsFrom(ctx).Set(func(f *services.LogFields) { f.TraceID = sc.TraceID().String() })
+		}
+
+		err := c.Next()
+
+		status := c.Response().StatusCode()
+		span.SetName(fmt.Sprintf("%s %s", c.Method(), c.Route().Path))
+		span.SetAttributes(
+			attribute.String("http.route", c.Route().Path),
+			attribute.Int("http.response.status_code", status),
+		)
+		if tenantID, ok := c.Locals("tenant_id").(string); ok {
+			span.SetAttributes(attribute.String("zaps.tenant_id", tenantID))
+		}
+		if keyID, ok := c.Locals("api_key_id").(string); ok && keyID != "" {
+			span.SetAttributes(attribute.String("zaps.api_key_id", keyID))
+		}
+		if err != nil || status >= 500 {
+			span.SetStatus(codes.Error, fmt.Sprintf("HTTP %d", status))
+		}
+		return err
+	}
+}
@@ -0,0 +1,187 @@
+package api
+
+import (
+	"context"
+	"encoding/json"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"zaps/db"
+
+	"github.com/DATA-DOG/go-sqlmock"
+	"github.com/alicebob/miniredis/v2"
+	"github.com/gofiber/fiber/v2"
+	"github.com/redis/go-redis/v9"
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/propagation"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	"go.opentelemetry.io/otel/sdk/trace/tracetest"
+	"go.opentelemetry.io/otel/trace"
+)
+
+const (
+	testTenantID = "0b8f4f7c-6a3e-4d0b-8a0f-2f6c1e9d5a22"
+	testKeyID    = "6f1c7e0e-2d5f-4c1e-9a53-3c9d3c2a0b11"
+)
+
+// useInMemoryTracing routes spans from the global tracer to an in-memory exporter
+func useInMemoryTracing(t *testing.T) *tracetest.InMemoryExporter {
+	t.Helper()
+	exporter := tracetest.NewInMemoryExporter()
+	tp := sdktrace.NewTracerProvider(sdktrace.WithSyncer(exporter))
+	prevTP, prevProp := otel.GetTracerProvider(), otel.GetTextMapPropagator()
+	otel.SetTracerProvider(tp)
+	otel.SetTextMapPropagator(propagation.NewCompositeTextMapPropagator(propagation.TraceContext{}, propagation.Baggage{}))
+	t.Cleanup(func() {
+		tp.Shutdown(context.Background())
+		otel.SetTracerProvider(prevTP)
+		otel.SetTextMapPropagator(prevProp)
+	})
+	return exporter
+}
+
+// useMockDB points db.DB at a sqlmock that matches expectations in any order. Queries
+// without an expectation fail, which the proxy treats as "nothing configured".
+func useMockDB(t *testing.T) sqlmock.Sqlmock {
+	t.Helper()
+	mockDB, mock, err := sqlmock.New()
+	if err != nil {
+		t.Fatal(err)
+	}
+	mock.MatchExpectationsInOrder(false)
+	db.DB = mockDB
+	// Left in place closed, so stray async writes fail instead of dereferencing nil
+	t.Cleanup(func() { mockDB.Close() })
+	return mock
+}
+
+func TestChatCompletionTracing(t *testing.T) {
+	exporter := useInMemoryTracing(t)
+	mr := miniredis.RunT(t)
+	rdb := redis.NewClient(&redis.Options{Addr: mr.Addr()})
+	defer rdb.Close()
+
+	mock := useMockDB(t)
+	mock.ExpectQuery(`SELECT current_usage, monthly_quota, overage_allowed`).
+		WillReturnRows(sqlmock.NewRows([]string{"current_usage", "monthly_quota", "overage_allowed"}).AddRow(0, 1000, false))
+	mock.ExpectQuery(`FROM pii_routing_policies`).WillReturnRows(sqlmock.NewRows([]string{"id"}))
+
+	const (
+		promptText = "Summarize the Nightingale acquisition plan"
+		secret     = "alice.nightingale@example.com"
+	)
+
+	var upstreamHeader http.Header
+	var upstreamBody string
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		upstreamHeader = r.Header.Clone()
+		b, _ := io.ReadAll(r.Body)
+		upstreamBody = string(b)
+		w.Header().Set("Content-Type", "application/json")
+		w.Write([]byte(`{"choices":[{"message":{"role":"assistant","content":"Done."}}],"usage":{"prompt_tokens":12,"completion_tokens":2}}`))
+	}))
+	defer upstream.Close()
+	t.Setenv("OLLAMA_API_URL", upstream.URL)
+
+	app := fiber.New()
+	app.Use(TracingMiddleware())
+	app.Post("/v1/chat/completions", func(c *fiber.Ctx) error {
+		c.Locals("tenant_id", testTenantID)
+		c.Locals("api_key_id", testKeyID)
+		return c.Next()
+	}, HandleChatCompletion(rdb))
+
+	const (
+		incomingTraceID = "4bf92f3577b34da6a3ce929d0e0e4736"
+		incomingSpanID  = "00f067aa0ba902b7"
+	)
+	body, _ := json.Marshal(map[string]interface{}{
+		"model": "llama3.1",
+		"messages": []map[string]string{
+			{"role": "user", "content": promptText + " and email it to " + secret},
+		},
+	})
+	req := httptest.NewRequest("POST", "/v1/chat/completions", strings.NewReader(string(body)))
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("traceparent", "00-"+incomingTraceID+"-"+incomingSpanID+"-01")
+	resp, err := app.Test(req, -1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if resp.StatusCode != 200 {
+		b, _ := io.ReadAll(resp.Body)
+		t.Fatalf("status %d: %s", resp.StatusCode, b)
+	}
+	if strings.Contains(upstreamBody, secret) {
+		t.Fatal("secret reached the upstream; redaction did not run")
+	}
+
+	spans := exporter.GetSpans()
+	var server, client *tracetest.SpanStub
+	for i := range spans {
+		switch {
+		case spans[i].SpanKind == trace.SpanKindServer:
+			server = &spans[i]
+		case spans[i].Name == "upstream.chat_completion":
+			client = &spans[i]
+		}
+	}
+	if server == nil || client == nil {
+		t.Fatalf("missing server or upstream span in %d spans", len(spans))
+	}
+
+	t.Run("server span is named after the route", func(t *testing.T) {
+		if server.Name != "POST /v1/chat/completions" {
+			t.Errorf("server span name = %q", server.Name)
+		}
+	})
+
+	t.Run("incoming traceparent is continued and forwarded upstream", func(t *testing.T) {
+		if got := server.SpanContext.TraceID().String(); got != incomingTraceID {
+			t.Errorf("server span trace ID = %s, want %s", got, incomingTraceID)
+		}
+		if got := server.Parent.SpanID().String(); got != incomingSpanID {
+			t.Errorf("server span parent = %s, want %s", got, incomingSpanID)
+		}
+		want := "00-" + incomingTraceID + "-" + client.SpanContext.SpanID().String() + "-01"
+		if got := upstreamHeader.Get("traceparent"); got != want {
+			t.Errorf("upstream traceparent = %q, want %q", got, want)
+		}
+		if got := resp.Header.Get("traceparent"); !strings.Contains(got, incomingTraceID) {
+			t.Errorf("response traceparent = %q", got)
+		}
+	})
+
+	t.Run("spans carry no prompt text or secrets", func(t *testing.T) {
+		forbidden := []string{"Nightingale", "nightingale", secret, "<SECRET:"}
+		redacted := false
+		for _, s := range spans {
+			values := []string{s.Name, s.Status.Description}
+			for _, kv := range s.Attributes {
+				values = append(values, kv.Value.Emit())
+				if s.Name == "pii.redact" && kv.Key == "pii.types" && strings.Contains(kv.Value.Emit(), "EMAIL") {
+					redacted = true
+				}
+			}
+			for _, e := range s.Events {
+				values = append(values, e.Name)
+				for _, kv := range e.Attributes {
+					values = append(values, kv.Value.Emit())
+				}
+			}
+			for _, v := range values {
+				for _, f := range forbidden {
+					if strings.Contains(v, f) {
+						t.Errorf("span %q carries %q: %q", s.Name, f, v)
+					}
+				}
+			}
+		}
+		if !redacted {
+			t.Error("pii.redact span does not report the EMAIL detection")
+		}
+	})
+}
@@ -25,14 +25,27 @@ func AuthMiddleware(rdb *redis.Client) fiber.Handler {
 				apiKey := parts[1]
 				if strings.HasPrefix(apiKey, services.ApiKeyPrefix) {
 					// Validate API Key
-					keyData, err := services.GetAPIKey(rdb, apiKey)
+					keyData, err := services.AuthenticateAPIKey(c.UserContext(), rdb, apiKey)
+					if err == nil && keyData.Enabled && keyData.Expired() {
+						return c.Status(401).JSON(fiber.Map{
+							"error":   "Unauthorized",
+							"message": "API key has expired",
+						})
+					}
 					if err == nil && keyData.Enabled {
-						go services.UpdateAPIKeyUsage(rdb, apiKey)
+						go services.UpdateAPIKeyUsage(rdb, keyData)
 
+						c.Locals("api_key_id", keyData.ID)
 						c.Locals("api_key_name", keyData.Name)
+						c.Locals("api_key_user_id", keyData.UserID)
 						c.Locals("api_key", apiKey)
+						c.Locals("api_key_data", keyData) // Rate limits (api.RateLimitMiddleware)
 						c.Locals("owner_id", keyData.OwnerID)
 						c.Locals("tenant_id", keyData.OwnerID)
+						services.LogFieldsFrom(c.UserContext()).Set(func(f *services.LogFields) {
+							f.TenantID = keyData.OwnerID
+							f.APIKeyID = keyData.ID
+						})
 						return c.Next()
 					}
 				}
@@ -84,6 +97,9 @@ func AuthMiddleware(rdb *redis.Client) fiber.Handler {
 					c.Locals("email", claims["email"])
 					// Support for Playground (which uses Session, but calls endpoints expecting owner_id)
 					c.Locals("owner_id", claims["user_id"])
+					if tenantID, ok := claims["tenant_id"].(string); ok {
+						services.LogFieldsFrom(c.UserContext()).Set(func(f *services.LogFields) { f.TenantID = tenantID })
+					}
 					return c.Next()
 				}
 			}
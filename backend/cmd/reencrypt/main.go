@@ -0,0 +1,65 @@
+package main
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"flag"
+	"fmt"
+	"log"
+
+	"zaps/db"
+	"zaps/services"
+
+	"github.com/joho/godotenv"
+)
+
+// Moves tenant secrets onto the current keys: rewraps data keys still wrapped by a
+// retired master key, optionally rotates every tenant's data key (-rotate), and
+// re-encrypts provider keys, audit sink secrets and prompt captures (including values
+// from before envelope encryption) under each tenant's newest data key. Run with the
+// same KMS settings as the gateway; it is safe to run while the gateway is up and to
+// re-run. -genkey prints a new master key for a KMS_KEY_FILE.
+func main() {
+	tenant := flag.String("tenant", "", "Tenant ID (default: all tenants)")
+	rotate := flag.Bool("rotate", false, "Create a new data key version for each tenant first")
+	genKey := flag.Bool("genkey", false, "Generate a 256-bit master key (hex) and exit")
+	flag.Parse()
+
+	if *genKey {
+		key := make([]byte, 32)
+		if _, err := rand.Read(key); err != nil {
+			log.Fatalf("Key generation failed: %v", err)
+		}
+		fmt.Println(hex.EncodeToString(key))
+		return
+	}
+
+	if err := godotenv.Load("../../.env"); err != nil {
+		log.Println("Warning: .env file not found")
+	}
+
+	if err := db.InitDB(); err != nil {
+		log.Fatalf("Failed to initialize database: %v", err)
+	}
+	defer db.CloseDB()
+
+	kms, err := services.KMSFromEnv()
+	if err != nil {
+		log.Fatalf("KMS error: %v", err)
+	}
+	services.SetKMS(kms)
+
+	result, err := services.ReencryptSecrets(context.Background(), services.ReencryptOptions{
+		TenantID:       *tenant,
+		RotateDataKeys: *rotate,
+	})
+	if err != nil {
+		log.Printf("Stopped after rewrapping %d data key(s), rotating %d, re-encrypting %d provider key(s), %d sink secret(s) and %d capture(s)",
+			result.DataKeysRewrapped, result.DataKeysRotated, result.ProviderKeys, result.SinkSecrets, result.Captures)
+		log.Fatalf("Re-encryption failed: %v", err)
+	}
+
+	log.Printf("Success! Rewrapped %d data key(s), rotated %d, re-encrypted %d provider key(s), %d sink secret(s) and %d capture(s) (master key %q).",
+		result.DataKeysRewrapped, result.DataKeysRotated, result.ProviderKeys, result.SinkSecrets, result.Captures, kms.KeyID())
+}
@@ -0,0 +1,46 @@
+package main
+
+import (
+	"context"
+	"log"
+	"os"
+
+	"zaps/db"
+	"zaps/services"
+
+	"github.com/joho/godotenv"
+	"github.com/redis/go-redis/v9"
+)
+
+// Rehashes API keys that are still stored in raw form (api_keys.key_hash and
+// "apikey:gk_..." Redis entries). Clients keep using their existing keys.
+// Run after migration 015 with the same API_KEY_HASH_SECRET as the gateway.
+func main() {
+	if err := godotenv.Load("../../.env"); err != nil {
+		log.Println("Warning: .env file not found")
+	}
+
+	if err := db.InitDB(); err != nil {
+		log.Fatalf("Failed to initialize database: %v", err)
+	}
+	defer db.CloseDB()
+
+	redisURL := os.Getenv("REDIS_URL")
+	if redisURL == "" {
+		redisURL = "localhost:6379"
+	}
+	rdb := redis.NewClient(&redis.Options{Addr: redisURL})
+	defer rdb.Close()
+
+	ctx := context.Background()
+	if err := rdb.Ping(ctx).Err(); err != nil {
+		log.Fatalf("Redis error: %v", err)
+	}
+
+	result, err := services.RehashAPIKeys(ctx, rdb)
+	if err != nil {
+		log.Fatalf("Rehash failed: %v", err)
+	}
+
+	log.Printf("Success! Rehashed %d database row(s) and %d Redis entr(ies).", result.DBRows, result.RedisEntries)
+}
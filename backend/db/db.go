@@ -4,7 +4,7 @@ import (
 	"context"
 	"database/sql"
 	"fmt"
-	"log"
+	"log/slog"
 	"os"
 	"time"
 
@@ -68,7 +68,7 @@ func InitDB() error {
 	DB.SetConnMaxLifetime(5 * time.Minute)
 	DB.SetConnMaxIdleTime(2 * time.Minute)
 
-	log.Println("✓ Connected to PostgreSQL")
+	slog.Info("connected to postgres")
 	return nil
 }
 
@@ -76,7 +76,7 @@ func InitDB() error {
 func CloseDB() {
 	if DB != nil {
 		DB.Close()
-		log.Println("✓ Database connection closed")
+		slog.Info("database connection closed")
 	}
 }
 
@@ -0,0 +1,3 @@
+-- Migration: 008_add_semantic_cache (Down)
+DROP TRIGGER IF EXISTS update_semantic_cache_settings_updated_at ON semantic_cache_settings;
+DROP TABLE IF EXISTS semantic_cache_settings;
@@ -0,0 +1,24 @@
+-- Migration: 008_add_semantic_cache
+-- Description: Per-tenant settings for the semantic (embedding-based) response cache
+-- Created: 2026-10-18
+
+CREATE TABLE semantic_cache_settings (
+    tenant_id UUID PRIMARY KEY REFERENCES tenants(id) ON DELETE CASCADE,
+
+    -- Behaviour
+    enabled BOOLEAN DEFAULT FALSE,
+    similarity_threshold REAL DEFAULT 0.95 CHECK (similarity_threshold > 0 AND similarity_threshold <= 1),
+    ttl_seconds INTEGER DEFAULT 3600,
+    enabled_models TEXT[] DEFAULT '{}', -- Empty = cache disabled for every model
+
+    -- Timestamps
+    created_at TIMESTAMP WITH TIME ZONE DEFAULT NOW(),
+    updated_at TIMESTAMP WITH TIME ZONE DEFAULT NOW()
+);
+
+-- Trigger for updated_at
+CREATE TRIGGER update_semantic_cache_settings_updated_at
+    BEFORE UPDATE ON semantic_cache_settings
+    FOR EACH ROW EXECUTE FUNCTION update_updated_at_column();
+
+COMMENT ON TABLE semantic_cache_settings IS 'Semantic cache configuration; vectors themselves live in Redis';
@@ -0,0 +1,3 @@
+-- Migration: 009_add_model_routing (Down)
+DROP TABLE IF EXISTS routing_rules;
+DROP TABLE IF EXISTS model_aliases;
@@ -0,0 +1,52 @@
+-- Migration: 009_add_model_routing
+-- Description: Per-tenant model aliases and rule-based routing
+-- Created: 2026-10-18
+
+-- Aliases (e.g. "zaps-fast" -> openai/gpt-4o-mini)
+CREATE TABLE model_aliases (
+    id UUID PRIMARY KEY DEFAULT uuid_generate_v4(),
+    tenant_id UUID NOT NULL REFERENCES tenants(id) ON DELETE CASCADE,
+
+    alias VARCHAR(100) NOT NULL,
+    provider VARCHAR(50) NOT NULL,
+    model VARCHAR(100) NOT NULL,
+
+    created_at TIMESTAMP WITH TIME ZONE DEFAULT NOW(),
+    updated_at TIMESTAMP WITH TIME ZONE DEFAULT NOW(),
+
+    UNIQUE(tenant_id, alias)
+);
+
+-- Routing rules, evaluated in priority order (lowest first); first match wins
+CREATE TABLE routing_rules (
+    id UUID PRIMARY KEY DEFAULT uuid_generate_v4(),
+    tenant_id UUID NOT NULL REFERENCES tenants(id) ON DELETE CASCADE,
+
+    name VARCHAR(255) NOT NULL,
+    priority INTEGER DEFAULT 100,
+    enabled BOOLEAN DEFAULT TRUE,
+
+    -- Conditions (NULL / empty = not checked)
+    match_model VARCHAR(100) DEFAULT '*', -- Requested model or alias, '*' for any
+    min_prompt_chars INTEGER,
+    max_prompt_chars INTEGER,
+    requires_pii BOOLEAN, -- TRUE: only when PII was detected, FALSE: only when none
+    api_key_ids TEXT[] DEFAULT '{}',
+
+    -- Target (model may itself be an alias)
+    target_provider VARCHAR(50),
+    target_model VARCHAR(100) NOT NULL,
+
+    created_at TIMESTAMP WITH TIME ZONE DEFAULT NOW(),
+    updated_at TIMESTAMP WITH TIME ZONE DEFAULT NOW()
+);
+
+CREATE TRIGGER update_model_aliases_updated_at
+    BEFORE UPDATE ON model_aliases
+    FOR EACH ROW EXECUTE FUNCTION update_updated_at_column();
+
+CREATE TRIGGER update_routing_rules_updated_at
+    BEFORE UPDATE ON routing_rules
+    FOR EACH ROW EXECUTE FUNCTION update_updated_at_column();
+
+CREATE INDEX idx_routing_rules_tenant ON routing_rules(tenant_id, priority) WHERE enabled = TRUE;
@@ -0,0 +1,3 @@
+-- Migration: 010_add_pii_routing (Down)
+DROP TABLE IF EXISTS pii_routing_policies;
+DROP TABLE IF EXISTS pii_custom_entities;
@@ -0,0 +1,45 @@
+-- Migration: 010_add_pii_routing
+-- Description: Tenant-defined PII entity types and PII-aware routing policies
+-- Created: 2026-10-18
+
+-- Custom entity detectors (e.g. PATIENT_ID), applied alongside the built-in patterns
+CREATE TABLE pii_custom_entities (
+    id UUID PRIMARY KEY DEFAULT uuid_generate_v4(),
+    tenant_id UUID NOT NULL REFERENCES tenants(id) ON DELETE CASCADE,
+
+    entity_type VARCHAR(50) NOT NULL CHECK (entity_type ~ '^[A-Z_]+$'),
+    pattern TEXT NOT NULL, -- Go RE2 syntax
+
+    created_at TIMESTAMP WITH TIME ZONE DEFAULT NOW(),
+
+    UNIQUE(tenant_id, entity_type)
+);
+
+-- Policies: prompts containing any of entity_types are routed to an approved target or rejected
+CREATE TABLE pii_routing_policies (
+    id UUID PRIMARY KEY DEFAULT uuid_generate_v4(),
+    tenant_id UUID NOT NULL REFERENCES tenants(id) ON DELETE CASCADE,
+
+    name VARCHAR(255) NOT NULL,
+    priority INTEGER DEFAULT 100,
+    enabled BOOLEAN DEFAULT TRUE,
+
+    entity_types TEXT[] NOT NULL, -- e.g. {SSN, PRIVATE_KEY, PATIENT_ID}
+    action VARCHAR(20) NOT NULL CHECK (action IN ('route', 'reject')),
+
+    -- Route target
+    target_provider VARCHAR(50),
+    target_model VARCHAR(100),
+    send_unredacted BOOLEAN DEFAULT FALSE, -- Approved targets may receive the original values
+
+    created_at TIMESTAMP WITH TIME ZONE DEFAULT NOW(),
+    updated_at TIMESTAMP WITH TIME ZONE DEFAULT NOW(),
+
+    CHECK (action = 'reject' OR (target_provider IS NOT NULL AND target_model IS NOT NULL))
+);
+
+CREATE TRIGGER update_pii_routing_policies_updated_at
+    BEFORE UPDATE ON pii_routing_policies
+    FOR EACH ROW EXECUTE FUNCTION update_updated_at_column();
+
+CREATE INDEX idx_pii_routing_policies_tenant ON pii_routing_policies(tenant_id, priority) WHERE enabled = TRUE;
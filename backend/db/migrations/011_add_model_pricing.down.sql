@@ -0,0 +1,7 @@
+-- Migration: 011_add_model_pricing (Down)
+ALTER TABLE usage_logs DROP COLUMN IF EXISTS cost_usd;
+ALTER TABLE usage_logs DROP COLUMN IF EXISTS cached_tokens;
+ALTER TABLE usage_logs DROP COLUMN IF EXISTS completion_tokens;
+ALTER TABLE usage_logs DROP COLUMN IF EXISTS prompt_tokens;
+
+DROP TABLE IF EXISTS model_pricing;
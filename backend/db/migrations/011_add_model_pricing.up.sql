@@ -0,0 +1,49 @@
+-- Migration: 011_add_model_pricing
+-- Description: Per-model token pricing and cost columns on usage_logs
+-- Created: 2026-10-18
+
+-- Prices are USD per 1M tokens. model = '*' is the provider-wide fallback.
+CREATE TABLE model_pricing (
+    provider VARCHAR(50) NOT NULL,
+    model VARCHAR(100) NOT NULL,
+
+    input_per_mtok NUMERIC(12, 6) NOT NULL DEFAULT 0,
+    output_per_mtok NUMERIC(12, 6) NOT NULL DEFAULT 0,
+    cached_input_per_mtok NUMERIC(12, 6) NOT NULL DEFAULT 0,
+
+    updated_at TIMESTAMP WITH TIME ZONE DEFAULT NOW(),
+
+    PRIMARY KEY (provider, model)
+);
+
+CREATE TRIGGER update_model_pricing_updated_at
+    BEFORE UPDATE ON model_pricing
+    FOR EACH ROW EXECUTE FUNCTION update_updated_at_column();
+
+INSERT INTO model_pricing (provider, model, input_per_mtok, output_per_mtok, cached_input_per_mtok) VALUES
+    ('openai', 'gpt-4o', 2.50, 10.00, 1.25),
+    ('openai', 'gpt-4o-mini', 0.15, 0.60, 0.075),
+    ('openai', 'gpt-4-turbo', 10.00, 30.00, 10.00),
+    ('openai', 'gpt-3.5-turbo', 0.50, 1.50, 0.50),
+    ('anthropic', 'claude-3-opus', 15.00, 75.00, 1.50),
+    ('anthropic', 'claude-3-sonnet', 3.00, 15.00, 0.30),
+    ('anthropic', 'claude-3-5-sonnet', 3.00, 15.00, 0.30),
+    ('anthropic', 'claude-3-haiku-20240307', 0.25, 1.25, 0.03),
+    ('deepseek', 'deepseek-chat', 0.27, 1.10, 0.07),
+    ('deepseek', 'deepseek-coder', 0.27, 1.10, 0.07),
+    ('deepseek', 'deepseek-reasoner', 0.55, 2.19, 0.14),
+    ('gemini', 'gemini-2.0-flash', 0.10, 0.40, 0.025),
+    ('gemini', 'gemini-pro', 0.10, 0.40, 0.025),
+    ('gemini', 'gemini-1.5-flash', 0.075, 0.30, 0.01875),
+    ('gemini', 'gemini-1.5-pro', 1.25, 5.00, 0.3125),
+    ('gemini', 'gemini-2.5-flash', 0.30, 2.50, 0.075),
+    ('gemini', 'gemini-2.5-pro', 1.25, 10.00, 0.31),
+    ('ollama', '*', 0, 0, 0);
+
+-- Token breakdown and cost per hourly bucket
+ALTER TABLE usage_logs ADD COLUMN prompt_tokens BIGINT DEFAULT 0;
+ALTER TABLE usage_logs ADD COLUMN completion_tokens BIGINT DEFAULT 0;
+ALTER TABLE usage_logs ADD COLUMN cached_tokens BIGINT DEFAULT 0;
+ALTER TABLE usage_logs ADD COLUMN cost_usd NUMERIC(14, 6) DEFAULT 0;
+
+COMMENT ON TABLE model_pricing IS 'Upstream token prices (USD per 1M tokens) used for cost accounting';
@@ -0,0 +1,2 @@
+-- Migration: 012_add_budgets (Down)
+DROP TABLE IF EXISTS budgets;
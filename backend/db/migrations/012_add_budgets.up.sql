@@ -0,0 +1,36 @@
+-- Migration: 012_add_budgets
+-- Description: Token / cost budgets at tenant, API key and user level
+-- Created: 2026-10-18
+
+CREATE TABLE budgets (
+    id UUID PRIMARY KEY DEFAULT uuid_generate_v4(),
+    tenant_id UUID NOT NULL REFERENCES tenants(id) ON DELETE CASCADE,
+
+    -- What the budget applies to
+    scope VARCHAR(20) NOT NULL CHECK (scope IN ('tenant', 'api_key', 'user')),
+    scope_id UUID NOT NULL, -- tenants.id, api_keys.id or users.id
+    name VARCHAR(255),
+
+    -- Limit
+    metric VARCHAR(20) NOT NULL CHECK (metric IN ('tokens', 'cost_usd')),
+    hard_limit NUMERIC(18, 6) NOT NULL CHECK (hard_limit > 0),
+    soft_limit NUMERIC(18, 6), -- Warn (header + audit event) once crossed
+
+    -- Window
+    window_type VARCHAR(20) NOT NULL DEFAULT 'calendar' CHECK (window_type IN ('calendar', 'rolling')),
+    period VARCHAR(20) NOT NULL DEFAULT 'month' CHECK (period IN ('day', 'week', 'month')),
+
+    enabled BOOLEAN DEFAULT TRUE,
+    created_at TIMESTAMP WITH TIME ZONE DEFAULT NOW(),
+    updated_at TIMESTAMP WITH TIME ZONE DEFAULT NOW(),
+
+    CHECK (soft_limit IS NULL OR soft_limit <= hard_limit)
+);
+
+CREATE TRIGGER update_budgets_updated_at
+    BEFORE UPDATE ON budgets
+    FOR EACH ROW EXECUTE FUNCTION update_updated_at_column();
+
+CREATE INDEX idx_budgets_scope ON budgets(tenant_id, scope, scope_id) WHERE enabled = TRUE;
+
+COMMENT ON TABLE budgets IS 'Token/cost budgets; running totals are kept in Redis';
@@ -0,0 +1,2 @@
+-- Migration: 013_add_job_runs (Down)
+DROP TABLE IF EXISTS job_runs;
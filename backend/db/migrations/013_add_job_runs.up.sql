@@ -0,0 +1,20 @@
+-- Migration: 013_add_job_runs
+-- Description: History of background job executions
+-- Created: 2026-10-18
+
+CREATE TABLE job_runs (
+    id BIGSERIAL PRIMARY KEY,
+    job_name VARCHAR(100) NOT NULL,
+    instance_id VARCHAR(255) NOT NULL, -- Replica that held the lock
+
+    status VARCHAR(20) NOT NULL CHECK (status IN ('running', 'succeeded', 'failed')),
+    result JSONB DEFAULT '{}'::jsonb,
+    error TEXT,
+
+    started_at TIMESTAMP WITH TIME ZONE DEFAULT NOW(),
+    finished_at TIMESTAMP WITH TIME ZONE
+);
+
+CREATE INDEX idx_job_runs_name_time ON job_runs(job_name, started_at DESC);
+
+COMMENT ON TABLE job_runs IS 'Background job runs (scheduler in backend/services/scheduler.go)';
@@ -0,0 +1,5 @@
+-- Migration: 014_add_rate_limits (Down)
+ALTER TABLE tenants DROP COLUMN IF EXISTS rate_limit_tpm;
+ALTER TABLE tenants DROP COLUMN IF EXISTS rate_limit_rpm;
+ALTER TABLE api_keys DROP COLUMN IF EXISTS rate_limit_tpm;
+ALTER TABLE api_keys DROP COLUMN IF EXISTS rate_limit_rpm;
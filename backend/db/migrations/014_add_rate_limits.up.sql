@@ -0,0 +1,11 @@
+-- Migration: 014_add_rate_limits
+-- Description: Per-key and per-tenant request/token rate limits
+-- Created: 2026-10-18
+
+-- Per-key limits (NULL = unlimited). RPM defaults to the historical 60 requests/minute.
+ALTER TABLE api_keys ADD COLUMN rate_limit_rpm INTEGER DEFAULT 60 CHECK (rate_limit_rpm IS NULL OR rate_limit_rpm > 0);
+ALTER TABLE api_keys ADD COLUMN rate_limit_tpm INTEGER CHECK (rate_limit_tpm IS NULL OR rate_limit_tpm > 0);
+
+-- Tenant-wide limits across all keys (NULL = unlimited)
+ALTER TABLE tenants ADD COLUMN rate_limit_rpm INTEGER CHECK (rate_limit_rpm IS NULL OR rate_limit_rpm > 0);
+ALTER TABLE tenants ADD COLUMN rate_limit_tpm INTEGER CHECK (rate_limit_tpm IS NULL OR rate_limit_tpm > 0);
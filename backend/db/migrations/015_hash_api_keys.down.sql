@@ -0,0 +1,4 @@
+-- Migration: 015_hash_api_keys (Down)
+-- Hashed keys cannot be reverted to raw form; only the marker column is removed.
+DROP INDEX IF EXISTS idx_api_keys_unhashed;
+ALTER TABLE api_keys DROP COLUMN IF EXISTS key_hashed;
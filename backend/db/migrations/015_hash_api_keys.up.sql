@@ -0,0 +1,12 @@
+-- Migration: 015_hash_api_keys
+-- Description: Track whether api_keys.key_hash holds a hash or a legacy raw key
+-- Created: 2026-10-18
+
+-- Existing rows still contain raw gk_ keys. They are rehashed lazily on first use
+-- and in bulk by `go run ./cmd/rehash_keys`.
+ALTER TABLE api_keys ADD COLUMN key_hashed BOOLEAN NOT NULL DEFAULT FALSE;
+
+-- New rows always store HashAPIKey(raw key)
+ALTER TABLE api_keys ALTER COLUMN key_hashed SET DEFAULT TRUE;
+
+CREATE INDEX idx_api_keys_unhashed ON api_keys(id) WHERE key_hashed = FALSE;
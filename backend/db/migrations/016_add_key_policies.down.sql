@@ -0,0 +1,6 @@
+-- Migration: 016_add_key_policies (Down)
+ALTER TABLE api_keys DROP COLUMN IF EXISTS max_tokens_per_request;
+ALTER TABLE api_keys DROP COLUMN IF EXISTS allowed_cidrs;
+ALTER TABLE api_keys DROP COLUMN IF EXISTS allowed_providers;
+ALTER TABLE api_keys DROP COLUMN IF EXISTS allowed_models;
+ALTER TABLE api_keys DROP COLUMN IF EXISTS scopes;
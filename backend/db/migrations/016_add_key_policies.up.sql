@@ -0,0 +1,10 @@
+-- Migration: 016_add_key_policies
+-- Description: API key scopes, model/provider allowlists, source CIDRs and per-request token caps
+-- Created: 2026-10-18
+
+-- NULL/empty means unrestricted, so existing keys keep full access
+ALTER TABLE api_keys ADD COLUMN scopes TEXT[];              -- chat, embeddings, models:read
+ALTER TABLE api_keys ADD COLUMN allowed_models TEXT[];
+ALTER TABLE api_keys ADD COLUMN allowed_providers TEXT[];
+ALTER TABLE api_keys ADD COLUMN allowed_cidrs TEXT[];       -- Normalised CIDRs, e.g. 10.0.0.0/8
+ALTER TABLE api_keys ADD COLUMN max_tokens_per_request INTEGER CHECK (max_tokens_per_request IS NULL OR max_tokens_per_request > 0);
@@ -0,0 +1,4 @@
+-- Migration: 017_add_key_expiry (Down)
+DROP INDEX IF EXISTS idx_api_keys_expires_at;
+ALTER TABLE api_keys DROP COLUMN IF EXISTS expiry_warned_at;
+ALTER TABLE api_keys DROP COLUMN IF EXISTS rotated_from;
@@ -0,0 +1,11 @@
+-- Migration: 017_add_key_expiry
+-- Description: API key rotation lineage and expiry warning tracking
+-- Created: 2026-10-18
+
+-- Key that this key replaced via rotation
+ALTER TABLE api_keys ADD COLUMN rotated_from UUID REFERENCES api_keys(id) ON DELETE SET NULL;
+
+-- Set when the owner has been warned about an upcoming expiry
+ALTER TABLE api_keys ADD COLUMN expiry_warned_at TIMESTAMP WITH TIME ZONE;
+
+CREATE INDEX idx_api_keys_expires_at ON api_keys(expires_at) WHERE expires_at IS NOT NULL AND enabled = TRUE;
@@ -0,0 +1,9 @@
+-- Migration: 018_add_usage_key_attribution (Down)
+DROP INDEX IF EXISTS idx_audit_logs_api_key;
+ALTER TABLE audit_logs DROP COLUMN IF EXISTS api_key_id;
+
+DROP INDEX IF EXISTS idx_usage_logs_unkeyed;
+
+UPDATE usage_logs SET api_key_id = NULL WHERE api_key_id NOT IN (SELECT id FROM api_keys);
+ALTER TABLE usage_logs ADD CONSTRAINT usage_logs_api_key_id_fkey
+    FOREIGN KEY (api_key_id) REFERENCES api_keys(id) ON DELETE SET NULL;
@@ -0,0 +1,48 @@
+-- Migration: 018_add_usage_key_attribution
+-- Description: Attribute usage_logs and audit_logs rows to the API key that made the request
+-- Created: 2026-10-18
+
+-- Unkeyed rows never conflicted on UNIQUE(tenant_id, api_key_id, hour_bucket) because
+-- NULLs are distinct, so each request inserted its own row. Merge them per hour first.
+WITH merged AS (
+    SELECT tenant_id, hour_bucket, MIN(id) AS keep_id,
+        SUM(request_count) AS request_count,
+        SUM(error_count) AS error_count,
+        SUM(COALESCE(avg_latency_ms, 0) * request_count) / NULLIF(SUM(request_count), 0) AS avg_latency_ms,
+        SUM(total_tokens_processed) AS total_tokens_processed,
+        SUM(prompt_tokens) AS prompt_tokens,
+        SUM(completion_tokens) AS completion_tokens,
+        SUM(cached_tokens) AS cached_tokens,
+        SUM(cost_usd) AS cost_usd
+    FROM usage_logs
+    WHERE api_key_id IS NULL
+    GROUP BY tenant_id, hour_bucket
+    HAVING COUNT(*) > 1
+)
+UPDATE usage_logs u
+SET request_count = m.request_count,
+    error_count = m.error_count,
+    avg_latency_ms = m.avg_latency_ms,
+    total_tokens_processed = m.total_tokens_processed,
+    prompt_tokens = m.prompt_tokens,
+    completion_tokens = m.completion_tokens,
+    cached_tokens = m.cached_tokens,
+    cost_usd = m.cost_usd
+FROM merged m
+WHERE u.id = m.keep_id;
+
+DELETE FROM usage_logs u
+USING usage_logs k
+WHERE u.api_key_id IS NULL AND k.api_key_id IS NULL
+    AND u.tenant_id = k.tenant_id AND u.hour_bucket = k.hour_bucket
+    AND u.id > k.id;
+
+CREATE UNIQUE INDEX idx_usage_logs_unkeyed ON usage_logs(tenant_id, hour_bucket) WHERE api_key_id IS NULL;
+
+-- Keep attribution after a key is revoked (ON DELETE SET NULL would also collide with the index above)
+ALTER TABLE usage_logs DROP CONSTRAINT IF EXISTS usage_logs_api_key_id_fkey;
+
+-- Key that made the request (NULL for dashboard sessions and system events)
+ALTER TABLE audit_logs ADD COLUMN api_key_id UUID;
+
+CREATE INDEX idx_audit_logs_api_key ON audit_logs(tenant_id, api_key_id, created_at DESC) WHERE api_key_id IS NOT NULL;
@@ -0,0 +1,2 @@
+-- Migration: 019_add_pii_event_counts (Down)
+DROP FUNCTION IF EXISTS jsonb_merge_counts(JSONB, JSONB);
@@ -0,0 +1,20 @@
+-- Migration: 019_add_pii_event_counts
+-- Description: Merge per-entity PII detection counts into usage_logs.pii_events
+-- Created: 2026-10-18
+
+-- Adds two {"EMAIL": 3, "SSN": 1} count objects key by key. Used in the usage_logs
+-- upsert so concurrent requests merge into the same hourly row without losing counts.
+CREATE OR REPLACE FUNCTION jsonb_merge_counts(a JSONB, b JSONB) RETURNS JSONB AS $$
+    SELECT COALESCE(jsonb_object_agg(key, total), '{}'::jsonb)
+    FROM (
+        SELECT key, SUM(value::bigint) AS total
+        FROM (
+            SELECT * FROM jsonb_each_text(COALESCE(a, '{}'::jsonb))
+            UNION ALL
+            SELECT * FROM jsonb_each_text(COALESCE(b, '{}'::jsonb))
+        ) counts
+        GROUP BY key
+    ) merged
+$$ LANGUAGE SQL IMMUTABLE;
+
+UPDATE usage_logs SET pii_events = '{}'::jsonb WHERE pii_events IS NULL;
@@ -0,0 +1,4 @@
+-- Migration: 020_add_usage_metrics (Down)
+DROP AGGREGATE IF EXISTS histogram_sum(BIGINT[]);
+DROP FUNCTION IF EXISTS histogram_add(BIGINT[], BIGINT[]);
+DROP TABLE IF EXISTS usage_metrics;
@@ -0,0 +1,45 @@
+-- Migration: 020_add_usage_metrics
+-- Description: Hourly usage rollups per key, provider, model and status with latency histograms
+-- Created: 2026-10-18
+
+CREATE TABLE usage_metrics (
+    id BIGSERIAL PRIMARY KEY,
+    tenant_id UUID NOT NULL REFERENCES tenants(id) ON DELETE CASCADE,
+    api_key_id UUID, -- No FK: attribution survives key revocation
+    provider VARCHAR(50) NOT NULL DEFAULT '',
+    model VARCHAR(255) NOT NULL DEFAULT '',
+    status_code INTEGER NOT NULL DEFAULT 0,
+    hour_bucket TIMESTAMP WITH TIME ZONE NOT NULL,
+
+    request_count BIGINT NOT NULL DEFAULT 0,
+    error_count BIGINT NOT NULL DEFAULT 0,
+    total_latency_ms BIGINT NOT NULL DEFAULT 0,
+    -- Request counts per latency bucket; bounds are services.LatencyBucketsMs plus an overflow bucket
+    latency_histogram BIGINT[] NOT NULL DEFAULT '{}',
+
+    prompt_tokens BIGINT NOT NULL DEFAULT 0,
+    completion_tokens BIGINT NOT NULL DEFAULT 0,
+    cached_tokens BIGINT NOT NULL DEFAULT 0,
+    total_tokens BIGINT NOT NULL DEFAULT 0,
+    cost_usd NUMERIC(14, 6) NOT NULL DEFAULT 0
+);
+
+CREATE UNIQUE INDEX idx_usage_metrics_bucket ON usage_metrics(
+    tenant_id, (COALESCE(api_key_id, '00000000-0000-0000-0000-000000000000'::uuid)),
+    provider, model, status_code, hour_bucket
+);
+CREATE INDEX idx_usage_metrics_tenant_time ON usage_metrics(tenant_id, hour_bucket DESC);
+
+-- Element-wise sum of two histograms (the shorter one is padded with zeros)
+CREATE OR REPLACE FUNCTION histogram_add(a BIGINT[], b BIGINT[]) RETURNS BIGINT[] AS $$
+    SELECT COALESCE(array_agg(COALESCE(x, 0) + COALESCE(y, 0) ORDER BY i), '{}')
+    FROM unnest(COALESCE(a, '{}'), COALESCE(b, '{}')) WITH ORDINALITY AS t(x, y, i)
+$$ LANGUAGE SQL IMMUTABLE;
+
+CREATE AGGREGATE histogram_sum(BIGINT[]) (
+    SFUNC = histogram_add,
+    STYPE = BIGINT[],
+    INITCOND = '{}'
+);
+
+COMMENT ON TABLE usage_metrics IS 'Hourly request rollups with latency histograms for analytics';
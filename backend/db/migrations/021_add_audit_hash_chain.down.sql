@@ -0,0 +1,11 @@
+-- Migration: 021_add_audit_hash_chain (Down)
+DROP TABLE IF EXISTS audit_checkpoints;
+DROP TABLE IF EXISTS audit_chain_heads;
+DROP INDEX IF EXISTS idx_audit_logs_chain;
+ALTER TABLE audit_logs
+    DROP COLUMN IF EXISTS row_hash,
+    DROP COLUMN IF EXISTS prev_hash,
+    DROP COLUMN IF EXISTS seq;
+UPDATE audit_logs SET user_id = NULL WHERE user_id IS NOT NULL AND user_id NOT IN (SELECT id FROM users);
+ALTER TABLE audit_logs
+    ADD CONSTRAINT audit_logs_user_id_fkey FOREIGN KEY (user_id) REFERENCES users(id) ON DELETE SET NULL;
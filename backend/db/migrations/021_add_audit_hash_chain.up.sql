@@ -0,0 +1,35 @@
+-- Migration: 021_add_audit_hash_chain
+-- Description: Per-tenant hash chain over audit_logs with signed checkpoints
+-- Created: 2026-10-18
+
+-- Chain position and hashes (rows written before this migration stay unchained)
+ALTER TABLE audit_logs
+    ADD COLUMN seq BIGINT,
+    ADD COLUMN prev_hash BYTEA,
+    ADD COLUMN row_hash BYTEA;
+
+CREATE UNIQUE INDEX idx_audit_logs_chain ON audit_logs(tenant_id, seq) WHERE seq IS NOT NULL;
+
+-- Hashed rows must never change: keep user_id when the user is deleted
+ALTER TABLE audit_logs DROP CONSTRAINT IF EXISTS audit_logs_user_id_fkey;
+
+-- Latest link per tenant; appends lock this row to serialize the chain
+CREATE TABLE audit_chain_heads (
+    tenant_id UUID PRIMARY KEY REFERENCES tenants(id) ON DELETE CASCADE,
+    seq BIGINT NOT NULL DEFAULT 0,
+    head_hash BYTEA NOT NULL DEFAULT '\x0000000000000000000000000000000000000000000000000000000000000000'::bytea,
+    updated_at TIMESTAMP WITH TIME ZONE DEFAULT NOW()
+);
+
+-- Ed25519-signed snapshots of a tenant's chain head
+CREATE TABLE audit_checkpoints (
+    id BIGSERIAL PRIMARY KEY,
+    tenant_id UUID NOT NULL REFERENCES tenants(id) ON DELETE CASCADE,
+    seq BIGINT NOT NULL,
+    head_hash BYTEA NOT NULL,
+    key_id VARCHAR(32) NOT NULL, -- services.AuditSigningKeyID of the signing key
+    signature BYTEA NOT NULL,
+    created_at TIMESTAMP WITH TIME ZONE DEFAULT NOW()
+);
+
+CREATE INDEX idx_audit_checkpoints_tenant ON audit_checkpoints(tenant_id, seq DESC);
@@ -0,0 +1,3 @@
+-- Migration: 022_add_audit_sinks (Down)
+DROP TABLE IF EXISTS audit_sink_dead_letters;
+DROP TABLE IF EXISTS audit_sinks;
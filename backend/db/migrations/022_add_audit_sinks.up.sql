@@ -0,0 +1,41 @@
+-- Migration: 022_add_audit_sinks
+-- Description: Per-tenant audit log forwarding (webhook, syslog, Splunk HEC) with dead letters
+-- Created: 2026-10-18
+
+CREATE TABLE audit_sinks (
+    id UUID PRIMARY KEY DEFAULT uuid_generate_v4(),
+    tenant_id UUID NOT NULL REFERENCES tenants(id) ON DELETE CASCADE,
+    name VARCHAR(100) NOT NULL,
+    type VARCHAR(20) NOT NULL CHECK (type IN ('webhook', 'syslog', 'splunk_hec')),
+    format VARCHAR(10) NOT NULL DEFAULT 'json' CHECK (format IN ('json', 'cef')),
+    endpoint TEXT NOT NULL,
+    secret_encrypted TEXT, -- Webhook HMAC secret or HEC token (services.EncryptSecret)
+    config JSONB NOT NULL DEFAULT '{}',
+    enabled BOOLEAN NOT NULL DEFAULT TRUE,
+    -- Delivery state: audit_logs.seq forwarded so far and the retry schedule
+    cursor_seq BIGINT NOT NULL DEFAULT 0,
+    attempts INTEGER NOT NULL DEFAULT 0,
+    next_attempt_at TIMESTAMP WITH TIME ZONE NOT NULL DEFAULT NOW(),
+    last_delivered_at TIMESTAMP WITH TIME ZONE,
+    last_error TEXT,
+    created_at TIMESTAMP WITH TIME ZONE DEFAULT NOW(),
+    updated_at TIMESTAMP WITH TIME ZONE DEFAULT NOW()
+);
+
+CREATE INDEX idx_audit_sinks_tenant ON audit_sinks(tenant_id);
+CREATE INDEX idx_audit_sinks_due ON audit_sinks(next_attempt_at) WHERE enabled = TRUE;
+
+-- Batches that still failed after every retry; the events are kept so they can be resent
+CREATE TABLE audit_sink_dead_letters (
+    id BIGSERIAL PRIMARY KEY,
+    sink_id UUID NOT NULL REFERENCES audit_sinks(id) ON DELETE CASCADE,
+    tenant_id UUID NOT NULL REFERENCES tenants(id) ON DELETE CASCADE,
+    first_seq BIGINT NOT NULL,
+    last_seq BIGINT NOT NULL,
+    events JSONB NOT NULL,
+    attempts INTEGER NOT NULL,
+    error TEXT,
+    created_at TIMESTAMP WITH TIME ZONE DEFAULT NOW()
+);
+
+CREATE INDEX idx_audit_sink_dead_letters_sink ON audit_sink_dead_letters(sink_id, id);
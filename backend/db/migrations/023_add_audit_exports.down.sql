@@ -0,0 +1,2 @@
+-- Migration: 023_add_audit_exports (Down)
+DROP TABLE IF EXISTS audit_exports;
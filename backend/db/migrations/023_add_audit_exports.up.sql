@@ -0,0 +1,25 @@
+-- Migration: 023_add_audit_exports
+-- Description: Asynchronous audit log export jobs
+-- Created: 2026-10-18
+
+CREATE TABLE audit_exports (
+    id UUID PRIMARY KEY DEFAULT uuid_generate_v4(),
+    tenant_id UUID NOT NULL REFERENCES tenants(id) ON DELETE CASCADE,
+    requested_by UUID REFERENCES users(id) ON DELETE SET NULL,
+    format VARCHAR(10) NOT NULL CHECK (format IN ('csv', 'jsonl', 'parquet')),
+    filters JSONB NOT NULL DEFAULT '{}', -- services.AuditLogFilter
+    status VARCHAR(20) NOT NULL DEFAULT 'pending' CHECK (status IN ('pending', 'running', 'completed', 'failed')),
+    row_count BIGINT,
+    size_bytes BIGINT,
+    sha256 VARCHAR(64),
+    file_path TEXT,
+    error TEXT,
+    created_at TIMESTAMP WITH TIME ZONE DEFAULT NOW(),
+    started_at TIMESTAMP WITH TIME ZONE,
+    heartbeat_at TIMESTAMP WITH TIME ZONE, -- Lets another worker take over a job whose replica died
+    completed_at TIMESTAMP WITH TIME ZONE,
+    expires_at TIMESTAMP WITH TIME ZONE
+);
+
+CREATE INDEX idx_audit_exports_tenant ON audit_exports(tenant_id, created_at DESC);
+CREATE INDEX idx_audit_exports_queue ON audit_exports(created_at) WHERE status IN ('pending', 'running');
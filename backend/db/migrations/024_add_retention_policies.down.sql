@@ -0,0 +1,7 @@
+-- Migration: 024_add_retention_policies (Down)
+ALTER TABLE audit_chain_heads
+    DROP COLUMN IF EXISTS purged_signature,
+    DROP COLUMN IF EXISTS purged_key_id,
+    DROP COLUMN IF EXISTS purged_hash,
+    DROP COLUMN IF EXISTS purged_seq;
+DROP TABLE IF EXISTS retention_policies;
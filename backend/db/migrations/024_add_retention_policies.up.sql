@@ -0,0 +1,23 @@
+-- Migration: 024_add_retention_policies
+-- Description: Per-tenant retention for audit, usage and prompt data, and audit chain purge markers
+-- Created: 2026-10-18
+
+-- NULL days keep data forever
+CREATE TABLE retention_policies (
+    tenant_id UUID PRIMARY KEY REFERENCES tenants(id) ON DELETE CASCADE,
+    audit_days INTEGER CHECK (audit_days > 0),
+    usage_days INTEGER CHECK (usage_days > 0),
+    prompt_days INTEGER CHECK (prompt_days > 0),
+    archive BOOLEAN NOT NULL DEFAULT TRUE, -- Copy rows to the archive store before deleting them
+    last_purge_at TIMESTAMP WITH TIME ZONE,
+    updated_at TIMESTAMP WITH TIME ZONE DEFAULT NOW()
+);
+
+-- The chain now starts after the last purged row: verification begins at purged_seq + 1
+-- with purged_hash as the previous hash. The marker is signed like a checkpoint when
+-- AUDIT_SIGNING_KEY is set.
+ALTER TABLE audit_chain_heads
+    ADD COLUMN purged_seq BIGINT NOT NULL DEFAULT 0,
+    ADD COLUMN purged_hash BYTEA,
+    ADD COLUMN purged_key_id VARCHAR(32),
+    ADD COLUMN purged_signature BYTEA;
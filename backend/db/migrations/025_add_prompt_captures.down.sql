@@ -0,0 +1,4 @@
+-- Migration: 025_add_prompt_captures (Down)
+DROP TABLE IF EXISTS prompt_captures;
+DROP TABLE IF EXISTS tenant_data_keys;
+ALTER TABLE api_keys DROP COLUMN IF EXISTS capture_bodies;
@@ -0,0 +1,33 @@
+-- Migration: 025_add_prompt_captures
+-- Description: Opt-in per-key capture of redacted request/response bodies, encrypted with a tenant data key
+-- Created: 2026-10-18
+
+ALTER TABLE api_keys ADD COLUMN capture_bodies BOOLEAN NOT NULL DEFAULT FALSE;
+
+-- One AES-256 data key per tenant, wrapped with ENCRYPTION_KEY
+CREATE TABLE tenant_data_keys (
+    tenant_id UUID PRIMARY KEY REFERENCES tenants(id) ON DELETE CASCADE,
+    key_encrypted TEXT NOT NULL,
+    created_at TIMESTAMP WITH TIME ZONE DEFAULT NOW()
+);
+
+CREATE TABLE prompt_captures (
+    id UUID PRIMARY KEY,
+    tenant_id UUID NOT NULL REFERENCES tenants(id) ON DELETE CASCADE,
+    api_key_id UUID, -- No FK: captures survive key revocation
+    request_id VARCHAR(128),
+    replay_of UUID REFERENCES prompt_captures(id) ON DELETE SET NULL,
+    provider VARCHAR(50) NOT NULL,
+    model VARCHAR(255) NOT NULL,
+    requested_model VARCHAR(255) NOT NULL DEFAULT '',
+    status_code INTEGER NOT NULL,
+    latency_ms INTEGER NOT NULL,
+    pii_types JSONB NOT NULL DEFAULT '{}'::jsonb, -- Redacted entity counts, e.g. {"email": 2}
+    -- AES-256-GCM (nonce || ciphertext) under the tenant data key
+    request_encrypted BYTEA NOT NULL,
+    response_encrypted BYTEA NOT NULL,
+    created_at TIMESTAMP WITH TIME ZONE DEFAULT NOW()
+);
+
+CREATE INDEX idx_prompt_captures_tenant ON prompt_captures(tenant_id, created_at DESC);
+CREATE INDEX idx_prompt_captures_request ON prompt_captures(tenant_id, request_id);
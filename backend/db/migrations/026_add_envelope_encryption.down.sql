@@ -0,0 +1,7 @@
+-- Migration: 026_add_envelope_encryption (Down)
+-- Data encrypted under data key versions above 1 becomes unreadable
+ALTER TABLE prompt_captures DROP COLUMN IF EXISTS data_key_version;
+DELETE FROM tenant_data_keys WHERE version > 1;
+ALTER TABLE tenant_data_keys DROP CONSTRAINT tenant_data_keys_pkey;
+ALTER TABLE tenant_data_keys DROP COLUMN IF EXISTS version, DROP COLUMN IF EXISTS kms_key_id;
+ALTER TABLE tenant_data_keys ADD PRIMARY KEY (tenant_id);
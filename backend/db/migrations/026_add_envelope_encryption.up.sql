@@ -0,0 +1,16 @@
+-- Migration: 026_add_envelope_encryption
+-- Description: Versioned tenant data keys wrapped by a KMS master key
+-- Created: 2026-10-18
+
+-- A tenant may hold several data key versions; the highest encrypts new data and older
+-- ones stay readable until the reencrypt command has moved everything off them
+ALTER TABLE tenant_data_keys DROP CONSTRAINT tenant_data_keys_pkey;
+ALTER TABLE tenant_data_keys
+    ADD COLUMN version INTEGER NOT NULL DEFAULT 1,
+    ADD COLUMN kms_key_id VARCHAR(64) NOT NULL DEFAULT 'env'; -- Master key that wrapped key_encrypted
+ALTER TABLE tenant_data_keys ADD PRIMARY KEY (tenant_id, version);
+
+ALTER TABLE prompt_captures ADD COLUMN data_key_version INTEGER NOT NULL DEFAULT 1;
+
+-- provider_keys.encrypted_key and audit_sinks.secret_encrypted now hold "dk<version>:<hex>"
+-- under the tenant data key; values without the prefix are still read with ENCRYPTION_KEY
@@ -0,0 +1,7 @@
+-- Migration: 027_add_provider_key_validation (Down)
+DROP INDEX IF EXISTS idx_provider_keys_last_checked;
+ALTER TABLE provider_keys
+    DROP COLUMN IF EXISTS validation_status,
+    DROP COLUMN IF EXISTS validation_error,
+    DROP COLUMN IF EXISTS last_checked_at,
+    DROP COLUMN IF EXISTS models;
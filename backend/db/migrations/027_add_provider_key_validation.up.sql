@@ -0,0 +1,11 @@
+-- Migration: 027_add_provider_key_validation
+-- Description: Provider key validation status and discovered models
+-- Created: 2026-10-18
+
+ALTER TABLE provider_keys
+    ADD COLUMN validation_status VARCHAR(20) NOT NULL DEFAULT 'unchecked', -- unchecked, valid, invalid, error
+    ADD COLUMN validation_error TEXT,
+    ADD COLUMN last_checked_at TIMESTAMP WITH TIME ZONE,
+    ADD COLUMN models JSONB NOT NULL DEFAULT '[]'; -- Model IDs listed by the provider at the last successful check
+
+CREATE INDEX idx_provider_keys_last_checked ON provider_keys(last_checked_at NULLS FIRST) WHERE enabled = true;
@@ -18,6 +18,8 @@ type Tenant struct {
 	CurrentUsage     int       `json:"current_usage" db:"current_usage"`
 	QuotaResetAt     time.Time `json:"quota_reset_at" db:"quota_reset_at"`
 	OverageAllowed   bool      `json:"overage_allowed" db:"overage_allowed"`
+	RateLimitRPM     *int      `json:"rate_limit_rpm,omitempty" db:"rate_limit_rpm"`
+	RateLimitTPM     *int      `json:"rate_limit_tpm,omitempty" db:"rate_limit_tpm"`
 	Metadata         JSONBMap  `json:"metadata,omitempty" db:"metadata"`
 }
 
@@ -57,6 +59,8 @@ type APIKey struct {
 	ExpiresAt    *time.Time `json:"expires_at,omitempty" db:"expires_at"`
 	CreatedBy    *uuid.UUID `json:"created_by,omitempty" db:"created_by"`
 	Notes        *string    `json:"notes,omitempty" db:"notes"`
+	RateLimitRPM *int       `json:"rate_limit_rpm,omitempty" db:"rate_limit_rpm"`
+	RateLimitTPM *int       `json:"rate_limit_tpm,omitempty" db:"rate_limit_tpm"`
 }
 
 // UsageLog represents aggregated hourly usage statistics
@@ -93,10 +97,12 @@ type AuditLog struct {
 	ID        int64      `json:"id" db:"id"`
 	TenantID  *uuid.UUID `json:"tenant_id,omitempty" db:"tenant_id"`
 	UserID    *uuid.UUID `json:"user_id,omitempty" db:"user_id"`
+	APIKeyID  *uuid.UUID `json:"api_key_id,omitempty" db:"api_key_id"`
 	EventType string     `json:"event_type" db:"event_type"`
 	EventData JSONBMap   `json:"event_data,omitempty" db:"event_data"`
 	IPAddress *string    `json:"ip_address,omitempty" db:"ip_address"`
 	UserAgent *string    `json:"user_agent,omitempty" db:"user_agent"`
+	Seq       *int64     `json:"seq,omitempty" db:"seq"` // Position in the tenant's hash chain
 	CreatedAt time.Time  `json:"created_at" db:"created_at"`
 }
 
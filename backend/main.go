@@ -2,15 +2,16 @@ package main
 
 import (
 	"context"
-	"log"
+	"log/slog"
 	"os"
+	"os/signal"
+	"syscall"
 	"time"
 
 	"github.com/gofiber/fiber/v2"
 	"github.com/gofiber/fiber/v2/middleware/cors"
 	"github.com/gofiber/fiber/v2/middleware/helmet"
 	"github.com/gofiber/fiber/v2/middleware/limiter"
-	"github.com/gofiber/fiber/v2/middleware/logger"
 	"github.com/redis/go-redis/v9"
 
 	"zaps/api"
@@ -33,6 +34,16 @@ func init() {
 // Regex patterns for secret detection
 
 func main() {
+	services.InitLogging()
+
+	// Initialize tracing (exports only when an OTLP endpoint is configured)
+	shutdownTracing, err := services.InitTracing(ctx)
+	if err != nil {
+		slog.Warn("tracing disabled", "error", err)
+	} else {
+		defer shutdownTracing(context.Background())
+	}
+
 	// Connect to Redis
 	redisURL := os.Getenv("REDIS_URL")
 	if redisURL == "" {
@@ -46,19 +57,25 @@ func main() {
 	rdb = redis.NewClient(&redis.Options{
 		Addr: redisURL,
 	})
+	rdb.AddHook(services.RedisMetricsHook{})
 
 	// Test Redis connection
 	if err := rdb.Ping(ctx).Err(); err != nil {
-		log.Printf("⚠️  Redis not available: %v. Running without caching.", err)
+		slog.Warn("redis not available, running without caching", "error", err)
 	} else {
-		log.Println("✓ Connected to Redis")
+		slog.Info("connected to redis")
 	}
 
 	// Initialize PostgreSQL
 	if err := db.InitDB(); err != nil {
-		log.Fatalf("Failed to initialize database: %v", err)
+		slog.Error("failed to initialize database", "error", err)
+		os.Exit(1)
 	}
 	defer db.CloseDB()
+	services.RegisterDBMetrics()
+
+	// Batched audit/usage writer; flushed on shutdown below, before the DB closes
+	services.StartEventWriter()
 
 	// Initialize Email Service (Mailgun)
 	// Initialize Email Service (Mailgun)
@@ -67,29 +84,52 @@ func main() {
 	services.InitOAuth()
 	services.InitGitHubOAuth()
 	services.InitStripe()
+	services.InitEmbeddings()
 
 	// Initialize Admin Dashboard (legacy system)
 	InitAdmin(rdb)
 
+	// Evict revoked/changed API keys from this replica's in-memory cache
+	keyCtx, stopKeyListener := context.WithCancel(ctx)
+	defer stopKeyListener()
+	go services.ListenForKeyInvalidations(keyCtx, rdb)
+
+	// Forward audit events to tenant sinks (per-sink Redis locks, so safe on every replica)
+	services.StartAuditSinkDispatcher(ctx, rdb)
+
+	// Run queued audit export jobs (claimed with SKIP LOCKED, so safe on every replica)
+	services.StartAuditExportWorker(ctx)
+
+	// Background jobs (quota reset, pruning). Every replica runs the scheduler;
+	// Redis locks make sure each job executes on only one of them.
+	scheduler := services.NewScheduler(rdb)
+	services.RegisterCoreJobs(scheduler)
+	scheduler.Register(api.ProviderValidationJob())
+	if os.Getenv("DISABLE_SCHEDULER") != "true" {
+		scheduler.Start(ctx)
+		defer scheduler.Stop()
+	}
+
 	// Setup Fiber
 	app := fiber.New(fiber.Config{
 		AppName:                 "Zaps.ai Gateway v2.0",
 		EnableTrustedProxyCheck: true,
-		TrustedProxies:          []string{"0.0.0.0/0"},
+		TrustedProxies:          api.TrustedProxies(),
 		ProxyHeader:             fiber.HeaderXForwardedFor,
 		ErrorHandler: func(c *fiber.Ctx, err error) error {
 			code := fiber.StatusInternalServerError
 			if e, ok := err.(*fiber.Error); ok {
 				code = e.Code
 			}
+			if code >= 500 {
+				slog.ErrorContext(c.UserContext(), "unhandled error", "error", err)
+			}
 			return c.Status(code).JSON(fiber.Map{"error": err.Error()})
 		},
 	})
 
 	// Middleware
-	app.Use(logger.New(logger.Config{
-		Format: "[${time}] ${status} - ${method} ${path} (${latency})\n",
-	}))
+	app.Use(api.RequestLogMiddleware())
 
 	allowedOrigins := os.Getenv("ALLOWED_ORIGINS")
 	if allowedOrigins == "" {
@@ -98,7 +138,8 @@ func main() {
 
 	app.Use(cors.New(cors.Config{
 		AllowOrigins:     "http://localhost:3001, http://localhost:3000, https://app.glassdesk.ai, https://glassdesk.ai, https://zaps.ai, https://www.zaps.ai, https://api.zaps.ai, https://dev.zaps.ai",
-		AllowHeaders:     "Origin, Content-Type, Accept, Authorization, x-client-id",
+		AllowHeaders:     "Origin, Content-Type, Accept, Authorization, x-client-id, X-Request-ID",
+		ExposeHeaders:    "X-Request-ID, traceparent",
 		AllowMethods:     "GET, POST, PUT, DELETE, OPTIONS",
 		AllowCredentials: true,
 	}))
@@ -133,6 +174,9 @@ func main() {
 		})
 	})
 
+	// Prometheus metrics (optionally protected by METRICS_TOKEN)
+	app.Get("/metrics", api.MetricsHandler())
+
 	// ==============================================
 	// AUTHENTICATION ROUTES (New SaaS)
 	// ==============================================
@@ -214,26 +258,76 @@ func main() {
 	apiGroup := app.Group("/api")
 
 	// Protected Billing Routes
-	billing := apiGroup.Group("/billing", AuthMiddleware(rdb))
+	billing := apiGroup.Group("/billing", AuthMiddleware(rdb), api.SessionOnlyMiddleware())
 	billing.Post("/checkout", api.HandleCreateCheckoutSession)
 	billing.Post("/portal", api.HandleCreatePortalSession)
 
 	// Super Admin Routes
-	admin := apiGroup.Group("/admin", AuthMiddleware(rdb), api.SuperAdminMiddleware())
+	admin := apiGroup.Group("/admin", AuthMiddleware(rdb), api.SessionOnlyMiddleware(), api.SuperAdminMiddleware())
 	admin.Get("/tenants", api.HandleListTenants)
 	admin.Put("/tenants/:id", api.HandleUpdateTenant)
+	admin.Put("/pricing", api.HandleUpdateModelPricing)
+	admin.Get("/jobs", api.HandleListJobRuns(scheduler))
+	admin.Post("/jobs/:name/run", api.HandleRunJob(scheduler))
 
 	// Protected Dashboard API
-	dashboard := apiGroup.Group("/dashboard", AuthMiddleware(rdb))
+	dashboard := apiGroup.Group("/dashboard", AuthMiddleware(rdb), api.SessionOnlyMiddleware())
 	dashboard.Get("/stats", api.GetDashboardStats)
+	dashboard.Get("/pricing", api.GetModelPricing)
+	dashboard.Get("/usage/keys", api.GetKeyUsage)
+	dashboard.Get("/analytics", api.GetAnalytics)
 	dashboard.Get("/keys", api.GetAPIKeys)
 	dashboard.Post("/keys", api.CreateAPIKey(rdb))
-	dashboard.Delete("/keys/:id", api.RevokeAPIKey)
+	dashboard.Put("/keys/:id", api.UpdateAPIKey(rdb))
+	dashboard.Put("/keys/:id/policy", api.UpdateAPIKeyPolicy(rdb))
+	dashboard.Post("/keys/:id/rotate", api.RotateAPIKey(rdb))
+	dashboard.Post("/keys/:id/disable", api.SetAPIKeyEnabled(rdb, false))
+	dashboard.Post("/keys/:id/enable", api.SetAPIKeyEnabled(rdb, true))
+	dashboard.Delete("/keys/:id", api.RevokeAPIKey(rdb))
 	dashboard.Get("/logs", api.GetAuditLogs)
+	dashboard.Get("/logs/verify", api.VerifyAuditChain)
+	dashboard.Get("/logs/sinks", api.GetAuditSinks)
+	dashboard.Post("/logs/sinks", api.SaveAuditSink)
+	dashboard.Put("/logs/sinks/:id", api.SaveAuditSink)
+	dashboard.Delete("/logs/sinks/:id", api.DeleteAuditSink)
+	dashboard.Post("/logs/sinks/:id/test", api.TestAuditSink)
+	dashboard.Get("/logs/sinks/:id/dead-letters", api.GetAuditSinkDeadLetters)
+	dashboard.Post("/logs/sinks/:id/dead-letters/retry", api.RetryAuditSinkDeadLetters)
 	dashboard.Get("/reports/export", api.ExportAuditLogs)
+	dashboard.Get("/reports/exports", api.GetAuditExports)
+	dashboard.Post("/reports/exports", api.CreateAuditExport)
+	dashboard.Get("/reports/exports/:id", api.GetAuditExport)
+	dashboard.Get("/reports/exports/:id/download", api.DownloadAuditExport)
+	dashboard.Get("/captures", api.GetPromptCaptures)
+	dashboard.Get("/captures/:id", api.GetPromptCapture)
+	dashboard.Post("/captures/:id/replay", api.ReplayPromptCapture(rdb))
+	dashboard.Get("/retention", api.GetRetentionPolicy)
+	dashboard.Put("/retention", api.UpdateRetentionPolicy)
 	dashboard.Get("/providers", api.GetProviders)
 	dashboard.Post("/providers", api.UpdateProvider(rdb))
 	dashboard.Delete("/providers/:name", api.DeleteProvider)
+	dashboard.Get("/routing/aliases", api.GetModelAliases)
+	dashboard.Post("/routing/aliases", api.SaveModelAlias)
+	dashboard.Delete("/routing/aliases/:alias", api.DeleteModelAlias)
+	dashboard.Get("/routing/rules", api.GetRoutingRules)
+	dashboard.Post("/routing/rules", api.SaveRoutingRule)
+	dashboard.Put("/routing/rules/:id", api.SaveRoutingRule)
+	dashboard.Delete("/routing/rules/:id", api.DeleteRoutingRule)
+	dashboard.Get("/pii/entities", api.GetCustomEntities)
+	dashboard.Post("/pii/entities", api.SaveCustomEntity)
+	dashboard.Delete("/pii/entities/:type", api.DeleteCustomEntity)
+	dashboard.Get("/pii/policies", api.GetPIIRoutingPolicies)
+	dashboard.Get("/pii/trends", api.GetPIITrends)
+	dashboard.Post("/pii/policies", api.SavePIIRoutingPolicy)
+	dashboard.Put("/pii/policies/:id", api.SavePIIRoutingPolicy)
+	dashboard.Delete("/pii/policies/:id", api.DeletePIIRoutingPolicy)
+	dashboard.Get("/budgets", api.GetBudgets(rdb))
+	dashboard.Post("/budgets", api.SaveBudget)
+	dashboard.Put("/budgets/:id", api.SaveBudget)
+	dashboard.Delete("/budgets/:id", api.DeleteBudget(rdb))
+	dashboard.Get("/cache/semantic", api.GetSemanticCache(rdb))
+	dashboard.Put("/cache/semantic", api.UpdateSemanticCache)
+	dashboard.Delete("/cache/semantic", api.InvalidateSemanticCache(rdb))
 
 	// User & Organization Management
 	dashboard.Get("/profile", api.GetProfile)
@@ -313,11 +407,28 @@ func main() {
 
 	// Main proxy endpoint (Protected by API Key auth only)
 	apiProxy := app.Group("/v1")
-	apiProxy.Use(AuthMiddleware(rdb))
+	apiProxy.Use(api.TracingMiddleware(), api.InflightMiddleware(), AuthMiddleware(rdb), api.KeySourceMiddleware(), api.RateLimitMiddleware(rdb))
 	// Use new API handlers
-	apiProxy.Post("/chat/completions", api.HandleChatCompletion(rdb))
-	apiProxy.Get("/models", api.HandleListModels(rdb))
-
-	log.Printf("🚀 Zaps.ai Gateway starting on %s", Port)
-	log.Fatal(app.Listen(Port))
+	apiProxy.Post("/chat/completions", api.RequireScope(services.ScopeChat), api.HandleChatCompletion(rdb))
+	apiProxy.Get("/models", api.RequireScope(services.ScopeModelsRead), api.HandleListModels(rdb))
+
+	go func() {
+		slog.Info("gateway starting", "addr", Port)
+		if err := app.Listen(Port); err != nil {
+			slog.Error("server stopped", "error", err)
+			os.Exit(1)
+		}
+	}()
+
+	// Graceful shutdown: finish in-flight requests, then flush queued events
+	quit := make(chan os.Signal, 1)
+	signal.Notify(quit, os.Interrupt, syscall.SIGTERM)
+	<-quit
+	slog.Info("shutting down")
+	if err := app.ShutdownWithTimeout(30 * time.Second); err != nil {
+		slog.Warn("server shutdown incomplete", "error", err)
+	}
+	flushCtx, cancelFlush := context.WithTimeout(ctx, 15*time.Second)
+	defer cancelFlush()
+	services.StopEventWriter(flushCtx)
 }
@@ -0,0 +1,328 @@
+package services
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+	"sort"
+	"time"
+
+	"zaps/db"
+
+	"github.com/google/uuid"
+	"github.com/lib/pq"
+)
+
+// LatencyBucketsMs are the upper bounds of the usage_metrics latency histogram.
+// A final overflow bucket counts anything slower. Only append to this list:
+// stored histograms are interpreted against it.
+var LatencyBucketsMs = []int64{
+	10, 25, 50, 75, 100, 150, 200, 300, 400, 500, 750,
+	1000, 1500, 2000, 3000, 4000, 5000, 7500, 10000, 15000, 20000, 30000, 60000, 120000,
+}
+
+// Analytics group_by dimensions
+const (
+	GroupByModel    = "model"
+	GroupByProvider = "provider"
+	GroupByKey      = "key"
+	GroupByStatus   = "status"
+)
+
+var analyticsGroupColumns = map[string]string{
+	GroupByModel:    "model",
+	GroupByProvider: "provider",
+	GroupByKey:      "COALESCE(api_key_id::text, '')",
+	GroupByStatus:   "status_code::text",
+}
+
+// latencyHistogram returns a one-request histogram for a latency
+func latencyHistogram(ms int64) []int64 {
+	hist := make([]int64, len(LatencyBucketsMs)+1)
+	i := sort.Search(len(LatencyBucketsMs), func(i int) bool { return ms <= LatencyBucketsMs[i] })
+	hist[i] = 1
+	return hist
+}
+
+// HistogramPercentile estimates the q-th quantile (0..1) of a latency histogram,
+// interpolating linearly inside the bucket that contains it
+func HistogramPercentile(hist []int64, q float64) float64 {
+	var total int64
+	for _, n := range hist {
+		total += n
+	}
+	if total == 0 {
+		return 0
+	}
+
+	rank := q * float64(total)
+	var seen int64
+	for i, n := range hist {
+		if n == 0 || float64(seen+n) < rank {
+			seen += n
+			continue
+		}
+		if i >= len(LatencyBucketsMs) {
+			return float64(LatencyBucketsMs[len(LatencyBucketsMs)-1]) // Overflow: report the last bound
+		}
+		var lower float64
+		if i > 0 {
+			lower = float64(LatencyBucketsMs[i-1])
+		}
+		upper := float64(LatencyBucketsMs[i])
+		return lower + (upper-lower)*(rank-float64(seen))/float64(n)
+	}
+	return float64(LatencyBucketsMs[len(LatencyBucketsMs)-1])
+}
+
+func addHistogram(dst, src []int64) []int64 {
+	for len(dst) < len(src) {
+		dst = append(dst, 0)
+	}
+	for i, n := range src {
+		dst[i] += n
+	}
+	return dst
+}
+
+// upsertUsageMetrics adds a batch of requests to their usage_metrics hourly rollups,
+// one row per tenant, key, provider, model, status and hour
+func upsertUsageMetrics(ctx context.Context, tx *sql.Tx, batch []*RequestUsage) error {
+	type metricKey struct {
+		tenantID, apiKeyID uuid.UUID
+		provider, model    string
+		statusCode         int
+		hour               int64
+	}
+	type metricRow struct {
+		key                               metricKey
+		apiKeyID                          *uuid.UUID
+		hourBucket                        time.Time
+		requests, errors, latencyMs       int64
+		histogram                         []int64
+		prompt, completion, cached, total int64
+		costUSD                           float64
+	}
+
+	rows := make(map[metricKey]*metricRow)
+	var order []metricKey
+	for _, u := range batch {
+		tID, err := uuid.Parse(u.TenantID)
+		if err != nil {
+			continue
+		}
+		model := u.Model
+		if len(model) > 255 {
+			model = model[:255]
+		}
+		hourBucket := u.At.Truncate(time.Hour)
+		k := metricKey{tenantID: tID, provider: u.Provider, model: model, statusCode: u.StatusCode, hour: hourBucket.Unix()}
+		var kID *uuid.UUID
+		if id, err := uuid.Parse(u.APIKeyID); err == nil {
+			kID = &id
+			k.apiKeyID = id
+		}
+
+		row, ok := rows[k]
+		if !ok {
+			row = &metricRow{key: k, apiKeyID: kID, hourBucket: hourBucket}
+			rows[k] = row
+			order = append(order, k)
+		}
+		row.requests++
+		if u.IsError {
+			row.errors++
+		}
+		row.latencyMs += u.LatencyMs
+		row.histogram = addHistogram(row.histogram, latencyHistogram(u.LatencyMs))
+		row.prompt += int64(u.Tokens.PromptTokens)
+		row.completion += int64(u.Tokens.CompletionTokens)
+		row.cached += int64(u.Tokens.CachedTokens)
+		row.total += int64(u.Tokens.Total())
+		row.costUSD += u.CostUSD
+	}
+
+	// A stable order keeps concurrent writers from deadlocking on row locks
+	sort.Slice(order, func(i, j int) bool {
+		a, b := order[i], order[j]
+		if a.tenantID != b.tenantID {
+			return a.tenantID.String() < b.tenantID.String()
+		}
+		if a.hour != b.hour {
+			return a.hour < b.hour
+		}
+		if a.apiKeyID != b.apiKeyID {
+			return a.apiKeyID.String() < b.apiKeyID.String()
+		}
+		if a.provider != b.provider {
+			return a.provider < b.provider
+		}
+		if a.model != b.model {
+			return a.model < b.model
+		}
+		return a.statusCode < b.statusCode
+	})
+
+	values := make([][]interface{}, 0, len(order))
+	for _, k := range order {
+		r := rows[k]
+		values = append(values, []interface{}{
+			k.tenantID, r.apiKeyID, k.provider, k.model, k.statusCode, r.hourBucket,
+			r.requests, r.errors, r.latencyMs, pq.Array(r.histogram),
+			r.prompt, r.completion, r.cached, r.total, r.costUSD,
+		})
+	}
+
+	return execValues(ctx, tx, `
+		INSERT INTO usage_metrics (
+			tenant_id, api_key_id, provider, model, status_code, hour_bucket,
+			request_count, error_count, total_latency_ms, latency_histogram,
+			prompt_tokens, completion_tokens, cached_tokens, total_tokens, cost_usd
+		)
+		VALUES `, `
+		ON CONFLICT (tenant_id, (COALESCE(api_key_id, '00000000-0000-0000-0000-000000000000'::uuid)),
+			provider, model, status_code, hour_bucket)
+		DO UPDATE SET
+			request_count = usage_metrics.request_count + EXCLUDED.request_count,
+			error_count = usage_metrics.error_count + EXCLUDED.error_count,
+			total_latency_ms = usage_metrics.total_latency_ms + EXCLUDED.total_latency_ms,
+			latency_histogram = histogram_add(usage_metrics.latency_histogram, EXCLUDED.latency_histogram),
+			prompt_tokens = usage_metrics.prompt_tokens + EXCLUDED.prompt_tokens,
+			completion_tokens = usage_metrics.completion_tokens + EXCLUDED.completion_tokens,
+			cached_tokens = usage_metrics.cached_tokens + EXCLUDED.cached_tokens,
+			total_tokens = usage_metrics.total_tokens + EXCLUDED.total_tokens,
+			cost_usd = usage_metrics.cost_usd + EXCLUDED.cost_usd
+	`, values)
+}
+
+// AnalyticsQuery selects usage_metrics rows for QueryAnalytics
+type AnalyticsQuery struct {
+	TenantID    string
+	From, To    time.Time
+	Granularity string // date_trunc unit: hour, day, week, month
+	GroupBy     string // Optional: GroupByModel, GroupByProvider, GroupByKey, GroupByStatus
+}
+
+// AnalyticsStats are aggregated metrics for a bucket or group
+type AnalyticsStats struct {
+	Requests         int64   `json:"requests"`
+	Errors           int64   `json:"errors"`
+	ErrorRate        float64 `json:"error_rate"`
+	AvgLatencyMs     float64 `json:"avg_latency_ms"`
+	P50LatencyMs     float64 `json:"p50_latency_ms"`
+	P95LatencyMs     float64 `json:"p95_latency_ms"`
+	P99LatencyMs     float64 `json:"p99_latency_ms"`
+	PromptTokens     int64   `json:"prompt_tokens"`
+	CompletionTokens int64   `json:"completion_tokens"`
+	CachedTokens     int64   `json:"cached_tokens"`
+	TotalTokens      int64   `json:"total_tokens"`
+	CostUSD          float64 `json:"cost_usd"`
+
+	totalLatencyMs int64
+	histogram      []int64
+}
+
+func (s *AnalyticsStats) add(o *AnalyticsStats) {
+	s.Requests += o.Requests
+	s.Errors += o.Errors
+	s.PromptTokens += o.PromptTokens
+	s.CompletionTokens += o.CompletionTokens
+	s.CachedTokens += o.CachedTokens
+	s.TotalTokens += o.TotalTokens
+	s.CostUSD += o.CostUSD
+	s.totalLatencyMs += o.totalLatencyMs
+	s.histogram = addHistogram(s.histogram, o.histogram)
+}
+
+// finish derives rates and percentiles from the summed counters
+func (s *AnalyticsStats) finish() {
+	if s.Requests > 0 {
+		s.ErrorRate = float64(s.Errors) / float64(s.Requests)
+		s.AvgLatencyMs = float64(s.totalLatencyMs) / float64(s.Requests)
+	}
+	s.P50LatencyMs = HistogramPercentile(s.histogram, 0.50)
+	s.P95LatencyMs = HistogramPercentile(s.histogram, 0.95)
+	s.P99LatencyMs = HistogramPercentile(s.histogram, 0.99)
+}
+
+// AnalyticsPoint is one time bucket (and group, when grouping)
+type AnalyticsPoint struct {
+	Bucket time.Time `json:"bucket"`
+	Group  *string   `json:"group,omitempty"`
+	AnalyticsStats
+}
+
+// AnalyticsGroup totals a group over the whole range
+type AnalyticsGroup struct {
+	Group string `json:"group"`
+	AnalyticsStats
+}
+
+// AnalyticsResult is the response of QueryAnalytics
+type AnalyticsResult struct {
+	Series  []*AnalyticsPoint `json:"series"`
+	Groups  []*AnalyticsGroup `json:"groups,omitempty"`
+	Summary AnalyticsStats    `json:"summary"`
+}
+
+// QueryAnalytics aggregates usage_metrics over a time range, per time bucket and
+// optionally per group
+func QueryAnalytics(q AnalyticsQuery) (*AnalyticsResult, error) {
+	groupExpr := "''"
+	if q.GroupBy != "" {
+		col, ok := analyticsGroupColumns[q.GroupBy]
+		if !ok {
+			return nil, fmt.Errorf("group_by must be model, provider, key or status")
+		}
+		groupExpr = col
+	}
+
+	rows, err := db.DB.Query(`
+		SELECT date_trunc($4, hour_bucket) AS bucket, `+groupExpr+` AS grp,
+			SUM(request_count), SUM(error_count), SUM(total_latency_ms), histogram_sum(latency_histogram),
+			SUM(prompt_tokens), SUM(completion_tokens), SUM(cached_tokens), SUM(total_tokens), SUM(cost_usd)
+		FROM usage_metrics
+		WHERE tenant_id = $1 AND hour_bucket >= $2 AND hour_bucket < $3
+		GROUP BY bucket, grp
+		ORDER BY bucket ASC, grp ASC
+	`, q.TenantID, q.From, q.To, q.Granularity)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	result := &AnalyticsResult{Series: []*AnalyticsPoint{}}
+	groups := make(map[string]*AnalyticsGroup)
+	for rows.Next() {
+		p := &AnalyticsPoint{}
+		var group string
+		if err := rows.Scan(&p.Bucket, &group, &p.Requests, &p.Errors, &p.totalLatencyMs, pq.Array(&p.histogram),
+			&p.PromptTokens, &p.CompletionTokens, &p.CachedTokens, &p.TotalTokens, &p.CostUSD); err != nil {
+			return nil, err
+		}
+
+		result.Summary.add(&p.AnalyticsStats)
+		if q.GroupBy != "" {
+			p.Group = &group
+			g, ok := groups[group]
+			if !ok {
+				g = &AnalyticsGroup{Group: group}
+				groups[group] = g
+				result.Groups = append(result.Groups, g)
+			}
+			g.add(&p.AnalyticsStats)
+		}
+		p.finish()
+		result.Series = append(result.Series, p)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+
+	for _, g := range result.Groups {
+		g.finish()
+	}
+	sort.Slice(result.Groups, func(i, j int) bool { return result.Groups[i].Requests > result.Groups[j].Requests })
+	result.Summary.finish()
+	return result, nil
+}
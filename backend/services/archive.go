@@ -0,0 +1,193 @@
+package services
+
+import (
+	"bytes"
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+)
+
+// ArchiveStore receives data copied out of Postgres before retention deletes it
+type ArchiveStore interface {
+	Put(ctx context.Context, key string, data []byte) error
+	// Location describes where key ends up, for audit events
+	Location(key string) string
+}
+
+// ArchiveStoreFromEnv returns the store named by ARCHIVE_URL, or nil when unset:
+//
+//	file:///var/lib/zaps/archive
+//	s3://bucket/optional/prefix  (ARCHIVE_S3_ENDPOINT, ARCHIVE_S3_REGION,
+//	                              ARCHIVE_S3_ACCESS_KEY_ID, ARCHIVE_S3_SECRET_ACCESS_KEY)
+func ArchiveStoreFromEnv() (ArchiveStore, error) {
+	raw := os.Getenv("ARCHIVE_URL")
+	if raw == "" {
+		return nil, nil
+	}
+	u, err := url.Parse(raw)
+	if err != nil {
+		return nil, fmt.Errorf("invalid ARCHIVE_URL: %w", err)
+	}
+
+	switch u.Scheme {
+	case "file":
+		return &fileArchive{dir: u.Path}, nil
+	case "s3":
+		region := os.Getenv("ARCHIVE_S3_REGION")
+		if region == "" {
+			region = "us-east-1"
+		}
+		endpoint := os.Getenv("ARCHIVE_S3_ENDPOINT")
+		if endpoint == "" {
+			endpoint = "https://s3." + region + ".amazonaws.com"
+		}
+		s := &s3Archive{
+			endpoint:  strings.TrimRight(endpoint, "/"),
+			bucket:    u.Host,
+			prefix:    strings.Trim(u.Path, "/"),
+			region:    region,
+			accessKey: os.Getenv("ARCHIVE_S3_ACCESS_KEY_ID"),
+			secretKey: os.Getenv("ARCHIVE_S3_SECRET_ACCESS_KEY"),
+			client:    &http.Client{Timeout: 2 * time.Minute},
+		}
+		if s.bucket == "" || s.accessKey == "" || s.secretKey == "" {
+			return nil, fmt.Errorf("s3 archive needs a bucket, ARCHIVE_S3_ACCESS_KEY_ID and ARCHIVE_S3_SECRET_ACCESS_KEY")
+		}
+		return s, nil
+	}
+	return nil, fmt.Errorf("ARCHIVE_URL must be file:// or s3://")
+}
+
+// fileArchive writes objects under a local (or mounted) directory
+type fileArchive struct {
+	dir string
+}
+
+func (f *fileArchive) Put(_ context.Context, key string, data []byte) error {
+	path := filepath.Join(f.dir, filepath.FromSlash(key))
+	if err := os.MkdirAll(filepath.Dir(path), 0o700); err != nil {
+		return err
+	}
+	tmp := path + ".tmp"
+	if err := os.WriteFile(tmp, data, 0o600); err != nil {
+		return err
+	}
+	return os.Rename(tmp, path)
+}
+
+func (f *fileArchive) Location(key string) string {
+	return "file://" + filepath.ToSlash(filepath.Join(f.dir, filepath.FromSlash(key)))
+}
+
+// s3Archive PUTs objects to S3 or an S3-compatible store (MinIO, R2, ...) using
+// path-style URLs and Signature Version 4
+type s3Archive struct {
+	endpoint  string
+	bucket    string
+	prefix    string
+	region    string
+	accessKey string
+	secretKey string
+	client    *http.Client
+}
+
+func (s *s3Archive) objectKey(key string) string {
+	if s.prefix == "" {
+		return key
+	}
+	return s.prefix + "/" + key
+}
+
+func (s *s3Archive) Location(key string) string {
+	return "s3://" + s.bucket + "/" + s.objectKey(key)
+}
+
+func (s *s3Archive) Put(ctx context.Context, key string, data []byte) error {
+	segments := strings.Split(s.bucket+"/"+s.objectKey(key), "/")
+	for i, seg := range segments {
+		segments[i] = url.PathEscape(seg)
+	}
+	req, err := http.NewRequestWithContext(ctx, http.MethodPut, s.endpoint+"/"+strings.Join(segments, "/"), bytes.NewReader(data))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/gzip")
+	signS3Request(req, sha256Hex(data), s.accessKey, s.secretKey, s.region, time.Now())
+
+	resp, err := s.client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		body, _ := io.ReadAll(io.LimitReader(resp.Body, 512))
+		return fmt.Errorf("s3 PUT %s returned HTTP %d: %s", s.Location(key), resp.StatusCode, strings.TrimSpace(string(body)))
+	}
+	return nil
+}
+
+func sha256Hex(data []byte) string {
+	sum := sha256.Sum256(data)
+	return hex.EncodeToString(sum[:])
+}
+
+func hmacSHA256(key []byte, data string) []byte {
+	mac := hmac.New(sha256.New, key)
+	mac.Write([]byte(data))
+	return mac.Sum(nil)
+}
+
+// signS3Request adds AWS Signature Version 4 headers, signing host and every header
+// already set on req
+func signS3Request(req *http.Request, payloadHash, accessKey, secretKey, region string, now time.Time) {
+	amzDate := now.UTC().Format("20060102T150405Z")
+	day := amzDate[:8]
+	req.Header.Set("X-Amz-Date", amzDate)
+	req.Header.Set("X-Amz-Content-Sha256", payloadHash)
+
+	headers := map[string]string{"host": req.URL.Host}
+	for name, values := range req.Header {
+		headers[strings.ToLower(name)] = strings.TrimSpace(strings.Join(values, ","))
+	}
+	names := make([]string, 0, len(headers))
+	for name := range headers {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	var canonicalHeaders strings.Builder
+	for _, name := range names {
+		canonicalHeaders.WriteString(name + ":" + headers[name] + "\n")
+	}
+	signedHeaders := strings.Join(names, ";")
+
+	canonicalRequest := strings.Join([]string{
+		req.Method,
+		req.URL.EscapedPath(),
+		req.URL.RawQuery,
+		canonicalHeaders.String(),
+		signedHeaders,
+		payloadHash,
+	}, "\n")
+
+	scope := day + "/" + region + "/s3/aws4_request"
+	stringToSign := "AWS4-HMAC-SHA256\n" + amzDate + "\n" + scope + "\n" + sha256Hex([]byte(canonicalRequest))
+
+	key := hmacSHA256([]byte("AWS4"+secretKey), day)
+	key = hmacSHA256(key, region)
+	key = hmacSHA256(key, "s3")
+	key = hmacSHA256(key, "aws4_request")
+	signature := hex.EncodeToString(hmacSHA256(key, stringToSign))
+
+	req.Header.Set("Authorization", fmt.Sprintf("AWS4-HMAC-SHA256 Credential=%s/%s, SignedHeaders=%s, Signature=%s",
+		accessKey, scope, signedHeaders, signature))
+}
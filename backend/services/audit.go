@@ -2,60 +2,68 @@ package services
 
 import (
 	"encoding/json"
-	"log"
 	"strings"
-
-	"zaps/db"
+	"time"
 
 	"github.com/google/uuid"
 )
 
 // LogAuditAsync inserts an audit log entry asynchronously
 func LogAuditAsync(tenantID string, userID *string, eventType string, eventData map[string]interface{}, ip string, userAgent string) {
+	logAuditAsync(tenantID, userID, "", eventType, eventData, ip, userAgent)
+}
+
+// LogKeyAuditAsync inserts an audit log entry attributed to the API key that made the
+// request. An empty apiKeyID (dashboard sessions, legacy keys) is stored as NULL.
+func LogKeyAuditAsync(tenantID, apiKeyID string, eventType string, eventData map[string]interface{}, ip string, userAgent string) {
+	logAuditAsync(tenantID, nil, apiKeyID, eventType, eventData, ip, userAgent)
+}
+
+func logAuditAsync(tenantID string, userID *string, apiKeyID string, eventType string, eventData map[string]interface{}, ip string, userAgent string) {
 	// Sanitize IP (handle X-Forwarded-For multiple IPs)
 	if strings.Contains(ip, ",") {
 		ip = strings.TrimSpace(strings.Split(ip, ",")[0])
 	}
-	go func() {
-		// Parse UUIDs
-		tID, err := uuid.Parse(tenantID)
-		if err != nil {
-			// Silently fail or log to standard logger if available
-			// log.Printf("❌ Audit Log Error: Invalid Tenant ID %s", tenantID)
-			return
-		}
-
-		var uID *uuid.UUID
-		if userID != nil {
-			if id, err := uuid.Parse(*userID); err == nil {
-				uID = &id
-			}
-		}
+	// Parse UUIDs
+	tID, err := uuid.Parse(tenantID)
+	if err != nil {
+		// Sessions without a tenant (e.g. admin tools) have nothing to attribute
+		return
+	}
 
-		// Handle empty IP for INET column
-		var ipPtr *string
-		if ip != "" {
-			ipPtr = &ip
+	var uID *uuid.UUID
+	if userID != nil {
+		if id, err := uuid.Parse(*userID); err == nil {
+			uID = &id
 		}
+	}
 
-		// Convert Map to JSONB
-		// In Go, db.JSONBMap is map[string]interface{}
-		// We ensure eventData is safe
+	var kID *uuid.UUID
+	if id, err := uuid.Parse(apiKeyID); err == nil {
+		kID = &id
+	}
 
-		// Marshal eventData to JSON
-		jsonData, err := json.Marshal(eventData)
-		if err != nil {
-			return
-		}
+	// Handle empty IP for INET column
+	var ipPtr *string
+	if ip != "" {
+		ipPtr = &ip
+	}
 
-		_, err = db.DB.Exec(`
-			INSERT INTO audit_logs (tenant_id, user_id, event_type, event_data, ip_address, user_agent)
-			VALUES ($1, $2, $3, $4, $5, $6)
-		`, tID, uID, eventType, jsonData, ipPtr, userAgent)
+	// Marshal eventData to JSON
+	jsonData, err := json.Marshal(eventData)
+	if err != nil {
+		return
+	}
 
-		if err != nil {
-			// In production, we might want to log this to a file
-			log.Printf("❌ Saved Audit Log Failed: %v", err)
-		}
-	}()
+	// Queued for the batched writer, which chains it under the tenant's head
+	events.enqueueAudit(&auditEntry{
+		TenantID:  tID,
+		UserID:    uID,
+		APIKeyID:  kID,
+		EventType: eventType,
+		EventData: jsonData,
+		IPAddress: ipPtr,
+		UserAgent: userAgent,
+		CreatedAt: time.Now().UTC().Truncate(time.Microsecond),
+	})
 }
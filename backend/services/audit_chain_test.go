@@ -0,0 +1,101 @@
+package services
+
+import (
+	"context"
+	"crypto/ed25519"
+	"database/sql/driver"
+	"encoding/base64"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/DATA-DOG/go-sqlmock"
+	"github.com/google/uuid"
+)
+
+// chainAfterPurge builds rows 2..4 of a chain whose row 1 was purged
+func chainAfterPurge(t *testing.T, tenantID uuid.UUID, lastEvent string, lastData string) (purgedHash []byte, rows *sqlmock.Rows, headHash []byte) {
+	t.Helper()
+	created := time.Date(2026, 1, 1, 0, 0, 0, 0, time.UTC)
+	rows = sqlmock.NewRows([]string{"id", "seq", "prev_hash", "row_hash", "user_id", "api_key_id",
+		"event_type", "event_data", "host", "user_agent", "created_at"})
+
+	prev := AuditGenesisHash
+	for seq := int64(1); seq <= 4; seq++ {
+		e := &auditEntry{TenantID: tenantID, EventType: "LOGIN", EventData: []byte(`{}`), CreatedAt: created}
+		if seq == 4 {
+			e.EventType, e.EventData = lastEvent, []byte(lastData)
+		}
+		rowHash, err := auditRowHash(prev, seq, e)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if seq == 1 {
+			purgedHash = rowHash
+		} else {
+			rows.AddRow(seq, seq, prev, rowHash, nil, nil, e.EventType, e.EventData, nil, "", created)
+		}
+		prev = rowHash
+	}
+	return purgedHash, rows, prev
+}
+
+func TestVerifyAuditChainPurgeMarker(t *testing.T) {
+	seed := make([]byte, ed25519.SeedSize)
+	t.Setenv("AUDIT_SIGNING_KEY", base64.StdEncoding.EncodeToString(seed))
+	t.Setenv("AUDIT_VERIFY_KEYS", "")
+	priv := ed25519.NewKeyFromSeed(seed)
+	keyID := AuditSigningKeyID(priv.Public().(ed25519.PublicKey))
+	tenantID := uuid.New()
+
+	tests := []struct {
+		name      string
+		lastEvent string
+		lastData  string
+		sign      func(purgedHash []byte) []byte // nil leaves the marker unsigned
+		wantValid bool
+		badSig    bool // Rejected before the rows are read
+	}{
+		{"signed marker", "LOGIN", `{}`, func(h []byte) []byte {
+			return ed25519.Sign(priv, auditPurgeMessage(tenantID, 1, h))
+		}, true, false},
+		{"unsigned marker recorded by RETENTION_PURGE", "RETENTION_PURGE", `{"table":"audit_logs","purged_through_seq":1}`, nil, true, false},
+		{"unsigned marker without an event", "LOGIN", `{}`, nil, false, false},
+		{"event for another boundary", "RETENTION_PURGE", `{"table":"audit_logs","purged_through_seq":7}`, nil, false, false},
+		{"checkpoint signature as marker", "LOGIN", `{}`, func(h []byte) []byte {
+			return ed25519.Sign(priv, auditCheckpointMessage(tenantID, 1, h))
+		}, false, true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			mock := newMockDB(t)
+			purgedHash, rows, headHash := chainAfterPurge(t, tenantID, tt.lastEvent, tt.lastData)
+			var markerKey, markerSig driver.Value
+			if tt.sign != nil {
+				markerKey, markerSig = keyID, tt.sign(purgedHash)
+			}
+
+			mock.ExpectQuery(`SELECT seq, head_hash, purged_seq, purged_hash, purged_key_id, purged_signature`).
+				WillReturnRows(sqlmock.NewRows([]string{"seq", "head_hash", "purged_seq", "purged_hash", "purged_key_id", "purged_signature"}).
+					AddRow(4, headHash, 1, purgedHash, markerKey, markerSig))
+			mock.ExpectQuery(`SELECT COUNT\(\*\) FROM audit_logs`).
+				WillReturnRows(sqlmock.NewRows([]string{"count"}).AddRow(0))
+			mock.ExpectQuery(`SELECT seq, head_hash, key_id, signature FROM audit_checkpoints`).
+				WillReturnRows(noRows("seq", "head_hash", "key_id", "signature"))
+			if !tt.badSig {
+				mock.ExpectQuery(`SELECT id, seq, prev_hash, row_hash`).WillReturnRows(rows)
+			}
+
+			report, err := VerifyAuditChain(context.Background(), tenantID.String())
+			if err != nil {
+				t.Fatal(err)
+			}
+			if report.Valid != tt.wantValid {
+				t.Fatalf("Valid = %v, want %v (break: %+v)", report.Valid, tt.wantValid, report.FirstBreak)
+			}
+			if !tt.wantValid && (report.FirstBreak == nil || !strings.Contains(report.FirstBreak.Reason, "purge marker")) {
+				t.Fatalf("first break = %+v, want a purge marker break", report.FirstBreak)
+			}
+		})
+	}
+}
@@ -0,0 +1,529 @@
+package services
+
+import (
+	"bufio"
+	"context"
+	"crypto/sha256"
+	"database/sql"
+	"encoding/csv"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log/slog"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+
+	"zaps/db"
+
+	"github.com/google/uuid"
+	"github.com/parquet-go/parquet-go"
+)
+
+// Audit export: filtered audit events streamed as CSV, JSON lines or Parquet, either
+// straight into a response or, for large ranges, into a file written by an export job
+// that the tenant downloads later.
+
+const (
+	AuditExportCSV     = "csv"
+	AuditExportJSONL   = "jsonl"
+	AuditExportParquet = "parquet"
+
+	AuditExportPending   = "pending"
+	AuditExportRunning   = "running"
+	AuditExportCompleted = "completed"
+	AuditExportFailed    = "failed"
+
+	// AuditExportSyncMaxRows is the most an export may return directly; larger ones need a job
+	AuditExportSyncMaxRows = 100000
+
+	// AuditExportTTL is how long finished export files can be downloaded
+	AuditExportTTL = 7 * 24 * time.Hour
+
+	auditExportMaxActive     = 3 // Pending or running jobs per tenant
+	auditExportPollInterval  = 5 * time.Second
+	auditExportHeartbeat     = 30 * time.Second
+	auditExportStaleAfter    = 5 * time.Minute
+	auditExportParquetGroups = 50000 // Rows per Parquet row group, which bounds writer memory
+)
+
+// AuditRecord is an audit event as exported and forwarded to sinks
+type AuditRecord struct {
+	ID        int64           `json:"id"`
+	Seq       int64           `json:"seq,omitempty"` // 0 for rows written before chaining
+	TenantID  string          `json:"tenant_id"`
+	UserID    *string         `json:"user_id,omitempty"`
+	APIKeyID  *string         `json:"api_key_id,omitempty"`
+	EventType string          `json:"event_type"`
+	EventData json.RawMessage `json:"event_data"`
+	IPAddress string          `json:"ip_address,omitempty"`
+	UserAgent string          `json:"user_agent,omitempty"`
+	CreatedAt time.Time       `json:"created_at"`
+	RowHash   string          `json:"row_hash,omitempty"`
+}
+
+const auditRecordColumns = `id, seq, user_id, api_key_id, event_type, event_data, COALESCE(host(ip_address), ''),
+	COALESCE(user_agent, ''), created_at, row_hash`
+
+func scanAuditRecord(rows *sql.Rows, tenantID uuid.UUID) (AuditRecord, error) {
+	e := AuditRecord{TenantID: tenantID.String()}
+	var seq sql.NullInt64
+	var data, rowHash []byte
+	if err := rows.Scan(&e.ID, &seq, &e.UserID, &e.APIKeyID, &e.EventType, &data, &e.IPAddress,
+		&e.UserAgent, &e.CreatedAt, &rowHash); err != nil {
+		return e, err
+	}
+	e.Seq = seq.Int64
+	e.EventData = data
+	if rowHash != nil {
+		e.RowHash = hex.EncodeToString(rowHash)
+	}
+	return e, nil
+}
+
+// AuditLogFilter selects audit events by time range, type, API key and user
+type AuditLogFilter struct {
+	From       *time.Time `json:"from,omitempty"`
+	To         *time.Time `json:"to,omitempty"`
+	EventTypes []string   `json:"event_types,omitempty"`
+	APIKeyID   *uuid.UUID `json:"api_key_id,omitempty"`
+	UserID     *uuid.UUID `json:"user_id,omitempty"`
+}
+
+// Where returns the filter's conditions on audit_logs for a tenant, with placeholders
+// numbered from $1
+func (f AuditLogFilter) Where(tenantID uuid.UUID) (string, []interface{}) {
+	conds := []string{"tenant_id = $1"}
+	args := []interface{}{tenantID}
+	add := func(cond string, arg interface{}) {
+		args = append(args, arg)
+		conds = append(conds, fmt.Sprintf(cond, len(args)))
+	}
+	if f.From != nil {
+		add("created_at >= $%d", *f.From)
+	}
+	if f.To != nil {
+		add("created_at < $%d", *f.To)
+	}
+	switch len(f.EventTypes) {
+	case 0:
+	case 1:
+		add("event_type = $%d", f.EventTypes[0])
+	default:
+		list := make([]string, len(f.EventTypes))
+		for i, t := range f.EventTypes {
+			args = append(args, t)
+			list[i] = "$" + strconv.Itoa(len(args))
+		}
+		conds = append(conds, "event_type IN ("+strings.Join(list, ", ")+")")
+	}
+	if f.APIKeyID != nil {
+		add("api_key_id = $%d", *f.APIKeyID)
+	}
+	if f.UserID != nil {
+		add("user_id = $%d", *f.UserID)
+	}
+	return strings.Join(conds, " AND "), args
+}
+
+// ValidAuditExportFormat reports whether format is csv, jsonl or parquet
+func ValidAuditExportFormat(format string) bool {
+	return format == AuditExportCSV || format == AuditExportJSONL || format == AuditExportParquet
+}
+
+// AuditExportContentType returns the MIME type and file extension for a format
+func AuditExportContentType(format string) (string, string) {
+	switch format {
+	case AuditExportJSONL:
+		return "application/x-ndjson", "jsonl"
+	case AuditExportParquet:
+		return "application/vnd.apache.parquet", "parquet"
+	}
+	return "text/csv; charset=utf-8", "csv"
+}
+
+// CountAuditLogs counts the events an export would contain
+func CountAuditLogs(ctx context.Context, tenantID uuid.UUID, f AuditLogFilter) (int64, error) {
+	where, args := f.Where(tenantID)
+	var n int64
+	err := db.DB.QueryRowContext(ctx, "SELECT COUNT(*) FROM audit_logs WHERE "+where, args...).Scan(&n)
+	return n, err
+}
+
+// auditExportWriter encodes records in one of the export formats
+type auditExportWriter interface {
+	write(e *AuditRecord) error
+	close() error
+}
+
+var auditCSVHeader = []string{"id", "seq", "created_at", "event_type", "user_id", "api_key_id",
+	"ip_address", "user_agent", "event_data", "row_hash"}
+
+type csvExportWriter struct{ w *csv.Writer }
+
+func (c *csvExportWriter) write(e *AuditRecord) error {
+	seq := ""
+	if e.Seq > 0 {
+		seq = strconv.FormatInt(e.Seq, 10)
+	}
+	deref := func(s *string) string {
+		if s == nil {
+			return ""
+		}
+		return *s
+	}
+	return c.w.Write([]string{
+		strconv.FormatInt(e.ID, 10), seq, e.CreatedAt.UTC().Format(time.RFC3339Nano), e.EventType,
+		deref(e.UserID), deref(e.APIKeyID), e.IPAddress, e.UserAgent, string(e.EventData), e.RowHash,
+	})
+}
+
+func (c *csvExportWriter) close() error {
+	c.w.Flush()
+	return c.w.Error()
+}
+
+type jsonlExportWriter struct{ enc *json.Encoder }
+
+func (j *jsonlExportWriter) write(e *AuditRecord) error { return j.enc.Encode(e) }
+
+func (j *jsonlExportWriter) close() error { return nil }
+
+// auditParquetRow is the Parquet schema; event_data keeps its JSON text
+type auditParquetRow struct {
+	ID        int64   `parquet:"id"`
+	Seq       *int64  `parquet:"seq,optional"`
+	TenantID  string  `parquet:"tenant_id"`
+	CreatedAt int64   `parquet:"created_at,timestamp(microsecond:utc)"`
+	EventType string  `parquet:"event_type,dict"`
+	UserID    *string `parquet:"user_id,optional"`
+	APIKeyID  *string `parquet:"api_key_id,optional"`
+	IPAddress *string `parquet:"ip_address,optional"`
+	UserAgent *string `parquet:"user_agent,optional"`
+	EventData string  `parquet:"event_data,json"`
+	RowHash   *string `parquet:"row_hash,optional"`
+}
+
+type parquetExportWriter struct {
+	w *parquet.GenericWriter[auditParquetRow]
+}
+
+func (p *parquetExportWriter) write(e *AuditRecord) error {
+	optional := func(s string) *string {
+		if s == "" {
+			return nil
+		}
+		return &s
+	}
+	row := auditParquetRow{
+		ID:        e.ID,
+		TenantID:  e.TenantID,
+		CreatedAt: e.CreatedAt.UnixMicro(),
+		EventType: e.EventType,
+		UserID:    e.UserID,
+		APIKeyID:  e.APIKeyID,
+		IPAddress: optional(e.IPAddress),
+		UserAgent: optional(e.UserAgent),
+		EventData: string(e.EventData),
+		RowHash:   optional(e.RowHash),
+	}
+	if e.Seq > 0 {
+		row.Seq = &e.Seq
+	}
+	_, err := p.w.Write([]auditParquetRow{row})
+	return err
+}
+
+func (p *parquetExportWriter) close() error { return p.w.Close() }
+
+func newAuditExportWriter(format string, w io.Writer) auditExportWriter {
+	switch format {
+	case AuditExportJSONL:
+		return &jsonlExportWriter{enc: json.NewEncoder(w)}
+	case AuditExportParquet:
+		return &parquetExportWriter{w: parquet.NewGenericWriter[auditParquetRow](w,
+			parquet.NewSchema("audit_log", parquet.SchemaOf(auditParquetRow{})),
+			parquet.Compression(&parquet.Zstd),
+			parquet.MaxRowsPerRowGroup(auditExportParquetGroups),
+		)}
+	}
+	cw := &csvExportWriter{w: csv.NewWriter(w)}
+	cw.w.Write(auditCSVHeader)
+	return cw
+}
+
+// WriteAuditExport streams the tenant's matching events to w, oldest first, and
+// returns how many were written. progress, if set, is called every 10000 rows.
+func WriteAuditExport(ctx context.Context, w io.Writer, tenantID uuid.UUID, f AuditLogFilter, format string, progress func(rows int64)) (int64, error) {
+	where, args := f.Where(tenantID)
+	rows, err := db.DB.QueryContext(ctx, `SELECT `+auditRecordColumns+` FROM audit_logs WHERE `+where+` ORDER BY created_at ASC, id ASC`, args...)
+	if err != nil {
+		return 0, err
+	}
+	defer rows.Close()
+
+	out := newAuditExportWriter(format, w)
+	var n int64
+	for rows.Next() {
+		e, err := scanAuditRecord(rows, tenantID)
+		if err != nil {
+			return n, err
+		}
+		if err := out.write(&e); err != nil {
+			return n, err
+		}
+		n++
+		if progress != nil && n%10000 == 0 {
+			progress(n)
+		}
+	}
+	if err := rows.Err(); err != nil {
+		return n, err
+	}
+	return n, out.close()
+}
+
+// -- Export jobs --
+
+// AuditExport is an asynchronous export job
+type AuditExport struct {
+	ID          uuid.UUID      `json:"id"`
+	Format      string         `json:"format"`
+	Filter      AuditLogFilter `json:"filters"`
+	Status      string         `json:"status"`
+	RowCount    *int64         `json:"row_count,omitempty"`
+	SizeBytes   *int64         `json:"size_bytes,omitempty"`
+	SHA256      *string        `json:"sha256,omitempty"`
+	Error       *string        `json:"error,omitempty"`
+	CreatedAt   time.Time      `json:"created_at"`
+	CompletedAt *time.Time     `json:"completed_at,omitempty"`
+	ExpiresAt   *time.Time     `json:"expires_at,omitempty"`
+	DownloadURL string         `json:"download_url,omitempty"`
+
+	TenantID uuid.UUID `json:"-"`
+	FilePath string    `json:"-"`
+}
+
+const auditExportColumns = `id, tenant_id, format, filters, status, row_count, size_bytes, sha256, error,
+	created_at, completed_at, expires_at, COALESCE(file_path, '')`
+
+func scanAuditExport(row interface{ Scan(...interface{}) error }) (*AuditExport, error) {
+	e := &AuditExport{}
+	var filters []byte
+	if err := row.Scan(&e.ID, &e.TenantID, &e.Format, &filters, &e.Status, &e.RowCount, &e.SizeBytes, &e.SHA256,
+		&e.Error, &e.CreatedAt, &e.CompletedAt, &e.ExpiresAt, &e.FilePath); err != nil {
+		return nil, err
+	}
+	json.Unmarshal(filters, &e.Filter)
+	return e, nil
+}
+
+func auditExportDir() string {
+	if dir := os.Getenv("AUDIT_EXPORT_DIR"); dir != "" {
+		return dir
+	}
+	return "data/exports"
+}
+
+// CreateAuditExport queues an export job for the worker
+func CreateAuditExport(ctx context.Context, tenantID uuid.UUID, userID *uuid.UUID, format string, f AuditLogFilter) (*AuditExport, error) {
+	if !ValidAuditExportFormat(format) {
+		return nil, fmt.Errorf("format must be csv, jsonl or parquet")
+	}
+	var active int
+	if err := db.DB.QueryRowContext(ctx, `
+		SELECT COUNT(*) FROM audit_exports WHERE tenant_id = $1 AND status IN ('pending', 'running')
+	`, tenantID).Scan(&active); err != nil {
+		return nil, err
+	}
+	if active >= auditExportMaxActive {
+		return nil, fmt.Errorf("at most %d exports can be in progress", auditExportMaxActive)
+	}
+
+	filters, err := json.Marshal(f)
+	if err != nil {
+		return nil, err
+	}
+	return scanAuditExport(db.DB.QueryRowContext(ctx, `
+		INSERT INTO audit_exports (tenant_id, requested_by, format, filters)
+		VALUES ($1, $2, $3, $4)
+		RETURNING `+auditExportColumns, tenantID, userID, format, filters))
+}
+
+// ListAuditExports returns a tenant's recent export jobs
+func ListAuditExports(ctx context.Context, tenantID uuid.UUID) ([]*AuditExport, error) {
+	rows, err := db.DB.QueryContext(ctx, `
+		SELECT `+auditExportColumns+` FROM audit_exports WHERE tenant_id = $1 ORDER BY created_at DESC LIMIT 50
+	`, tenantID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	exports := []*AuditExport{}
+	for rows.Next() {
+		e, err := scanAuditExport(rows)
+		if err != nil {
+			return nil, err
+		}
+		exports = append(exports, e)
+	}
+	return exports, rows.Err()
+}
+
+// GetAuditExport loads one of a tenant's export jobs (sql.ErrNoRows if it does not exist)
+func GetAuditExport(ctx context.Context, tenantID uuid.UUID, id string) (*AuditExport, error) {
+	exportID, err := uuid.Parse(id)
+	if err != nil {
+		return nil, sql.ErrNoRows
+	}
+	return scanAuditExport(db.DB.QueryRowContext(ctx,
+		`SELECT `+auditExportColumns+` FROM audit_exports WHERE id = $1 AND tenant_id = $2`, exportID, tenantID))
+}
+
+// StartAuditExportWorker runs queued export jobs until ctx is cancelled. Jobs are
+// claimed with SKIP LOCKED, so every replica can run a worker; a job whose worker
+// stopped sending heartbeats is picked up again. AUDIT_EXPORT_DIR must be shared
+// between replicas so any of them can serve the download.
+func StartAuditExportWorker(ctx context.Context) {
+	go func() {
+		ticker := time.NewTicker(auditExportPollInterval)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-ctx.Done():
+				return
+			case <-ticker.C:
+			}
+			for ctx.Err() == nil {
+				job, err := claimAuditExport(ctx)
+				if err != nil {
+					if err != sql.ErrNoRows && ctx.Err() == nil {
+						slog.Error("audit export: failed to claim job", "error", err)
+					}
+					break
+				}
+				runAuditExport(ctx, job)
+			}
+		}
+	}()
+}
+
+func claimAuditExport(ctx context.Context) (*AuditExport, error) {
+	return scanAuditExport(db.DB.QueryRowContext(ctx, `
+		UPDATE audit_exports
+		SET status = 'running', started_at = NOW(), heartbeat_at = NOW()
+		WHERE id = (
+			SELECT id FROM audit_exports
+			WHERE status = 'pending' OR (status = 'running' AND heartbeat_at < $1)
+			ORDER BY created_at ASC
+			FOR UPDATE SKIP LOCKED
+			LIMIT 1
+		)
+		RETURNING `+auditExportColumns, time.Now().Add(-auditExportStaleAfter)))
+}
+
+// runAuditExport writes the job's file next to its final name and renames it once complete
+func runAuditExport(ctx context.Context, job *AuditExport) {
+	start := time.Now()
+	_, ext := AuditExportContentType(job.Format)
+	path := filepath.Join(auditExportDir(), job.ID.String()+"."+ext)
+
+	rows, size, sum, err := writeAuditExportFile(ctx, job, path)
+	if err != nil {
+		os.Remove(path + ".tmp")
+		slog.Error("audit export failed", "export_id", job.ID, "tenant_id", job.TenantID, "error", err)
+		db.DB.ExecContext(context.Background(), `
+			UPDATE audit_exports SET status = 'failed', error = $2, completed_at = NOW() WHERE id = $1
+		`, job.ID, err.Error())
+		return
+	}
+
+	if _, err := db.DB.ExecContext(ctx, `
+		UPDATE audit_exports
+		SET status = 'completed', row_count = $2, size_bytes = $3, sha256 = $4, file_path = $5,
+			completed_at = NOW(), expires_at = $6
+		WHERE id = $1
+	`, job.ID, rows, size, sum, path, time.Now().Add(AuditExportTTL)); err != nil {
+		slog.Error("audit export: failed to record completion", "export_id", job.ID, "error", err)
+		return
+	}
+	slog.Info("audit export completed", "export_id", job.ID, "tenant_id", job.TenantID,
+		"rows", rows, "bytes", size, "duration_ms", time.Since(start).Milliseconds())
+}
+
+type countingWriter struct {
+	w io.Writer
+	n int64
+}
+
+func (c *countingWriter) Write(p []byte) (int, error) {
+	n, err := c.w.Write(p)
+	c.n += int64(n)
+	return n, err
+}
+
+func writeAuditExportFile(ctx context.Context, job *AuditExport, path string) (rows, size int64, sum string, err error) {
+	if err := os.MkdirAll(filepath.Dir(path), 0o700); err != nil {
+		return 0, 0, "", err
+	}
+	f, err := os.OpenFile(path+".tmp", os.O_CREATE|os.O_WRONLY|os.O_TRUNC, 0o600)
+	if err != nil {
+		return 0, 0, "", err
+	}
+	defer f.Close()
+
+	hash := sha256.New()
+	buf := bufio.NewWriterSize(f, 256*1024)
+	out := &countingWriter{w: io.MultiWriter(buf, hash)}
+
+	lastBeat := time.Now()
+	rows, err = WriteAuditExport(ctx, out, job.TenantID, job.Filter, job.Format, func(int64) {
+		if time.Since(lastBeat) >= auditExportHeartbeat {
+			db.DB.ExecContext(ctx, "UPDATE audit_exports SET heartbeat_at = NOW() WHERE id = $1", job.ID)
+			lastBeat = time.Now()
+		}
+	})
+	if err != nil {
+		return 0, 0, "", err
+	}
+	if err := buf.Flush(); err != nil {
+		return 0, 0, "", err
+	}
+	if err := f.Sync(); err != nil {
+		return 0, 0, "", err
+	}
+	if err := os.Rename(path+".tmp", path); err != nil {
+		return 0, 0, "", err
+	}
+	return rows, out.n, hex.EncodeToString(hash.Sum(nil)), nil
+}
+
+// pruneAuditExports deletes expired export files and their jobs, plus failed jobs
+// older than the download window
+func pruneAuditExports(ctx context.Context) (int64, error) {
+	rows, err := db.DB.QueryContext(ctx, `
+		DELETE FROM audit_exports
+		WHERE expires_at < NOW() OR (status = 'failed' AND created_at < $1)
+		RETURNING COALESCE(file_path, '')
+	`, time.Now().Add(-AuditExportTTL))
+	if err != nil {
+		return 0, err
+	}
+	defer rows.Close()
+
+	var n int64
+	for rows.Next() {
+		var path string
+		if rows.Scan(&path) == nil && path != "" {
+			if err := os.Remove(path); err != nil && !os.IsNotExist(err) {
+				slog.Warn("audit export: failed to remove file", "path", path, "error", err)
+			}
+		}
+		n++
+	}
+	return n, rows.Err()
+}
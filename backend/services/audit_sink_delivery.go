@@ -0,0 +1,354 @@
+package services
+
+import (
+	"bytes"
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"crypto/tls"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/url"
+	"os"
+	"strconv"
+	"strings"
+	"syscall"
+	"time"
+)
+
+// Audit sink delivery: events are rendered as JSON or CEF and sent over the sink's
+// transport. Every connection goes through sinkDialer, which refuses loopback and
+// private addresses unless AUDIT_SINK_ALLOW_INSECURE is set (local development).
+
+const (
+	// HeaderSinkSignature carries "t=<unix seconds>,v1=<hex HMAC-SHA256 of "<t>.<body>">"
+	HeaderSinkSignature = "X-Zaps-Signature"
+
+	auditSinkTimeout = 10 * time.Second
+
+	// RFC 5424 facility 13 (log audit)
+	syslogFacilityAudit = 13
+)
+
+// auditSinkInsecure allows plain HTTP, unverified TLS and private addresses
+func auditSinkInsecure() bool {
+	return os.Getenv("AUDIT_SINK_ALLOW_INSECURE") == "true"
+}
+
+// sinkDialer connects to sink endpoints, rejecting internal addresses after DNS
+// resolution so a tenant cannot point a sink at the gateway's own network
+func sinkDialer() *net.Dialer {
+	d := &net.Dialer{Timeout: auditSinkTimeout}
+	if auditSinkInsecure() {
+		return d
+	}
+	d.Control = func(_, address string, _ syscall.RawConn) error {
+		host, _, err := net.SplitHostPort(address)
+		if err != nil {
+			return err
+		}
+		ip := net.ParseIP(host)
+		if ip == nil || ip.IsLoopback() || ip.IsPrivate() || ip.IsLinkLocalUnicast() ||
+			ip.IsLinkLocalMulticast() || ip.IsUnspecified() || ip.IsMulticast() {
+			return fmt.Errorf("address %s is not allowed for audit sinks", host)
+		}
+		return nil
+	}
+	return d
+}
+
+func sinkTLSConfig(s *AuditSink, serverName string) *tls.Config {
+	return &tls.Config{
+		ServerName:         serverName,
+		MinVersion:         tls.VersionTLS12,
+		InsecureSkipVerify: s.Config.TLSSkipVerify && auditSinkInsecure(),
+	}
+}
+
+func sinkHTTPClient(s *AuditSink) *http.Client {
+	transport := &http.Transport{
+		DialContext:         sinkDialer().DialContext,
+		TLSHandshakeTimeout: auditSinkTimeout,
+	}
+	if u, err := url.Parse(s.Endpoint); err == nil {
+		transport.TLSClientConfig = sinkTLSConfig(s, u.Hostname())
+	}
+	return &http.Client{
+		Timeout:   auditSinkTimeout,
+		Transport: transport,
+		// A redirect could point anywhere; sinks must name their final URL
+		CheckRedirect: func(*http.Request, []*http.Request) error { return http.ErrUseLastResponse },
+	}
+}
+
+// deliverToSink sends events over the sink's transport. secret is the decrypted
+// webhook secret or HEC token.
+func deliverToSink(ctx context.Context, s *AuditSink, secret string, events []AuditRecord) error {
+	if len(events) == 0 {
+		return nil
+	}
+	switch s.Type {
+	case AuditSinkWebhook:
+		return deliverWebhook(ctx, s, secret, events)
+	case AuditSinkSyslog:
+		return deliverSyslog(ctx, s, events)
+	case AuditSinkSplunkHEC:
+		return deliverSplunkHEC(ctx, s, secret, events)
+	}
+	return fmt.Errorf("unknown sink type %q", s.Type)
+}
+
+// -- Webhook --
+
+// SignSinkPayload returns the X-Zaps-Signature value for body sent at ts
+func SignSinkPayload(secret string, ts time.Time, body []byte) string {
+	t := strconv.FormatInt(ts.Unix(), 10)
+	mac := hmac.New(sha256.New, []byte(secret))
+	mac.Write([]byte(t + "."))
+	mac.Write(body)
+	return "t=" + t + ",v1=" + hex.EncodeToString(mac.Sum(nil))
+}
+
+func deliverWebhook(ctx context.Context, s *AuditSink, secret string, events []AuditRecord) error {
+	var body []byte
+	contentType := "application/json"
+	if s.Format == AuditSinkFormatCEF {
+		// One CEF record per line
+		var lines []string
+		for i := range events {
+			lines = append(lines, formatCEF(&events[i]))
+		}
+		body = []byte(strings.Join(lines, "\n") + "\n")
+		contentType = "text/plain; charset=utf-8"
+	} else {
+		var err error
+		body, err = json.Marshal(map[string]interface{}{
+			"sink_id":   s.ID,
+			"tenant_id": s.TenantID,
+			"events":    events,
+		})
+		if err != nil {
+			return err
+		}
+	}
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, s.Endpoint, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", contentType)
+	req.Header.Set("User-Agent", "Zaps.ai-Audit/2.0")
+	req.Header.Set(HeaderSinkSignature, SignSinkPayload(secret, time.Now(), body))
+	return doSinkRequest(s, req)
+}
+
+func doSinkRequest(s *AuditSink, req *http.Request) error {
+	resp, err := sinkHTTPClient(s).Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	snippet, _ := io.ReadAll(io.LimitReader(resp.Body, 512))
+	if resp.StatusCode < 200 || resp.StatusCode >= 300 {
+		return fmt.Errorf("endpoint returned HTTP %d: %s", resp.StatusCode, strings.TrimSpace(string(snippet)))
+	}
+	return nil
+}
+
+// -- Splunk HEC --
+
+func deliverSplunkHEC(ctx context.Context, s *AuditSink, token string, events []AuditRecord) error {
+	host, _ := os.Hostname()
+	sourceType := s.Config.SourceType
+	if sourceType == "" {
+		sourceType = "zaps:audit"
+		if s.Format == AuditSinkFormatCEF {
+			sourceType = "cef"
+		}
+	}
+
+	// HEC accepts a batch as concatenated event objects
+	var body bytes.Buffer
+	for i := range events {
+		e := &events[i]
+		var event interface{} = e
+		if s.Format == AuditSinkFormatCEF {
+			event = formatCEF(e)
+		}
+		obj := map[string]interface{}{
+			"time":       float64(e.CreatedAt.UnixMicro()) / 1e6,
+			"host":       host,
+			"source":     "zaps",
+			"sourcetype": sourceType,
+			"event":      event,
+		}
+		if s.Config.Index != "" {
+			obj["index"] = s.Config.Index
+		}
+		line, err := json.Marshal(obj)
+		if err != nil {
+			return err
+		}
+		body.Write(line)
+		body.WriteByte('\n')
+	}
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, s.Endpoint, &body)
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("Authorization", "Splunk "+token)
+	return doSinkRequest(s, req)
+}
+
+// -- Syslog --
+
+func deliverSyslog(ctx context.Context, s *AuditSink, events []AuditRecord) error {
+	u, err := url.Parse(s.Endpoint)
+	if err != nil {
+		return err
+	}
+
+	dialer := sinkDialer()
+	var conn net.Conn
+	if u.Scheme == "tls" {
+		conn, err = (&tls.Dialer{NetDialer: dialer, Config: sinkTLSConfig(s, u.Hostname())}).DialContext(ctx, "tcp", u.Host)
+	} else {
+		conn, err = dialer.DialContext(ctx, "tcp", u.Host)
+	}
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+	conn.SetDeadline(time.Now().Add(auditSinkTimeout))
+
+	host, _ := os.Hostname()
+	appName := s.Config.AppName
+	if appName == "" {
+		appName = "zaps"
+	}
+
+	// Octet-counting framing (RFC 6587 / RFC 5425): "<length> <message>"
+	var buf bytes.Buffer
+	for i := range events {
+		msg, err := formatSyslog(s, &events[i], host, appName)
+		if err != nil {
+			return err
+		}
+		fmt.Fprintf(&buf, "%d %s", len(msg), msg)
+	}
+	_, err = conn.Write(buf.Bytes())
+	return err
+}
+
+// formatSyslog renders an RFC 5424 message whose MSG is the event JSON or CEF record
+func formatSyslog(s *AuditSink, e *AuditRecord, host, appName string) (string, error) {
+	severity := 6 // informational
+	switch cefSeverity(e.EventType) {
+	case 7:
+		severity = 4 // warning
+	case 5:
+		severity = 5 // notice
+	}
+
+	msg := formatCEF(e)
+	if s.Format != AuditSinkFormatCEF {
+		raw, err := json.Marshal(e)
+		if err != nil {
+			return "", err
+		}
+		msg = string(raw)
+	}
+
+	// No structured data: tenant and seq are in MSG
+	return fmt.Sprintf("<%d>1 %s %s %s - %s - %s",
+		syslogFacilityAudit*8+severity,
+		e.CreatedAt.UTC().Format("2006-01-02T15:04:05.000000Z"),
+		syslogHeaderField(host, 255),
+		syslogHeaderField(appName, 48),
+		syslogHeaderField(e.EventType, 32),
+		msg), nil
+}
+
+// syslogHeaderField limits a header field to printable ASCII without spaces, or "-"
+func syslogHeaderField(s string, max int) string {
+	var b strings.Builder
+	for _, r := range s {
+		if r > 32 && r < 127 && b.Len() < max {
+			b.WriteRune(r)
+		}
+	}
+	if b.Len() == 0 {
+		return "-"
+	}
+	return b.String()
+}
+
+// -- CEF --
+
+// cefSeverity maps an event type to a CEF severity (0-10)
+func cefSeverity(eventType string) int {
+	t := strings.ToUpper(eventType)
+	for _, marker := range []string{"FAIL", "DENIED", "BLOCKED", "VIOLATION", "EXCEEDED", "REJECT"} {
+		if strings.Contains(t, marker) {
+			return 7
+		}
+	}
+	for _, marker := range []string{"REVOKE", "DELETE", "DISABLE", "ROTATE", "PASSWORD", "2FA"} {
+		if strings.Contains(t, marker) {
+			return 5
+		}
+	}
+	return 3
+}
+
+var (
+	cefHeaderEscaper    = strings.NewReplacer(`\`, `\\`, `|`, `\|`, "\r", " ", "\n", " ")
+	cefExtensionEscaper = strings.NewReplacer(`\`, `\\`, `=`, `\=`, "\r", `\r`, "\n", `\n`)
+)
+
+// formatCEF renders an event as an ArcSight Common Event Format record
+func formatCEF(e *AuditRecord) string {
+	name := strings.ToLower(strings.ReplaceAll(e.EventType, "_", " "))
+	header := []string{
+		"CEF:0", "Zaps.ai", "Gateway", "2.0",
+		cefHeaderEscaper.Replace(e.EventType),
+		cefHeaderEscaper.Replace(name),
+		strconv.Itoa(cefSeverity(e.EventType)),
+	}
+
+	ext := [][2]string{
+		{"rt", strconv.FormatInt(e.CreatedAt.UnixMilli(), 10)},
+		{"externalId", strconv.FormatInt(e.Seq, 10)},
+		{"cs1Label", "tenantId"}, {"cs1", e.TenantID},
+	}
+	if e.APIKeyID != nil {
+		ext = append(ext, [2]string{"cs2Label", "apiKeyId"}, [2]string{"cs2", *e.APIKeyID})
+	}
+	if e.RowHash != "" {
+		ext = append(ext, [2]string{"cs3Label", "rowHash"}, [2]string{"cs3", e.RowHash})
+	}
+	if e.UserID != nil {
+		ext = append(ext, [2]string{"suid", *e.UserID})
+	}
+	if e.IPAddress != "" {
+		ext = append(ext, [2]string{"src", e.IPAddress})
+	}
+	if e.UserAgent != "" {
+		ext = append(ext, [2]string{"requestClientApplication", e.UserAgent})
+	}
+	if len(e.EventData) > 0 {
+		ext = append(ext, [2]string{"msg", string(e.EventData)})
+	}
+
+	parts := make([]string, 0, len(ext))
+	for _, kv := range ext {
+		parts = append(parts, kv[0]+"="+cefExtensionEscaper.Replace(kv[1]))
+	}
+	return strings.Join(header, "|") + "|" + strings.Join(parts, " ")
+}
@@ -0,0 +1,333 @@
+package services
+
+import (
+	"bufio"
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"regexp"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/DATA-DOG/go-sqlmock"
+	"github.com/google/uuid"
+)
+
+var testSinkTenant = uuid.MustParse("22222222-2222-2222-2222-222222222222")
+
+func testAuditRecords() []AuditRecord {
+	keyID := "33333333-3333-3333-3333-333333333333"
+	created := time.Date(2026, 3, 14, 9, 26, 53, 589793000, time.UTC)
+	return []AuditRecord{
+		{
+			ID: 41, Seq: 7, TenantID: testSinkTenant.String(), APIKeyID: &keyID,
+			EventType: "API_KEY_CREATED", EventData: json.RawMessage(`{"name":"ci"}`),
+			IPAddress: "203.0.113.9", CreatedAt: created,
+		},
+		{
+			ID: 42, Seq: 8, TenantID: testSinkTenant.String(),
+			EventType: "LOGIN_FAILED", EventData: json.RawMessage(`{"reason":"a=b|c\\d\ne"}`),
+			UserAgent: "curl/8.0 | x=y", CreatedAt: created.Add(time.Second),
+		},
+	}
+}
+
+// newSinkServer starts a local TLS endpoint, allowing sinks to reach it
+func newSinkServer(t *testing.T, handler http.HandlerFunc) *httptest.Server {
+	t.Helper()
+	t.Setenv("AUDIT_SINK_ALLOW_INSECURE", "true")
+	srv := httptest.NewTLSServer(handler)
+	t.Cleanup(srv.Close)
+	return srv
+}
+
+func TestWebhookSinkSignsPayload(t *testing.T) {
+	const secret = "whsec_test"
+	var body []byte
+	var header http.Header
+	srv := newSinkServer(t, func(w http.ResponseWriter, r *http.Request) {
+		body, _ = io.ReadAll(r.Body)
+		header = r.Header.Clone()
+	})
+
+	s := &AuditSink{ID: uuid.New(), TenantID: testSinkTenant, Type: AuditSinkWebhook, Format: AuditSinkFormatJSON,
+		Endpoint: srv.URL, Config: AuditSinkConfig{TLSSkipVerify: true}}
+	if err := deliverToSink(context.Background(), s, secret, testAuditRecords()); err != nil {
+		t.Fatal(err)
+	}
+
+	sig := header.Get(HeaderSinkSignature)
+	m := regexp.MustCompile(`^t=(\d+),v1=([0-9a-f]{64})$`).FindStringSubmatch(sig)
+	if m == nil {
+		t.Fatalf("malformed signature %q", sig)
+	}
+	ts, _ := strconv.ParseInt(m[1], 10, 64)
+	if d := time.Since(time.Unix(ts, 0)); d < 0 || d > time.Minute {
+		t.Errorf("signature timestamp %d is not current", ts)
+	}
+	mac := hmac.New(sha256.New, []byte(secret))
+	mac.Write([]byte(m[1] + "."))
+	mac.Write(body)
+	if !hmac.Equal([]byte(m[2]), []byte(hex.EncodeToString(mac.Sum(nil)))) {
+		t.Error("signature does not match the body")
+	}
+	if sig != SignSinkPayload(secret, time.Unix(ts, 0), body) {
+		t.Error("SignSinkPayload disagrees with the delivered signature")
+	}
+
+	var payload struct {
+		SinkID   uuid.UUID     `json:"sink_id"`
+		TenantID uuid.UUID     `json:"tenant_id"`
+		Events   []AuditRecord `json:"events"`
+	}
+	if err := json.Unmarshal(body, &payload); err != nil {
+		t.Fatal(err)
+	}
+	if payload.SinkID != s.ID || payload.TenantID != testSinkTenant || len(payload.Events) != 2 || payload.Events[1].Seq != 8 {
+		t.Errorf("unexpected payload %s", body)
+	}
+	if ct := header.Get("Content-Type"); ct != "application/json" {
+		t.Errorf("Content-Type = %q", ct)
+	}
+}
+
+func TestSplunkHECSinkBody(t *testing.T) {
+	var body []byte
+	var auth string
+	srv := newSinkServer(t, func(w http.ResponseWriter, r *http.Request) {
+		body, _ = io.ReadAll(r.Body)
+		auth = r.Header.Get("Authorization")
+		w.Write([]byte(`{"text":"Success","code":0}`))
+	})
+
+	s := &AuditSink{ID: uuid.New(), TenantID: testSinkTenant, Type: AuditSinkSplunkHEC, Format: AuditSinkFormatCEF,
+		Endpoint: srv.URL + "/services/collector/event", Config: AuditSinkConfig{TLSSkipVerify: true, Index: "security"}}
+	events := testAuditRecords()
+	if err := deliverToSink(context.Background(), s, "hec-token", events); err != nil {
+		t.Fatal(err)
+	}
+
+	if auth != "Splunk hec-token" {
+		t.Errorf("Authorization = %q", auth)
+	}
+
+	// A batch is concatenated event objects, one per line
+	lines := strings.Split(strings.TrimSuffix(string(body), "\n"), "\n")
+	if len(lines) != len(events) {
+		t.Fatalf("got %d HEC events, want %d:\n%s", len(lines), len(events), body)
+	}
+	for i, line := range lines {
+		var obj struct {
+			Time       float64 `json:"time"`
+			Source     string  `json:"source"`
+			SourceType string  `json:"sourcetype"`
+			Index      string  `json:"index"`
+			Event      string  `json:"event"`
+		}
+		if err := json.Unmarshal([]byte(line), &obj); err != nil {
+			t.Fatalf("line %d: %v", i, err)
+		}
+		if obj.Source != "zaps" || obj.SourceType != "cef" || obj.Index != "security" {
+			t.Errorf("line %d: unexpected metadata %s", i, line)
+		}
+		if want := float64(events[i].CreatedAt.UnixMicro()) / 1e6; obj.Time != want {
+			t.Errorf("line %d: time = %f, want %f", i, obj.Time, want)
+		}
+		if obj.Event != formatCEF(&events[i]) {
+			t.Errorf("line %d: event = %q", i, obj.Event)
+		}
+	}
+}
+
+func TestSinkRejectsPrivateAddresses(t *testing.T) {
+	srv := httptest.NewTLSServer(http.HandlerFunc(func(http.ResponseWriter, *http.Request) {}))
+	defer srv.Close()
+	t.Setenv("AUDIT_SINK_ALLOW_INSECURE", "")
+
+	s := &AuditSink{Type: AuditSinkWebhook, Format: AuditSinkFormatJSON, Endpoint: srv.URL}
+	err := deliverToSink(context.Background(), s, "secret", testAuditRecords())
+	if err == nil || !strings.Contains(err.Error(), "not allowed for audit sinks") {
+		t.Errorf("expected loopback endpoint to be refused, got %v", err)
+	}
+}
+
+// readOctetCounted splits an RFC 6587 octet-counted stream into messages
+func readOctetCounted(r *bufio.Reader) ([]string, error) {
+	var msgs []string
+	for {
+		prefix, err := r.ReadString(' ')
+		if err == io.EOF && prefix == "" {
+			return msgs, nil
+		}
+		if err != nil {
+			return msgs, fmt.Errorf("reading frame length: %w", err)
+		}
+		n, err := strconv.Atoi(strings.TrimSuffix(prefix, " "))
+		if err != nil {
+			return msgs, fmt.Errorf("bad frame length %q", prefix)
+		}
+		msg := make([]byte, n)
+		if _, err := io.ReadFull(r, msg); err != nil {
+			return msgs, fmt.Errorf("reading %d-byte frame: %w", n, err)
+		}
+		msgs = append(msgs, string(msg))
+	}
+}
+
+func TestSyslogSinkFraming(t *testing.T) {
+	t.Setenv("AUDIT_SINK_ALLOW_INSECURE", "true")
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ln.Close()
+
+	type result struct {
+		msgs []string
+		err  error
+	}
+	received := make(chan result, 1)
+	go func() {
+		conn, err := ln.Accept()
+		if err != nil {
+			received <- result{err: err}
+			return
+		}
+		defer conn.Close()
+		msgs, err := readOctetCounted(bufio.NewReader(conn))
+		received <- result{msgs, err}
+	}()
+
+	s := &AuditSink{Type: AuditSinkSyslog, Format: AuditSinkFormatCEF, Endpoint: "tcp://" + ln.Addr().String(),
+		Config: AuditSinkConfig{AppName: "zaps gateway"}}
+	events := testAuditRecords()
+	if err := deliverToSink(context.Background(), s, "", events); err != nil {
+		t.Fatal(err)
+	}
+
+	var msgs []string
+	select {
+	case r := <-received:
+		if r.err != nil {
+			t.Fatal(r.err)
+		}
+		msgs = r.msgs
+	case <-time.After(5 * time.Second):
+		t.Fatal("timed out waiting for syslog messages")
+	}
+	if len(msgs) != len(events) {
+		t.Fatalf("got %d messages, want %d", len(msgs), len(events))
+	}
+
+	// <PRI>VERSION SP TIMESTAMP SP HOSTNAME SP APP-NAME SP PROCID SP MSGID SP SD SP MSG
+	header := regexp.MustCompile(`^<(\d+)>1 (\S+) \S+ (\S+) - (\S+) - (.*)$`)
+	wantPRI := []int{syslogFacilityAudit*8 + 6, syslogFacilityAudit*8 + 4} // informational, warning
+	for i, msg := range msgs {
+		m := header.FindStringSubmatch(msg)
+		if m == nil {
+			t.Fatalf("message %d is not RFC 5424: %q", i, msg)
+		}
+		if m[1] != strconv.Itoa(wantPRI[i]) {
+			t.Errorf("message %d: PRI = %s, want %d", i, m[1], wantPRI[i])
+		}
+		if ts, err := time.Parse(time.RFC3339Nano, m[2]); err != nil || !ts.Equal(events[i].CreatedAt) {
+			t.Errorf("message %d: timestamp %q", i, m[2])
+		}
+		if m[3] != "zapsgateway" {
+			t.Errorf("message %d: APP-NAME = %q", i, m[3])
+		}
+		if m[4] != events[i].EventType {
+			t.Errorf("message %d: MSGID = %q", i, m[4])
+		}
+		if m[5] != formatCEF(&events[i]) {
+			t.Errorf("message %d: MSG = %q", i, m[5])
+		}
+	}
+}
+
+func TestFormatCEFEscaping(t *testing.T) {
+	e := testAuditRecords()[1]
+	e.EventType = `LOGIN|FAILED\X`
+	got := formatCEF(&e)
+
+	wantHeader := `CEF:0|Zaps.ai|Gateway|2.0|LOGIN\|FAILED\\X|login\|failed\\x|7|`
+	if !strings.HasPrefix(got, wantHeader) {
+		t.Errorf("header:\n got %q\nwant prefix %q", got, wantHeader)
+	}
+	if strings.ContainsAny(got, "\r\n") {
+		t.Errorf("record spans lines: %q", got)
+	}
+
+	ext := strings.TrimPrefix(got, wantHeader)
+	for _, want := range []string{
+		`rt=` + strconv.FormatInt(e.CreatedAt.UnixMilli(), 10),
+		`externalId=8`,
+		`cs1Label=tenantId cs1=` + testSinkTenant.String(),
+		`requestClientApplication=curl/8.0 | x\=y`,
+		// Pipes are literal in extensions; backslashes, equals signs and newlines are escaped
+		`msg={"reason":"a\=b|c\\\\d\\ne"}`,
+	} {
+		if !strings.Contains(ext, want) {
+			t.Errorf("extension missing %q:\n%s", want, ext)
+		}
+	}
+}
+
+func TestAuditSinkDeadLettersAfterMaxAttempts(t *testing.T) {
+	mock := newMockDB(t)
+	var calls int
+	srv := newSinkServer(t, func(w http.ResponseWriter, r *http.Request) {
+		calls++
+		http.Error(w, "collector unavailable", http.StatusServiceUnavailable)
+	})
+
+	s := &AuditSink{ID: uuid.New(), TenantID: testSinkTenant, Type: AuditSinkWebhook, Format: AuditSinkFormatJSON,
+		Endpoint: srv.URL, Config: AuditSinkConfig{TLSSkipVerify: true}, CursorSeq: 6}
+
+	auditRows := func() *sqlmock.Rows {
+		rows := sqlmock.NewRows([]string{"id", "seq", "user_id", "api_key_id", "event_type", "event_data",
+			"ip_address", "user_agent", "created_at", "row_hash"})
+		for _, e := range testAuditRecords() {
+			rows.AddRow(e.ID, e.Seq, nil, e.APIKeyID, e.EventType, []byte(e.EventData), e.IPAddress, e.UserAgent, e.CreatedAt, nil)
+		}
+		return rows
+	}
+	deliveryErr := "endpoint returned HTTP 503: collector unavailable"
+
+	// Attempts before the last one back off
+	for attempt := 0; attempt < AuditSinkMaxAttempts-1; attempt++ {
+		s.Attempts = attempt
+		mock.ExpectQuery(`FROM audit_logs`).WithArgs(testSinkTenant, int64(6), auditSinkBatchSize).WillReturnRows(auditRows())
+		mock.ExpectExec(`UPDATE audit_sinks\s+SET attempts = attempts \+ 1`).
+			WithArgs(s.ID, sqlmock.AnyArg(), deliveryErr).WillReturnResult(sqlmock.NewResult(0, 1))
+		runAuditSink(context.Background(), s)
+	}
+
+	// The last attempt moves the batch to the dead letters and the cursor past it
+	s.Attempts = AuditSinkMaxAttempts - 1
+	mock.ExpectQuery(`FROM audit_logs`).WithArgs(testSinkTenant, int64(6), auditSinkBatchSize).WillReturnRows(auditRows())
+	mock.ExpectBegin()
+	mock.ExpectExec(`INSERT INTO audit_sink_dead_letters`).
+		WithArgs(s.ID, testSinkTenant, int64(7), int64(8), sqlmock.AnyArg(), AuditSinkMaxAttempts, deliveryErr).
+		WillReturnResult(sqlmock.NewResult(1, 1))
+	mock.ExpectExec(`UPDATE audit_sinks SET cursor_seq = \$2, attempts = 0`).
+		WithArgs(s.ID, int64(8), int64(6), deliveryErr).WillReturnResult(sqlmock.NewResult(0, 1))
+	mock.ExpectCommit()
+	runAuditSink(context.Background(), s)
+
+	if calls != AuditSinkMaxAttempts {
+		t.Errorf("endpoint called %d times, want %d", calls, AuditSinkMaxAttempts)
+	}
+	if s.CursorSeq != 8 || s.Attempts != 0 {
+		t.Errorf("cursor = %d, attempts = %d after dead-lettering", s.CursorSeq, s.Attempts)
+	}
+}
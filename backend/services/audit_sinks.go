@@ -0,0 +1,564 @@
+package services
+
+import (
+	"context"
+	"crypto/rand"
+	"database/sql"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"log/slog"
+	"net/url"
+	"os"
+	"strings"
+	"sync"
+	"time"
+
+	"zaps/db"
+
+	"github.com/google/uuid"
+	"github.com/redis/go-redis/v9"
+)
+
+// Audit sinks forward a tenant's audit events to its SIEM. Each sink keeps a cursor on
+// the tenant's audit chain (audit_logs.seq) and a dispatcher on every replica delivers
+// whatever is past it; a per-sink Redis lock keeps replicas from sending a batch twice.
+// A failing batch is retried with backoff and, after AuditSinkMaxAttempts, moved to
+// audit_sink_dead_letters so the sink can move on.
+
+const (
+	AuditSinkWebhook   = "webhook"
+	AuditSinkSyslog    = "syslog"
+	AuditSinkSplunkHEC = "splunk_hec"
+
+	AuditSinkFormatJSON = "json"
+	AuditSinkFormatCEF  = "cef"
+
+	// AuditSinkMaxAttempts is how often a batch is tried before it is dead-lettered
+	AuditSinkMaxAttempts = 8
+
+	auditSinkBatchSize     = 100
+	auditSinkMaxBatches    = 10 // Per sink per poll, so one busy tenant cannot starve the rest
+	auditSinkPollInterval  = 2 * time.Second
+	auditSinkBaseBackoff   = 5 * time.Second
+	auditSinkMaxBackoff    = 10 * time.Minute
+	auditSinkWorkers       = 8
+	auditSinkLockPrefix    = "audit_sink:lock:"
+	auditSinkMaxSinks      = 10 // Per tenant
+	auditSinkDeadLetterMax = 100
+)
+
+// AuditSinkConfig holds type-specific settings
+type AuditSinkConfig struct {
+	EventTypes    []string `json:"event_types,omitempty"`     // Only forward these types (all when empty)
+	TLSSkipVerify bool     `json:"tls_skip_verify,omitempty"` // Honoured only with AUDIT_SINK_ALLOW_INSECURE
+	Index         string   `json:"index,omitempty"`           // Splunk HEC
+	SourceType    string   `json:"sourcetype,omitempty"`      // Splunk HEC
+	AppName       string   `json:"app_name,omitempty"`        // Syslog APP-NAME
+}
+
+// AuditSink is a tenant's audit forwarding destination
+type AuditSink struct {
+	ID              uuid.UUID       `json:"id"`
+	TenantID        uuid.UUID       `json:"-"`
+	Name            string          `json:"name"`
+	Type            string          `json:"type"`
+	Format          string          `json:"format"`
+	Endpoint        string          `json:"endpoint"`
+	Secret          string          `json:"secret,omitempty"` // Write-only, except a generated webhook secret returned on create
+	HasSecret       bool            `json:"has_secret"`
+	Config          AuditSinkConfig `json:"config"`
+	Enabled         bool            `json:"enabled"`
+	CursorSeq       int64           `json:"cursor_seq"`
+	Attempts        int             `json:"attempts"`
+	NextAttemptAt   time.Time       `json:"next_attempt_at"`
+	LastDeliveredAt *time.Time      `json:"last_delivered_at,omitempty"`
+	LastError       *string         `json:"last_error,omitempty"`
+	DeadLetters     int             `json:"dead_letters"`
+	CreatedAt       time.Time       `json:"created_at"`
+
+	secretEncrypted sql.NullString
+}
+
+// AuditSinkDeadLetter is a batch that could not be delivered
+type AuditSinkDeadLetter struct {
+	ID        int64     `json:"id"`
+	FirstSeq  int64     `json:"first_seq"`
+	LastSeq   int64     `json:"last_seq"`
+	Events    int       `json:"events"`
+	Attempts  int       `json:"attempts"`
+	Error     *string   `json:"error,omitempty"`
+	CreatedAt time.Time `json:"created_at"`
+}
+
+const auditSinkColumns = `s.id, s.tenant_id, s.name, s.type, s.format, s.endpoint, s.secret_encrypted, s.config,
+	s.enabled, s.cursor_seq, s.attempts, s.next_attempt_at, s.last_delivered_at, s.last_error, s.created_at,
+	(SELECT COUNT(*) FROM audit_sink_dead_letters d WHERE d.sink_id = s.id)`
+
+func scanAuditSink(row interface{ Scan(...interface{}) error }) (*AuditSink, error) {
+	s := &AuditSink{}
+	var config []byte
+	err := row.Scan(&s.ID, &s.TenantID, &s.Name, &s.Type, &s.Format, &s.Endpoint, &s.secretEncrypted, &config,
+		&s.Enabled, &s.CursorSeq, &s.Attempts, &s.NextAttemptAt, &s.LastDeliveredAt, &s.LastError, &s.CreatedAt,
+		&s.DeadLetters)
+	if err != nil {
+		return nil, err
+	}
+	s.HasSecret = s.secretEncrypted.Valid && s.secretEncrypted.String != ""
+	json.Unmarshal(config, &s.Config)
+	return s, nil
+}
+
+// ListAuditSinks returns a tenant's sinks
+func ListAuditSinks(ctx context.Context, tenantID uuid.UUID) ([]*AuditSink, error) {
+	rows, err := db.DB.QueryContext(ctx, `SELECT `+auditSinkColumns+` FROM audit_sinks s WHERE s.tenant_id = $1 ORDER BY s.created_at ASC`, tenantID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	sinks := []*AuditSink{}
+	for rows.Next() {
+		s, err := scanAuditSink(rows)
+		if err != nil {
+			return nil, err
+		}
+		sinks = append(sinks, s)
+	}
+	return sinks, rows.Err()
+}
+
+// GetAuditSink loads one of a tenant's sinks (sql.ErrNoRows if it does not exist)
+func GetAuditSink(ctx context.Context, tenantID uuid.UUID, id string) (*AuditSink, error) {
+	sinkID, err := uuid.Parse(id)
+	if err != nil {
+		return nil, sql.ErrNoRows
+	}
+	return scanAuditSink(db.DB.QueryRowContext(ctx,
+		`SELECT `+auditSinkColumns+` FROM audit_sinks s WHERE s.id = $1 AND s.tenant_id = $2`, sinkID, tenantID))
+}
+
+// validate normalises the sink and checks its endpoint against the transport
+func (s *AuditSink) validate() error {
+	s.Name = strings.TrimSpace(s.Name)
+	if s.Name == "" || len(s.Name) > 100 {
+		return fmt.Errorf("name is required (max 100 characters)")
+	}
+	if s.Format == "" {
+		s.Format = AuditSinkFormatJSON
+	}
+	if s.Format != AuditSinkFormatJSON && s.Format != AuditSinkFormatCEF {
+		return fmt.Errorf("format must be json or cef")
+	}
+
+	u, err := url.Parse(s.Endpoint)
+	if err != nil || u.Host == "" {
+		return fmt.Errorf("endpoint must be an absolute URL")
+	}
+	switch s.Type {
+	case AuditSinkWebhook, AuditSinkSplunkHEC:
+		if u.Scheme != "https" && !(u.Scheme == "http" && auditSinkInsecure()) {
+			return fmt.Errorf("endpoint must use https")
+		}
+	case AuditSinkSyslog:
+		if u.Scheme != "tls" && u.Scheme != "tcp" {
+			return fmt.Errorf("syslog endpoint must be tls://host:port or tcp://host:port")
+		}
+		if u.Port() == "" {
+			return fmt.Errorf("syslog endpoint needs a port")
+		}
+	default:
+		return fmt.Errorf("type must be webhook, syslog or splunk_hec")
+	}
+	if u.User != nil {
+		return fmt.Errorf("endpoint must not contain credentials")
+	}
+	return nil
+}
+
+// SaveAuditSink creates a sink (ID nil) or updates one. A new sink starts at the
+// tenant's current chain head, so only events from now on are forwarded. An empty
+// Secret on update keeps the stored one; a new webhook without a secret gets a
+// generated one, returned in s.Secret.
+func SaveAuditSink(ctx context.Context, tenantID uuid.UUID, s *AuditSink) error {
+	if err := s.validate(); err != nil {
+		return err
+	}
+	if s.Type == AuditSinkSplunkHEC && s.Secret == "" && s.ID == uuid.Nil {
+		return fmt.Errorf("secret (HEC token) is required")
+	}
+
+	generated := ""
+	if s.Type == AuditSinkWebhook && s.Secret == "" && s.ID == uuid.Nil {
+		buf := make([]byte, 32)
+		if _, err := rand.Read(buf); err != nil {
+			return err
+		}
+		generated = "whsec_" + hex.EncodeToString(buf)
+		s.Secret = generated
+	}
+
+	var secret sql.NullString
+	if s.Secret != "" {
+		encrypted, err := EncryptTenantSecret(ctx, tenantID, s.Secret)
+		if err != nil {
+			return fmt.Errorf("failed to encrypt secret: %w", err)
+		}
+		secret = sql.NullString{String: encrypted, Valid: true}
+	}
+	config, err := json.Marshal(s.Config)
+	if err != nil {
+		return err
+	}
+
+	if s.ID == uuid.Nil {
+		var count int
+		if err := db.DB.QueryRowContext(ctx, "SELECT COUNT(*) FROM audit_sinks WHERE tenant_id = $1", tenantID).Scan(&count); err != nil {
+			return err
+		}
+		if count >= auditSinkMaxSinks {
+			return fmt.Errorf("a tenant can have at most %d audit sinks", auditSinkMaxSinks)
+		}
+		err = db.DB.QueryRowContext(ctx, `
+			INSERT INTO audit_sinks (tenant_id, name, type, format, endpoint, secret_encrypted, config, enabled, cursor_seq)
+			VALUES ($1, $2, $3, $4, $5, $6, $7, $8,
+				COALESCE((SELECT seq FROM audit_chain_heads WHERE tenant_id = $1), 0))
+			RETURNING id
+		`, tenantID, s.Name, s.Type, s.Format, s.Endpoint, secret, config, s.Enabled).Scan(&s.ID)
+		s.Secret = generated
+		return err
+	}
+
+	s.Secret = ""
+	res, err := db.DB.ExecContext(ctx, `
+		UPDATE audit_sinks
+		SET name = $3, type = $4, format = $5, endpoint = $6, secret_encrypted = COALESCE($7, secret_encrypted),
+			config = $8, enabled = $9, attempts = 0, next_attempt_at = NOW(), updated_at = NOW()
+		WHERE id = $1 AND tenant_id = $2
+	`, s.ID, tenantID, s.Name, s.Type, s.Format, s.Endpoint, secret, config, s.Enabled)
+	if err != nil {
+		return err
+	}
+	if n, _ := res.RowsAffected(); n == 0 {
+		return sql.ErrNoRows
+	}
+	return nil
+}
+
+// DeleteAuditSink removes a sink and its dead letters
+func DeleteAuditSink(ctx context.Context, tenantID uuid.UUID, id string) (bool, error) {
+	sinkID, err := uuid.Parse(id)
+	if err != nil {
+		return false, nil
+	}
+	res, err := db.DB.ExecContext(ctx, "DELETE FROM audit_sinks WHERE id = $1 AND tenant_id = $2", sinkID, tenantID)
+	if err != nil {
+		return false, err
+	}
+	n, _ := res.RowsAffected()
+	return n > 0, nil
+}
+
+func (s *AuditSink) decryptSecret(ctx context.Context) (string, error) {
+	if !s.HasSecret {
+		return "", nil
+	}
+	return DecryptTenantSecret(ctx, s.TenantID, s.secretEncrypted.String)
+}
+
+// TestAuditSink sends one synthetic AUDIT_SINK_TEST event and reports how long it took
+func TestAuditSink(ctx context.Context, s *AuditSink) (time.Duration, error) {
+	secret, err := s.decryptSecret(ctx)
+	if err != nil {
+		return 0, fmt.Errorf("failed to decrypt secret: %w", err)
+	}
+	data, _ := json.Marshal(map[string]interface{}{"sink_id": s.ID, "message": "Test delivery from Zaps.ai"})
+	event := AuditRecord{
+		TenantID:  s.TenantID.String(),
+		EventType: "AUDIT_SINK_TEST",
+		EventData: data,
+		CreatedAt: time.Now().UTC(),
+	}
+
+	start := time.Now()
+	err = deliverToSink(ctx, s, secret, []AuditRecord{event})
+	return time.Since(start), err
+}
+
+// -- Dead letters --
+
+// ListAuditSinkDeadLetters returns a sink's oldest undelivered batches
+func ListAuditSinkDeadLetters(ctx context.Context, sinkID uuid.UUID) ([]AuditSinkDeadLetter, error) {
+	rows, err := db.DB.QueryContext(ctx, `
+		SELECT id, first_seq, last_seq, jsonb_array_length(events), attempts, error, created_at
+		FROM audit_sink_dead_letters WHERE sink_id = $1 ORDER BY id ASC LIMIT $2
+	`, sinkID, auditSinkDeadLetterMax)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	letters := []AuditSinkDeadLetter{}
+	for rows.Next() {
+		var d AuditSinkDeadLetter
+		if err := rows.Scan(&d.ID, &d.FirstSeq, &d.LastSeq, &d.Events, &d.Attempts, &d.Error, &d.CreatedAt); err != nil {
+			return nil, err
+		}
+		letters = append(letters, d)
+	}
+	return letters, rows.Err()
+}
+
+// RetryAuditSinkDeadLetters resends dead-lettered batches oldest first, deleting each
+// once delivered, and stops at the first failure
+func RetryAuditSinkDeadLetters(ctx context.Context, s *AuditSink) (delivered int, err error) {
+	secret, err := s.decryptSecret(ctx)
+	if err != nil {
+		return 0, fmt.Errorf("failed to decrypt secret: %w", err)
+	}
+	rows, err := db.DB.QueryContext(ctx, `
+		SELECT id, events FROM audit_sink_dead_letters WHERE sink_id = $1 ORDER BY id ASC LIMIT $2
+	`, s.ID, auditSinkDeadLetterMax)
+	if err != nil {
+		return 0, err
+	}
+	type letter struct {
+		id     int64
+		events []AuditRecord
+	}
+	var letters []letter
+	for rows.Next() {
+		var l letter
+		var raw []byte
+		if err := rows.Scan(&l.id, &raw); err != nil {
+			rows.Close()
+			return 0, err
+		}
+		if err := json.Unmarshal(raw, &l.events); err != nil {
+			rows.Close()
+			return 0, err
+		}
+		letters = append(letters, l)
+	}
+	rows.Close()
+
+	for _, l := range letters {
+		if err := deliverToSink(ctx, s, secret, l.events); err != nil {
+			db.DB.ExecContext(ctx, "UPDATE audit_sink_dead_letters SET attempts = attempts + 1, error = $2 WHERE id = $1",
+				l.id, err.Error())
+			return delivered, err
+		}
+		if _, err := db.DB.ExecContext(ctx, "DELETE FROM audit_sink_dead_letters WHERE id = $1", l.id); err != nil {
+			return delivered, err
+		}
+		auditSinkDeliveries.WithLabelValues(s.Type, "delivered").Add(float64(len(l.events)))
+		delivered++
+	}
+	return delivered, nil
+}
+
+// -- Dispatcher --
+
+// StartAuditSinkDispatcher polls for due sinks until ctx is cancelled
+func StartAuditSinkDispatcher(ctx context.Context, rdb *redis.Client) {
+	host, _ := os.Hostname()
+	instanceID := fmt.Sprintf("%s-%s", host, uuid.NewString()[:8])
+
+	go func() {
+		ticker := time.NewTicker(auditSinkPollInterval)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-ctx.Done():
+				return
+			case <-ticker.C:
+				dispatchAuditSinks(ctx, rdb, instanceID)
+			}
+		}
+	}()
+}
+
+func dispatchAuditSinks(ctx context.Context, rdb *redis.Client, instanceID string) {
+	rows, err := db.DB.QueryContext(ctx, `
+		SELECT `+auditSinkColumns+`
+		FROM audit_sinks s
+		WHERE s.enabled = TRUE AND s.next_attempt_at <= NOW()
+			AND s.cursor_seq < COALESCE((SELECT seq FROM audit_chain_heads h WHERE h.tenant_id = s.tenant_id), 0)
+	`)
+	if err != nil {
+		if ctx.Err() == nil {
+			slog.Error("audit sinks: failed to load due sinks", "error", err)
+		}
+		return
+	}
+	var due []*AuditSink
+	for rows.Next() {
+		if s, err := scanAuditSink(rows); err == nil {
+			due = append(due, s)
+		}
+	}
+	rows.Close()
+
+	sem := make(chan struct{}, auditSinkWorkers)
+	var wg sync.WaitGroup
+	for _, s := range due {
+		lockKey := auditSinkLockPrefix + s.ID.String()
+		ok, err := rdb.SetNX(ctx, lockKey, instanceID, 2*auditSinkMaxBatches*auditSinkTimeout).Result()
+		if err != nil || !ok {
+			continue
+		}
+		wg.Add(1)
+		sem <- struct{}{}
+		go func(s *AuditSink) {
+			defer wg.Done()
+			defer func() { <-sem }()
+			defer releaseLockScript.Run(context.Background(), rdb, []string{lockKey}, instanceID)
+			runAuditSink(ctx, s)
+		}(s)
+	}
+	wg.Wait()
+}
+
+// runAuditSink delivers batches past the sink's cursor until it catches up or a batch fails
+func runAuditSink(ctx context.Context, s *AuditSink) {
+	secret, err := s.decryptSecret(ctx)
+	if err != nil {
+		recordAuditSinkFailure(ctx, s, nil, fmt.Errorf("failed to decrypt secret: %w", err))
+		return
+	}
+
+	for i := 0; i < auditSinkMaxBatches && ctx.Err() == nil; i++ {
+		batch, lastSeq, err := loadAuditRecords(ctx, s, auditSinkBatchSize)
+		if err != nil {
+			slog.ErrorContext(ctx, "audit sinks: failed to read audit log", "sink_id", s.ID, "error", err)
+			return
+		}
+		if lastSeq == s.CursorSeq {
+			return
+		}
+
+		deliverCtx, cancel := context.WithTimeout(ctx, auditSinkTimeout)
+		err = deliverToSink(deliverCtx, s, secret, batch)
+		cancel()
+		if err != nil {
+			recordAuditSinkFailure(ctx, s, batch, err)
+			return
+		}
+		auditSinkDeliveries.WithLabelValues(s.Type, "delivered").Add(float64(len(batch)))
+		if err := advanceAuditSink(ctx, s, lastSeq, nil, nil); err != nil {
+			slog.ErrorContext(ctx, "audit sinks: failed to save cursor", "sink_id", s.ID, "error", err)
+			return
+		}
+	}
+}
+
+// loadAuditRecords reads the events after the sink's cursor that pass its filter, and
+// the seq of the last row read (which the cursor moves to, matched or not)
+func loadAuditRecords(ctx context.Context, s *AuditSink, limit int) ([]AuditRecord, int64, error) {
+	rows, err := db.DB.QueryContext(ctx, `
+		SELECT `+auditRecordColumns+`
+		FROM audit_logs
+		WHERE tenant_id = $1 AND seq > $2
+		ORDER BY seq ASC
+		LIMIT $3
+	`, s.TenantID, s.CursorSeq, limit)
+	if err != nil {
+		return nil, 0, err
+	}
+	defer rows.Close()
+
+	filter := map[string]bool{}
+	for _, t := range s.Config.EventTypes {
+		filter[t] = true
+	}
+
+	lastSeq := s.CursorSeq
+	var batch []AuditRecord
+	for rows.Next() {
+		e, err := scanAuditRecord(rows, s.TenantID)
+		if err != nil {
+			return nil, 0, err
+		}
+		lastSeq = e.Seq
+		if len(filter) > 0 && !filter[e.EventType] {
+			continue
+		}
+		batch = append(batch, e)
+	}
+	return batch, lastSeq, rows.Err()
+}
+
+// advanceAuditSink moves the cursor past a batch, optionally dead-lettering it, and
+// resets the retry state
+func advanceAuditSink(ctx context.Context, s *AuditSink, lastSeq int64, deadLetter []AuditRecord, deliveryErr error) error {
+	tx, err := db.DB.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	if len(deadLetter) > 0 {
+		payload, err := json.Marshal(deadLetter)
+		if err != nil {
+			return err
+		}
+		if _, err := tx.ExecContext(ctx, `
+			INSERT INTO audit_sink_dead_letters (sink_id, tenant_id, first_seq, last_seq, events, attempts, error)
+			VALUES ($1, $2, $3, $4, $5, $6, $7)
+		`, s.ID, s.TenantID, deadLetter[0].Seq, deadLetter[len(deadLetter)-1].Seq, payload, s.Attempts+1, deliveryErr.Error()); err != nil {
+			return err
+		}
+	}
+
+	var lastError sql.NullString
+	query := `UPDATE audit_sinks SET cursor_seq = $2, attempts = 0, next_attempt_at = NOW(), updated_at = NOW(), last_error = $4`
+	if len(deadLetter) == 0 {
+		query += `, last_delivered_at = NOW()`
+	} else {
+		lastError = sql.NullString{String: deliveryErr.Error(), Valid: true}
+	}
+	// Compare-and-set on the cursor so a sink deleted or reset meanwhile is left alone
+	res, err := tx.ExecContext(ctx, query+` WHERE id = $1 AND cursor_seq = $3`, s.ID, lastSeq, s.CursorSeq, lastError)
+	if err != nil {
+		return err
+	}
+	if n, _ := res.RowsAffected(); n == 0 {
+		return fmt.Errorf("sink changed during delivery")
+	}
+	if err := tx.Commit(); err != nil {
+		return err
+	}
+	s.CursorSeq = lastSeq
+	s.Attempts = 0
+	return nil
+}
+
+// recordAuditSinkFailure schedules the next attempt with exponential backoff, or
+// dead-letters the batch once it has been tried AuditSinkMaxAttempts times
+func recordAuditSinkFailure(ctx context.Context, s *AuditSink, batch []AuditRecord, deliveryErr error) {
+	slog.WarnContext(ctx, "audit sink delivery failed", "sink_id", s.ID, "tenant_id", s.TenantID,
+		"type", s.Type, "attempt", s.Attempts+1, "error", deliveryErr)
+
+	if len(batch) > 0 && s.Attempts+1 >= AuditSinkMaxAttempts {
+		lastSeq := batch[len(batch)-1].Seq
+		if err := advanceAuditSink(ctx, s, lastSeq, batch, deliveryErr); err != nil {
+			slog.ErrorContext(ctx, "audit sinks: failed to dead-letter batch", "sink_id", s.ID, "error", err)
+			return
+		}
+		auditSinkDeliveries.WithLabelValues(s.Type, "dead_lettered").Add(float64(len(batch)))
+		return
+	}
+
+	auditSinkDeliveries.WithLabelValues(s.Type, "failed").Add(float64(len(batch)))
+	backoff := auditSinkBaseBackoff << s.Attempts
+	if backoff > auditSinkMaxBackoff || backoff <= 0 {
+		backoff = auditSinkMaxBackoff
+	}
+	if _, err := db.DB.ExecContext(ctx, `
+		UPDATE audit_sinks
+		SET attempts = attempts + 1, next_attempt_at = $2, last_error = $3, updated_at = NOW()
+		WHERE id = $1
+	`, s.ID, time.Now().Add(backoff), deliveryErr.Error()); err != nil {
+		slog.ErrorContext(ctx, "audit sinks: failed to record failure", "sink_id", s.ID, "error", err)
+	}
+}
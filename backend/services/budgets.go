@@ -0,0 +1,448 @@
+package services
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+	"log/slog"
+	"math"
+	"time"
+
+	"zaps/db"
+
+	"github.com/google/uuid"
+	"github.com/redis/go-redis/v9"
+)
+
+const (
+	BudgetScopeTenant = "tenant"
+	BudgetScopeAPIKey = "api_key"
+	BudgetScopeUser   = "user"
+
+	BudgetMetricTokens = "tokens"
+	BudgetMetricCost   = "cost_usd"
+
+	BudgetWindowCalendar = "calendar"
+	BudgetWindowRolling  = "rolling"
+
+	BudgetRedisPrefix = "budget:"
+
+	// Completion tokens reserved when the request sets no max_tokens
+	DefaultCompletionReserve = 1024
+)
+
+// Budget limits tokens or spend for a tenant, API key or user over a window
+type Budget struct {
+	ID         uuid.UUID `json:"id"`
+	Scope      string    `json:"scope"`
+	ScopeID    string    `json:"scope_id"`
+	Name       string    `json:"name"`
+	Metric     string    `json:"metric"`
+	HardLimit  float64   `json:"hard_limit"`
+	SoftLimit  *float64  `json:"soft_limit,omitempty"`
+	WindowType string    `json:"window_type"`
+	Period     string    `json:"period"`
+	Enabled    bool      `json:"enabled"`
+}
+
+// BudgetExceededError is returned when a request would cross a hard limit
+type BudgetExceededError struct {
+	Budget Budget
+	Used   float64
+}
+
+func (e *BudgetExceededError) Error() string {
+	return fmt.Sprintf("budget %s exceeded (%s %.6f of %.6f)", e.Budget.ID, e.Budget.Metric, e.Used, e.Budget.HardLimit)
+}
+
+// BudgetReservation holds amounts reserved before an upstream call so they can be settled afterwards
+type BudgetReservation struct {
+	budgets  []Budget
+	windows  []budgetWindow // Counters reserved against, so settling hits the same period
+	reserved []int64
+	Warnings []Budget // Budgets whose soft limit is crossed
+}
+
+// -- Units --
+// Redis counters are integers: tokens, or micro-dollars for cost budgets.
+
+func (b *Budget) toUnits(v float64) int64 {
+	if b.Metric == BudgetMetricCost {
+		return int64(math.Round(v * 1e6))
+	}
+	return int64(math.Round(v))
+}
+
+func (b *Budget) fromUnits(v int64) float64 {
+	if b.Metric == BudgetMetricCost {
+		return float64(v) / 1e6
+	}
+	return float64(v)
+}
+
+func (b *Budget) amount(tokens int, cost float64) int64 {
+	if b.Metric == BudgetMetricCost {
+		return b.toUnits(cost)
+	}
+	return int64(tokens)
+}
+
+// -- Windows --
+
+func periodDuration(period string) time.Duration {
+	switch period {
+	case "day":
+		return 24 * time.Hour
+	case "week":
+		return 7 * 24 * time.Hour
+	default:
+		return 30 * 24 * time.Hour
+	}
+}
+
+// calendarPeriod returns the current period ID and when it ends (UTC)
+func calendarPeriod(period string, now time.Time) (string, time.Time) {
+	now = now.UTC()
+	switch period {
+	case "day":
+		start := time.Date(now.Year(), now.Month(), now.Day(), 0, 0, 0, 0, time.UTC)
+		return start.Format("2006-01-02"), start.AddDate(0, 0, 1)
+	case "week":
+		year, week := now.ISOWeek()
+		offset := (int(now.Weekday()) + 6) % 7 // Monday = 0
+		start := time.Date(now.Year(), now.Month(), now.Day()-offset, 0, 0, 0, 0, time.UTC)
+		return fmt.Sprintf("%d-W%02d", year, week), start.AddDate(0, 0, 7)
+	default:
+		start := time.Date(now.Year(), now.Month(), 1, 0, 0, 0, 0, time.UTC)
+		return start.Format("2006-01"), start.AddDate(0, 1, 0)
+	}
+}
+
+// budgetWindow is the counter key plus the Lua arguments describing a budget's window at one point in time
+type budgetWindow struct {
+	key       string
+	mode      string
+	bucket    int64
+	minBucket int64
+	ttl       int64
+}
+
+func (b *Budget) window(now time.Time) budgetWindow {
+	if b.WindowType == BudgetWindowRolling {
+		hours := int64(periodDuration(b.Period) / time.Hour)
+		bucket := now.Unix() / 3600
+		return budgetWindow{BudgetRedisPrefix + b.ID.String() + ":rolling", "rolling", bucket, bucket - hours + 1, (hours + 1) * 3600}
+	}
+	periodID, end := calendarPeriod(b.Period, now)
+	return budgetWindow{BudgetRedisPrefix + b.ID.String() + ":" + periodID, "calendar", 0, 0, int64(time.Until(end).Seconds()) + 86400}
+}
+
+func budgetWindows(budgets []Budget, now time.Time) []budgetWindow {
+	windows := make([]budgetWindow, len(budgets))
+	for i := range budgets {
+		windows[i] = budgets[i].window(now)
+	}
+	return windows
+}
+
+// budgetScript checks every budget, then applies all increments only if none would be exceeded.
+// KEYS[i] = counter key; ARGV = check flag, then per budget: mode, limit, amount, bucket, minBucket, ttl.
+// Returns {0, used_1, ..., used_n} on success or {i, used_i} for the first exceeded budget.
+var budgetScript = redis.NewScript(`
+local check = ARGV[1] == "1"
+local n = #KEYS
+local used = {}
+for i = 1, n do
+	local base = 1 + (i - 1) * 6
+	local mode = ARGV[base + 1]
+	local limit = tonumber(ARGV[base + 2])
+	local amount = tonumber(ARGV[base + 3])
+	local u = 0
+	if mode == "calendar" then
+		u = tonumber(redis.call("GET", KEYS[i]) or "0")
+	else
+		local minb = tonumber(ARGV[base + 5])
+		local fields = redis.call("HGETALL", KEYS[i])
+		for j = 1, #fields, 2 do
+			if tonumber(fields[j]) < minb then
+				redis.call("HDEL", KEYS[i], fields[j])
+			else
+				u = u + tonumber(fields[j + 1])
+			end
+		end
+	end
+	if check and amount > 0 and u + amount > limit then
+		return {i, u}
+	end
+	used[i] = u + amount
+end
+for i = 1, n do
+	local base = 1 + (i - 1) * 6
+	local mode = ARGV[base + 1]
+	local amount = tonumber(ARGV[base + 3])
+	local ttl = tonumber(ARGV[base + 6])
+	if mode == "calendar" then
+		redis.call("INCRBY", KEYS[i], amount)
+	else
+		redis.call("HINCRBY", KEYS[i], ARGV[base + 4], amount)
+	end
+	redis.call("EXPIRE", KEYS[i], ttl)
+end
+local out = {0}
+for i = 1, n do out[i + 1] = used[i] end
+return out
+`)
+
+func runBudgetScript(ctx context.Context, rdb *redis.Client, budgets []Budget, windows []budgetWindow, amounts []int64, check bool) ([]int64, error) {
+	keys := make([]string, len(budgets))
+	args := []interface{}{"0"}
+	if check {
+		args[0] = "1"
+	}
+
+	for i, w := range windows {
+		keys[i] = w.key
+		args = append(args, w.mode, budgets[i].toUnits(budgets[i].HardLimit), amounts[i], w.bucket, w.minBucket, w.ttl)
+	}
+
+	res, err := budgetScript.Run(ctx, rdb, keys, args...).Int64Slice()
+	if err != nil {
+		return nil, err
+	}
+	return res, nil
+}
+
+// ReserveBudgets atomically reserves the estimated usage against every applicable budget.
+// It returns a *BudgetExceededError when any hard limit would be crossed, in which case
+// nothing is reserved.
+func ReserveBudgets(ctx context.Context, rdb *redis.Client, budgets []Budget, estTokens int, estCost float64) (*BudgetReservation, error) {
+	return reserveBudgetsAt(ctx, rdb, budgets, estTokens, estCost, time.Now())
+}
+
+func reserveBudgetsAt(ctx context.Context, rdb *redis.Client, budgets []Budget, estTokens int, estCost float64, now time.Time) (*BudgetReservation, error) {
+	res := &BudgetReservation{budgets: budgets, windows: budgetWindows(budgets, now), reserved: make([]int64, len(budgets))}
+	if len(budgets) == 0 {
+		return res, nil
+	}
+
+	for i := range budgets {
+		res.reserved[i] = budgets[i].amount(estTokens, estCost)
+	}
+
+	out, err := runBudgetScript(ctx, rdb, budgets, res.windows, res.reserved, true)
+	if err != nil {
+		return nil, err
+	}
+
+	if out[0] != 0 {
+		b := budgets[out[0]-1]
+		return nil, &BudgetExceededError{Budget: b, Used: b.fromUnits(out[1])}
+	}
+
+	for i, b := range budgets {
+		if b.SoftLimit != nil && out[i+1] >= b.toUnits(*b.SoftLimit) {
+			res.Warnings = append(res.Warnings, b)
+		}
+	}
+	return res, nil
+}
+
+// SettleBudgets replaces the reserved estimate with the actual usage (0 for failed requests).
+// The difference is applied to the windows reserved against, even when a calendar period
+// or rolling hour has ended since.
+func SettleBudgets(ctx context.Context, rdb *redis.Client, res *BudgetReservation, tokens int, cost float64) {
+	if res == nil || len(res.budgets) == 0 {
+		return
+	}
+
+	deltas := make([]int64, len(res.budgets))
+	changed := false
+	for i := range res.budgets {
+		deltas[i] = res.budgets[i].amount(tokens, cost) - res.reserved[i]
+		changed = changed || deltas[i] != 0
+	}
+	if !changed {
+		return
+	}
+
+	if _, err := runBudgetScript(ctx, rdb, res.budgets, res.windows, deltas, false); err != nil {
+		slog.Error("failed to settle budgets", "error", err)
+	}
+}
+
+// BudgetUsage returns the current usage of a budget in its own unit (tokens or USD)
+func BudgetUsage(ctx context.Context, rdb *redis.Client, b Budget) (float64, error) {
+	out, err := runBudgetScript(ctx, rdb, []Budget{b}, budgetWindows([]Budget{b}, time.Now()), []int64{0}, false)
+	if err != nil {
+		return 0, err
+	}
+	return b.fromUnits(out[1]), nil
+}
+
+// ShouldNotifyBudgetWarning returns true the first time a soft limit is crossed in the current window
+func ShouldNotifyBudgetWarning(ctx context.Context, rdb *redis.Client, b Budget) bool {
+	w := b.window(time.Now())
+	ttl := w.ttl
+	if b.WindowType == BudgetWindowRolling {
+		// Rolling windows re-warn at most once per window length
+		ttl = int64(periodDuration(b.Period).Seconds())
+	}
+	ok, err := rdb.SetNX(ctx, w.key+":warned", 1, time.Duration(ttl)*time.Second).Result()
+	return err == nil && ok
+}
+
+// -- Persistence --
+
+const budgetColumns = `id, scope, scope_id, COALESCE(name, ''), metric, hard_limit, soft_limit, window_type, period, enabled`
+
+func scanBudget(row interface{ Scan(...interface{}) error }) (Budget, error) {
+	var b Budget
+	var soft sql.NullFloat64
+	err := row.Scan(&b.ID, &b.Scope, &b.ScopeID, &b.Name, &b.Metric, &b.HardLimit, &soft, &b.WindowType, &b.Period, &b.Enabled)
+	if soft.Valid {
+		v := soft.Float64
+		b.SoftLimit = &v
+	}
+	return b, err
+}
+
+// ListBudgets returns all budgets of a tenant
+func ListBudgets(tenantID string) ([]Budget, error) {
+	rows, err := db.DB.Query(`SELECT `+budgetColumns+` FROM budgets WHERE tenant_id = $1 ORDER BY created_at ASC`, tenantID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	budgets := []Budget{}
+	for rows.Next() {
+		if b, err := scanBudget(rows); err == nil {
+			budgets = append(budgets, b)
+		}
+	}
+	return budgets, nil
+}
+
+// ApplicableBudgets returns the enabled budgets for a request's tenant, key and user
+func ApplicableBudgets(tenantID, apiKeyID, userID string) ([]Budget, error) {
+	scopeIDs := []interface{}{tenantID, tenantID}
+	query := `SELECT ` + budgetColumns + ` FROM budgets
+		WHERE tenant_id = $1 AND enabled = TRUE AND (
+			(scope = 'tenant' AND scope_id = $2)`
+	if apiKeyID != "" {
+		scopeIDs = append(scopeIDs, apiKeyID)
+		query += fmt.Sprintf(" OR (scope = 'api_key' AND scope_id = $%d)", len(scopeIDs))
+	}
+	if userID != "" {
+		scopeIDs = append(scopeIDs, userID)
+		query += fmt.Sprintf(" OR (scope = 'user' AND scope_id = $%d)", len(scopeIDs))
+	}
+	query += `) ORDER BY created_at ASC`
+
+	rows, err := db.DB.Query(query, scopeIDs...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	budgets := []Budget{}
+	for rows.Next() {
+		if b, err := scanBudget(rows); err == nil {
+			budgets = append(budgets, b)
+		}
+	}
+	return budgets, nil
+}
+
+// SaveBudget validates and inserts a budget, or updates it when b.ID is set
+func SaveBudget(tenantID uuid.UUID, b *Budget) error {
+	switch b.Scope {
+	case BudgetScopeTenant:
+		b.ScopeID = tenantID.String()
+	case BudgetScopeAPIKey, BudgetScopeUser:
+		table := "api_keys"
+		if b.Scope == BudgetScopeUser {
+			table = "users"
+		}
+		var exists bool
+		err := db.DB.QueryRow(`SELECT EXISTS(SELECT 1 FROM `+table+` WHERE id::text = $1 AND tenant_id = $2)`, b.ScopeID, tenantID).Scan(&exists)
+		if err != nil {
+			return err
+		}
+		if !exists {
+			return fmt.Errorf("%s %s not found", b.Scope, b.ScopeID)
+		}
+	default:
+		return fmt.Errorf("scope must be tenant, api_key or user")
+	}
+
+	if b.Metric != BudgetMetricTokens && b.Metric != BudgetMetricCost {
+		return fmt.Errorf("metric must be tokens or cost_usd")
+	}
+	if b.HardLimit <= 0 {
+		return fmt.Errorf("hard_limit must be positive")
+	}
+	if b.SoftLimit != nil && (*b.SoftLimit <= 0 || *b.SoftLimit > b.HardLimit) {
+		return fmt.Errorf("soft_limit must be positive and not above hard_limit")
+	}
+	if b.WindowType == "" {
+		b.WindowType = BudgetWindowCalendar
+	}
+	if b.WindowType != BudgetWindowCalendar && b.WindowType != BudgetWindowRolling {
+		return fmt.Errorf("window_type must be calendar or rolling")
+	}
+	if b.Period == "" {
+		b.Period = "month"
+	}
+	if b.Period != "day" && b.Period != "week" && b.Period != "month" {
+		return fmt.Errorf("period must be day, week or month")
+	}
+
+	if b.ID == uuid.Nil {
+		return db.DB.QueryRow(`
+			INSERT INTO budgets (tenant_id, scope, scope_id, name, metric, hard_limit, soft_limit, window_type, period, enabled)
+			VALUES ($1, $2, $3, $4, $5, $6, $7, $8, $9, $10)
+			RETURNING id
+		`, tenantID, b.Scope, b.ScopeID, b.Name, b.Metric, b.HardLimit, b.SoftLimit, b.WindowType, b.Period, b.Enabled).Scan(&b.ID)
+	}
+
+	res, err := db.DB.Exec(`
+		UPDATE budgets
+		SET scope = $3, scope_id = $4, name = $5, metric = $6, hard_limit = $7, soft_limit = $8,
+			window_type = $9, period = $10, enabled = $11
+		WHERE id = $1 AND tenant_id = $2
+	`, b.ID, tenantID, b.Scope, b.ScopeID, b.Name, b.Metric, b.HardLimit, b.SoftLimit, b.WindowType, b.Period, b.Enabled)
+	if err != nil {
+		return err
+	}
+	if n, _ := res.RowsAffected(); n == 0 {
+		return sql.ErrNoRows
+	}
+	return nil
+}
+
+// DeleteBudget removes a budget and its Redis counters
+func DeleteBudget(ctx context.Context, rdb *redis.Client, tenantID uuid.UUID, id string) (bool, error) {
+	res, err := db.DB.Exec("DELETE FROM budgets WHERE id = $1 AND tenant_id = $2", id, tenantID)
+	if err != nil {
+		return false, err
+	}
+	n, _ := res.RowsAffected()
+	if n > 0 {
+		var cursor uint64
+		for {
+			keys, next, err := rdb.Scan(ctx, cursor, BudgetRedisPrefix+id+":*", 100).Result()
+			if err != nil {
+				break
+			}
+			if len(keys) > 0 {
+				rdb.Del(ctx, keys...)
+			}
+			if next == 0 {
+				break
+			}
+			cursor = next
+		}
+	}
+	return n > 0, nil
+}
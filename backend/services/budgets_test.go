@@ -0,0 +1,56 @@
+package services
+
+import (
+	"context"
+	"strconv"
+	"testing"
+	"time"
+
+	"github.com/google/uuid"
+)
+
+func TestSettleBudgetsAcrossPeriodBoundary(t *testing.T) {
+	mr, rdb := newTestRedis(t)
+	ctx := context.Background()
+
+	now := time.Now()
+	calendar := Budget{ID: uuid.New(), Metric: BudgetMetricTokens, HardLimit: 10000, WindowType: BudgetWindowCalendar, Period: "day"}
+	rolling := Budget{ID: uuid.New(), Metric: BudgetMetricCost, HardLimit: 5, WindowType: BudgetWindowRolling, Period: "day"}
+	budgets := []Budget{calendar, rolling}
+
+	// Reserved just before yesterday ended, settled today
+	todayStart := time.Date(now.UTC().Year(), now.UTC().Month(), now.UTC().Day(), 0, 0, 0, 0, time.UTC)
+	reservedAt := todayStart.Add(-time.Second)
+	res, err := reserveBudgetsAt(ctx, rdb, budgets, 1500, 0.25, reservedAt)
+	if err != nil {
+		t.Fatal(err)
+	}
+	SettleBudgets(ctx, rdb, res, 400, 0.1)
+
+	yesterdayKey := calendar.window(reservedAt).key
+	if got, _ := mr.Get(yesterdayKey); got != "400" {
+		t.Errorf("reserved period %s = %q, want 400", yesterdayKey, got)
+	}
+	if todayKey := calendar.window(now).key; mr.Exists(todayKey) {
+		t.Errorf("settlement leaked into the new period %s", todayKey)
+	}
+
+	rollingKey := rolling.window(now).key
+	reservedBucket := strconv.FormatInt(reservedAt.Unix()/3600, 10)
+	if got := mr.HGet(rollingKey, reservedBucket); got != "100000" {
+		t.Errorf("reserved hour %s = %q, want 100000 micro-dollars", reservedBucket, got)
+	}
+	if currentBucket := strconv.FormatInt(now.Unix()/3600, 10); currentBucket != reservedBucket {
+		if got := mr.HGet(rollingKey, currentBucket); got != "" {
+			t.Errorf("settlement leaked into the current hour: %q", got)
+		}
+	}
+
+	// Today's usage starts empty; the rolling window still counts the settled cost
+	if used, err := BudgetUsage(ctx, rdb, calendar); err != nil || used != 0 {
+		t.Errorf("calendar usage today = %v, %v", used, err)
+	}
+	if used, err := BudgetUsage(ctx, rdb, rolling); err != nil || used != 0.1 {
+		t.Errorf("rolling usage = %v, %v", used, err)
+	}
+}
@@ -0,0 +1,232 @@
+package services
+
+import (
+	"context"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"database/sql"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"zaps/db"
+
+	"github.com/google/uuid"
+)
+
+// Envelope encryption: each tenant has AES-256 data keys, stored in tenant_data_keys
+// wrapped by the KMS master key (see KMS). Tenant secrets (provider keys, audit sink
+// secrets) are stored as "dk<version>:<hex nonce+ciphertext>" and bulk data (prompt
+// captures) records the version next to the ciphertext. Rotating a data key adds a
+// version; the highest version encrypts new data and the reencrypt command moves old
+// data forward.
+
+// tenantSecretPrefix starts every secret encrypted under a tenant data key. Hex
+// ciphertexts written by EncryptSecret never contain ':'.
+const tenantSecretPrefix = "dk"
+
+// currentVersionTTL bounds how long a replica keeps encrypting with a data key
+// version after a rotation
+const currentVersionTTL = 5 * time.Minute
+
+type dataKeyID struct {
+	tenantID uuid.UUID
+	version  int
+}
+
+type currentDataKey struct {
+	version int
+	at      time.Time
+}
+
+var (
+	dataKeyCache    sync.Map // dataKeyID -> []byte
+	dataKeyVersions sync.Map // tenant uuid.UUID -> currentDataKey
+)
+
+// currentDataKeyVersion returns the tenant's newest data key version, creating
+// version 1 on first use
+func currentDataKeyVersion(ctx context.Context, tenantID uuid.UUID) (int, error) {
+	if v, ok := dataKeyVersions.Load(tenantID); ok && time.Since(v.(currentDataKey).at) < currentVersionTTL {
+		return v.(currentDataKey).version, nil
+	}
+
+	var version int
+	err := db.DB.QueryRowContext(ctx, "SELECT COALESCE(MAX(version), 0) FROM tenant_data_keys WHERE tenant_id = $1", tenantID).Scan(&version)
+	if err != nil {
+		return 0, err
+	}
+	if version == 0 {
+		if err := insertDataKey(ctx, tenantID, 1); err != nil {
+			return 0, err
+		}
+		version = 1
+	}
+	dataKeyVersions.Store(tenantID, currentDataKey{version: version, at: time.Now()})
+	return version, nil
+}
+
+// insertDataKey generates and stores a data key version. A concurrent insert of the
+// same version wins; callers read back whichever key was stored.
+func insertDataKey(ctx context.Context, tenantID uuid.UUID, version int) error {
+	kms, err := currentKMS()
+	if err != nil {
+		return err
+	}
+	key := make([]byte, 32)
+	if _, err := io.ReadFull(rand.Reader, key); err != nil {
+		return err
+	}
+	wrapped, err := kms.Wrap(ctx, key)
+	if err != nil {
+		return err
+	}
+	_, err = db.DB.ExecContext(ctx, `
+		INSERT INTO tenant_data_keys (tenant_id, version, key_encrypted, kms_key_id) VALUES ($1, $2, $3, $4)
+		ON CONFLICT (tenant_id, version) DO NOTHING
+	`, tenantID, version, hex.EncodeToString(wrapped), kms.KeyID())
+	return err
+}
+
+// tenantDataKey returns one version of the tenant's data key
+func tenantDataKey(ctx context.Context, tenantID uuid.UUID, version int) ([]byte, error) {
+	id := dataKeyID{tenantID, version}
+	if key, ok := dataKeyCache.Load(id); ok {
+		return key.([]byte), nil
+	}
+
+	var wrappedHex, kmsKeyID string
+	err := db.DB.QueryRowContext(ctx, `
+		SELECT key_encrypted, kms_key_id FROM tenant_data_keys WHERE tenant_id = $1 AND version = $2
+	`, tenantID, version).Scan(&wrappedHex, &kmsKeyID)
+	if err == sql.ErrNoRows {
+		return nil, fmt.Errorf("tenant data key version %d not found", version)
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	key, err := unwrapDataKey(ctx, kmsKeyID, wrappedHex)
+	if err != nil {
+		return nil, err
+	}
+	dataKeyCache.Store(id, key)
+	return key, nil
+}
+
+func unwrapDataKey(ctx context.Context, kmsKeyID, wrappedHex string) ([]byte, error) {
+	kms, err := currentKMS()
+	if err != nil {
+		return nil, err
+	}
+	wrapped, err := hex.DecodeString(wrappedHex)
+	if err != nil {
+		return nil, fmt.Errorf("malformed tenant data key")
+	}
+	key, err := kms.Unwrap(ctx, kmsKeyID, wrapped)
+	if err != nil {
+		return nil, fmt.Errorf("unwrap tenant data key: %w", err)
+	}
+	if len(key) != 32 {
+		return nil, fmt.Errorf("malformed tenant data key")
+	}
+	return key, nil
+}
+
+func tenantGCM(ctx context.Context, tenantID uuid.UUID, version int) (cipher.AEAD, error) {
+	key, err := tenantDataKey(ctx, tenantID, version)
+	if err != nil {
+		return nil, err
+	}
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+	return cipher.NewGCM(block)
+}
+
+// SealTenantData encrypts plaintext under the tenant's current data key (nonce ||
+// ciphertext) and returns the key version to store with it. aad binds the ciphertext
+// to its context, e.g. the row it is stored in.
+func SealTenantData(ctx context.Context, tenantID uuid.UUID, plaintext, aad []byte) ([]byte, int, error) {
+	version, err := currentDataKeyVersion(ctx, tenantID)
+	if err != nil {
+		return nil, 0, err
+	}
+	sealed, err := sealTenantDataVersion(ctx, tenantID, version, plaintext, aad)
+	return sealed, version, err
+}
+
+func sealTenantDataVersion(ctx context.Context, tenantID uuid.UUID, version int, plaintext, aad []byte) ([]byte, error) {
+	gcm, err := tenantGCM(ctx, tenantID, version)
+	if err != nil {
+		return nil, err
+	}
+	nonce := make([]byte, gcm.NonceSize())
+	if _, err := io.ReadFull(rand.Reader, nonce); err != nil {
+		return nil, err
+	}
+	return gcm.Seal(nonce, nonce, plaintext, aad), nil
+}
+
+// OpenTenantData decrypts a value produced by SealTenantData with the same version and aad
+func OpenTenantData(ctx context.Context, tenantID uuid.UUID, version int, sealed, aad []byte) ([]byte, error) {
+	gcm, err := tenantGCM(ctx, tenantID, version)
+	if err != nil {
+		return nil, err
+	}
+	if len(sealed) < gcm.NonceSize() {
+		return nil, fmt.Errorf("malformed ciphertext")
+	}
+	nonce, ciphertext := sealed[:gcm.NonceSize()], sealed[gcm.NonceSize():]
+	return gcm.Open(nil, nonce, ciphertext, aad)
+}
+
+// EncryptTenantSecret encrypts a short secret under the tenant's current data key
+func EncryptTenantSecret(ctx context.Context, tenantID uuid.UUID, plaintext string) (string, error) {
+	sealed, version, err := SealTenantData(ctx, tenantID, []byte(plaintext), nil)
+	if err != nil {
+		return "", err
+	}
+	return formatTenantSecret(version, sealed), nil
+}
+
+func formatTenantSecret(version int, sealed []byte) string {
+	return tenantSecretPrefix + strconv.Itoa(version) + ":" + hex.EncodeToString(sealed)
+}
+
+// DecryptTenantSecret opens a value produced by EncryptTenantSecret, or by
+// EncryptSecret for values stored before envelope encryption
+func DecryptTenantSecret(ctx context.Context, tenantID uuid.UUID, ciphertext string) (string, error) {
+	version, sealedHex := tenantSecretVersion(ciphertext)
+	if version == 0 {
+		return DecryptSecret(ciphertext)
+	}
+	sealed, err := hex.DecodeString(sealedHex)
+	if err != nil {
+		return "", err
+	}
+	plaintext, err := OpenTenantData(ctx, tenantID, version, sealed, nil)
+	if err != nil {
+		return "", err
+	}
+	return string(plaintext), nil
+}
+
+// tenantSecretVersion splits "dk<version>:<hex>"; version is 0 for legacy values
+func tenantSecretVersion(ciphertext string) (int, string) {
+	prefix, rest, ok := strings.Cut(ciphertext, ":")
+	if !ok || !strings.HasPrefix(prefix, tenantSecretPrefix) {
+		return 0, ciphertext
+	}
+	version, err := strconv.Atoi(strings.TrimPrefix(prefix, tenantSecretPrefix))
+	if err != nil || version < 1 {
+		return 0, ciphertext
+	}
+	return version, rest
+}
@@ -3,7 +3,7 @@ package services
 import (
 	"context"
 	"fmt"
-	"log"
+	"log/slog"
 	"os"
 	"time"
 
@@ -18,12 +18,12 @@ func InitMailgun() {
 	apiKey := os.Getenv("MAILGUN_API_KEY")
 
 	if domain == "" || apiKey == "" {
-		log.Println("⚠️  Mailgun not configured - emails will be logged only (dev mode)")
+		slog.Warn("mailgun not configured, emails will be logged only (dev mode)")
 		return
 	}
 
 	mg = mailgun.NewMailgun(domain, apiKey)
-	log.Println("✓ Mailgun initialized")
+	slog.Info("mailgun initialized")
 }
 
 // SendVerificationEmail sends account verification email
@@ -32,7 +32,7 @@ func SendVerificationEmail(email, token string) error {
 		// In dev mode, just log the verification link
 		frontendURL := os.Getenv("FRONTEND_URL")
 		verifyURL := fmt.Sprintf("%s/verify?token=%s", frontendURL, token)
-		log.Printf("[Email - Dev Mode] Verification link for %s:\n%s", email, verifyURL)
+		slog.Info("dev mode: verification email", "to", email, "link", verifyURL)
 		return nil
 	}
 
@@ -121,13 +121,13 @@ Questions? Email us at support@zaps.ai
 	ctx, cancel := context.WithTimeout(context.Background(), time.Second*10)
 	defer cancel()
 
-	resp, id, err := mg.Send(ctx, message)
+	_, id, err := mg.Send(ctx, message)
 	if err != nil {
-		log.Printf("❌ Failed to send verification email to %s: %v", email, err)
+		slog.Error("failed to send verification email", "to", email, "error", err)
 		return err
 	}
 
-	log.Printf("✉️  Verification email sent to %s (ID: %s, Response: %s)", email, id, resp)
+	slog.Info("verification email sent", "to", email, "message_id", id)
 	return nil
 }
 
@@ -136,7 +136,7 @@ func SendPasswordResetEmail(email, token string) error {
 	if mg == nil {
 		frontendURL := os.Getenv("FRONTEND_URL")
 		resetURL := fmt.Sprintf("%s/reset-password?token=%s", frontendURL, token)
-		log.Printf("[Email - Dev Mode] Password reset link for %s:\n%s", email, resetURL)
+		slog.Info("dev mode: password reset email", "to", email, "link", resetURL)
 		return nil
 	}
 
@@ -185,10 +185,69 @@ func SendPasswordResetEmail(email, token string) error {
 
 	_, id, err := mg.Send(ctx, message)
 	if err != nil {
-		log.Printf("❌ Failed to send password reset email to %s: %v", email, err)
+		slog.Error("failed to send password reset email", "to", email, "error", err)
+		return err
+	}
+
+	slog.Info("password reset email sent", "to", email, "message_id", id)
+	return nil
+}
+
+// SendAPIKeyExpiryWarningEmail tells a key owner that a key is about to expire
+func SendAPIKeyExpiryWarningEmail(email, keyName, keyPrefix string, expiresAt time.Time) error {
+	frontendURL := os.Getenv("FRONTEND_URL")
+	keysURL := fmt.Sprintf("%s/dashboard/keys", frontendURL)
+	expiry := expiresAt.UTC().Format("January 2, 2006 15:04 MST")
+
+	if mg == nil {
+		slog.Info("dev mode: API key expiry email", "to", email, "key_name", keyName, "key_prefix", keyPrefix, "expires", expiry, "link", keysURL)
+		return nil
+	}
+
+	subject := fmt.Sprintf("Your Zaps.ai API key \"%s\" expires soon", keyName)
+	htmlBody := fmt.Sprintf(`
+<!DOCTYPE html>
+<html>
+<head>
+    <meta charset="UTF-8">
+</head>
+<body style="font-family: Arial, sans-serif; background-color: #0A0E27; color: #fff; padding: 20px;">
+    <div style="max-width: 600px; margin: 0 auto; background: #1a1f3a; border-radius: 8px; padding: 30px;">
+        <h1 style="color: #00FFFF;">API Key Expiring Soon</h1>
+        <p style="font-size: 16px; line-height: 1.6;">
+            Your API key <strong>%s</strong> (<code>%s</code>) expires on <strong>%s</strong>.
+            Requests using it will be rejected after that time.
+        </p>
+        <p style="font-size: 16px; line-height: 1.6;">
+            Rotate the key to get a replacement while the current one keeps working for a short grace period:
+        </p>
+        <div style="text-align: center; margin: 30px 0;">
+            <a href="%s" style="display: inline-block; background: #0066FF; color: white; text-decoration: none; padding: 12px 30px; border-radius: 6px; font-weight: bold;">
+                Manage API Keys
+            </a>
+        </div>
+    </div>
+</body>
+</html>
+	`, keyName, keyPrefix, expiry, keysURL)
+
+	message := mg.NewMessage(
+		"Zaps.ai <noreply@"+os.Getenv("MAILGUN_DOMAIN")+">",
+		subject,
+		fmt.Sprintf("Your API key %q (%s) expires on %s. Rotate it at %s", keyName, keyPrefix, expiry, keysURL),
+		email,
+	)
+	message.SetHtml(htmlBody)
+
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second*10)
+	defer cancel()
+
+	_, id, err := mg.Send(ctx, message)
+	if err != nil {
+		slog.Error("failed to send API key expiry email", "to", email, "error", err)
 		return err
 	}
 
-	log.Printf("✉️  Password reset email sent to %s (ID: %s)", email, id)
+	slog.Info("API key expiry email sent", "to", email, "message_id", id)
 	return nil
 }
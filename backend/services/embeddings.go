@@ -0,0 +1,185 @@
+package services
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"hash/fnv"
+	"log/slog"
+	"math"
+	"net/http"
+	"os"
+	"strings"
+	"time"
+	"unicode"
+)
+
+// Embedder turns text into a fixed-size vector for similarity search
+type Embedder interface {
+	Embed(ctx context.Context, text string) ([]float32, error)
+	Name() string
+}
+
+var embedder Embedder = NewLocalEmbedder(LocalEmbeddingDims)
+
+// InitEmbeddings selects the embeddings provider used by the semantic cache.
+// Without EMBEDDINGS_API_URL we fall back to the local hashing embedder.
+func InitEmbeddings() {
+	url := os.Getenv("EMBEDDINGS_API_URL")
+	if url == "" {
+		slog.Warn("embeddings API not configured, semantic cache uses local hashing embedder")
+		return
+	}
+
+	model := os.Getenv("EMBEDDINGS_MODEL")
+	if model == "" {
+		model = "text-embedding-3-small"
+	}
+
+	embedder = &OpenAIEmbedder{
+		URL:    strings.TrimRight(url, "/") + "/embeddings",
+		APIKey: os.Getenv("EMBEDDINGS_API_KEY"),
+		Model:  model,
+		client: &http.Client{Timeout: 10 * time.Second},
+	}
+	slog.Info("embeddings provider initialized", "model", model)
+}
+
+// SetEmbedder overrides the active embedder (used by tooling and local stubs)
+func SetEmbedder(e Embedder) {
+	embedder = e
+}
+
+// -- OpenAI-compatible embeddings endpoint --
+
+// OpenAIEmbedder calls any OpenAI-compatible /embeddings endpoint
+type OpenAIEmbedder struct {
+	URL    string
+	APIKey string
+	Model  string
+	client *http.Client
+}
+
+func (e *OpenAIEmbedder) Name() string { return e.Model }
+
+func (e *OpenAIEmbedder) Embed(ctx context.Context, text string) ([]float32, error) {
+	payload, _ := json.Marshal(map[string]interface{}{
+		"model": e.Model,
+		"input": text,
+	})
+
+	req, err := http.NewRequestWithContext(ctx, "POST", e.URL, bytes.NewReader(payload))
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	if e.APIKey != "" {
+		req.Header.Set("Authorization", "Bearer "+e.APIKey)
+	}
+
+	resp, err := e.client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("embeddings provider returned %d", resp.StatusCode)
+	}
+
+	var out struct {
+		Data []struct {
+			Embedding []float32 `json:"embedding"`
+		} `json:"data"`
+	}
+	if err := json.NewDecoder(resp.Body).Decode(&out); err != nil {
+		return nil, err
+	}
+	if len(out.Data) == 0 {
+		return nil, fmt.Errorf("embeddings provider returned no vectors")
+	}
+
+	return normalize(out.Data[0].Embedding), nil
+}
+
+// -- Local hashing embedder --
+
+const LocalEmbeddingDims = 256
+
+// LocalEmbedder is a deterministic feature-hashing embedder. It needs no network
+// access, so it is the default for development and for tests.
+type LocalEmbedder struct {
+	Dims int
+}
+
+func NewLocalEmbedder(dims int) *LocalEmbedder {
+	return &LocalEmbedder{Dims: dims}
+}
+
+func (e *LocalEmbedder) Name() string { return "local-hash" }
+
+func (e *LocalEmbedder) Embed(ctx context.Context, text string) ([]float32, error) {
+	vec := make([]float32, e.Dims)
+
+	words := strings.FieldsFunc(strings.ToLower(text), func(r rune) bool {
+		return !unicode.IsLetter(r) && !unicode.IsNumber(r) && r != '<' && r != '>' && r != ':' && r != '_'
+	})
+
+	// Unigrams and bigrams, signed hashing to reduce collision bias
+	for i, w := range words {
+		addFeature(vec, w)
+		if i > 0 {
+			addFeature(vec, words[i-1]+" "+w)
+		}
+	}
+
+	return normalize(vec), nil
+}
+
+func addFeature(vec []float32, feature string) {
+	h := fnv.New64a()
+	h.Write([]byte(feature))
+	sum := h.Sum64()
+
+	idx := int(sum % uint64(len(vec)))
+	if sum&(1<<63) != 0 {
+		vec[idx]--
+	} else {
+		vec[idx]++
+	}
+}
+
+// -- Vector helpers --
+
+func normalize(vec []float32) []float32 {
+	var norm float64
+	for _, v := range vec {
+		norm += float64(v) * float64(v)
+	}
+	if norm == 0 {
+		return vec
+	}
+	norm = math.Sqrt(norm)
+	for i := range vec {
+		vec[i] = float32(float64(vec[i]) / norm)
+	}
+	return vec
+}
+
+// CosineSimilarity returns the cosine similarity of two vectors (0 if dimensions differ)
+func CosineSimilarity(a, b []float32) float64 {
+	if len(a) != len(b) || len(a) == 0 {
+		return 0
+	}
+	var dot, na, nb float64
+	for i := range a {
+		dot += float64(a[i]) * float64(b[i])
+		na += float64(a[i]) * float64(a[i])
+		nb += float64(b[i]) * float64(b[i])
+	}
+	if na == 0 || nb == 0 {
+		return 0
+	}
+	return dot / (math.Sqrt(na) * math.Sqrt(nb))
+}
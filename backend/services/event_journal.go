@@ -0,0 +1,171 @@
+package services
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// journalRecord is one line of the event journal
+type journalRecord struct {
+	Kind  string        `json:"kind"`
+	Audit *auditEntry   `json:"audit,omitempty"`
+	Usage *RequestUsage `json:"usage,omitempty"`
+}
+
+// eventJournal appends spilled events to JSON-lines files in dir. Appends go to the
+// current file; replay seals it first, so files being replayed are never written.
+type eventJournal struct {
+	mu  sync.Mutex
+	dir string
+	f   *os.File
+}
+
+func newEventJournal(dir string) *eventJournal {
+	return &eventJournal{dir: dir}
+}
+
+func (j *eventJournal) append(recs []journalRecord) error {
+	var buf []byte
+	for _, r := range recs {
+		line, err := json.Marshal(r)
+		if err != nil {
+			return err
+		}
+		buf = append(append(buf, line...), '\n')
+	}
+
+	j.mu.Lock()
+	defer j.mu.Unlock()
+	if j.f == nil {
+		if err := os.MkdirAll(j.dir, 0o700); err != nil {
+			return err
+		}
+		name := filepath.Join(j.dir, fmt.Sprintf("events-%d.jsonl", time.Now().UnixNano()))
+		f, err := os.OpenFile(name, os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0o600)
+		if err != nil {
+			return err
+		}
+		j.f = f
+	}
+	_, err := j.f.Write(buf)
+	return err
+}
+
+// seal closes the current file so the next append starts a new one
+func (j *eventJournal) seal() {
+	if j.f != nil {
+		j.f.Sync()
+		j.f.Close()
+		j.f = nil
+	}
+}
+
+func (j *eventJournal) close() {
+	j.mu.Lock()
+	defer j.mu.Unlock()
+	j.seal()
+}
+
+// replay writes journaled events to the database in batches, oldest file first, and
+// removes each file once it is written. On a write error the unwritten remainder is
+// re-journaled and replay stops until the next attempt.
+func (j *eventJournal) replay(ctx context.Context, batchSize int) (int, error) {
+	j.mu.Lock()
+	j.seal()
+	files, err := filepath.Glob(filepath.Join(j.dir, "events-*.jsonl"))
+	j.mu.Unlock()
+	if err != nil || len(files) == 0 {
+		return 0, err
+	}
+	sort.Strings(files)
+
+	replayed := 0
+	for _, name := range files {
+		if ctx.Err() != nil {
+			return replayed, nil
+		}
+		recs, err := readJournalFile(name)
+		if err != nil {
+			return replayed, err
+		}
+
+		// Audit entries first, so a failure re-journals only what was not written
+		var audits []*auditEntry
+		var usages []*RequestUsage
+		for _, r := range recs {
+			switch {
+			case r.Audit != nil:
+				audits = append(audits, r.Audit)
+			case r.Usage != nil:
+				usages = append(usages, r.Usage)
+			}
+		}
+
+		n, err := replayBatches(ctx, audits, batchSize, eventKindAudit, writeAuditBatch)
+		audits = audits[n:]
+		replayed += n
+		if err == nil {
+			n, err = replayBatches(ctx, usages, batchSize, eventKindUsage, writeUsageBatch)
+			usages = usages[n:]
+			replayed += n
+		}
+		if err != nil {
+			rest := append(toJournalRecords(eventKindAudit, audits), toJournalRecords(eventKindUsage, usages)...)
+			if jerr := j.append(rest); jerr != nil {
+				return replayed, jerr // Keep the file; it is retried as a whole
+			}
+			os.Remove(name)
+			return replayed, err
+		}
+		if err := os.Remove(name); err != nil {
+			return replayed, err
+		}
+	}
+	return replayed, nil
+}
+
+// replayBatches writes items in batches and returns how many were handled
+func replayBatches[T any](ctx context.Context, items []*T, batchSize int, kind string, write func(context.Context, []*T) error) (int, error) {
+	handled := 0
+	for handled < len(items) {
+		end := min(handled+batchSize, len(items))
+		n, err := writeEvents(ctx, kind, items[handled:end], write)
+		handled += n
+		if err != nil {
+			return handled, err
+		}
+	}
+	return handled, nil
+}
+
+func readJournalFile(name string) ([]journalRecord, error) {
+	f, err := os.Open(name)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	var recs []journalRecord
+	scanner := bufio.NewScanner(f)
+	scanner.Buffer(make([]byte, 64*1024), 16*1024*1024)
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" {
+			continue
+		}
+		var r journalRecord
+		if err := json.Unmarshal([]byte(line), &r); err != nil {
+			continue // A torn final line from a crash
+		}
+		recs = append(recs, r)
+	}
+	return recs, scanner.Err()
+}
@@ -0,0 +1,311 @@
+package services
+
+import (
+	"context"
+	"errors"
+	"log/slog"
+	"os"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/lib/pq"
+)
+
+// Event writer: audit events and usage records are queued in bounded channels and
+// written in batches by one goroutine per kind. A full queue, or a batch that still
+// fails after retries, spills to the local disk journal, which is replayed on start
+// and periodically while the database is reachable. Stop drains the queues.
+
+const (
+	eventKindAudit = "audit"
+	eventKindUsage = "usage"
+)
+
+var (
+	eventFlushRetries    = []time.Duration{100 * time.Millisecond, 500 * time.Millisecond, 2 * time.Second}
+	eventFlushInterval   = time.Second
+	eventJournalInterval = time.Minute
+)
+
+// EventWriter batches audit and usage writes
+type EventWriter struct {
+	mu      sync.RWMutex // Guards closing the channels
+	running bool
+
+	audit     chan *auditEntry
+	usage     chan *RequestUsage
+	batchSize int
+	journal   *eventJournal
+
+	stopReplay context.CancelFunc
+	wg         sync.WaitGroup
+}
+
+var events = &EventWriter{}
+
+func envInt(name string, def int) int {
+	if n, err := strconv.Atoi(os.Getenv(name)); err == nil && n > 0 {
+		return n
+	}
+	return def
+}
+
+// StartEventWriter starts the background writers and replays any journaled events.
+// Until it is called (e.g. in CLI tools) events are written synchronously.
+// EVENT_QUEUE_SIZE, EVENT_BATCH_SIZE and EVENT_JOURNAL_DIR tune it.
+func StartEventWriter() {
+	w := events
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	if w.running {
+		return
+	}
+
+	queueSize := envInt("EVENT_QUEUE_SIZE", 10000)
+	w.audit = make(chan *auditEntry, queueSize)
+	w.usage = make(chan *RequestUsage, queueSize)
+	w.batchSize = envInt("EVENT_BATCH_SIZE", 500)
+
+	dir := os.Getenv("EVENT_JOURNAL_DIR")
+	if dir == "" {
+		dir = "data/journal"
+	}
+	w.journal = newEventJournal(dir)
+
+	w.wg.Add(2)
+	go runEventLoop(w, w.audit, eventKindAudit, writeAuditBatch)
+	go runEventLoop(w, w.usage, eventKindUsage, writeUsageBatch)
+
+	replayCtx, cancel := context.WithCancel(context.Background())
+	w.stopReplay = cancel
+	w.wg.Add(1)
+	go w.replayLoop(replayCtx)
+
+	w.running = true
+	slog.Info("event writer started", "queue_size", queueSize, "batch_size", w.batchSize, "journal", dir)
+}
+
+// StopEventWriter stops accepting queued events and flushes what is buffered. Events
+// still queued when ctx ends are spilled to the journal.
+func StopEventWriter(ctx context.Context) {
+	w := events
+	w.mu.Lock()
+	if !w.running {
+		w.mu.Unlock()
+		return
+	}
+	w.running = false
+	w.stopReplay()
+	close(w.audit)
+	close(w.usage)
+	w.mu.Unlock()
+
+	done := make(chan struct{})
+	go func() {
+		w.wg.Wait()
+		close(done)
+	}()
+	select {
+	case <-done:
+		slog.Info("event writer flushed")
+	case <-ctx.Done():
+		// Loops are still writing; take what they have not reached yet
+		spilled := 0
+		for e := range w.audit {
+			w.spill(eventKindAudit, []journalRecord{{Kind: eventKindAudit, Audit: e}})
+			spilled++
+		}
+		for u := range w.usage {
+			w.spill(eventKindUsage, []journalRecord{{Kind: eventKindUsage, Usage: u}})
+			spilled++
+		}
+		slog.Warn("event writer flush timed out, queued events journaled", "events", spilled)
+	}
+	w.journal.close()
+}
+
+// enqueueAudit queues an audit entry, spilling it to the journal when the queue is full
+func (w *EventWriter) enqueueAudit(e *auditEntry) {
+	w.mu.RLock()
+	defer w.mu.RUnlock()
+	if !w.running {
+		if err := writeAuditBatch(context.Background(), []*auditEntry{e}); err != nil {
+			slog.Error("failed to save audit log", "event_type", e.EventType, "error", err)
+		}
+		return
+	}
+	select {
+	case w.audit <- e:
+	default:
+		w.spill(eventKindAudit, []journalRecord{{Kind: eventKindAudit, Audit: e}})
+	}
+}
+
+// enqueueUsage queues a usage record, spilling it to the journal when the queue is full
+func (w *EventWriter) enqueueUsage(u *RequestUsage) {
+	w.mu.RLock()
+	defer w.mu.RUnlock()
+	if !w.running {
+		if err := writeUsageBatch(context.Background(), []*RequestUsage{u}); err != nil {
+			slog.Error("failed to log usage stats", "error", err)
+		}
+		return
+	}
+	select {
+	case w.usage <- u:
+	default:
+		w.spill(eventKindUsage, []journalRecord{{Kind: eventKindUsage, Usage: u}})
+	}
+}
+
+func (w *EventWriter) spill(kind string, recs []journalRecord) {
+	if err := w.journal.append(recs); err != nil {
+		slog.Error("event journal write failed, events lost", "kind", kind, "events", len(recs), "error", err)
+		eventsDropped.WithLabelValues(kind).Add(float64(len(recs)))
+		return
+	}
+	eventsSpilled.WithLabelValues(kind).Add(float64(len(recs)))
+}
+
+// runEventLoop batches a queue until it is closed
+func runEventLoop[T any](w *EventWriter, queue chan *T, kind string, write func(context.Context, []*T) error) {
+	defer w.wg.Done()
+	ticker := time.NewTicker(eventFlushInterval)
+	defer ticker.Stop()
+
+	batch := make([]*T, 0, w.batchSize)
+	flush := func() {
+		if len(batch) > 0 {
+			flushEvents(w, kind, batch, write)
+			batch = make([]*T, 0, w.batchSize)
+		}
+	}
+
+	for {
+		select {
+		case item, ok := <-queue:
+			if !ok {
+				flush()
+				return
+			}
+			batch = append(batch, item)
+			if len(batch) >= w.batchSize {
+				flush()
+			}
+		case <-ticker.C:
+			flush()
+		}
+	}
+}
+
+// flushEvents writes a batch, retrying with backoff before spilling what is left to the journal
+func flushEvents[T any](w *EventWriter, kind string, batch []*T, write func(context.Context, []*T) error) {
+	start := time.Now()
+	handled := 0
+	var err error
+	for attempt := 0; ; attempt++ {
+		ctx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
+		var n int
+		n, err = writeEvents(ctx, kind, batch[handled:], write)
+		cancel()
+		handled += n
+		if err == nil || attempt >= len(eventFlushRetries) {
+			break
+		}
+		time.Sleep(eventFlushRetries[attempt])
+	}
+	eventFlushDuration.WithLabelValues(kind).Observe(time.Since(start).Seconds())
+
+	if err != nil {
+		slog.Error("event batch write failed, journaling", "kind", kind, "events", len(batch)-handled, "error", err)
+		ObserveBackendError(BackendPostgres, kind+"_batch")
+		w.spill(kind, toJournalRecords(kind, batch[handled:]))
+	}
+}
+
+// writeEvents writes items in one batch. When the database rejects the batch's data
+// (e.g. a deleted tenant), rows are retried one by one and rejected rows are dropped,
+// so a bad event cannot block the queue or the journal. It returns how many items were
+// handled before a transient error.
+func writeEvents[T any](ctx context.Context, kind string, items []*T, write func(context.Context, []*T) error) (int, error) {
+	err := write(ctx, items)
+	if err == nil {
+		eventsWritten.WithLabelValues(kind).Add(float64(len(items)))
+		return len(items), nil
+	}
+	if !isDataError(err) {
+		return 0, err
+	}
+	for i, item := range items {
+		if err := write(ctx, []*T{item}); err != nil {
+			if !isDataError(err) {
+				return i, err
+			}
+			slog.Error("event rejected by database, dropped", "kind", kind, "error", err)
+			eventsDropped.WithLabelValues(kind).Inc()
+			continue
+		}
+		eventsWritten.WithLabelValues(kind).Inc()
+	}
+	return len(items), nil
+}
+
+// isDataError reports whether Postgres rejected the data itself (data exceptions,
+// constraint violations, bad values) rather than failing for a transient reason
+func isDataError(err error) bool {
+	var pqErr *pq.Error
+	if !errors.As(err, &pqErr) {
+		return false
+	}
+	switch pqErr.Code.Class() {
+	case "22", "23":
+		return true
+	}
+	return false
+}
+
+func toJournalRecords[T any](kind string, batch []*T) []journalRecord {
+	recs := make([]journalRecord, 0, len(batch))
+	for _, item := range batch {
+		switch v := any(item).(type) {
+		case *auditEntry:
+			recs = append(recs, journalRecord{Kind: kind, Audit: v})
+		case *RequestUsage:
+			recs = append(recs, journalRecord{Kind: kind, Usage: v})
+		}
+	}
+	return recs
+}
+
+// replayLoop replays the journal now and then every eventJournalInterval
+func (w *EventWriter) replayLoop(ctx context.Context) {
+	defer w.wg.Done()
+	ticker := time.NewTicker(eventJournalInterval)
+	defer ticker.Stop()
+	for {
+		if n, err := w.journal.replay(ctx, w.batchSize); err != nil {
+			slog.Warn("event journal replay incomplete", "replayed", n, "error", err)
+		} else if n > 0 {
+			slog.Info("event journal replayed", "events", n)
+		}
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+// queueDepth reports how many events of a kind are waiting to be written
+func (w *EventWriter) queueDepth(kind string) int {
+	w.mu.RLock()
+	defer w.mu.RUnlock()
+	if !w.running {
+		return 0
+	}
+	if kind == eventKindAudit {
+		return len(w.audit)
+	}
+	return len(w.usage)
+}
@@ -0,0 +1,43 @@
+package services
+
+import (
+	"testing"
+
+	"zaps/db"
+
+	"github.com/DATA-DOG/go-sqlmock"
+	"github.com/alicebob/miniredis/v2"
+	"github.com/redis/go-redis/v9"
+)
+
+// newTestRedis starts an in-memory Redis and returns its server and a client
+func newTestRedis(t *testing.T) (*miniredis.Miniredis, *redis.Client) {
+	t.Helper()
+	mr := miniredis.RunT(t)
+	rdb := redis.NewClient(&redis.Options{Addr: mr.Addr()})
+	t.Cleanup(func() { rdb.Close() })
+	return mr, rdb
+}
+
+// newMockDB points db.DB at a sqlmock
+func newMockDB(t *testing.T) sqlmock.Sqlmock {
+	t.Helper()
+	mockDB, mock, err := sqlmock.New()
+	if err != nil {
+		t.Fatal(err)
+	}
+	db.DB = mockDB
+	t.Cleanup(func() {
+		// Left in place closed, so stray async writes fail instead of dereferencing nil
+		mockDB.Close()
+		if err := mock.ExpectationsWereMet(); err != nil {
+			t.Error(err)
+		}
+	})
+	return mock
+}
+
+// noRows is an empty result set (sql.ErrNoRows on QueryRow)
+func noRows(columns ...string) *sqlmock.Rows {
+	return sqlmock.NewRows(columns)
+}
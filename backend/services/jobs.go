@@ -0,0 +1,169 @@
+package services
+
+import (
+	"context"
+	"time"
+
+	"zaps/db"
+
+	"github.com/redis/go-redis/v9"
+)
+
+const (
+	JobQuotaReset   = "quota_reset"
+	JobPruneExpired = "prune_expired"
+	JobAPIKeyExpiry = "api_key_expiry"
+	JobAPIKeySync   = "api_key_sync"
+
+	JobAuditCheckpoint = "audit_checkpoint"
+	JobRetentionPurge  = "retention_purge"
+
+	// JobProviderValidation is registered by the api package, which owns the provider registry
+	JobProviderValidation = "provider_validation"
+
+	// JobRunRetention is how long job_runs history is kept
+	JobRunRetention = 30 * 24 * time.Hour
+)
+
+// RegisterCoreJobs adds the built-in maintenance jobs to a scheduler
+func RegisterCoreJobs(s *Scheduler) {
+	s.Register(Job{
+		Name:     JobQuotaReset,
+		Interval: 5 * time.Minute,
+		Run:      runQuotaReset,
+	})
+	s.Register(Job{
+		Name:     JobPruneExpired,
+		Interval: time.Hour,
+		Timeout:  10 * time.Minute,
+		Run:      runPruneExpired,
+	})
+	s.Register(Job{
+		Name:     JobAPIKeyExpiry,
+		Interval: time.Hour,
+		Run: func(ctx context.Context) (map[string]interface{}, error) {
+			return runAPIKeyExpiry(ctx, s.rdb)
+		},
+	})
+	s.Register(Job{
+		Name:     JobAPIKeySync,
+		Interval: 15 * time.Minute,
+		Run: func(ctx context.Context) (map[string]interface{}, error) {
+			res, err := SyncAPIKeys(ctx, s.rdb)
+			if res == nil {
+				return nil, err
+			}
+			return map[string]interface{}{
+				"checked":   res.Checked,
+				"refreshed": res.Refreshed,
+				"removed":   res.Removed,
+			}, err
+		},
+	})
+	s.Register(Job{
+		Name:     JobAuditCheckpoint,
+		Interval: time.Hour,
+		Run: func(ctx context.Context) (map[string]interface{}, error) {
+			created, err := CreateAuditCheckpoints(ctx)
+			return map[string]interface{}{"checkpoints": created}, err
+		},
+	})
+	s.Register(Job{
+		Name:     JobRetentionPurge,
+		Interval: 6 * time.Hour,
+		Timeout:  time.Hour,
+		Run: func(ctx context.Context) (map[string]interface{}, error) {
+			return runRetentionPurge(ctx, s.rdb)
+		},
+	})
+}
+
+// runQuotaReset zeroes current_usage for tenants whose quota_reset_at has passed
+// and rolls quota_reset_at forward to the start of the next month.
+func runQuotaReset(ctx context.Context) (map[string]interface{}, error) {
+	rows, err := db.DB.QueryContext(ctx, `
+		UPDATE tenants
+		SET current_usage = 0,
+			quota_reset_at = DATE_TRUNC('month', NOW() + INTERVAL '1 month')
+		WHERE quota_reset_at <= NOW()
+		RETURNING id, quota_reset_at
+	`)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	reset := 0
+	for rows.Next() {
+		var tenantID string
+		var nextReset time.Time
+		if err := rows.Scan(&tenantID, &nextReset); err != nil {
+			continue
+		}
+		reset++
+		LogAuditAsync(tenantID, nil, "QUOTA_RESET", map[string]interface{}{
+			"next_reset_at": nextReset,
+		}, "", "scheduler")
+	}
+
+	return map[string]interface{}{"tenants_reset": reset}, rows.Err()
+}
+
+// runPruneExpired clears expired one-time tokens and old job history
+func runPruneExpired(ctx context.Context) (map[string]interface{}, error) {
+	result := map[string]interface{}{}
+
+	res, err := db.DB.ExecContext(ctx, `
+		UPDATE users
+		SET verification_token = NULL, verification_token_expires_at = NULL
+		WHERE verification_token IS NOT NULL AND verification_token_expires_at < NOW()
+	`)
+	if err != nil {
+		return result, err
+	}
+	n, _ := res.RowsAffected()
+	result["verification_tokens_cleared"] = n
+
+	res, err = db.DB.ExecContext(ctx, `
+		UPDATE users
+		SET password_reset_token = NULL, password_reset_expires_at = NULL
+		WHERE password_reset_token IS NOT NULL AND password_reset_expires_at < NOW()
+	`)
+	if err != nil {
+		return result, err
+	}
+	n, _ = res.RowsAffected()
+	result["password_reset_tokens_cleared"] = n
+
+	res, err = db.DB.ExecContext(ctx, `
+		DELETE FROM job_runs WHERE started_at < $1
+	`, time.Now().Add(-JobRunRetention))
+	if err != nil {
+		return result, err
+	}
+	n, _ = res.RowsAffected()
+	result["job_runs_deleted"] = n
+
+	n, err = pruneAuditExports(ctx)
+	if err != nil {
+		return result, err
+	}
+	result["audit_exports_deleted"] = n
+
+	return result, nil
+}
+
+// runAPIKeyExpiry disables expired API keys and warns owners of keys expiring soon
+func runAPIKeyExpiry(ctx context.Context, rdb *redis.Client) (map[string]interface{}, error) {
+	result := map[string]interface{}{}
+
+	expired, err := ExpireAPIKeys(ctx, rdb)
+	result["keys_expired"] = expired
+	if err != nil {
+		return result, err
+	}
+
+	warned, err := WarnExpiringAPIKeys(ctx, KeyExpiryWarningWindow())
+	result["warnings_sent"] = warned
+	return result, err
+}
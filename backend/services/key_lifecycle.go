@@ -0,0 +1,440 @@
+package services
+
+import (
+	"context"
+	"crypto/rand"
+	"database/sql"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log/slog"
+	"strings"
+	"sync"
+	"time"
+
+	"zaps/db"
+
+	"github.com/google/uuid"
+	"github.com/lib/pq"
+	"github.com/redis/go-redis/v9"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+)
+
+// Key lifecycle: api_keys in Postgres is the source of truth, "apikey:<hash>" in Redis
+// is a read-through cache shared by all replicas, and each replica keeps a short-lived
+// in-process copy for AuthMiddleware. Every change drops the Redis entry and publishes
+// the hash on KeyInvalidationChannel so replicas evict their copy immediately.
+// Revoked and disabled keys also get a short tombstone so an in-flight read-through
+// cannot write a stale entry back.
+
+const (
+	KeyInvalidationChannel = "apikey:invalidate"
+	KeyRevokedRedisPrefix  = "apikey_revoked:"
+
+	// KeyRevocationTTL outlives any in-flight read-through of a revoked key
+	KeyRevocationTTL = 10 * time.Minute
+
+	// localKeyCacheTTL bounds staleness if an invalidation message is missed
+	localKeyCacheTTL = 30 * time.Second
+)
+
+// ErrAPIKeyNotFound is returned when a key does not exist for the tenant
+var ErrAPIKeyNotFound = errors.New("API key not found")
+
+// storeAPIKeyScript sets KEYS[1] unless the KEYS[2] tombstone exists.
+// ARGV[2] == "1" only overwrites an existing entry.
+var storeAPIKeyScript = redis.NewScript(`
+if redis.call('EXISTS', KEYS[2]) == 1 then
+	return 0
+end
+if ARGV[2] == '1' and redis.call('EXISTS', KEYS[1]) == 0 then
+	return 0
+end
+redis.call('SET', KEYS[1], ARGV[1])
+return 1
+`)
+
+type localKeyEntry struct {
+	key      *APIKey
+	loadedAt time.Time
+}
+
+// keyCache is a replica's in-process copy of API keys. It is only used while its
+// invalidation listener is running.
+type keyCache struct {
+	sync.RWMutex
+	enabled bool
+	entries map[string]localKeyEntry
+}
+
+func newKeyCache() *keyCache {
+	return &keyCache{entries: make(map[string]localKeyEntry)}
+}
+
+// localKeyCache is this process's cache, filled by AuthenticateAPIKey
+var localKeyCache = newKeyCache()
+
+func (kc *keyCache) evict(keyHash string) {
+	kc.Lock()
+	delete(kc.entries, keyHash)
+	kc.Unlock()
+}
+
+func (kc *keyCache) reset(enabled bool) {
+	kc.Lock()
+	kc.enabled = enabled
+	kc.entries = make(map[string]localKeyEntry)
+	kc.Unlock()
+}
+
+func evictLocalAPIKey(keyHash string) {
+	localKeyCache.evict(keyHash)
+}
+
+// AuthenticateAPIKey resolves a raw key for AuthMiddleware, from the in-process cache
+// when possible and otherwise through GetAPIKey. Callers must still check Enabled and Expired.
+func AuthenticateAPIKey(ctx context.Context, rdb *redis.Client, rawKey string) (*APIKey, error) {
+	return localKeyCache.authenticate(ctx, rdb, rawKey)
+}
+
+func (kc *keyCache) authenticate(ctx context.Context, rdb *redis.Client, rawKey string) (*APIKey, error) {
+	ctx, span := StartSpan(ctx, "auth.api_key")
+	defer span.End()
+	keyHash := HashAPIKey(rawKey)
+
+	kc.RLock()
+	entry, ok := kc.entries[keyHash]
+	enabled := kc.enabled
+	kc.RUnlock()
+	if ok && time.Since(entry.loadedAt) < localKeyCacheTTL {
+		span.SetAttributes(attribute.String("apikey.source", "memory"))
+		return entry.key, nil
+	}
+
+	apiKey, err := getAPIKey(ctx, rdb, rawKey)
+	if err != nil {
+		span.SetStatus(codes.Error, "API key not found")
+		return nil, err
+	}
+	if enabled {
+		kc.Lock()
+		kc.entries[keyHash] = localKeyEntry{key: apiKey, loadedAt: time.Now()}
+		kc.Unlock()
+	}
+	return apiKey, nil
+}
+
+// ListenForKeyInvalidations subscribes to KeyInvalidationChannel and evicts keys from
+// the in-process cache until ctx is cancelled. The cache is flushed whenever the
+// subscription is (re)established, since messages may have been missed meanwhile.
+func ListenForKeyInvalidations(ctx context.Context, rdb *redis.Client) {
+	localKeyCache.listen(ctx, rdb)
+}
+
+func (kc *keyCache) listen(ctx context.Context, rdb *redis.Client) {
+	pubsub := rdb.Subscribe(ctx, KeyInvalidationChannel)
+	defer pubsub.Close()
+	defer kc.reset(false)
+
+	for {
+		msg, err := pubsub.Receive(ctx)
+		if err != nil {
+			if ctx.Err() != nil {
+				return
+			}
+			// Stop serving from memory until the subscription is back
+			kc.reset(false)
+			slog.Warn("API key invalidation subscription error", "error", err)
+			select {
+			case <-ctx.Done():
+				return
+			case <-time.After(time.Second):
+			}
+			continue
+		}
+
+		switch m := msg.(type) {
+		case *redis.Subscription:
+			if m.Kind == "subscribe" {
+				kc.reset(true)
+			}
+		case *redis.Message:
+			kc.evict(m.Payload)
+		}
+	}
+}
+
+// ErrAPIKeyStore is returned when a key passed validation but could not be saved
+var ErrAPIKeyStore = errors.New("failed to store API key")
+
+// NewTenantAPIKey describes a dashboard key to create
+type NewTenantAPIKey struct {
+	TenantID    string
+	CreatedBy   string // User ID (optional)
+	Name        string
+	Limits      RateLimits
+	Policy      APIKeyPolicy
+	ExpiresAt   *time.Time
+	RotatedFrom string // Key this one replaces (optional)
+}
+
+// CreateTenantAPIKey generates a key, stores its hash in api_keys and syncs it to
+// Redis for AuthMiddleware. The returned APIKey carries the raw key in Key; it is
+// never stored and must be shown to the user only once.
+func CreateTenantAPIKey(rdb *redis.Client, n *NewTenantAPIKey) (*APIKey, error) {
+	if n.Limits.RPM < 0 || n.Limits.TPM < 0 {
+		return nil, fmt.Errorf("rate limits must not be negative")
+	}
+	if err := n.Policy.Validate(); err != nil {
+		return nil, err
+	}
+	if n.ExpiresAt != nil && !n.ExpiresAt.After(time.Now()) {
+		return nil, fmt.Errorf("expires_at must be in the future")
+	}
+	if n.Limits.RPM == 0 {
+		n.Limits.RPM = DefaultKeyRPM
+	}
+
+	// Generate Key (gk_ + 32 random hex chars)
+	bytes := make([]byte, 16)
+	if _, err := rand.Read(bytes); err != nil {
+		return nil, err
+	}
+	rawKey := ApiKeyPrefix + hex.EncodeToString(bytes)
+
+	apiKey := &APIKey{
+		ID:           uuid.New().String(),
+		Key:          rawKey,
+		KeyHash:      HashAPIKey(rawKey), // Only the hash is stored; the raw key is shown once
+		Prefix:       rawKey[:7] + "...", // Simplified prefix for display
+		Name:         n.Name,
+		CreatedAt:    time.Now(),
+		Enabled:      true,
+		OwnerID:      n.TenantID, // AuthMiddleware uses this as tenant_id
+		UserID:       n.CreatedBy,
+		ExpiresAt:    n.ExpiresAt,
+		RateLimit:    n.Limits.RPM,
+		TokenLimit:   n.Limits.TPM,
+		APIKeyPolicy: n.Policy,
+	}
+
+	var createdBy, rotatedFrom *string
+	if n.CreatedBy != "" {
+		createdBy = &n.CreatedBy
+	}
+	if n.RotatedFrom != "" {
+		rotatedFrom = &n.RotatedFrom
+	}
+
+	_, err := db.DB.Exec(`
+		INSERT INTO api_keys (id, tenant_id, name, key_prefix, key_hash, enabled, created_at, created_by,
+			expires_at, rotated_from, rate_limit_rpm, rate_limit_tpm,
+			scopes, allowed_models, allowed_providers, allowed_cidrs, max_tokens_per_request, capture_bodies)
+		VALUES ($1, $2, $3, $4, $5, $6, $7, $8, $9, $10, $11, NULLIF($12, 0), $13, $14, $15, $16, NULLIF($17, 0), $18)
+	`, apiKey.ID, n.TenantID, apiKey.Name, apiKey.Prefix, apiKey.KeyHash, apiKey.Enabled, apiKey.CreatedAt, createdBy,
+		apiKey.ExpiresAt, rotatedFrom, n.Limits.RPM, n.Limits.TPM,
+		pq.Array(n.Policy.Scopes), pq.Array(n.Policy.AllowedModels), pq.Array(n.Policy.AllowedProviders),
+		pq.Array(n.Policy.AllowedCIDRs), n.Policy.MaxTokensPerRequest, n.Policy.CaptureBodies)
+	if err != nil {
+		slog.Error("failed to insert API key", "error", err)
+		return nil, ErrAPIKeyStore
+	}
+
+	// Sync to Redis for AuthMiddleware
+	if err := StoreAPIKey(rdb, apiKey); err != nil {
+		slog.Warn("failed to cache API key", "key_id", apiKey.ID, "error", err)
+	}
+
+	return apiKey, nil
+}
+
+// DisableAPIKey switches a key off without deleting it. It stops working on every
+// replica immediately and can be re-enabled later.
+func DisableAPIKey(rdb *redis.Client, tenantID, keyID string) error {
+	keyHash, err := setAPIKeyEnabled(rdb, tenantID, keyID, false)
+	if err != nil {
+		return err
+	}
+	return invalidateAPIKey(rdb, keyHash, true)
+}
+
+// EnableAPIKey switches a disabled key back on
+func EnableAPIKey(rdb *redis.Client, tenantID, keyID string) error {
+	keyHash, err := setAPIKeyEnabled(rdb, tenantID, keyID, true)
+	if err != nil {
+		return err
+	}
+	rdb.Del(context.Background(), KeyRevokedRedisPrefix+keyHash)
+	return DeleteAPIKey(rdb, keyHash)
+}
+
+func setAPIKeyEnabled(rdb *redis.Client, tenantID, keyID string, enabled bool) (string, error) {
+	var keyHash string
+	var hashed bool
+	err := db.DB.QueryRow(`
+		UPDATE api_keys SET enabled = $3
+		WHERE id = $1 AND tenant_id = $2
+		RETURNING key_hash, key_hashed
+	`, keyID, tenantID, enabled).Scan(&keyHash, &hashed)
+	if err == sql.ErrNoRows {
+		return "", ErrAPIKeyNotFound
+	}
+	if err != nil {
+		return "", err
+	}
+	return rowKeyHash(rdb, keyHash, hashed), nil
+}
+
+// RevokeAPIKey permanently deletes a key and drops it from every replica
+func RevokeAPIKey(rdb *redis.Client, tenantID, keyID string) error {
+	var keyHash string
+	var hashed bool
+	err := db.DB.QueryRow(`
+		DELETE FROM api_keys WHERE id = $1 AND tenant_id = $2
+		RETURNING key_hash, key_hashed
+	`, keyID, tenantID).Scan(&keyHash, &hashed)
+	if err == sql.ErrNoRows {
+		return ErrAPIKeyNotFound
+	}
+	if err != nil {
+		return err
+	}
+	return invalidateAPIKey(rdb, rowKeyHash(rdb, keyHash, hashed), true)
+}
+
+// RevokeAPIKeyHash permanently deletes a key by hash, whether it is a tenant key with
+// an api_keys row or a Redis-only admin key, and drops it from every replica
+func RevokeAPIKeyHash(rdb *redis.Client, keyHash string) error {
+	if _, err := db.DB.Exec("DELETE FROM api_keys WHERE key_hash = $1", keyHash); err != nil {
+		return err
+	}
+	return invalidateAPIKey(rdb, keyHash, true)
+}
+
+// CreateAdminAPIKey generates a Redis-only key owned by an admin user. The returned
+// APIKey carries the raw key in Key, which is shown once and never stored.
+func CreateAdminAPIKey(rdb *redis.Client, owner, name string) (*APIKey, error) {
+	rawKey, err := GenerateAPIKey()
+	if err != nil {
+		return nil, err
+	}
+	apiKey := &APIKey{
+		Key:       rawKey,
+		Name:      name,
+		CreatedAt: time.Now(),
+		Enabled:   true,
+		OwnerID:   owner,
+	}
+	if err := StoreAPIKey(rdb, apiKey); err != nil {
+		slog.Error("failed to store admin API key", "error", err)
+		return nil, ErrAPIKeyStore
+	}
+	return apiKey, nil
+}
+
+// rowKeyHash returns the hash of an api_keys key_hash value. Rows created before key
+// hashing (key_hashed = FALSE) still hold the raw key, so it is hashed here and its
+// legacy "apikey:<raw>" Redis entry is dropped; the raw key is never published or
+// used in a Redis key name.
+func rowKeyHash(rdb *redis.Client, keyHash string, hashed bool) string {
+	if hashed {
+		return keyHash
+	}
+	rdb.Del(context.Background(), RedisKeyPrefix+keyHash)
+	return HashAPIKey(keyHash)
+}
+
+// invalidateAPIKey drops a key from Redis and all replicas, optionally leaving a
+// tombstone that blocks read-through writes for KeyRevocationTTL
+func invalidateAPIKey(rdb *redis.Client, keyHash string, tombstone bool) error {
+	ctx := context.Background()
+	evictLocalAPIKey(keyHash)
+
+	pipe := rdb.TxPipeline()
+	if tombstone {
+		pipe.Set(ctx, KeyRevokedRedisPrefix+keyHash, 1, KeyRevocationTTL)
+	}
+	pipe.Del(ctx, RedisKeyPrefix+keyHash)
+	pipe.Publish(ctx, KeyInvalidationChannel, keyHash)
+	if _, err := pipe.Exec(ctx); err != nil {
+		slog.Error("failed to invalidate API key cache", "error", err)
+		return err
+	}
+	return nil
+}
+
+// KeySyncResult summarises a SyncAPIKeys run
+type KeySyncResult struct {
+	Checked   int `json:"checked"`
+	Refreshed int `json:"refreshed"`
+	Removed   int `json:"removed"`
+}
+
+// SyncAPIKeys reconciles cached Redis entries with api_keys. Entries whose row is gone,
+// disabled or expired are removed everywhere; the rest are refreshed from Postgres.
+// Redis-only keys (legacy admin and device keys) have no row and are left alone.
+func SyncAPIKeys(ctx context.Context, rdb *redis.Client) (*KeySyncResult, error) {
+	result := &KeySyncResult{}
+
+	cached := make(map[string]*APIKey) // api_keys.id -> cached entry
+	iter := rdb.Scan(ctx, 0, RedisKeyPrefix+"*", 500).Iterator()
+	for iter.Next(ctx) {
+		data, err := rdb.Get(ctx, iter.Val()).Result()
+		if err != nil {
+			continue
+		}
+		var apiKey APIKey
+		if err := json.Unmarshal([]byte(data), &apiKey); err != nil || apiKey.ID == "" || apiKey.KeyHash == "" {
+			continue
+		}
+		if strings.TrimPrefix(iter.Val(), RedisKeyPrefix) != apiKey.KeyHash {
+			continue
+		}
+		cached[apiKey.ID] = &apiKey
+	}
+	if err := iter.Err(); err != nil {
+		return result, err
+	}
+	result.Checked = len(cached)
+	if len(cached) == 0 {
+		return result, nil
+	}
+
+	ids := make([]string, 0, len(cached))
+	for id := range cached {
+		ids = append(ids, id)
+	}
+	rows, err := db.DB.QueryContext(ctx, `
+		SELECT `+apiKeyColumns+`
+		FROM api_keys WHERE id = ANY($1::uuid[])`, pq.Array(ids))
+	if err != nil {
+		return result, err
+	}
+	current := make(map[string]*APIKey)
+	for rows.Next() {
+		if k, _, err := scanAPIKeyRow(rows); err == nil {
+			current[k.ID] = k
+		}
+	}
+	rows.Close()
+
+	for id, entry := range cached {
+		fresh, ok := current[id]
+		if !ok || !fresh.Enabled || fresh.Expired() || fresh.KeyHash != entry.KeyHash {
+			if err := invalidateAPIKey(rdb, entry.KeyHash, !ok); err == nil {
+				result.Removed++
+			}
+			continue
+		}
+
+		fresh.UsageCount = entry.UsageCount
+		fresh.LastUsedAt = entry.LastUsedAt
+		if _, err := storeAPIKey(ctx, rdb, fresh, true); err != nil {
+			return result, err
+		}
+		result.Refreshed++
+	}
+	return result, nil
+}
@@ -0,0 +1,177 @@
+package services
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/DATA-DOG/go-sqlmock"
+	"github.com/redis/go-redis/v9"
+)
+
+// startReplica runs a second gateway's key cache and invalidation listener against rdb
+func startReplica(t *testing.T, rdb *redis.Client) *keyCache {
+	t.Helper()
+	ctx, cancel := context.WithCancel(context.Background())
+	t.Cleanup(cancel)
+	kc := newKeyCache()
+	go kc.listen(ctx, rdb)
+	waitFor(t, "replica subscription", func() bool {
+		kc.RLock()
+		defer kc.RUnlock()
+		return kc.enabled
+	})
+	return kc
+}
+
+func (kc *keyCache) cached(keyHash string) bool {
+	kc.RLock()
+	defer kc.RUnlock()
+	_, ok := kc.entries[keyHash]
+	return ok
+}
+
+// waitFor polls cond for well under localKeyCacheTTL
+func waitFor(t *testing.T, what string, cond func() bool) {
+	t.Helper()
+	deadline := time.Now().Add(time.Second)
+	for !cond() {
+		if time.Now().After(deadline) {
+			t.Fatalf("timed out waiting for %s", what)
+		}
+		time.Sleep(5 * time.Millisecond)
+	}
+}
+
+// assertRevokedEverywhere checks that a replica which had the key cached rejects it
+// right away and that a stale read-through cannot bring it back
+func assertRevokedEverywhere(t *testing.T, mock sqlmock.Sqlmock, rdbB *redis.Client, replica *keyCache, apiKey *APIKey, rawKey string) {
+	t.Helper()
+	ctx := context.Background()
+
+	waitFor(t, "invalidation on the other replica", func() bool { return !replica.cached(apiKey.KeyHash) })
+
+	mock.ExpectQuery(`SELECT .+ FROM api_keys`).WillReturnRows(noRows("id"))
+	if _, err := replica.authenticate(ctx, rdbB, rawKey); err == nil {
+		t.Fatal("revoked key still authenticates on the other replica")
+	}
+
+	if err := StoreAPIKey(rdbB, apiKey); err != nil {
+		t.Fatal(err)
+	}
+	if n, _ := rdbB.Exists(ctx, RedisKeyPrefix+apiKey.KeyHash).Result(); n != 0 {
+		t.Fatal("read-through wrote a revoked key back to Redis")
+	}
+	if ttl := rdbB.TTL(ctx, KeyRevokedRedisPrefix+apiKey.KeyHash).Val(); ttl <= 0 || ttl > KeyRevocationTTL {
+		t.Fatalf("tombstone TTL = %v", ttl)
+	}
+}
+
+func TestRevokeAPIKeyTakesEffectOnOtherReplicas(t *testing.T) {
+	mr, rdbA := newTestRedis(t)
+	rdbB := redis.NewClient(&redis.Options{Addr: mr.Addr()})
+	defer rdbB.Close()
+	mock := newMockDB(t)
+	ctx := context.Background()
+
+	rawKey := ApiKeyPrefix + "0123456789abcdef0123456789abcdef"
+	apiKey := &APIKey{
+		ID:        "6f1c7e0e-2d5f-4c1e-9a53-3c9d3c2a0b11",
+		Key:       rawKey,
+		Name:      "ci",
+		CreatedAt: time.Now(),
+		Enabled:   true,
+		OwnerID:   "0b8f4f7c-6a3e-4d0b-8a0f-2f6c1e9d5a22",
+	}
+	if err := StoreAPIKey(rdbA, apiKey); err != nil {
+		t.Fatal(err)
+	}
+
+	replica := startReplica(t, rdbB)
+	if _, err := replica.authenticate(ctx, rdbB, rawKey); err != nil {
+		t.Fatalf("authenticate before revocation: %v", err)
+	}
+	if !replica.cached(apiKey.KeyHash) {
+		t.Fatal("key not cached in memory on the replica")
+	}
+
+	mock.ExpectQuery(`DELETE FROM api_keys WHERE id = \$1 AND tenant_id = \$2`).
+		WithArgs(apiKey.ID, apiKey.OwnerID).
+		WillReturnRows(sqlmock.NewRows([]string{"key_hash", "key_hashed"}).AddRow(apiKey.KeyHash, true))
+	if err := RevokeAPIKey(rdbA, apiKey.OwnerID, apiKey.ID); err != nil {
+		t.Fatal(err)
+	}
+
+	assertRevokedEverywhere(t, mock, rdbB, replica, apiKey, rawKey)
+}
+
+func TestRevokeUnhashedAPIKeyNeverExposesRawKey(t *testing.T) {
+	_, rdb := newTestRedis(t)
+	mock := newMockDB(t)
+	ctx := context.Background()
+
+	rawKey := ApiKeyPrefix + "fedcba9876543210fedcba9876543210"
+	keyHash := HashAPIKey(rawKey)
+	tenantID := "0b8f4f7c-6a3e-4d0b-8a0f-2f6c1e9d5a22"
+	rdb.Set(ctx, RedisKeyPrefix+rawKey, `{"name":"legacy"}`, 0)
+	rdb.Set(ctx, RedisKeyPrefix+keyHash, `{"name":"legacy"}`, 0)
+
+	sub := rdb.Subscribe(ctx, KeyInvalidationChannel)
+	defer sub.Close()
+	if _, err := sub.Receive(ctx); err != nil {
+		t.Fatal(err)
+	}
+
+	keyID := "6f1c7e0e-2d5f-4c1e-9a53-3c9d3c2a0b11"
+	mock.ExpectQuery(`DELETE FROM api_keys WHERE id = \$1 AND tenant_id = \$2`).
+		WithArgs(keyID, tenantID).
+		WillReturnRows(sqlmock.NewRows([]string{"key_hash", "key_hashed"}).AddRow(rawKey, false))
+	if err := RevokeAPIKey(rdb, tenantID, keyID); err != nil {
+		t.Fatal(err)
+	}
+
+	msg, err := sub.ReceiveMessage(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if msg.Payload != keyHash {
+		t.Fatalf("published %q, want the key hash", msg.Payload)
+	}
+	if n := rdb.Exists(ctx, RedisKeyPrefix+rawKey, RedisKeyPrefix+keyHash).Val(); n != 0 {
+		t.Fatalf("%d Redis entries left for the revoked key", n)
+	}
+	if n := rdb.Exists(ctx, KeyRevokedRedisPrefix+rawKey).Val(); n != 0 {
+		t.Fatal("tombstone named after the raw key")
+	}
+	if n := rdb.Exists(ctx, KeyRevokedRedisPrefix+keyHash).Val(); n != 1 {
+		t.Fatal("no tombstone for the key hash")
+	}
+}
+
+func TestRevokeAdminAPIKeyTakesEffectOnOtherReplicas(t *testing.T) {
+	mr, rdbA := newTestRedis(t)
+	rdbB := redis.NewClient(&redis.Options{Addr: mr.Addr()})
+	defer rdbB.Close()
+	mock := newMockDB(t)
+	ctx := context.Background()
+
+	apiKey, err := CreateAdminAPIKey(rdbA, "admin", "ops")
+	if err != nil {
+		t.Fatal(err)
+	}
+	rawKey := apiKey.Key
+
+	replica := startReplica(t, rdbB)
+	if _, err := replica.authenticate(ctx, rdbB, rawKey); err != nil {
+		t.Fatalf("authenticate before revocation: %v", err)
+	}
+
+	mock.ExpectExec(`DELETE FROM api_keys WHERE key_hash = \$1`).
+		WithArgs(apiKey.KeyHash).
+		WillReturnResult(sqlmock.NewResult(0, 0))
+	if err := RevokeAPIKeyHash(rdbA, apiKey.KeyHash); err != nil {
+		t.Fatal(err)
+	}
+
+	assertRevokedEverywhere(t, mock, rdbB, replica, apiKey, rawKey)
+}
@@ -0,0 +1,135 @@
+package services
+
+import (
+	"database/sql"
+	"fmt"
+	"net"
+	"strings"
+
+	"zaps/db"
+
+	"github.com/lib/pq"
+	"github.com/redis/go-redis/v9"
+)
+
+const (
+	ScopeChat       = "chat"
+	ScopeEmbeddings = "embeddings"
+	ScopeModelsRead = "models:read"
+)
+
+// KeyScopes lists every scope a key can be granted
+var KeyScopes = []string{ScopeChat, ScopeEmbeddings, ScopeModelsRead}
+
+// APIKeyPolicy restricts what a key may do. Empty lists and 0 mean unrestricted,
+// so keys created before policies existed keep full access.
+type APIKeyPolicy struct {
+	Scopes              []string `json:"scopes,omitempty"`
+	AllowedModels       []string `json:"allowed_models,omitempty"`
+	AllowedProviders    []string `json:"allowed_providers,omitempty"`
+	AllowedCIDRs        []string `json:"allowed_cidrs,omitempty"`
+	MaxTokensPerRequest int      `json:"max_tokens_per_request,omitempty"` // Upper bound for a request's max_tokens
+	CaptureBodies       bool     `json:"capture_bodies,omitempty"`         // Store encrypted request/response bodies (see CapturePrompt)
+}
+
+// Validate checks scopes and CIDRs and normalises bare IPs to single-host CIDRs
+func (p *APIKeyPolicy) Validate() error {
+	for _, s := range p.Scopes {
+		if !containsString(KeyScopes, s) {
+			return fmt.Errorf("unknown scope %q (valid: %s)", s, strings.Join(KeyScopes, ", "))
+		}
+	}
+	for i, cidr := range p.AllowedCIDRs {
+		if !strings.Contains(cidr, "/") {
+			ip := net.ParseIP(cidr)
+			if ip == nil {
+				return fmt.Errorf("invalid CIDR %q", cidr)
+			}
+			if ip.To4() != nil {
+				cidr += "/32"
+			} else {
+				cidr += "/128"
+			}
+		}
+		_, network, err := net.ParseCIDR(cidr)
+		if err != nil {
+			return fmt.Errorf("invalid CIDR %q", cidr)
+		}
+		p.AllowedCIDRs[i] = network.String()
+	}
+	if p.MaxTokensPerRequest < 0 {
+		return fmt.Errorf("max_tokens_per_request must not be negative")
+	}
+	return nil
+}
+
+// HasScope reports whether the key may use a scope
+func (p *APIKeyPolicy) HasScope(scope string) bool {
+	return len(p.Scopes) == 0 || containsString(p.Scopes, scope)
+}
+
+// AllowsModel reports whether the key may use a model. Pass the model a request
+// resolved to, so aliases and routing rules cannot reach models off the list.
+func (p *APIKeyPolicy) AllowsModel(model string) bool {
+	return len(p.AllowedModels) == 0 || containsString(p.AllowedModels, strings.TrimPrefix(model, "models/"))
+}
+
+// AllowsProvider reports whether the key may reach a provider
+func (p *APIKeyPolicy) AllowsProvider(provider string) bool {
+	return len(p.AllowedProviders) == 0 || containsString(p.AllowedProviders, provider)
+}
+
+// AllowsIP reports whether a client IP is inside one of the allowed CIDRs. ip must
+// be a single address resolved from trusted hops only (see api.ClientIP).
+func (p *APIKeyPolicy) AllowsIP(ip string) bool {
+	if len(p.AllowedCIDRs) == 0 {
+		return true
+	}
+	parsed := net.ParseIP(ip)
+	if parsed == nil {
+		return false
+	}
+	for _, cidr := range p.AllowedCIDRs {
+		if _, network, err := net.ParseCIDR(cidr); err == nil && network.Contains(parsed) {
+			return true
+		}
+	}
+	return false
+}
+
+// SetAPIKeyPolicy stores a key's policy and drops its cached Redis entry so
+// AuthMiddleware reloads it from the database.
+func SetAPIKeyPolicy(rdb *redis.Client, tenantID, keyID string, p *APIKeyPolicy) (bool, error) {
+	if err := p.Validate(); err != nil {
+		return false, err
+	}
+
+	var keyHash string
+	var hashed bool
+	err := db.DB.QueryRow(`
+		UPDATE api_keys
+		SET scopes = $3, allowed_models = $4, allowed_providers = $5, allowed_cidrs = $6,
+			max_tokens_per_request = NULLIF($7, 0), capture_bodies = $8
+		WHERE id = $1 AND tenant_id = $2
+		RETURNING key_hash, key_hashed
+	`, keyID, tenantID, pq.Array(p.Scopes), pq.Array(p.AllowedModels), pq.Array(p.AllowedProviders),
+		pq.Array(p.AllowedCIDRs), p.MaxTokensPerRequest, p.CaptureBodies).Scan(&keyHash, &hashed)
+	if err == sql.ErrNoRows {
+		return false, nil
+	}
+	if err != nil {
+		return false, err
+	}
+
+	DeleteAPIKey(rdb, rowKeyHash(rdb, keyHash, hashed))
+	return true, nil
+}
+
+func containsString(list []string, s string) bool {
+	for _, v := range list {
+		if v == s {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,170 @@
+package services
+
+import (
+	"context"
+	"errors"
+	"log/slog"
+	"os"
+	"strconv"
+	"time"
+
+	"zaps/db"
+
+	"github.com/redis/go-redis/v9"
+)
+
+const (
+	DefaultKeyRotationGrace       = 24 * time.Hour
+	DefaultKeyExpiryWarningWindow = 7 * 24 * time.Hour
+)
+
+// ErrAPIKeyInactive is returned when rotating a disabled or expired key
+var ErrAPIKeyInactive = errors.New("only active keys can be rotated")
+
+// KeyRotationGrace is how long a rotated key keeps working (API_KEY_ROTATION_GRACE_HOURS)
+func KeyRotationGrace() time.Duration {
+	if h, err := strconv.Atoi(os.Getenv("API_KEY_ROTATION_GRACE_HOURS")); err == nil && h >= 0 {
+		return time.Duration(h) * time.Hour
+	}
+	return DefaultKeyRotationGrace
+}
+
+// KeyExpiryWarningWindow is how long before expiry owners are emailed (API_KEY_EXPIRY_WARNING_DAYS)
+func KeyExpiryWarningWindow() time.Duration {
+	if d, err := strconv.Atoi(os.Getenv("API_KEY_EXPIRY_WARNING_DAYS")); err == nil && d > 0 {
+		return time.Duration(d) * 24 * time.Hour
+	}
+	return DefaultKeyExpiryWarningWindow
+}
+
+// RotateAPIKey issues a replacement for a key with the same name, limits and policy.
+// The old key stays valid for the grace period (or until its own expiry, if sooner).
+// A new key inherits the old key's lifetime when the old key had an expiry.
+func RotateAPIKey(rdb *redis.Client, tenantID, keyID, userID string, grace time.Duration) (*APIKey, time.Time, error) {
+	old, _, err := scanAPIKeyRow(db.DB.QueryRow(`
+		SELECT `+apiKeyColumns+`
+		FROM api_keys WHERE id = $1 AND tenant_id = $2`, keyID, tenantID))
+	if err != nil {
+		return nil, time.Time{}, err
+	}
+	if !old.Enabled || old.Expired() {
+		return nil, time.Time{}, ErrAPIKeyInactive
+	}
+
+	var expiresAt *time.Time
+	if old.ExpiresAt != nil {
+		t := time.Now().Add(old.ExpiresAt.Sub(old.CreatedAt))
+		expiresAt = &t
+	}
+
+	newKey, err := CreateTenantAPIKey(rdb, &NewTenantAPIKey{
+		TenantID:    tenantID,
+		CreatedBy:   userID,
+		Name:        old.Name,
+		Limits:      RateLimits{RPM: old.RateLimit, TPM: old.TokenLimit},
+		Policy:      old.APIKeyPolicy,
+		ExpiresAt:   expiresAt,
+		RotatedFrom: old.ID,
+	})
+	if err != nil {
+		return nil, time.Time{}, err
+	}
+
+	// Shorten the old key's life to the grace window; no expiry warning is needed for it
+	var oldExpiresAt time.Time
+	var oldHash string
+	err = db.DB.QueryRow(`
+		UPDATE api_keys
+		SET expires_at = LEAST(COALESCE(expires_at, $2), $2), expiry_warned_at = NOW()
+		WHERE id = $1
+		RETURNING expires_at, key_hash
+	`, old.ID, time.Now().Add(grace)).Scan(&oldExpiresAt, &oldHash)
+	if err != nil {
+		return newKey, time.Time{}, err
+	}
+	DeleteAPIKey(rdb, oldHash)
+
+	return newKey, oldExpiresAt, nil
+}
+
+// ExpireAPIKeys disables every key past its expires_at and drops it from Redis
+func ExpireAPIKeys(ctx context.Context, rdb *redis.Client) (int, error) {
+	rows, err := db.DB.QueryContext(ctx, `
+		UPDATE api_keys SET enabled = FALSE
+		WHERE enabled = TRUE AND expires_at <= NOW()
+		RETURNING id, tenant_id, key_hash, name
+	`)
+	if err != nil {
+		return 0, err
+	}
+	defer rows.Close()
+
+	expired := 0
+	for rows.Next() {
+		var id, tenantID, keyHash, name string
+		if err := rows.Scan(&id, &tenantID, &keyHash, &name); err != nil {
+			continue
+		}
+		expired++
+		DeleteAPIKey(rdb, keyHash)
+		LogAuditAsync(tenantID, nil, "API_KEY_EXPIRED", map[string]interface{}{
+			"key_id": id,
+			"name":   name,
+		}, "", "scheduler")
+	}
+	return expired, rows.Err()
+}
+
+// WarnExpiringAPIKeys emails the owner of each key expiring within the window, once per key.
+// Keys that have already been rotated are skipped. The owner is the key's creator, or
+// the tenant's first user when the creator is gone.
+func WarnExpiringAPIKeys(ctx context.Context, within time.Duration) (int, error) {
+	rows, err := db.DB.QueryContext(ctx, `
+		SELECT k.id, k.tenant_id, k.name, k.key_prefix, k.expires_at,
+			COALESCE(u.email, (SELECT email FROM users WHERE tenant_id = k.tenant_id ORDER BY created_at LIMIT 1), '')
+		FROM api_keys k
+		LEFT JOIN users u ON u.id = k.created_by
+		WHERE k.enabled = TRUE
+			AND k.expiry_warned_at IS NULL
+			AND k.expires_at > NOW()
+			AND k.expires_at <= NOW() + make_interval(secs => $1)
+			AND NOT EXISTS (SELECT 1 FROM api_keys r WHERE r.rotated_from = k.id)
+	`, within.Seconds())
+	if err != nil {
+		return 0, err
+	}
+
+	type expiring struct {
+		id, tenantID, name, prefix, email string
+		expiresAt                         time.Time
+	}
+	var keys []expiring
+	for rows.Next() {
+		var k expiring
+		if err := rows.Scan(&k.id, &k.tenantID, &k.name, &k.prefix, &k.expiresAt, &k.email); err != nil {
+			continue
+		}
+		keys = append(keys, k)
+	}
+	rows.Close()
+
+	warned := 0
+	for _, k := range keys {
+		if k.email == "" {
+			continue
+		}
+		if err := SendAPIKeyExpiryWarningEmail(k.email, k.name, k.prefix, k.expiresAt); err != nil {
+			continue // Retried on the next run
+		}
+		if _, err := db.DB.ExecContext(ctx, "UPDATE api_keys SET expiry_warned_at = NOW() WHERE id = $1", k.id); err != nil {
+			slog.Warn("failed to mark API key expiry warning", "key_id", k.id, "error", err)
+		}
+		warned++
+		LogAuditAsync(k.tenantID, nil, "API_KEY_EXPIRY_WARNING", map[string]interface{}{
+			"key_id":     k.id,
+			"name":       k.name,
+			"expires_at": k.expiresAt,
+		}, "", "scheduler")
+	}
+	return warned, nil
+}
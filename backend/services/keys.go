@@ -2,11 +2,20 @@ package services
 
 import (
 	"context"
+	"crypto/hmac"
 	"crypto/rand"
+	"crypto/sha256"
+	"database/sql"
 	"encoding/base64"
+	"encoding/hex"
 	"encoding/json"
+	"errors"
+	"log/slog"
+	"os"
+	"strings"
 	"time"
 
+	"github.com/lib/pq"
 	"github.com/redis/go-redis/v9"
 
 	"zaps/db"
@@ -14,15 +23,22 @@ import (
 
 // APIKey represents a stored API credential in Redis
 type APIKey struct {
-	Key         string    `json:"key"`
-	Name        string    `json:"name"`
-	Description string    `json:"description"`
-	CreatedAt   time.Time `json:"created_at"`
-	LastUsedAt  time.Time `json:"last_used_at"`
-	UsageCount  int64     `json:"usage_count"`
-	RateLimit   int       `json:"rate_limit"` // requests per minute
-	Enabled     bool      `json:"enabled"`
-	OwnerID     string    `json:"owner_id"` // User/Tenant ID
+	ID          string     `json:"id,omitempty"`  // api_keys.id (empty for legacy admin keys)
+	Key         string     `json:"key,omitempty"` // Raw key: only set in memory when generated (or in legacy entries), never persisted
+	KeyHash     string     `json:"key_hash"`      // HashAPIKey(raw key); also the Redis key suffix
+	Prefix      string     `json:"prefix,omitempty"`
+	Name        string     `json:"name"`
+	Description string     `json:"description"`
+	CreatedAt   time.Time  `json:"created_at"`
+	LastUsedAt  time.Time  `json:"last_used_at"`
+	UsageCount  int64      `json:"usage_count"`
+	RateLimit   int        `json:"rate_limit"`                 // requests per minute (0 = DefaultKeyRPM)
+	TokenLimit  int        `json:"token_rate_limit,omitempty"` // tokens per minute (0 = unlimited)
+	Enabled     bool       `json:"enabled"`
+	OwnerID     string     `json:"owner_id"`          // User/Tenant ID
+	UserID      string     `json:"user_id,omitempty"` // Creator (api_keys.created_by)
+	ExpiresAt   *time.Time `json:"expires_at,omitempty"`
+	APIKeyPolicy
 }
 
 const (
@@ -40,23 +56,72 @@ func GenerateAPIKey() (string, error) {
 	return ApiKeyPrefix + base64.URLEncoding.EncodeToString(bytes)[:ApiKeyLength], nil
 }
 
-// StoreAPIKey saves an API key to Redis
+// HashAPIKey returns the at-rest identifier of a raw key: HMAC-SHA256 keyed with
+// API_KEY_HASH_SECRET when set, plain SHA-256 otherwise. Changing the secret
+// invalidates every existing key.
+func HashAPIKey(rawKey string) string {
+	if secret := os.Getenv("API_KEY_HASH_SECRET"); secret != "" {
+		mac := hmac.New(sha256.New, []byte(secret))
+		mac.Write([]byte(rawKey))
+		return hex.EncodeToString(mac.Sum(nil))
+	}
+	sum := sha256.Sum256([]byte(rawKey))
+	return hex.EncodeToString(sum[:])
+}
+
+// DisplayPrefix returns the non-secret part of a key shown in dashboards
+func DisplayPrefix(rawKey string) string {
+	if len(rawKey) > 12 {
+		return rawKey[:12] + "..."
+	}
+	return ApiKeyPrefix + "???..."
+}
+
+// StoreAPIKey saves an API key to Redis under its hash. The raw key is never written.
+// Keys revoked in the last KeyRevocationTTL are not written back (see RevokeAPIKey).
 func StoreAPIKey(rdb *redis.Client, apiKey *APIKey) error {
-	data, err := json.Marshal(apiKey)
+	_, err := storeAPIKey(context.Background(), rdb, apiKey, false)
+	return err
+}
+
+// storeAPIKey writes the Redis entry unless the key is tombstoned. With mustExist it
+// only overwrites an entry that is still present, so a concurrent delete wins.
+func storeAPIKey(ctx context.Context, rdb *redis.Client, apiKey *APIKey, mustExist bool) (bool, error) {
+	if apiKey.KeyHash == "" {
+		apiKey.KeyHash = HashAPIKey(apiKey.Key)
+	}
+	if apiKey.Prefix == "" && apiKey.Key != "" {
+		apiKey.Prefix = DisplayPrefix(apiKey.Key)
+	}
+
+	stored := *apiKey
+	stored.Key = ""
+	data, err := json.Marshal(stored)
 	if err != nil {
-		return err
+		return false, err
 	}
 
-	key := RedisKeyPrefix + apiKey.Key
-	return rdb.Set(context.Background(), key, data, 0).Err()
+	flag := "0"
+	if mustExist {
+		flag = "1"
+	}
+	n, err := storeAPIKeyScript.Run(ctx, rdb,
+		[]string{RedisKeyPrefix + apiKey.KeyHash, KeyRevokedRedisPrefix + apiKey.KeyHash},
+		data, flag).Int()
+	return n == 1, err
 }
 
-// GetAPIKey retrieves an API key from Redis
+// GetAPIKey retrieves an API key by its raw value, from Redis then Postgres.
+// Keys still stored in the legacy raw form are rehashed on first use.
 func GetAPIKey(rdb *redis.Client, key string) (*APIKey, error) {
-	redisKey := RedisKeyPrefix + key
-	data, err := rdb.Get(context.Background(), redisKey).Result()
+	return getAPIKey(context.Background(), rdb, key)
+}
+
+func getAPIKey(ctx context.Context, rdb *redis.Client, key string) (*APIKey, error) {
+	keyHash := HashAPIKey(key)
 
 	// 1. Found in Redis
+	data, err := rdb.Get(ctx, RedisKeyPrefix+keyHash).Result()
 	if err == nil {
 		var apiKey APIKey
 		if err := json.Unmarshal([]byte(data), &apiKey); err == nil {
@@ -64,67 +129,165 @@ func GetAPIKey(rdb *redis.Client, key string) (*APIKey, error) {
 		}
 	}
 
-	// 2. Fallback to DB
-	// Note: We need to import zaps/db. Ideally this should be dependency injected,
-	// but for now we reference the global DB as the rest of the app does.
-	var k struct {
-		ID        string
-		TenantID  string
-		Name      string
-		KeyPrefix string
-		KeyHash   string
-		Enabled   bool
-		CreatedAt time.Time
-	}
-
-	// Query DB for specific key_hash (raw key)
-	// Note: In real prod, we'd hash the input 'key' before querying 'key_hash'.
-	// But our current implementation stores RAW keys in key_hash for simplicity (as noted in CreateAPIKey).
-	err = db.DB.QueryRow(`
-		SELECT id, tenant_id, name, key_prefix, key_hash, enabled, created_at 
-		FROM api_keys WHERE key_hash = $1`, key).Scan(
-		&k.ID, &k.TenantID, &k.Name, &k.KeyPrefix, &k.KeyHash, &k.Enabled, &k.CreatedAt,
-	)
+	// 1b. Legacy Redis entry stored under the raw key
+	legacyRedisKey := RedisKeyPrefix + key
+	if data, err := rdb.Get(ctx, legacyRedisKey).Result(); err == nil {
+		var apiKey APIKey
+		if err := json.Unmarshal([]byte(data), &apiKey); err == nil {
+			apiKey.Key = key
+			err := migrateLegacyRedisKey(ctx, rdb, legacyRedisKey, &apiKey)
+			if errors.Is(err, errLegacyKeyRevoked) {
+				return nil, sql.ErrNoRows
+			}
+			if err != nil {
+				slog.WarnContext(ctx, "failed to rehash legacy API key", "key_prefix", apiKey.Prefix, "error", err)
+			}
+			return &apiKey, nil
+		}
+	}
 
+	// 2. Fallback to DB
+	// Rows created before key hashing hold the raw key until cmd/rehash_keys runs
+	ctx, span := StartSpan(ctx, "apikey.db_lookup")
+	defer span.End()
+	apiKey, hashed, err := scanAPIKeyRow(db.DB.QueryRowContext(ctx, `
+		SELECT `+apiKeyColumns+`
+		FROM api_keys
+		WHERE key_hash = $1 OR (key_hash = $2 AND key_hashed = FALSE)`, keyHash, key))
 	if err != nil {
+		if err != sql.ErrNoRows {
+			ObserveBackendError(BackendPostgres, "api_key_lookup")
+		}
 		return nil, err // Not found in DB either
 	}
 
-	// 3. Reconstruct APIKey object
-	apiKey := APIKey{
-		Key:       k.KeyHash,
-		Name:      k.Name,
-		Enabled:   k.Enabled,
-		CreatedAt: k.CreatedAt,
-		OwnerID:   k.TenantID,
-		// Missing fields from DB: Description, UsageCount (in usage_logs?), RateLimit
-		// Set defaults
-		RateLimit: 60,
+	if !hashed {
+		if _, err := db.DB.Exec("UPDATE api_keys SET key_hash = $1, key_hashed = TRUE WHERE id = $2", keyHash, apiKey.ID); err != nil {
+			slog.WarnContext(ctx, "failed to rehash API key", "key_id", apiKey.ID, "error", err)
+		}
 	}
+	apiKey.KeyHash = keyHash
 
-	// 4. Store back to Redis (Read-Through)
-	StoreAPIKey(rdb, &apiKey)
+	// 3. Store back to Redis (Read-Through)
+	StoreAPIKey(rdb, apiKey)
 
-	return &apiKey, nil
+	return apiKey, nil
 }
 
-// UpdateAPIKeyUsage increments usage counter and updates last used timestamp
-func UpdateAPIKeyUsage(rdb *redis.Client, key string) error {
-	apiKey, err := GetAPIKey(rdb, key)
+// apiKeyColumns are the api_keys columns read by scanAPIKeyRow
+const apiKeyColumns = `id, tenant_id, name, key_prefix, key_hash, key_hashed, enabled, created_at, created_by,
+	expires_at, rate_limit_rpm, rate_limit_tpm,
+	scopes, allowed_models, allowed_providers, allowed_cidrs, max_tokens_per_request, capture_bodies`
+
+// scanAPIKeyRow reconstructs an APIKey from an api_keys row selected with apiKeyColumns.
+// It also reports whether key_hash already holds a hash.
+func scanAPIKeyRow(row interface{ Scan(...interface{}) error }) (*APIKey, bool, error) {
+	var k APIKey
+	var hashed bool
+	var createdBy sql.NullString
+	var rpm, tpm, maxTokens sql.NullInt64
+
+	err := row.Scan(&k.ID, &k.OwnerID, &k.Name, &k.Prefix, &k.KeyHash, &hashed, &k.Enabled, &k.CreatedAt, &createdBy,
+		&k.ExpiresAt, &rpm, &tpm,
+		pq.Array(&k.Scopes), pq.Array(&k.AllowedModels), pq.Array(&k.AllowedProviders),
+		pq.Array(&k.AllowedCIDRs), &maxTokens, &k.CaptureBodies)
+	if err != nil {
+		return nil, false, err
+	}
+
+	// Missing fields from DB: Description, UsageCount (api_keys.request_count)
+	k.UserID = createdBy.String
+	k.RateLimit = int(rpm.Int64)
+	k.TokenLimit = int(tpm.Int64)
+	k.MaxTokensPerRequest = int(maxTokens.Int64)
+	return &k, hashed, nil
+}
+
+// errLegacyKeyRevoked is returned by migrateLegacyRedisKey for a key with a revocation
+// tombstone; its legacy entry has been deleted
+var errLegacyKeyRevoked = errors.New("legacy API key was revoked")
+
+// migrateLegacyRedisKey moves an entry stored under "apikey:<raw key>" to its hash
+// and, for dashboard keys, rehashes the matching api_keys row.
+func migrateLegacyRedisKey(ctx context.Context, rdb *redis.Client, legacyRedisKey string, apiKey *APIKey) error {
+	apiKey.KeyHash = ""
+	stored, err := storeAPIKey(ctx, rdb, apiKey, false)
 	if err != nil {
 		return err
 	}
+	if !stored {
+		// The tombstone refused the write: the key was revoked after this entry was written
+		if err := rdb.Del(ctx, legacyRedisKey).Err(); err != nil {
+			return err
+		}
+		return errLegacyKeyRevoked
+	}
+	if apiKey.ID != "" {
+		if _, err := db.DB.Exec(`
+			UPDATE api_keys SET key_hash = $1, key_hashed = TRUE
+			WHERE id = $2 AND key_hashed = FALSE
+		`, apiKey.KeyHash, apiKey.ID); err != nil {
+			return err
+		}
+	}
+	apiKey.Key = ""
+	return rdb.Del(ctx, legacyRedisKey).Err()
+}
+
+// Expired reports whether the key is past its expires_at
+func (k *APIKey) Expired() bool {
+	return k.ExpiresAt != nil && !time.Now().Before(*k.ExpiresAt)
+}
+
+// Limits returns the key's effective per-minute limits
+func (k *APIKey) Limits() RateLimits {
+	limits := RateLimits{RPM: k.RateLimit, TPM: k.TokenLimit}
+	if limits.RPM <= 0 {
+		limits.RPM = DefaultKeyRPM
+	}
+	return limits
+}
+
+// UpdateAPIKeyUsage bumps request_count/last_used on the api_keys row and the cached
+// Redis entry. It never recreates an entry that was deleted while the request was in flight.
+func UpdateAPIKeyUsage(rdb *redis.Client, keyData *APIKey) error {
+	ctx := context.Background()
+	if keyData.ID != "" {
+		if _, err := db.DB.Exec(`
+			UPDATE api_keys SET request_count = request_count + 1, last_used = NOW()
+			WHERE id = $1
+		`, keyData.ID); err != nil {
+			slog.Warn("failed to update API key stats", "key_id", keyData.ID, "error", err)
+		}
+	}
+
+	data, err := rdb.Get(ctx, RedisKeyPrefix+keyData.KeyHash).Result()
+	if err != nil {
+		return err
+	}
+	var apiKey APIKey
+	if err := json.Unmarshal([]byte(data), &apiKey); err != nil {
+		return err
+	}
 
 	apiKey.LastUsedAt = time.Now()
 	apiKey.UsageCount++
 
-	return StoreAPIKey(rdb, apiKey)
+	_, err = storeAPIKey(ctx, rdb, &apiKey, true)
+	return err
 }
 
-// DeleteAPIKey removes an API key from Redis
-func DeleteAPIKey(rdb *redis.Client, key string) error {
-	redisKey := RedisKeyPrefix + key
-	return rdb.Del(context.Background(), redisKey).Err()
+// DeleteAPIKey removes the cached Redis entry for a key hash and tells every
+// replica to drop its in-process copy
+func DeleteAPIKey(rdb *redis.Client, keyHash string) error {
+	ctx := context.Background()
+	evictLocalAPIKey(keyHash)
+
+	pipe := rdb.TxPipeline()
+	pipe.Del(ctx, RedisKeyPrefix+keyHash)
+	pipe.Publish(ctx, KeyInvalidationChannel, keyHash)
+	_, err := pipe.Exec(ctx)
+	return err
 }
 
 // ListAPIKeys returns all API keys
@@ -149,8 +312,80 @@ func ListAPIKeys(rdb *redis.Client) ([]*APIKey, error) {
 			continue
 		}
 
+		// Never hand out raw keys from entries that predate hashing
+		if apiKey.KeyHash == "" {
+			apiKey.Key = strings.TrimPrefix(key, RedisKeyPrefix)
+			if err := migrateLegacyRedisKey(ctx, rdb, key, &apiKey); err != nil {
+				continue
+			}
+		}
+
 		apiKeys = append(apiKeys, &apiKey)
 	}
 
 	return apiKeys, nil
 }
+
+// RehashResult summarises a RehashAPIKeys run
+type RehashResult struct {
+	DBRows       int `json:"db_rows"`
+	RedisEntries int `json:"redis_entries"`
+}
+
+// RehashAPIKeys converts every key still stored in raw form (api_keys rows with
+// key_hashed = FALSE and "apikey:gk_..." Redis entries) to its hash. Clients keep
+// using the same raw keys; it is safe to run repeatedly.
+func RehashAPIKeys(ctx context.Context, rdb *redis.Client) (*RehashResult, error) {
+	result := &RehashResult{}
+
+	rows, err := db.DB.QueryContext(ctx, "SELECT id, key_hash FROM api_keys WHERE key_hashed = FALSE")
+	if err != nil {
+		return nil, err
+	}
+	type legacyRow struct{ id, raw string }
+	var pending []legacyRow
+	for rows.Next() {
+		var r legacyRow
+		if err := rows.Scan(&r.id, &r.raw); err == nil {
+			pending = append(pending, r)
+		}
+	}
+	rows.Close()
+
+	for _, r := range pending {
+		_, err := db.DB.ExecContext(ctx, `
+			UPDATE api_keys SET key_hash = $1, key_hashed = TRUE
+			WHERE id = $2 AND key_hashed = FALSE
+		`, HashAPIKey(r.raw), r.id)
+		if err != nil {
+			return result, err
+		}
+		result.DBRows++
+	}
+
+	legacyKeys, err := rdb.Keys(ctx, RedisKeyPrefix+ApiKeyPrefix+"*").Result()
+	if err != nil {
+		return result, err
+	}
+	for _, key := range legacyKeys {
+		data, err := rdb.Get(ctx, key).Result()
+		if err != nil {
+			continue
+		}
+		var apiKey APIKey
+		if err := json.Unmarshal([]byte(data), &apiKey); err != nil {
+			continue
+		}
+		apiKey.Key = strings.TrimPrefix(key, RedisKeyPrefix)
+		err = migrateLegacyRedisKey(ctx, rdb, key, &apiKey)
+		if errors.Is(err, errLegacyKeyRevoked) {
+			continue
+		}
+		if err != nil {
+			return result, err
+		}
+		result.RedisEntries++
+	}
+
+	return result, nil
+}
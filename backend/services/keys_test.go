@@ -0,0 +1,42 @@
+package services
+
+import (
+	"context"
+	"encoding/json"
+	"testing"
+	"time"
+)
+
+func TestRevokedLegacyRedisKeyIsRejected(t *testing.T) {
+	mr, rdb := newTestRedis(t)
+	ctx := context.Background()
+
+	rawKey := ApiKeyPrefix + "fedcba9876543210fedcba9876543210"
+	legacy, _ := json.Marshal(APIKey{Name: "legacy", Enabled: true, CreatedAt: time.Now()})
+	mr.Set(RedisKeyPrefix+rawKey, string(legacy))
+	mr.Set(KeyRevokedRedisPrefix+HashAPIKey(rawKey), "1")
+
+	if apiKey, err := getAPIKey(ctx, rdb, rawKey); err == nil {
+		t.Fatalf("revoked legacy key authenticated as %q", apiKey.Name)
+	}
+	if mr.Exists(RedisKeyPrefix + rawKey) {
+		t.Error("legacy entry of a revoked key was kept")
+	}
+	if mr.Exists(RedisKeyPrefix + HashAPIKey(rawKey)) {
+		t.Error("revoked key was migrated to its hash")
+	}
+
+	// Without a tombstone the entry moves to the hash and keeps working
+	other := ApiKeyPrefix + "00112233445566778899aabbccddeeff"
+	mr.Set(RedisKeyPrefix+other, string(legacy))
+	apiKey, err := getAPIKey(ctx, rdb, other)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if apiKey.Key != "" || apiKey.KeyHash != HashAPIKey(other) {
+		t.Errorf("unexpected migrated key %+v", apiKey)
+	}
+	if mr.Exists(RedisKeyPrefix+other) || !mr.Exists(RedisKeyPrefix+HashAPIKey(other)) {
+		t.Error("legacy entry was not moved to its hash")
+	}
+}
@@ -0,0 +1,181 @@
+package services
+
+import (
+	"context"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"sync"
+)
+
+// KMS wraps and unwraps tenant data keys with master keys it never hands out. The
+// master key used for new wraps is KeyID(); older key IDs must keep unwrapping until
+// the reencrypt command has moved every data key off them.
+type KMS interface {
+	KeyID() string
+	Wrap(ctx context.Context, dataKey []byte) ([]byte, error)
+	Unwrap(ctx context.Context, keyID string, wrapped []byte) ([]byte, error)
+}
+
+var (
+	kmsMu     sync.Mutex
+	activeKMS KMS
+)
+
+// KMSFromEnv builds the KMS named by KMS_PROVIDER:
+//
+//	env   (default) a single master key, ENCRYPTION_KEY (hex), key ID "env"
+//	file  master keys in the JSON file KMS_KEY_FILE:
+//	      {"current": "2026-10", "keys": {"2026-10": "<hex>", "2025-01": "<hex>"}}
+//
+// With the file KMS, ENCRYPTION_KEY (when set) still unwraps data keys wrapped by "env",
+// so the reencrypt command can move them to the file's current key.
+func KMSFromEnv() (KMS, error) {
+	switch provider := os.Getenv("KMS_PROVIDER"); provider {
+	case "", "env":
+		key, err := getEncryptionKey()
+		if err != nil {
+			return nil, err
+		}
+		return newLocalKMS("env", map[string][]byte{"env": key})
+	case "file":
+		k, err := loadFileKMS(os.Getenv("KMS_KEY_FILE"))
+		if err != nil {
+			return nil, err
+		}
+		if key, err := getEncryptionKey(); err == nil {
+			if _, ok := k.keys["env"]; !ok {
+				if err := k.addKey("env", key); err != nil {
+					return nil, err
+				}
+			}
+		}
+		return k, nil
+	default:
+		return nil, fmt.Errorf("unknown KMS_PROVIDER %q (valid: env, file)", provider)
+	}
+}
+
+// SetKMS replaces the KMS used for tenant data keys (commands and tests)
+func SetKMS(k KMS) {
+	kmsMu.Lock()
+	defer kmsMu.Unlock()
+	activeKMS = k
+	dataKeyCache.Range(func(key, _ interface{}) bool {
+		dataKeyCache.Delete(key)
+		return true
+	})
+}
+
+// currentKMS returns the configured KMS, built from the environment on first use
+func currentKMS() (KMS, error) {
+	kmsMu.Lock()
+	defer kmsMu.Unlock()
+	if activeKMS == nil {
+		k, err := KMSFromEnv()
+		if err != nil {
+			return nil, err
+		}
+		activeKMS = k
+	}
+	return activeKMS, nil
+}
+
+// localKMS holds AES-256 master keys in process memory
+type localKMS struct {
+	current string
+	keys    map[string]cipher.AEAD
+}
+
+func newLocalKMS(current string, keys map[string][]byte) (*localKMS, error) {
+	k := &localKMS{current: current, keys: map[string]cipher.AEAD{}}
+	for id, key := range keys {
+		if err := k.addKey(id, key); err != nil {
+			return nil, err
+		}
+	}
+	if _, ok := k.keys[current]; !ok {
+		return nil, fmt.Errorf("current master key %q is not configured", current)
+	}
+	return k, nil
+}
+
+func (k *localKMS) addKey(id string, key []byte) error {
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return fmt.Errorf("master key %q: %w", id, err)
+	}
+	gcm, err := cipher.NewGCM(block)
+	if err != nil {
+		return err
+	}
+	k.keys[id] = gcm
+	return nil
+}
+
+// NewFileKMS loads master keys from a JSON key file (see KMSFromEnv). Meant for tests
+// and single-host installs; the file must be readable only by the gateway.
+func NewFileKMS(path string) (KMS, error) {
+	return loadFileKMS(path)
+}
+
+func loadFileKMS(path string) (*localKMS, error) {
+	if path == "" {
+		return nil, fmt.Errorf("KMS_KEY_FILE not set")
+	}
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	var file struct {
+		Current string            `json:"current"`
+		Keys    map[string]string `json:"keys"`
+	}
+	if err := json.Unmarshal(data, &file); err != nil {
+		return nil, fmt.Errorf("invalid KMS key file: %w", err)
+	}
+	keys := map[string][]byte{}
+	for id, keyHex := range file.Keys {
+		key, err := hex.DecodeString(keyHex)
+		if err != nil || len(key) != 32 {
+			return nil, fmt.Errorf("master key %q must be 32 bytes of hex", id)
+		}
+		keys[id] = key
+	}
+	return newLocalKMS(file.Current, keys)
+}
+
+func (k *localKMS) KeyID() string { return k.current }
+
+// Wrap seals dataKey as nonce || ciphertext, authenticated with the key ID
+func (k *localKMS) Wrap(_ context.Context, dataKey []byte) ([]byte, error) {
+	gcm := k.keys[k.current]
+	nonce := make([]byte, gcm.NonceSize())
+	if _, err := io.ReadFull(rand.Reader, nonce); err != nil {
+		return nil, err
+	}
+	return gcm.Seal(nonce, nonce, dataKey, []byte(k.current)), nil
+}
+
+func (k *localKMS) Unwrap(_ context.Context, keyID string, wrapped []byte) ([]byte, error) {
+	gcm, ok := k.keys[keyID]
+	if !ok {
+		return nil, fmt.Errorf("master key %q is not configured", keyID)
+	}
+	if len(wrapped) < gcm.NonceSize() {
+		return nil, fmt.Errorf("malformed wrapped key")
+	}
+	nonce, ciphertext := wrapped[:gcm.NonceSize()], wrapped[gcm.NonceSize():]
+	key, err := gcm.Open(nil, nonce, ciphertext, []byte(keyID))
+	if err != nil && keyID == "env" {
+		// Data keys created before key IDs existed were sealed with ENCRYPTION_KEY and
+		// no associated data
+		return gcm.Open(nil, nonce, ciphertext, nil)
+	}
+	return key, err
+}
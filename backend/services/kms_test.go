@@ -0,0 +1,138 @@
+package services
+
+import (
+	"bytes"
+	"context"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"database/sql/driver"
+	"encoding/hex"
+	"encoding/json"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/DATA-DOG/go-sqlmock"
+	"github.com/google/uuid"
+)
+
+func randomKey(t *testing.T) []byte {
+	t.Helper()
+	key := make([]byte, 32)
+	if _, err := rand.Read(key); err != nil {
+		t.Fatal(err)
+	}
+	return key
+}
+
+// writeKeyFile writes a KMS key file and loads it
+func writeKeyFile(t *testing.T, current string, keys map[string][]byte) KMS {
+	t.Helper()
+	file := struct {
+		Current string            `json:"current"`
+		Keys    map[string]string `json:"keys"`
+	}{current, map[string]string{}}
+	for id, key := range keys {
+		file.Keys[id] = hex.EncodeToString(key)
+	}
+	data, _ := json.Marshal(file)
+	path := filepath.Join(t.TempDir(), "kms.json")
+	if err := os.WriteFile(path, data, 0600); err != nil {
+		t.Fatal(err)
+	}
+	k, err := NewFileKMS(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return k
+}
+
+// capturedArg matches any value and remembers it
+type capturedArg struct{ value driver.Value }
+
+func (a *capturedArg) Match(v driver.Value) bool {
+	a.value = v
+	return true
+}
+
+func TestFileKMSRotationRoundTrip(t *testing.T) {
+	ctx := context.Background()
+	oldMaster, newMaster := randomKey(t), randomKey(t)
+	dataKey := randomKey(t)
+	tenantID := uuid.New()
+
+	k := writeKeyFile(t, "2026-01", map[string][]byte{"2026-01": oldMaster})
+	SetKMS(k)
+	t.Cleanup(func() { SetKMS(nil) })
+	wrapped, err := k.Wrap(ctx, dataKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got, err := k.Unwrap(ctx, "2026-01", wrapped); err != nil || !bytes.Equal(got, dataKey) {
+		t.Fatalf("unwrap with the wrapping key: %v", err)
+	}
+
+	// Rotate: the new key becomes current, the old one stays for unwrapping
+	k = writeKeyFile(t, "2026-10", map[string][]byte{"2026-01": oldMaster, "2026-10": newMaster})
+	SetKMS(k)
+
+	mock := newMockDB(t)
+	rewrapped := &capturedArg{}
+	mock.ExpectQuery(`SELECT tenant_id, version, key_encrypted, kms_key_id FROM tenant_data_keys`).
+		WithArgs("2026-10", nil).
+		WillReturnRows(sqlmock.NewRows([]string{"tenant_id", "version", "key_encrypted", "kms_key_id"}).
+			AddRow(tenantID, 1, hex.EncodeToString(wrapped), "2026-01"))
+	mock.ExpectExec(`UPDATE tenant_data_keys SET key_encrypted = \$4, kms_key_id = \$5`).
+		WithArgs(tenantID, 1, hex.EncodeToString(wrapped), rewrapped, "2026-10").
+		WillReturnResult(sqlmock.NewResult(0, 1))
+
+	n, err := rewrapTenantDataKeys(ctx, nil)
+	if err != nil || n != 1 {
+		t.Fatalf("rewrapTenantDataKeys = %d, %v", n, err)
+	}
+
+	newWrapped, err := hex.DecodeString(rewrapped.value.(string))
+	if err != nil {
+		t.Fatal(err)
+	}
+	// Once every data key is rewrapped the old master key can be dropped
+	k = writeKeyFile(t, "2026-10", map[string][]byte{"2026-10": newMaster})
+	if got, err := k.Unwrap(ctx, "2026-10", newWrapped); err != nil || !bytes.Equal(got, dataKey) {
+		t.Fatalf("unwrap after rotation: %v", err)
+	}
+	if _, err := k.Unwrap(ctx, "2026-01", wrapped); err == nil {
+		t.Error("unwrapped with a master key that is no longer configured")
+	}
+}
+
+func TestLocalKMSBindsKeyID(t *testing.T) {
+	ctx := context.Background()
+	master, dataKey := randomKey(t), randomKey(t)
+
+	k := writeKeyFile(t, "a", map[string][]byte{"a": master, "b": master})
+	wrapped, err := k.Wrap(ctx, dataKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := k.Unwrap(ctx, "b", wrapped); err == nil {
+		t.Error("a key wrapped under ID \"a\" unwrapped as \"b\"")
+	}
+
+	// Legacy wraps carry no associated data; only ENCRYPTION_KEY ("env") produced them
+	block, _ := aes.NewCipher(master)
+	gcm, _ := cipher.NewGCM(block)
+	nonce := make([]byte, gcm.NonceSize())
+	legacy := gcm.Seal(nonce, nonce, dataKey, nil)
+
+	env, err := newLocalKMS("env", map[string][]byte{"env": master})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got, err := env.Unwrap(ctx, "env", legacy); err != nil || !bytes.Equal(got, dataKey) {
+		t.Errorf("legacy env wrap: %v", err)
+	}
+	if _, err := k.Unwrap(ctx, "a", legacy); err == nil {
+		t.Error("legacy wrap without associated data accepted for a file key")
+	}
+}
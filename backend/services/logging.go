@@ -0,0 +1,149 @@
+package services
+
+import (
+	"context"
+	"log/slog"
+	"os"
+	"regexp"
+	"strings"
+	"sync"
+)
+
+// Logging: the gateway writes leveled JSON through log/slog. Request-scoped fields
+// (request ID, tenant, key, provider, trace) travel in the request context and are
+// added to every record logged with a *Context function. As a last line of defence
+// the handler scrubs anything that looks like a secret from messages and string
+// attributes, so values never reach logs even if a caller passes one by mistake.
+
+// logScrubPatterns are the SecretPatterns worth scrubbing from logs (UUIDs are
+// identifiers, not secrets) plus gateway API keys
+var logScrubPatterns = func() map[string]*regexp.Regexp {
+	patterns := map[string]*regexp.Regexp{
+		"ZAPS_KEY": regexp.MustCompile(regexp.QuoteMeta(ApiKeyPrefix) + `[A-Za-z0-9_-]{16,}`),
+	}
+	for label, regex := range SecretPatterns {
+		if label != "UUID" {
+			patterns[label] = regex
+		}
+	}
+	return patterns
+}()
+
+// ScrubSecrets replaces secret-looking values in s with [REDACTED:TYPE]
+func ScrubSecrets(s string) string {
+	for label, regex := range logScrubPatterns {
+		if regex.MatchString(s) {
+			s = regex.ReplaceAllLiteralString(s, "[REDACTED:"+label+"]")
+		}
+	}
+	return s
+}
+
+// LogFields are the request-scoped values attached to log records
+type LogFields struct {
+	mu        sync.Mutex
+	RequestID string
+	TraceID   string
+	TenantID  string
+	APIKeyID  string
+	Provider  string
+}
+
+type logFieldsKey struct{}
+
+// WithLogFields returns a context whose log records carry f
+func WithLogFields(ctx context.Context, f *LogFields) context.Context {
+	return context.WithValue(ctx, logFieldsKey{}, f)
+}
+
+// LogFieldsFrom returns the request's fields, or a detached value when there are none
+func LogFieldsFrom(ctx context.Context) *LogFields {
+	if ctx != nil {
+		if f, ok := ctx.Value(logFieldsKey{}).(*LogFields); ok {
+			return f
+		}
+	}
+	return &LogFields{}
+}
+
+// Set updates fields once the request has been authenticated or routed
+func (f *LogFields) Set(update func(f *LogFields)) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	update(f)
+}
+
+func (f *LogFields) attrs() []slog.Attr {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	var attrs []slog.Attr
+	for _, kv := range [][2]string{
+		{"request_id", f.RequestID},
+		{"trace_id", f.TraceID},
+		{"tenant_id", f.TenantID},
+		{"api_key_id", f.APIKeyID},
+		{"provider", f.Provider},
+	} {
+		if kv[1] != "" {
+			attrs = append(attrs, slog.String(kv[0], kv[1]))
+		}
+	}
+	return attrs
+}
+
+// logHandler adds the request fields; scrubAttr then cleans every attribute
+type logHandler struct {
+	slog.Handler
+}
+
+func (h logHandler) Handle(ctx context.Context, r slog.Record) error {
+	if ctx != nil {
+		if f, ok := ctx.Value(logFieldsKey{}).(*LogFields); ok {
+			r = r.Clone()
+			r.AddAttrs(f.attrs()...)
+		}
+	}
+	return h.Handler.Handle(ctx, r)
+}
+
+func (h logHandler) WithAttrs(attrs []slog.Attr) slog.Handler {
+	return logHandler{h.Handler.WithAttrs(attrs)}
+}
+
+func (h logHandler) WithGroup(name string) slog.Handler {
+	return logHandler{h.Handler.WithGroup(name)}
+}
+
+// scrubAttr runs on every attribute, including the message and those bound with Logger.With
+func scrubAttr(_ []string, a slog.Attr) slog.Attr {
+	switch a.Value.Kind() {
+	case slog.KindString:
+		return slog.String(a.Key, ScrubSecrets(a.Value.String()))
+	case slog.KindAny:
+		if err, ok := a.Value.Any().(error); ok {
+			return slog.String(a.Key, ScrubSecrets(err.Error()))
+		}
+	}
+	return a
+}
+
+// InitLogging makes JSON on stdout the default slog (and log package) output.
+// LOG_LEVEL selects debug, info (default), warn or error.
+func InitLogging() {
+	level := slog.LevelInfo
+	switch strings.ToLower(os.Getenv("LOG_LEVEL")) {
+	case "debug":
+		level = slog.LevelDebug
+	case "warn", "warning":
+		level = slog.LevelWarn
+	case "error":
+		level = slog.LevelError
+	}
+
+	handler := slog.NewJSONHandler(os.Stdout, &slog.HandlerOptions{
+		Level:       level,
+		ReplaceAttr: scrubAttr,
+	})
+	slog.SetDefault(slog.New(logHandler{handler}))
+}
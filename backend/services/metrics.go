@@ -0,0 +1,192 @@
+package services
+
+import (
+	"context"
+	"errors"
+	"net"
+	"strconv"
+	"strings"
+	"time"
+
+	"zaps/db"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/collectors"
+	"github.com/redis/go-redis/v9"
+)
+
+// Prometheus metrics. Every label takes values from a fixed set (providers and models
+// are normalised by the caller, custom PII entities are folded into "CUSTOM") so
+// cardinality stays bounded no matter what clients send.
+
+// Quota rejection reasons
+const (
+	RejectQuota        = "quota"
+	RejectBudget       = "budget"
+	RejectRateRequests = "rate_limit_requests"
+	RejectRateTokens   = "rate_limit_tokens"
+)
+
+// Backends for ObserveBackendError
+const (
+	BackendRedis    = "redis"
+	BackendPostgres = "postgres"
+)
+
+// MetricsRegistry holds the gateway metrics served on /metrics
+var MetricsRegistry = prometheus.NewRegistry()
+
+var (
+	proxyRequests = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: "zaps_proxy_requests_total",
+		Help: "Proxied chat completion requests by provider, model and status code.",
+	}, []string{"provider", "model", "status"})
+
+	upstreamLatency = prometheus.NewHistogramVec(prometheus.HistogramOpts{
+		Name:    "zaps_upstream_latency_seconds",
+		Help:    "Time spent waiting for the upstream provider.",
+		Buckets: []float64{0.1, 0.25, 0.5, 1, 2, 4, 8, 15, 30, 60, 120, 300},
+	}, []string{"provider", "model"})
+
+	piiRedactions = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: "zaps_pii_redactions_total",
+		Help: "Redacted PII values by entity type (tenant-defined entities are reported as CUSTOM).",
+	}, []string{"entity_type"})
+
+	rehydrationMisses = prometheus.NewCounter(prometheus.CounterOpts{
+		Name: "zaps_rehydration_misses_total",
+		Help: "Secret tokens in upstream responses that could not be restored.",
+	})
+
+	quotaRejections = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: "zaps_quota_rejections_total",
+		Help: "Requests rejected by quotas, budgets or rate limits.",
+	}, []string{"reason"})
+
+	backendErrors = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: "zaps_backend_errors_total",
+		Help: "Redis and Postgres errors by backend and operation.",
+	}, []string{"backend", "operation"})
+
+	eventsWritten = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: "zaps_events_written_total",
+		Help: "Audit and usage events written to Postgres by the batched writer.",
+	}, []string{"kind"})
+
+	eventsSpilled = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: "zaps_events_spilled_total",
+		Help: "Events written to the local journal because the queue was full or a batch failed.",
+	}, []string{"kind"})
+
+	eventsDropped = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: "zaps_events_dropped_total",
+		Help: "Events lost because the journal could not be written.",
+	}, []string{"kind"})
+
+	eventFlushDuration = prometheus.NewHistogramVec(prometheus.HistogramOpts{
+		Name:    "zaps_event_flush_seconds",
+		Help:    "Time to write one event batch, including retries.",
+		Buckets: prometheus.DefBuckets,
+	}, []string{"kind"})
+
+	auditSinkDeliveries = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: "zaps_audit_sink_events_total",
+		Help: "Audit events sent to tenant sinks by sink type and result (delivered, failed, dead_lettered).",
+	}, []string{"type", "result"})
+
+	// InflightRequests counts /v1 requests currently being served
+	InflightRequests = prometheus.NewGauge(prometheus.GaugeOpts{
+		Name: "zaps_inflight_requests",
+		Help: "Gateway requests currently in flight.",
+	})
+)
+
+func init() {
+	MetricsRegistry.MustRegister(
+		collectors.NewGoCollector(),
+		collectors.NewProcessCollector(collectors.ProcessCollectorOpts{}),
+		proxyRequests, upstreamLatency, piiRedactions, rehydrationMisses,
+		quotaRejections, backendErrors, InflightRequests,
+		eventsWritten, eventsSpilled, eventsDropped, eventFlushDuration,
+		auditSinkDeliveries,
+	)
+	for _, kind := range []string{eventKindAudit, eventKindUsage} {
+		kind := kind
+		MetricsRegistry.MustRegister(prometheus.NewGaugeFunc(prometheus.GaugeOpts{
+			Name:        "zaps_event_queue_depth",
+			Help:        "Events waiting in the writer queue.",
+			ConstLabels: prometheus.Labels{"kind": kind},
+		}, func() float64 { return float64(events.queueDepth(kind)) }))
+	}
+}
+
+// RegisterDBMetrics exports connection pool stats for the database
+func RegisterDBMetrics() {
+	if db.DB != nil {
+		MetricsRegistry.MustRegister(collectors.NewDBStatsCollector(db.DB, "postgres"))
+	}
+}
+
+// ObserveProxyRequest counts a proxied request. provider and model must already be bounded.
+func ObserveProxyRequest(provider, model string, status int) {
+	proxyRequests.WithLabelValues(provider, model, strconv.Itoa(status)).Inc()
+}
+
+// ObserveUpstreamLatency records how long the upstream call took
+func ObserveUpstreamLatency(provider, model string, d time.Duration) {
+	upstreamLatency.WithLabelValues(provider, model).Observe(d.Seconds())
+}
+
+// ObserveRedactions counts detections from SecretTypes
+func ObserveRedactions(types map[string]int) {
+	for typ, n := range types {
+		if _, builtin := SecretPatterns[typ]; !builtin {
+			typ = "CUSTOM"
+		}
+		piiRedactions.WithLabelValues(typ).Add(float64(n))
+	}
+}
+
+// ObserveQuotaRejection counts a request rejected for one of the Reject* reasons
+func ObserveQuotaRejection(reason string) {
+	quotaRejections.WithLabelValues(reason).Inc()
+}
+
+// ObserveBackendError counts a failed Redis or Postgres operation. operation must be a constant.
+func ObserveBackendError(backend, operation string) {
+	backendErrors.WithLabelValues(backend, operation).Inc()
+}
+
+// RedisMetricsHook counts failed Redis commands (misses are not errors)
+type RedisMetricsHook struct{}
+
+func (RedisMetricsHook) DialHook(next redis.DialHook) redis.DialHook {
+	return func(ctx context.Context, network, addr string) (net.Conn, error) {
+		conn, err := next(ctx, network, addr)
+		if err != nil {
+			ObserveBackendError(BackendRedis, "dial")
+		}
+		return conn, err
+	}
+}
+
+func (RedisMetricsHook) ProcessHook(next redis.ProcessHook) redis.ProcessHook {
+	return func(ctx context.Context, cmd redis.Cmder) error {
+		err := next(ctx, cmd)
+		// Script.Run retries NOSCRIPT with EVAL, so it is not a failure
+		if err != nil && !errors.Is(err, redis.Nil) && !strings.HasPrefix(err.Error(), "NOSCRIPT") {
+			ObserveBackendError(BackendRedis, strings.ToLower(cmd.Name()))
+		}
+		return err
+	}
+}
+
+func (RedisMetricsHook) ProcessPipelineHook(next redis.ProcessPipelineHook) redis.ProcessPipelineHook {
+	return func(ctx context.Context, cmds []redis.Cmder) error {
+		err := next(ctx, cmds)
+		if err != nil && !errors.Is(err, redis.Nil) {
+			ObserveBackendError(BackendRedis, "pipeline")
+		}
+		return err
+	}
+}
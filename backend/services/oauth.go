@@ -5,6 +5,7 @@ import (
 	"encoding/json"
 	"fmt"
 	"io"
+	"log/slog"
 	"net/http"
 	"os"
 
@@ -23,7 +24,7 @@ func InitOAuth() {
 	redirectURL := os.Getenv("GOOGLE_REDIRECT_URL")
 
 	if clientID == "" || clientSecret == "" {
-		fmt.Println("⚠️ Google OAuth not configured (missing GOOGLE_CLIENT_ID or GOOGLE_CLIENT_SECRET)")
+		slog.Warn("google OAuth not configured (missing GOOGLE_CLIENT_ID or GOOGLE_CLIENT_SECRET)")
 		return
 	}
 
@@ -5,6 +5,7 @@ import (
 	"encoding/json"
 	"fmt"
 	"io"
+	"log/slog"
 	"os"
 
 	"golang.org/x/oauth2"
@@ -19,7 +20,7 @@ func InitGitHubOAuth() {
 	redirectURL := os.Getenv("GITHUB_REDIRECT_URL")
 
 	if clientID == "" || clientSecret == "" {
-		fmt.Println("⚠️ GitHub OAuth not configured (missing GITHUB_CLIENT_ID or GITHUB_CLIENT_SECRET)")
+		slog.Warn("github OAuth not configured (missing GITHUB_CLIENT_ID or GITHUB_CLIENT_SECRET)")
 		return
 	}
 
@@ -4,6 +4,7 @@ import (
 	"crypto/sha1"
 	"fmt"
 	"io"
+	"log/slog"
 	"net/http"
 	"strings"
 	"unicode"
@@ -63,8 +64,7 @@ func isPwned(password string) bool {
 	resp, err := http.Get("https://api.pwnedpasswords.com/range/" + prefix)
 	if err != nil {
 		// If API fails, default to safe (allow password) rather than blocking user
-		// Log the error in a real app
-		fmt.Printf("⚠️ HIBP API check failed: %v\n", err)
+		slog.Warn("HIBP API check failed", "error", err)
 		return false
 	}
 	defer resp.Body.Close()
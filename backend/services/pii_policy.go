@@ -0,0 +1,274 @@
+package services
+
+import (
+	"database/sql"
+	"fmt"
+	"log/slog"
+	"os"
+	"regexp"
+	"sort"
+	"strings"
+
+	"zaps/db"
+
+	"github.com/google/uuid"
+	"github.com/lib/pq"
+)
+
+const (
+	PIIActionRoute  = "route"
+	PIIActionReject = "reject"
+)
+
+var entityTypeRegex = regexp.MustCompile(`^[A-Z_]+$`)
+
+// UnredactedProviderAllowed reports whether prompts may be sent to provider with their
+// PII intact. Only the self-hosted ollama endpoint is allowed unless further providers
+// are listed in PII_UNREDACTED_PROVIDERS.
+func UnredactedProviderAllowed(provider string) bool {
+	if provider == "ollama" {
+		return true
+	}
+	for _, p := range strings.Split(os.Getenv("PII_UNREDACTED_PROVIDERS"), ",") {
+		if p = strings.TrimSpace(p); p != "" && p == provider {
+			return true
+		}
+	}
+	return false
+}
+
+// CustomEntity is a tenant-defined PII detector
+type CustomEntity struct {
+	ID         uuid.UUID `json:"id"`
+	EntityType string    `json:"entity_type"`
+	Pattern    string    `json:"pattern"`
+}
+
+// PIIRoutingPolicy decides where prompts containing certain entity types may go
+type PIIRoutingPolicy struct {
+	ID             uuid.UUID `json:"id"`
+	Name           string    `json:"name"`
+	Priority       int       `json:"priority"`
+	Enabled        bool      `json:"enabled"`
+	EntityTypes    []string  `json:"entity_types"`
+	Action         string    `json:"action"`
+	TargetProvider string    `json:"target_provider,omitempty"`
+	TargetModel    string    `json:"target_model,omitempty"`
+	SendUnredacted bool      `json:"send_unredacted"`
+}
+
+// PIIRoutingDecision is the outcome of policy evaluation for one request
+type PIIRoutingDecision struct {
+	Policy  *PIIRoutingPolicy
+	Matched []string // Detected entity types that triggered the policy
+}
+
+// -- Custom entities --
+
+// ListCustomEntities returns a tenant's custom entity detectors
+func ListCustomEntities(tenantID string) ([]CustomEntity, error) {
+	rows, err := db.DB.Query(`
+		SELECT id, entity_type, pattern
+		FROM pii_custom_entities
+		WHERE tenant_id = $1
+		ORDER BY entity_type ASC
+	`, tenantID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	entities := []CustomEntity{}
+	for rows.Next() {
+		var e CustomEntity
+		if err := rows.Scan(&e.ID, &e.EntityType, &e.Pattern); err != nil {
+			continue
+		}
+		entities = append(entities, e)
+	}
+	return entities, nil
+}
+
+// LoadCustomPatterns compiles a tenant's custom detectors for RedactSecretsWithPatterns.
+// Invalid patterns are skipped (they are validated on save).
+func LoadCustomPatterns(tenantID string) (map[string]*regexp.Regexp, error) {
+	entities, err := ListCustomEntities(tenantID)
+	if err != nil {
+		return nil, err
+	}
+
+	patterns := make(map[string]*regexp.Regexp, len(entities))
+	for _, e := range entities {
+		re, err := regexp.Compile(e.Pattern)
+		if err != nil {
+			slog.Warn("skipping invalid custom PII pattern", "entity_type", e.EntityType, "tenant_id", tenantID, "error", err)
+			continue
+		}
+		patterns[e.EntityType] = re
+	}
+	return patterns, nil
+}
+
+// SaveCustomEntity validates and upserts a custom entity detector
+func SaveCustomEntity(tenantID uuid.UUID, e *CustomEntity) error {
+	if !entityTypeRegex.MatchString(e.EntityType) {
+		return fmt.Errorf("entity_type must be uppercase letters and underscores")
+	}
+	if _, builtin := SecretPatterns[e.EntityType]; builtin {
+		return fmt.Errorf("%s is a built-in entity type", e.EntityType)
+	}
+	if len(e.Pattern) == 0 || len(e.Pattern) > 500 {
+		return fmt.Errorf("pattern must be between 1 and 500 characters")
+	}
+	re, err := regexp.Compile(e.Pattern)
+	if err != nil {
+		return fmt.Errorf("invalid pattern: %v", err)
+	}
+	if re.MatchString("") {
+		return fmt.Errorf("pattern must not match the empty string")
+	}
+
+	return db.DB.QueryRow(`
+		INSERT INTO pii_custom_entities (tenant_id, entity_type, pattern)
+		VALUES ($1, $2, $3)
+		ON CONFLICT (tenant_id, entity_type)
+		DO UPDATE SET pattern = EXCLUDED.pattern
+		RETURNING id
+	`, tenantID, e.EntityType, e.Pattern).Scan(&e.ID)
+}
+
+// DeleteCustomEntity removes a custom entity detector
+func DeleteCustomEntity(tenantID uuid.UUID, entityType string) (bool, error) {
+	res, err := db.DB.Exec("DELETE FROM pii_custom_entities WHERE tenant_id = $1 AND entity_type = $2", tenantID, entityType)
+	if err != nil {
+		return false, err
+	}
+	n, _ := res.RowsAffected()
+	return n > 0, nil
+}
+
+// -- Policies --
+
+// ListPIIRoutingPolicies returns a tenant's policies in evaluation order
+func ListPIIRoutingPolicies(tenantID string) ([]PIIRoutingPolicy, error) {
+	rows, err := db.DB.Query(`
+		SELECT id, name, priority, enabled, entity_types, action,
+			COALESCE(target_provider, ''), COALESCE(target_model, ''), send_unredacted
+		FROM pii_routing_policies
+		WHERE tenant_id = $1
+		ORDER BY priority ASC, created_at ASC
+	`, tenantID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	policies := []PIIRoutingPolicy{}
+	for rows.Next() {
+		var p PIIRoutingPolicy
+		if err := rows.Scan(&p.ID, &p.Name, &p.Priority, &p.Enabled, pq.Array(&p.EntityTypes), &p.Action,
+			&p.TargetProvider, &p.TargetModel, &p.SendUnredacted); err != nil {
+			continue
+		}
+		policies = append(policies, p)
+	}
+	return policies, nil
+}
+
+// SavePIIRoutingPolicy inserts a policy, or updates it when p.ID is set
+func SavePIIRoutingPolicy(tenantID uuid.UUID, p *PIIRoutingPolicy) error {
+	if p.Name == "" || len(p.EntityTypes) == 0 {
+		return fmt.Errorf("name and entity_types are required")
+	}
+	for _, t := range p.EntityTypes {
+		if !entityTypeRegex.MatchString(t) {
+			return fmt.Errorf("invalid entity type %q", t)
+		}
+	}
+	switch p.Action {
+	case PIIActionReject:
+		p.TargetProvider, p.TargetModel, p.SendUnredacted = "", "", false
+	case PIIActionRoute:
+		if p.TargetProvider == "" || p.TargetModel == "" {
+			return fmt.Errorf("route policies require target_provider and target_model")
+		}
+		if p.SendUnredacted && !UnredactedProviderAllowed(p.TargetProvider) {
+			return fmt.Errorf("send_unredacted is only allowed for self-hosted providers")
+		}
+	default:
+		return fmt.Errorf("action must be %q or %q", PIIActionRoute, PIIActionReject)
+	}
+
+	var targetProvider, targetModel *string
+	if p.Action == PIIActionRoute {
+		targetProvider, targetModel = &p.TargetProvider, &p.TargetModel
+	}
+
+	if p.ID == uuid.Nil {
+		return db.DB.QueryRow(`
+			INSERT INTO pii_routing_policies (tenant_id, name, priority, enabled, entity_types, action,
+				target_provider, target_model, send_unredacted)
+			VALUES ($1, $2, $3, $4, $5, $6, $7, $8, $9)
+			RETURNING id
+		`, tenantID, p.Name, p.Priority, p.Enabled, pq.Array(p.EntityTypes), p.Action,
+			targetProvider, targetModel, p.SendUnredacted).Scan(&p.ID)
+	}
+
+	res, err := db.DB.Exec(`
+		UPDATE pii_routing_policies
+		SET name = $3, priority = $4, enabled = $5, entity_types = $6, action = $7,
+			target_provider = $8, target_model = $9, send_unredacted = $10
+		WHERE id = $1 AND tenant_id = $2
+	`, p.ID, tenantID, p.Name, p.Priority, p.Enabled, pq.Array(p.EntityTypes), p.Action,
+		targetProvider, targetModel, p.SendUnredacted)
+	if err != nil {
+		return err
+	}
+	if n, _ := res.RowsAffected(); n == 0 {
+		return sql.ErrNoRows
+	}
+	return nil
+}
+
+// DeletePIIRoutingPolicy removes a policy
+func DeletePIIRoutingPolicy(tenantID uuid.UUID, id string) (bool, error) {
+	res, err := db.DB.Exec("DELETE FROM pii_routing_policies WHERE id = $1 AND tenant_id = $2", id, tenantID)
+	if err != nil {
+		return false, err
+	}
+	n, _ := res.RowsAffected()
+	return n > 0, nil
+}
+
+// EvaluatePIIRouting returns the first enabled policy triggered by the detected entity
+// types, or nil when the request may proceed normally.
+func EvaluatePIIRouting(tenantID string, detected map[string]int) (*PIIRoutingDecision, error) {
+	if len(detected) == 0 {
+		return nil, nil
+	}
+
+	policies, err := ListPIIRoutingPolicies(tenantID)
+	if err != nil {
+		return nil, err
+	}
+
+	for i := range policies {
+		p := &policies[i]
+		if !p.Enabled {
+			continue
+		}
+
+		var matched []string
+		for _, t := range p.EntityTypes {
+			if detected[t] > 0 {
+				matched = append(matched, t)
+			}
+		}
+		if len(matched) > 0 {
+			sort.Strings(matched)
+			return &PIIRoutingDecision{Policy: p, Matched: matched}, nil
+		}
+	}
+
+	return nil, nil
+}
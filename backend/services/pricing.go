@@ -0,0 +1,203 @@
+package services
+
+import (
+	"fmt"
+	"log/slog"
+	"math"
+	"strings"
+	"sync"
+	"time"
+	"unicode"
+
+	"zaps/db"
+)
+
+const pricingCacheTTL = 5 * time.Minute
+
+// ModelPrice holds USD prices per 1M tokens
+type ModelPrice struct {
+	Provider           string  `json:"provider"`
+	Model              string  `json:"model"`
+	InputPerMTok       float64 `json:"input_per_mtok"`
+	OutputPerMTok      float64 `json:"output_per_mtok"`
+	CachedInputPerMTok float64 `json:"cached_input_per_mtok"`
+}
+
+// TokenUsage is the token breakdown of a single request
+type TokenUsage struct {
+	PromptTokens     int  `json:"prompt_tokens"`
+	CompletionTokens int  `json:"completion_tokens"`
+	CachedTokens     int  `json:"cached_tokens"`
+	Estimated        bool `json:"estimated"` // Upstream did not report usage
+}
+
+func (u TokenUsage) Total() int {
+	return u.PromptTokens + u.CompletionTokens
+}
+
+var pricingCache = struct {
+	sync.RWMutex
+	prices   map[string]ModelPrice
+	loadedAt time.Time
+}{}
+
+func priceKey(provider, model string) string {
+	return provider + "/" + model
+}
+
+// ListModelPrices returns the full pricing table
+func ListModelPrices() ([]ModelPrice, error) {
+	rows, err := db.DB.Query(`
+		SELECT provider, model, input_per_mtok, output_per_mtok, cached_input_per_mtok
+		FROM model_pricing
+		ORDER BY provider, model
+	`)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	prices := []ModelPrice{}
+	for rows.Next() {
+		var p ModelPrice
+		if err := rows.Scan(&p.Provider, &p.Model, &p.InputPerMTok, &p.OutputPerMTok, &p.CachedInputPerMTok); err != nil {
+			continue
+		}
+		prices = append(prices, p)
+	}
+	return prices, nil
+}
+
+// SaveModelPrice upserts a pricing row and invalidates the in-memory cache
+func SaveModelPrice(p *ModelPrice) error {
+	if p.Provider == "" || p.Model == "" {
+		return fmt.Errorf("provider and model are required")
+	}
+	if p.InputPerMTok < 0 || p.OutputPerMTok < 0 || p.CachedInputPerMTok < 0 {
+		return fmt.Errorf("prices must not be negative")
+	}
+
+	_, err := db.DB.Exec(`
+		INSERT INTO model_pricing (provider, model, input_per_mtok, output_per_mtok, cached_input_per_mtok)
+		VALUES ($1, $2, $3, $4, $5)
+		ON CONFLICT (provider, model)
+		DO UPDATE SET input_per_mtok = EXCLUDED.input_per_mtok,
+			output_per_mtok = EXCLUDED.output_per_mtok,
+			cached_input_per_mtok = EXCLUDED.cached_input_per_mtok
+	`, p.Provider, p.Model, p.InputPerMTok, p.OutputPerMTok, p.CachedInputPerMTok)
+	if err != nil {
+		return err
+	}
+
+	pricingCache.Lock()
+	pricingCache.loadedAt = time.Time{}
+	pricingCache.Unlock()
+	return nil
+}
+
+// GetModelPrice looks up the price for provider/model, falling back to the provider's '*' row
+func GetModelPrice(provider, model string) (ModelPrice, bool) {
+	pricingCache.RLock()
+	fresh := time.Since(pricingCache.loadedAt) < pricingCacheTTL
+	pricingCache.RUnlock()
+
+	if !fresh {
+		if prices, err := ListModelPrices(); err == nil {
+			m := make(map[string]ModelPrice, len(prices))
+			for _, p := range prices {
+				m[priceKey(p.Provider, p.Model)] = p
+			}
+			pricingCache.Lock()
+			pricingCache.prices = m
+			pricingCache.loadedAt = time.Now()
+			pricingCache.Unlock()
+		} else {
+			slog.Warn("failed to load model pricing", "error", err)
+		}
+	}
+
+	pricingCache.RLock()
+	defer pricingCache.RUnlock()
+
+	model = strings.TrimPrefix(model, "models/")
+	if p, ok := pricingCache.prices[priceKey(provider, model)]; ok {
+		return p, true
+	}
+	if p, ok := pricingCache.prices[priceKey(provider, "*")]; ok {
+		return p, true
+	}
+	return ModelPrice{}, false
+}
+
+// CalculateCost returns the USD cost of a request (0 when the model has no price)
+func CalculateCost(provider, model string, usage TokenUsage) float64 {
+	price, ok := GetModelPrice(provider, model)
+	if !ok {
+		return 0
+	}
+
+	cached := usage.CachedTokens
+	if cached > usage.PromptTokens {
+		cached = usage.PromptTokens
+	}
+	uncached := usage.PromptTokens - cached
+
+	cost := (float64(uncached)*price.InputPerMTok +
+		float64(cached)*price.CachedInputPerMTok +
+		float64(usage.CompletionTokens)*price.OutputPerMTok) / 1_000_000
+
+	// Round to micro-dollars to match the NUMERIC(14, 6) columns
+	return math.Round(cost*1e6) / 1e6
+}
+
+// EstimateTokens approximates a BPE token count locally, used when the upstream
+// omits usage. It takes the larger of the ~4 characters/token rule and a word
+// count, so it tends to err high rather than undercount.
+func EstimateTokens(text string) int {
+	if text == "" {
+		return 0
+	}
+
+	chars := 0
+	words := 0
+	inWord := false
+	nonASCII := 0
+
+	for _, r := range text {
+		chars++
+		if r > unicode.MaxASCII {
+			nonASCII++
+		}
+		if unicode.IsSpace(r) || unicode.IsPunct(r) {
+			if unicode.IsPunct(r) {
+				words++ // Punctuation is usually its own token
+			}
+			inWord = false
+			continue
+		}
+		if !inWord {
+			words++
+			inWord = true
+		}
+	}
+
+	byChars := float64(chars-nonASCII)/4 + float64(nonASCII) // Non-Latin scripts ~1 token/char
+	byWords := float64(words) * 1.3
+
+	return int(math.Ceil(math.Max(byChars, byWords)))
+}
+
+// EstimateMessageTokens estimates prompt tokens for OpenAI-style chat messages,
+// including the small per-message overhead of the chat format.
+func EstimateMessageTokens(messages []interface{}) int {
+	total := 3 // Reply priming
+	for _, msg := range messages {
+		m, ok := msg.(map[string]interface{})
+		if !ok {
+			continue
+		}
+		content, _ := m["content"].(string)
+		total += 4 + EstimateTokens(content)
+	}
+	return total
+}
@@ -0,0 +1,214 @@
+package services
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"log/slog"
+	"time"
+
+	"zaps/db"
+
+	"github.com/google/uuid"
+)
+
+// Prompt capture: keys with capture_bodies set store the redacted request forwarded
+// upstream (OpenAI format, after routing) and the upstream response before
+// rehydration, both encrypted with the tenant's current data key. Captures never hold original
+// secret values; requests sent unredacted under a PII policy are not captured.
+// Retention's prompt_days removes them.
+
+const (
+	// PromptCaptureMaxBytes skips capturing bodies larger than this
+	PromptCaptureMaxBytes = 1 << 20
+
+	promptCaptureWriteTimeout = 10 * time.Second
+)
+
+// PromptCapture is one captured exchange. Request and Response are only set when the
+// capture is opened.
+type PromptCapture struct {
+	ID             uuid.UUID       `json:"id"`
+	TenantID       uuid.UUID       `json:"-"`
+	APIKeyID       *string         `json:"api_key_id,omitempty"`
+	RequestID      string          `json:"request_id,omitempty"`
+	ReplayOf       *uuid.UUID      `json:"replay_of,omitempty"`
+	Provider       string          `json:"provider"`
+	Model          string          `json:"model"`
+	RequestedModel string          `json:"requested_model,omitempty"`
+	StatusCode     int             `json:"status_code"`
+	LatencyMs      int64           `json:"latency_ms"`
+	PIITypes       map[string]int  `json:"pii_types"`
+	CreatedAt      time.Time       `json:"created_at"`
+	Request        json.RawMessage `json:"request,omitempty"`
+	Response       json.RawMessage `json:"response,omitempty"`
+}
+
+// captureAAD binds a sealed body to its capture and role, so bodies cannot be swapped
+// between rows
+func captureAAD(id uuid.UUID, part string) []byte {
+	return []byte(id.String() + ":" + part)
+}
+
+// SavePromptCapture encrypts and stores a capture. A zero ID is filled in.
+func SavePromptCapture(ctx context.Context, c *PromptCapture, request, response []byte) error {
+	if c.ID == uuid.Nil {
+		c.ID = uuid.New()
+	}
+	sealedReq, sealedResp, version, err := sealPromptCapture(ctx, c, request, response)
+	if err != nil {
+		return err
+	}
+	if c.PIITypes == nil {
+		c.PIITypes = map[string]int{}
+	}
+	piiTypes, err := json.Marshal(c.PIITypes)
+	if err != nil {
+		return err
+	}
+
+	var requestID *string
+	if c.RequestID != "" {
+		requestID = &c.RequestID
+	}
+	return db.DB.QueryRowContext(ctx, `
+		INSERT INTO prompt_captures (id, tenant_id, api_key_id, request_id, replay_of, provider, model,
+			requested_model, status_code, latency_ms, pii_types, request_encrypted, response_encrypted, data_key_version)
+		VALUES ($1, $2, $3, $4, $5, $6, $7, $8, $9, $10, $11, $12, $13, $14)
+		RETURNING created_at
+	`, c.ID, c.TenantID, c.APIKeyID, requestID, c.ReplayOf, c.Provider, c.Model,
+		c.RequestedModel, c.StatusCode, c.LatencyMs, piiTypes, sealedReq, sealedResp, version).Scan(&c.CreatedAt)
+}
+
+// sealPromptCapture encrypts both bodies under the tenant's current data key
+func sealPromptCapture(ctx context.Context, c *PromptCapture, request, response []byte) ([]byte, []byte, int, error) {
+	version, err := currentDataKeyVersion(ctx, c.TenantID)
+	if err != nil {
+		return nil, nil, 0, err
+	}
+	sealedReq, err := sealTenantDataVersion(ctx, c.TenantID, version, request, captureAAD(c.ID, "request"))
+	if err != nil {
+		return nil, nil, 0, err
+	}
+	sealedResp, err := sealTenantDataVersion(ctx, c.TenantID, version, response, captureAAD(c.ID, "response"))
+	if err != nil {
+		return nil, nil, 0, err
+	}
+	return sealedReq, sealedResp, version, nil
+}
+
+// CapturePromptAsync stores a capture in the background and returns its ID, or
+// uuid.Nil when the bodies are too large to capture
+func CapturePromptAsync(ctx context.Context, c *PromptCapture, request, response []byte) uuid.UUID {
+	if len(request) > PromptCaptureMaxBytes || len(response) > PromptCaptureMaxBytes {
+		slog.DebugContext(ctx, "prompt capture skipped, body too large", "request_len", len(request), "response_len", len(response))
+		return uuid.Nil
+	}
+	c.ID = uuid.New()
+	go func() {
+		writeCtx, cancel := context.WithTimeout(context.Background(), promptCaptureWriteTimeout)
+		defer cancel()
+		if err := SavePromptCapture(writeCtx, c, request, response); err != nil {
+			slog.WarnContext(ctx, "failed to store prompt capture", "capture_id", c.ID, "error", err)
+		}
+	}()
+	return c.ID
+}
+
+const promptCaptureColumns = `id, tenant_id, api_key_id, COALESCE(request_id, ''), replay_of, provider, model,
+	requested_model, status_code, latency_ms, pii_types, created_at`
+
+func scanPromptCapture(row interface{ Scan(...interface{}) error }, extra ...interface{}) (*PromptCapture, error) {
+	var c PromptCapture
+	var piiTypes []byte
+	dest := []interface{}{&c.ID, &c.TenantID, &c.APIKeyID, &c.RequestID, &c.ReplayOf, &c.Provider, &c.Model,
+		&c.RequestedModel, &c.StatusCode, &c.LatencyMs, &piiTypes, &c.CreatedAt}
+	if err := row.Scan(append(dest, extra...)...); err != nil {
+		return nil, err
+	}
+	if err := json.Unmarshal(piiTypes, &c.PIITypes); err != nil {
+		return nil, fmt.Errorf("prompt capture %s: malformed pii_types: %w", c.ID, err)
+	}
+	return &c, nil
+}
+
+// PromptCaptureFilter narrows ListPromptCaptures
+type PromptCaptureFilter struct {
+	APIKeyID  string
+	RequestID string
+}
+
+// ListPromptCaptures returns a tenant's most recent captures without their bodies
+func ListPromptCaptures(ctx context.Context, tenantID uuid.UUID, f PromptCaptureFilter, limit int) ([]*PromptCapture, error) {
+	rows, err := db.DB.QueryContext(ctx, `
+		SELECT `+promptCaptureColumns+` FROM prompt_captures
+		WHERE tenant_id = $1
+			AND ($2 = '' OR api_key_id::text = $2)
+			AND ($3 = '' OR request_id = $3)
+		ORDER BY created_at DESC
+		LIMIT $4
+	`, tenantID, f.APIKeyID, f.RequestID, limit)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	captures := []*PromptCapture{}
+	for rows.Next() {
+		c, err := scanPromptCapture(rows)
+		if err != nil {
+			return nil, err
+		}
+		captures = append(captures, c)
+	}
+	return captures, rows.Err()
+}
+
+// OpenPromptCapture loads and decrypts one of a tenant's captures (sql.ErrNoRows if it
+// does not exist)
+func OpenPromptCapture(ctx context.Context, tenantID uuid.UUID, id string) (*PromptCapture, error) {
+	captureID, err := uuid.Parse(id)
+	if err != nil {
+		return nil, sql.ErrNoRows
+	}
+
+	var sealedReq, sealedResp []byte
+	var version int
+	c, err := scanPromptCapture(db.DB.QueryRowContext(ctx, `
+		SELECT `+promptCaptureColumns+`, request_encrypted, response_encrypted, data_key_version
+		FROM prompt_captures WHERE id = $1 AND tenant_id = $2
+	`, captureID, tenantID), &sealedReq, &sealedResp, &version)
+	if err != nil {
+		return nil, err
+	}
+
+	request, response, err := openPromptCapture(ctx, c, version, sealedReq, sealedResp)
+	if err != nil {
+		return nil, err
+	}
+	c.Request = PromptCaptureJSON(request)
+	c.Response = PromptCaptureJSON(response)
+	return c, nil
+}
+
+func openPromptCapture(ctx context.Context, c *PromptCapture, version int, sealedReq, sealedResp []byte) ([]byte, []byte, error) {
+	request, err := OpenTenantData(ctx, c.TenantID, version, sealedReq, captureAAD(c.ID, "request"))
+	if err != nil {
+		return nil, nil, err
+	}
+	response, err := OpenTenantData(ctx, c.TenantID, version, sealedResp, captureAAD(c.ID, "response"))
+	if err != nil {
+		return nil, nil, err
+	}
+	return request, response, nil
+}
+
+// PromptCaptureJSON returns a captured body as JSON, quoting it when it is not JSON (e.g. an HTML error page)
+func PromptCaptureJSON(body []byte) json.RawMessage {
+	if json.Valid(body) {
+		return body
+	}
+	quoted, _ := json.Marshal(string(body))
+	return quoted
+}
@@ -0,0 +1,250 @@
+package services
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+	"sync"
+	"time"
+
+	"zaps/db"
+
+	"github.com/redis/go-redis/v9"
+)
+
+const (
+	RateLimitRedisPrefix = "ratelimit:"
+	RateLimitWindow      = time.Minute
+
+	RateLimitRequests = "requests"
+	RateLimitTokens   = "tokens"
+
+	// DefaultKeyRPM applies to keys without a stored RPM limit
+	DefaultKeyRPM = 60
+
+	tenantLimitsCacheTTL = time.Minute
+)
+
+// RateLimits are per-minute limits; 0 means unlimited (see APIKey.Limits for the key RPM default)
+type RateLimits struct {
+	RPM int `json:"rate_limit_rpm"`
+	TPM int `json:"rate_limit_tpm"`
+}
+
+// RateLimitCheck is one counter to test and increment
+type RateLimitCheck struct {
+	Key    string // Redis counter base, see KeyRateLimitKey / TenantRateLimitKey
+	Kind   string // RateLimitRequests or RateLimitTokens
+	Limit  int64
+	Amount int64
+}
+
+// RateLimitStatus is the state of the most constrained counter of a kind, for x-ratelimit-* headers
+type RateLimitStatus struct {
+	Limit     int64
+	Remaining int64
+	Reset     time.Duration
+}
+
+// RateLimitResult is the outcome of CheckRateLimits
+type RateLimitResult struct {
+	Allowed  bool
+	Exceeded *RateLimitCheck // First counter that rejected the request
+	Status   map[string]RateLimitStatus
+	Counted  []RateLimitCheck // Counters that were incremented (for AdjustRateLimit)
+}
+
+// rateLimitScript implements a sliding-window counter: the previous minute's
+// count is weighted by how much of it still overlaps the window. All counters
+// are checked before any is incremented, so a rejected request consumes nothing.
+//
+// KEYS: counter bases. ARGV: now_ms, window_ms, then limit, amount per key.
+// Returns {rejected_index (0 = allowed), remaining_1, ..., remaining_n, reset_ms}.
+var rateLimitScript = redis.NewScript(`
+local now = tonumber(ARGV[1])
+local window = tonumber(ARGV[2])
+local cur = math.floor(now / window)
+local elapsed = (now % window) / window
+local reset = window - (now % window)
+
+local usage = {}
+local rejected = 0
+for i, base in ipairs(KEYS) do
+	local limit = tonumber(ARGV[1 + i * 2])
+	local amount = tonumber(ARGV[2 + i * 2])
+	local prev = tonumber(redis.call("GET", base .. ":" .. (cur - 1)) or "0")
+	local curr = tonumber(redis.call("GET", base .. ":" .. cur) or "0")
+	usage[i] = math.floor(prev * (1 - elapsed) + curr)
+	if rejected == 0 and usage[i] + amount > limit then
+		rejected = i
+	end
+end
+
+local result = {rejected}
+for i, base in ipairs(KEYS) do
+	local limit = tonumber(ARGV[1 + i * 2])
+	local amount = tonumber(ARGV[2 + i * 2])
+	if rejected == 0 then
+		local k = base .. ":" .. cur
+		redis.call("INCRBY", k, amount)
+		redis.call("PEXPIRE", k, window * 2)
+		usage[i] = usage[i] + amount
+	end
+	local remaining = limit - usage[i]
+	if remaining < 0 then remaining = 0 end
+	result[#result + 1] = remaining
+end
+result[#result + 1] = reset
+return result
+`)
+
+// KeyRateLimitKey returns the counter base for an API key. Legacy admin keys
+// without an ID are identified by their hash.
+func KeyRateLimitKey(apiKey *APIKey, kind string) string {
+	id := apiKey.ID
+	if id == "" {
+		id = "legacy-" + apiKey.KeyHash
+	}
+	return fmt.Sprintf("%skey:%s:%s", RateLimitRedisPrefix, id, kind)
+}
+
+// TenantRateLimitKey returns the counter base for a tenant
+func TenantRateLimitKey(tenantID, kind string) string {
+	return fmt.Sprintf("%stenant:%s:%s", RateLimitRedisPrefix, tenantID, kind)
+}
+
+// CheckRateLimits atomically tests every counter and, if all have room, increments them.
+// Checks with Limit <= 0 are unlimited and skipped.
+func CheckRateLimits(ctx context.Context, rdb *redis.Client, checks []RateLimitCheck) (*RateLimitResult, error) {
+	result := &RateLimitResult{Allowed: true, Status: map[string]RateLimitStatus{}}
+
+	var active []RateLimitCheck
+	keys := []string{}
+	args := []interface{}{time.Now().UnixMilli(), RateLimitWindow.Milliseconds()}
+	for _, chk := range checks {
+		if chk.Limit <= 0 {
+			continue
+		}
+		active = append(active, chk)
+		keys = append(keys, chk.Key)
+		args = append(args, chk.Limit, chk.Amount)
+	}
+	if len(active) == 0 {
+		return result, nil
+	}
+
+	vals, err := rateLimitScript.Run(ctx, rdb, keys, args...).Int64Slice()
+	if err != nil {
+		return nil, err
+	}
+
+	reset := time.Duration(vals[len(vals)-1]) * time.Millisecond
+	for i, chk := range active {
+		remaining := vals[i+1]
+		if st, ok := result.Status[chk.Kind]; !ok || remaining < st.Remaining {
+			result.Status[chk.Kind] = RateLimitStatus{Limit: chk.Limit, Remaining: remaining, Reset: reset}
+		}
+	}
+
+	if rejected := vals[0]; rejected > 0 {
+		result.Allowed = false
+		result.Exceeded = &active[rejected-1]
+		return result, nil
+	}
+
+	result.Counted = active
+	return result, nil
+}
+
+// AdjustRateLimit corrects token counters once the real usage is known (delta may be negative)
+func AdjustRateLimit(ctx context.Context, rdb *redis.Client, counted []RateLimitCheck, delta int64) {
+	if delta == 0 {
+		return
+	}
+	cur := time.Now().UnixMilli() / RateLimitWindow.Milliseconds()
+	pipe := rdb.Pipeline()
+	for _, chk := range counted {
+		k := fmt.Sprintf("%s:%d", chk.Key, cur)
+		pipe.IncrBy(ctx, k, delta)
+		pipe.PExpire(ctx, k, 2*RateLimitWindow)
+	}
+	pipe.Exec(ctx)
+}
+
+// -- Limit configuration --
+
+var tenantLimitsCache = struct {
+	sync.RWMutex
+	entries map[string]tenantLimitsEntry
+}{entries: map[string]tenantLimitsEntry{}}
+
+type tenantLimitsEntry struct {
+	limits   RateLimits
+	loadedAt time.Time
+}
+
+// GetTenantRateLimits returns the tenant-wide limits (cached briefly in memory)
+func GetTenantRateLimits(tenantID string) (RateLimits, error) {
+	tenantLimitsCache.RLock()
+	entry, ok := tenantLimitsCache.entries[tenantID]
+	tenantLimitsCache.RUnlock()
+	if ok && time.Since(entry.loadedAt) < tenantLimitsCacheTTL {
+		return entry.limits, nil
+	}
+
+	var rpm, tpm sql.NullInt64
+	err := db.DB.QueryRow("SELECT rate_limit_rpm, rate_limit_tpm FROM tenants WHERE id = $1", tenantID).Scan(&rpm, &tpm)
+	if err != nil {
+		return RateLimits{}, err
+	}
+	limits := RateLimits{RPM: int(rpm.Int64), TPM: int(tpm.Int64)}
+
+	tenantLimitsCache.Lock()
+	tenantLimitsCache.entries[tenantID] = tenantLimitsEntry{limits: limits, loadedAt: time.Now()}
+	tenantLimitsCache.Unlock()
+	return limits, nil
+}
+
+// SetTenantRateLimits updates the tenant-wide limits (0 = unlimited)
+func SetTenantRateLimits(tenantID string, limits RateLimits) error {
+	if limits.RPM < 0 || limits.TPM < 0 {
+		return fmt.Errorf("rate limits must not be negative")
+	}
+	_, err := db.DB.Exec(`
+		UPDATE tenants SET rate_limit_rpm = NULLIF($2, 0), rate_limit_tpm = NULLIF($3, 0)
+		WHERE id = $1
+	`, tenantID, limits.RPM, limits.TPM)
+	if err != nil {
+		return err
+	}
+
+	tenantLimitsCache.Lock()
+	delete(tenantLimitsCache.entries, tenantID)
+	tenantLimitsCache.Unlock()
+	return nil
+}
+
+// SetAPIKeyRateLimits updates a key's limits and drops its cached Redis entry so
+// AuthMiddleware reloads it from the database. RPM 0 restores DefaultKeyRPM; TPM 0 is unlimited.
+func SetAPIKeyRateLimits(rdb *redis.Client, tenantID, keyID string, limits RateLimits) (bool, error) {
+	if limits.RPM < 0 || limits.TPM < 0 {
+		return false, fmt.Errorf("rate limits must not be negative")
+	}
+
+	var keyHash string
+	var hashed bool
+	err := db.DB.QueryRow(`
+		UPDATE api_keys SET rate_limit_rpm = NULLIF($3, 0), rate_limit_tpm = NULLIF($4, 0)
+		WHERE id = $1 AND tenant_id = $2
+		RETURNING key_hash, key_hashed
+	`, keyID, tenantID, limits.RPM, limits.TPM).Scan(&keyHash, &hashed)
+	if err == sql.ErrNoRows {
+		return false, nil
+	}
+	if err != nil {
+		return false, err
+	}
+
+	DeleteAPIKey(rdb, rowKeyHash(rdb, keyHash, hashed))
+	return true, nil
+}
@@ -3,7 +3,7 @@ package services
 import (
 	"context"
 	"fmt"
-	"log"
+	"log/slog"
 	"regexp"
 	"time"
 
@@ -30,10 +30,26 @@ var SecretPatterns = map[string]*regexp.Regexp{
 // RedactSecrets finds secrets and replaces them with tokens
 // redisClient can be nil if caching is not needed (e.g. strict simulation)
 func RedactSecrets(ctx context.Context, input string, clientID string, rdb *redis.Client) (string, map[string]string) {
+	return RedactSecretsWithPatterns(ctx, input, clientID, rdb, nil)
+}
+
+// RedactSecretsWithPatterns is RedactSecrets plus tenant-defined entity patterns
+func RedactSecretsWithPatterns(ctx context.Context, input string, clientID string, rdb *redis.Client, extra map[string]*regexp.Regexp) (string, map[string]string) {
 	secrets := make(map[string]string)
 	output := input
 
-	for label, regex := range SecretPatterns {
+	patterns := SecretPatterns
+	if len(extra) > 0 {
+		patterns = make(map[string]*regexp.Regexp, len(SecretPatterns)+len(extra))
+		for label, regex := range SecretPatterns {
+			patterns[label] = regex
+		}
+		for label, regex := range extra {
+			patterns[label] = regex
+		}
+	}
+
+	for label, regex := range patterns {
 		output = regex.ReplaceAllStringFunc(output, func(match string) string {
 			// Generate unique token
 			timestamp := time.Now().UnixNano()
@@ -45,7 +61,7 @@ func RedactSecrets(ctx context.Context, input string, clientID string, rdb *redi
 			// Cache in Redis (TTL 10 mins)
 			if rdb != nil {
 				rdb.Set(ctx, token, match, 10*time.Minute)
-				log.Printf("[%s] Redacted %s: %s -> %s", clientID, label, MaskSecret(match), token)
+				slog.DebugContext(ctx, "secret redacted", "client_id", clientID, "type", label, "token", token)
 			}
 
 			return token
@@ -64,7 +80,7 @@ func RehydrateSecrets(ctx context.Context, input string, secretMap map[string]st
 		if input != replaceAll(input, token, original) {
 			output = replaceAll(output, token, original)
 			if regexp.MustCompile(regexp.QuoteMeta(token)).MatchString(input) {
-				log.Printf("[Rehydration] Restored %s -> %s", token, MaskSecret(original))
+				slog.DebugContext(ctx, "secret rehydrated", "token", token)
 			}
 		}
 	}
@@ -87,11 +103,12 @@ func RehydrateSecrets(ctx context.Context, input string, secretMap map[string]st
 
 		if rdb != nil {
 			if val, err := rdb.Get(ctx, strictToken).Result(); err == nil {
-				log.Printf("[Rehydration] Restored (Redis) %s -> %s", strictToken, MaskSecret(val))
+				slog.DebugContext(ctx, "secret rehydrated", "token", strictToken, "source", "redis")
 				return val
 			}
 		}
 
+		rehydrationMisses.Inc()
 		return match
 	})
 
@@ -117,3 +134,16 @@ func SanitizeMap(secrets map[string]string) map[string]string {
 	}
 	return sanitized
 }
+
+// SecretTypes counts detected secrets per entity type (e.g. {"EMAIL": 2})
+func SecretTypes(secrets map[string]string) map[string]int {
+	counts := make(map[string]int)
+	for token := range secrets {
+		if m := secretTokenRegex.FindStringSubmatch(token); len(m) == 2 {
+			counts[m[1]]++
+		}
+	}
+	return counts
+}
+
+var secretTokenRegex = regexp.MustCompile(`^<SECRET:([A-Z_]+):\d+>$`)
@@ -0,0 +1,280 @@
+package services
+
+import (
+	"context"
+	"encoding/hex"
+	"fmt"
+
+	"zaps/db"
+
+	"github.com/google/uuid"
+)
+
+// ReencryptOptions selects the tenants and whether to rotate their data keys
+type ReencryptOptions struct {
+	TenantID       string // Empty for every tenant
+	RotateDataKeys bool   // Add a new data key version before re-encrypting
+}
+
+// ReencryptResult counts what ReencryptSecrets rewrote
+type ReencryptResult struct {
+	DataKeysRewrapped int
+	DataKeysRotated   int
+	ProviderKeys      int
+	SinkSecrets       int
+	Captures          int
+}
+
+// ReencryptSecrets moves tenant data onto the current keys:
+//
+//  1. data keys wrapped by an older master key are rewrapped with the KMS's current key
+//  2. with RotateDataKeys, each tenant gets a new data key version
+//  3. provider keys, audit sink secrets and prompt captures not encrypted under the
+//     tenant's newest data key version (including values still under ENCRYPTION_KEY)
+//     are re-encrypted
+//
+// Every update is conditional on the old value, so it is safe to run while the gateway
+// is serving traffic, and running it again finishes whatever a previous run left.
+func ReencryptSecrets(ctx context.Context, opts ReencryptOptions) (*ReencryptResult, error) {
+	res := &ReencryptResult{}
+
+	var tenantFilter *uuid.UUID
+	if opts.TenantID != "" {
+		id, err := uuid.Parse(opts.TenantID)
+		if err != nil {
+			return res, fmt.Errorf("invalid tenant ID: %w", err)
+		}
+		tenantFilter = &id
+	}
+
+	n, err := rewrapTenantDataKeys(ctx, tenantFilter)
+	res.DataKeysRewrapped = n
+	if err != nil {
+		return res, err
+	}
+
+	rows, err := db.DB.QueryContext(ctx, `
+		SELECT tenant_id FROM provider_keys
+		UNION SELECT tenant_id FROM audit_sinks WHERE secret_encrypted IS NOT NULL
+		UNION SELECT tenant_id FROM tenant_data_keys
+	`)
+	if err != nil {
+		return res, err
+	}
+	var tenants []uuid.UUID
+	for rows.Next() {
+		var id uuid.UUID
+		if err := rows.Scan(&id); err != nil {
+			rows.Close()
+			return res, err
+		}
+		if tenantFilter == nil || id == *tenantFilter {
+			tenants = append(tenants, id)
+		}
+	}
+	rows.Close()
+
+	for _, tenantID := range tenants {
+		if opts.RotateDataKeys {
+			if err := rotateTenantDataKey(ctx, tenantID); err != nil {
+				return res, fmt.Errorf("rotate data key for tenant %s: %w", tenantID, err)
+			}
+			res.DataKeysRotated++
+		}
+		dataKeyVersions.Delete(tenantID)
+		version, err := currentDataKeyVersion(ctx, tenantID)
+		if err != nil {
+			return res, err
+		}
+
+		n, err := reencryptSecretColumn(ctx, tenantID, version, "provider_keys", "encrypted_key")
+		res.ProviderKeys += n
+		if err != nil {
+			return res, fmt.Errorf("provider keys of tenant %s: %w", tenantID, err)
+		}
+		n, err = reencryptSecretColumn(ctx, tenantID, version, "audit_sinks", "secret_encrypted")
+		res.SinkSecrets += n
+		if err != nil {
+			return res, fmt.Errorf("audit sink secrets of tenant %s: %w", tenantID, err)
+		}
+		n, err = reencryptPromptCaptures(ctx, tenantID, version)
+		res.Captures += n
+		if err != nil {
+			return res, fmt.Errorf("prompt captures of tenant %s: %w", tenantID, err)
+		}
+	}
+	return res, nil
+}
+
+// rewrapTenantDataKeys rewraps data keys whose master key is not the KMS's current key
+func rewrapTenantDataKeys(ctx context.Context, tenantFilter *uuid.UUID) (int, error) {
+	kms, err := currentKMS()
+	if err != nil {
+		return 0, err
+	}
+	rows, err := db.DB.QueryContext(ctx, `
+		SELECT tenant_id, version, key_encrypted, kms_key_id FROM tenant_data_keys
+		WHERE kms_key_id <> $1 AND ($2::uuid IS NULL OR tenant_id = $2)
+	`, kms.KeyID(), tenantFilter)
+	if err != nil {
+		return 0, err
+	}
+	type wrappedKey struct {
+		tenantID       uuid.UUID
+		version        int
+		wrapped, keyID string
+	}
+	var keys []wrappedKey
+	for rows.Next() {
+		var k wrappedKey
+		if err := rows.Scan(&k.tenantID, &k.version, &k.wrapped, &k.keyID); err != nil {
+			rows.Close()
+			return 0, err
+		}
+		keys = append(keys, k)
+	}
+	rows.Close()
+
+	rewrapped := 0
+	for _, k := range keys {
+		key, err := unwrapDataKey(ctx, k.keyID, k.wrapped)
+		if err != nil {
+			return rewrapped, fmt.Errorf("tenant %s version %d: %w", k.tenantID, k.version, err)
+		}
+		wrapped, err := kms.Wrap(ctx, key)
+		if err != nil {
+			return rewrapped, err
+		}
+		res, err := db.DB.ExecContext(ctx, `
+			UPDATE tenant_data_keys SET key_encrypted = $4, kms_key_id = $5
+			WHERE tenant_id = $1 AND version = $2 AND key_encrypted = $3
+		`, k.tenantID, k.version, k.wrapped, hex.EncodeToString(wrapped), kms.KeyID())
+		if err != nil {
+			return rewrapped, err
+		}
+		if n, _ := res.RowsAffected(); n > 0 {
+			rewrapped++
+		}
+	}
+	return rewrapped, nil
+}
+
+// rotateTenantDataKey adds the tenant's next data key version
+func rotateTenantDataKey(ctx context.Context, tenantID uuid.UUID) error {
+	var version int
+	if err := db.DB.QueryRowContext(ctx, `
+		SELECT COALESCE(MAX(version), 0) FROM tenant_data_keys WHERE tenant_id = $1
+	`, tenantID).Scan(&version); err != nil {
+		return err
+	}
+	return insertDataKey(ctx, tenantID, version+1)
+}
+
+// reencryptSecretColumn re-encrypts a tenant's "dk<version>:" or legacy values in
+// table.column that are not under the given data key version
+func reencryptSecretColumn(ctx context.Context, tenantID uuid.UUID, version int, table, column string) (int, error) {
+	rows, err := db.DB.QueryContext(ctx, fmt.Sprintf(`
+		SELECT id, %s FROM %s WHERE tenant_id = $1 AND %s IS NOT NULL
+	`, column, table, column), tenantID)
+	if err != nil {
+		return 0, err
+	}
+	type secretRow struct {
+		id         uuid.UUID
+		ciphertext string
+	}
+	var stale []secretRow
+	for rows.Next() {
+		var r secretRow
+		if err := rows.Scan(&r.id, &r.ciphertext); err != nil {
+			rows.Close()
+			return 0, err
+		}
+		if v, _ := tenantSecretVersion(r.ciphertext); v != version {
+			stale = append(stale, r)
+		}
+	}
+	rows.Close()
+
+	updated := 0
+	for _, r := range stale {
+		plaintext, err := DecryptTenantSecret(ctx, tenantID, r.ciphertext)
+		if err != nil {
+			return updated, fmt.Errorf("%s %s: %w", table, r.id, err)
+		}
+		sealed, err := sealTenantDataVersion(ctx, tenantID, version, []byte(plaintext), nil)
+		if err != nil {
+			return updated, err
+		}
+		ciphertext := formatTenantSecret(version, sealed)
+		res, err := db.DB.ExecContext(ctx, fmt.Sprintf(`
+			UPDATE %s SET %s = $3 WHERE id = $1 AND %s = $2
+		`, table, column, column), r.id, r.ciphertext, ciphertext)
+		if err != nil {
+			return updated, err
+		}
+		if n, _ := res.RowsAffected(); n > 0 {
+			updated++
+		}
+	}
+	return updated, nil
+}
+
+// reencryptPromptCaptures reseals a tenant's captures under the given data key version
+func reencryptPromptCaptures(ctx context.Context, tenantID uuid.UUID, version int) (int, error) {
+	updated := 0
+	for ctx.Err() == nil {
+		rows, err := db.DB.QueryContext(ctx, `
+			SELECT id, request_encrypted, response_encrypted, data_key_version FROM prompt_captures
+			WHERE tenant_id = $1 AND data_key_version <> $2
+			LIMIT 100
+		`, tenantID, version)
+		if err != nil {
+			return updated, err
+		}
+		type captureRow struct {
+			id                    uuid.UUID
+			sealedReq, sealedResp []byte
+			version               int
+		}
+		var batch []captureRow
+		for rows.Next() {
+			var r captureRow
+			if err := rows.Scan(&r.id, &r.sealedReq, &r.sealedResp, &r.version); err != nil {
+				rows.Close()
+				return updated, err
+			}
+			batch = append(batch, r)
+		}
+		rows.Close()
+		if len(batch) == 0 {
+			break
+		}
+
+		for _, r := range batch {
+			c := &PromptCapture{ID: r.id, TenantID: tenantID}
+			request, response, err := openPromptCapture(ctx, c, r.version, r.sealedReq, r.sealedResp)
+			if err != nil {
+				return updated, fmt.Errorf("capture %s: %w", r.id, err)
+			}
+			sealedReq, sealedResp, newVersion, err := sealPromptCapture(ctx, c, request, response)
+			if err != nil {
+				return updated, err
+			}
+			if newVersion != version {
+				return updated, fmt.Errorf("data key version changed during re-encryption")
+			}
+			res, err := db.DB.ExecContext(ctx, `
+				UPDATE prompt_captures SET request_encrypted = $3, response_encrypted = $4, data_key_version = $5
+				WHERE id = $1 AND data_key_version = $2
+			`, r.id, r.version, sealedReq, sealedResp, newVersion)
+			if err != nil {
+				return updated, err
+			}
+			if n, _ := res.RowsAffected(); n > 0 {
+				updated++
+			}
+		}
+	}
+	return updated, ctx.Err()
+}
@@ -0,0 +1,498 @@
+package services
+
+import (
+	"bytes"
+	"compress/gzip"
+	"context"
+	"crypto/ed25519"
+	"database/sql"
+	"fmt"
+	"log/slog"
+	"time"
+
+	"zaps/db"
+
+	"github.com/google/uuid"
+	"github.com/lib/pq"
+	"github.com/redis/go-redis/v9"
+)
+
+// Retention: tenants choose how many days audit events, usage data and prompt-derived
+// data (prompt captures and semantic cache entries) are kept. The retention_purge job deletes expired rows
+// in batches, copying each batch to the archive store first when the tenant asks for
+// it, and records every purge as a RETENTION_PURGE audit event.
+//
+// Audit rows are purged strictly in chain order and the chain head remembers the last
+// purged link, so VerifyAuditChain keeps validating what remains.
+
+const (
+	// MaxRetentionDays bounds every retention setting (ten years)
+	MaxRetentionDays = 3650
+
+	retentionBatchSize = 5000
+)
+
+// RetentionPolicy is a tenant's retention configuration. Nil days keep data forever.
+type RetentionPolicy struct {
+	AuditDays   *int       `json:"audit_days"`
+	UsageDays   *int       `json:"usage_days"`
+	PromptDays  *int       `json:"prompt_days"`
+	Archive     bool       `json:"archive"`
+	LastPurgeAt *time.Time `json:"last_purge_at,omitempty"`
+}
+
+// GetRetentionPolicy loads a tenant's policy (defaults to keeping everything)
+func GetRetentionPolicy(ctx context.Context, tenantID uuid.UUID) (*RetentionPolicy, error) {
+	p := &RetentionPolicy{Archive: true}
+	err := db.DB.QueryRowContext(ctx, `
+		SELECT audit_days, usage_days, prompt_days, archive, last_purge_at
+		FROM retention_policies WHERE tenant_id = $1
+	`, tenantID).Scan(&p.AuditDays, &p.UsageDays, &p.PromptDays, &p.Archive, &p.LastPurgeAt)
+	if err == sql.ErrNoRows {
+		return p, nil
+	}
+	return p, err
+}
+
+// SaveRetentionPolicy validates and stores a tenant's policy
+func SaveRetentionPolicy(ctx context.Context, tenantID uuid.UUID, p *RetentionPolicy) error {
+	for name, days := range map[string]*int{"audit_days": p.AuditDays, "usage_days": p.UsageDays, "prompt_days": p.PromptDays} {
+		if days != nil && (*days < 1 || *days > MaxRetentionDays) {
+			return fmt.Errorf("%s must be between 1 and %d, or null to keep data forever", name, MaxRetentionDays)
+		}
+	}
+	if p.Archive {
+		store, err := ArchiveStoreFromEnv()
+		if err != nil {
+			return err
+		}
+		if store == nil && (p.AuditDays != nil || p.UsageDays != nil) {
+			return fmt.Errorf("archive is enabled but no archive store is configured (ARCHIVE_URL)")
+		}
+	}
+
+	_, err := db.DB.ExecContext(ctx, `
+		INSERT INTO retention_policies (tenant_id, audit_days, usage_days, prompt_days, archive)
+		VALUES ($1, $2, $3, $4, $5)
+		ON CONFLICT (tenant_id) DO UPDATE SET
+			audit_days = EXCLUDED.audit_days,
+			usage_days = EXCLUDED.usage_days,
+			prompt_days = EXCLUDED.prompt_days,
+			archive = EXCLUDED.archive,
+			updated_at = NOW()
+	`, tenantID, p.AuditDays, p.UsageDays, p.PromptDays, p.Archive)
+	return err
+}
+
+// retentionTarget is one table the purge job deletes from
+type retentionTarget struct {
+	table      string
+	timeColumn string
+	where      string // Extra condition
+}
+
+var (
+	unchainedAuditTarget = retentionTarget{"audit_logs", "created_at", "seq IS NULL"}
+	usageTargets         = []retentionTarget{
+		{"usage_logs", "hour_bucket", ""},
+		{"usage_metrics", "hour_bucket", ""},
+	}
+)
+
+// purgeResult summarises what one purge removed from one table
+type purgeResult struct {
+	rows       int64
+	objects    []string // Archive locations
+	firstID    int64
+	lastID     int64
+	throughSeq int64 // Audit chain only
+}
+
+// runRetentionPurge applies every tenant's policy
+func runRetentionPurge(ctx context.Context, rdb *redis.Client) (map[string]interface{}, error) {
+	result := map[string]interface{}{}
+
+	store, storeErr := ArchiveStoreFromEnv()
+	rows, err := db.DB.QueryContext(ctx, `
+		SELECT tenant_id, audit_days, usage_days, prompt_days, archive
+		FROM retention_policies
+		WHERE audit_days IS NOT NULL OR usage_days IS NOT NULL OR prompt_days IS NOT NULL
+	`)
+	if err != nil {
+		return result, err
+	}
+	type tenantPolicy struct {
+		tenantID uuid.UUID
+		policy   RetentionPolicy
+	}
+	var policies []tenantPolicy
+	for rows.Next() {
+		var tp tenantPolicy
+		if err := rows.Scan(&tp.tenantID, &tp.policy.AuditDays, &tp.policy.UsageDays, &tp.policy.PromptDays, &tp.policy.Archive); err != nil {
+			rows.Close()
+			return result, err
+		}
+		policies = append(policies, tp)
+	}
+	rows.Close()
+
+	var purged, failed int64
+	for _, tp := range policies {
+		if ctx.Err() != nil {
+			break
+		}
+		var tenantStore ArchiveStore
+		if tp.policy.Archive && (tp.policy.AuditDays != nil || tp.policy.UsageDays != nil) {
+			if store == nil {
+				// Never delete what the tenant wants archived first
+				slog.ErrorContext(ctx, "retention: archive store unavailable, purge skipped", "tenant_id", tp.tenantID, "error", storeErr)
+				failed++
+				continue
+			}
+			tenantStore = store
+		}
+
+		n, err := purgeTenant(ctx, rdb, tp.tenantID, &tp.policy, tenantStore)
+		purged += n
+		if err != nil {
+			slog.ErrorContext(ctx, "retention purge failed", "tenant_id", tp.tenantID, "error", err)
+			failed++
+			continue
+		}
+		db.DB.ExecContext(ctx, "UPDATE retention_policies SET last_purge_at = NOW() WHERE tenant_id = $1", tp.tenantID)
+	}
+
+	result["tenants"] = len(policies)
+	result["rows_purged"] = purged
+	result["tenants_failed"] = failed
+	if failed > 0 {
+		return result, fmt.Errorf("retention purge failed for %d tenants", failed)
+	}
+	return result, nil
+}
+
+// purgeTenant removes one tenant's expired data, recording an audit event per table
+func purgeTenant(ctx context.Context, rdb *redis.Client, tenantID uuid.UUID, p *RetentionPolicy, store ArchiveStore) (int64, error) {
+	now := time.Now()
+	var total int64
+	record := func(table string, days int, cutoff time.Time, res purgeResult) {
+		total += res.rows
+		if res.rows == 0 {
+			return
+		}
+		data := map[string]interface{}{
+			"table":          table,
+			"rows":           res.rows,
+			"retention_days": days,
+			"cutoff":         cutoff.UTC().Format(time.RFC3339),
+			"first_id":       res.firstID,
+			"last_id":        res.lastID,
+			"archived":       len(res.objects) > 0,
+		}
+		if len(res.objects) > 0 {
+			data["archive_objects"] = res.objects
+		}
+		if res.throughSeq > 0 {
+			data["purged_through_seq"] = res.throughSeq
+		}
+		LogAuditAsync(tenantID.String(), nil, "RETENTION_PURGE", data, "", "scheduler")
+	}
+
+	if p.AuditDays != nil {
+		cutoff := now.AddDate(0, 0, -*p.AuditDays)
+		res, err := purgeAuditChain(ctx, tenantID, cutoff, store)
+		record("audit_logs", *p.AuditDays, cutoff, res)
+		if err != nil {
+			return total, err
+		}
+		res, err = purgeTarget(ctx, unchainedAuditTarget, tenantID, cutoff, store)
+		record("audit_logs", *p.AuditDays, cutoff, res)
+		if err != nil {
+			return total, err
+		}
+	}
+	if p.UsageDays != nil {
+		cutoff := now.AddDate(0, 0, -*p.UsageDays)
+		for _, t := range usageTargets {
+			res, err := purgeTarget(ctx, t, tenantID, cutoff, store)
+			record(t.table, *p.UsageDays, cutoff, res)
+			if err != nil {
+				return total, err
+			}
+		}
+	}
+	if p.PromptDays != nil {
+		cutoff := now.AddDate(0, 0, -*p.PromptDays)
+		// Prompt data is deleted outright, never archived
+		n, err := purgePromptCaptures(ctx, tenantID, cutoff)
+		record("prompt_captures", *p.PromptDays, cutoff, purgeResult{rows: n})
+		if err != nil {
+			return total, err
+		}
+		n, err = purgeSemanticCache(ctx, rdb, tenantID.String(), cutoff)
+		record("semantic_cache", *p.PromptDays, cutoff, purgeResult{rows: n})
+		if err != nil {
+			return total, err
+		}
+	}
+	return total, nil
+}
+
+// archiveRows gzips JSON lines and stores them under
+// <tenant>/<table>/<yyyy>/<mm>/<dd>/<first>-<last>.jsonl.gz
+func archiveRows(ctx context.Context, store ArchiveStore, tenantID uuid.UUID, table string, firstID, lastID int64, lines []string) (string, error) {
+	var buf bytes.Buffer
+	zw := gzip.NewWriter(&buf)
+	for _, line := range lines {
+		zw.Write([]byte(line))
+		zw.Write([]byte{'\n'})
+	}
+	if err := zw.Close(); err != nil {
+		return "", err
+	}
+	key := fmt.Sprintf("%s/%s/%s/%d-%d.jsonl.gz", tenantID, table, time.Now().UTC().Format("2006/01/02"), firstID, lastID)
+	if err := store.Put(ctx, key, buf.Bytes()); err != nil {
+		return "", err
+	}
+	return store.Location(key), nil
+}
+
+// purgeTarget deletes a tenant's rows older than cutoff from a table, batch by batch,
+// archiving each batch (as row_to_json) before it is deleted
+func purgeTarget(ctx context.Context, t retentionTarget, tenantID uuid.UUID, cutoff time.Time, store ArchiveStore) (purgeResult, error) {
+	var res purgeResult
+	cond := fmt.Sprintf("tenant_id = $1 AND %s < $2", t.timeColumn)
+	if t.where != "" {
+		cond += " AND " + t.where
+	}
+
+	for ctx.Err() == nil {
+		rows, err := db.DB.QueryContext(ctx, fmt.Sprintf(`
+			SELECT id, row_to_json(t)::text FROM %s t WHERE %s ORDER BY id ASC LIMIT $3
+		`, t.table, cond), tenantID, cutoff, retentionBatchSize)
+		if err != nil {
+			return res, err
+		}
+		var ids []int64
+		var lines []string
+		for rows.Next() {
+			var id int64
+			var line string
+			if err := rows.Scan(&id, &line); err != nil {
+				rows.Close()
+				return res, err
+			}
+			ids = append(ids, id)
+			lines = append(lines, line)
+		}
+		rows.Close()
+		if err := rows.Err(); err != nil {
+			return res, err
+		}
+		if len(ids) == 0 {
+			break
+		}
+
+		if store != nil {
+			loc, err := archiveRows(ctx, store, tenantID, t.table, ids[0], ids[len(ids)-1], lines)
+			if err != nil {
+				return res, fmt.Errorf("archive %s: %w", t.table, err)
+			}
+			res.objects = append(res.objects, loc)
+		}
+		if _, err := db.DB.ExecContext(ctx, fmt.Sprintf(`DELETE FROM %s WHERE id = ANY($1) AND tenant_id = $2`, t.table),
+			pq.Array(ids), tenantID); err != nil {
+			return res, err
+		}
+
+		if res.firstID == 0 {
+			res.firstID = ids[0]
+		}
+		res.lastID = ids[len(ids)-1]
+		res.rows += int64(len(ids))
+		if len(ids) < retentionBatchSize {
+			break
+		}
+	}
+	return res, ctx.Err()
+}
+
+// purgeAuditChain deletes the oldest chained audit rows up to the first one newer than
+// cutoff, so what remains is an unbroken suffix of the chain. The head row records the
+// last purged link, which becomes the starting point for verification.
+func purgeAuditChain(ctx context.Context, tenantID uuid.UUID, cutoff time.Time, store ArchiveStore) (purgeResult, error) {
+	var res purgeResult
+
+	for ctx.Err() == nil {
+		var purgedSeq int64
+		err := db.DB.QueryRowContext(ctx, "SELECT purged_seq FROM audit_chain_heads WHERE tenant_id = $1", tenantID).Scan(&purgedSeq)
+		if err == sql.ErrNoRows {
+			break
+		}
+		if err != nil {
+			return res, err
+		}
+
+		rows, err := db.DB.QueryContext(ctx, `
+			SELECT id, seq, row_hash, created_at, row_to_json(t)::text
+			FROM audit_logs t
+			WHERE tenant_id = $1 AND seq > $2
+			ORDER BY seq ASC
+			LIMIT $3
+		`, tenantID, purgedSeq, retentionBatchSize)
+		if err != nil {
+			return res, err
+		}
+		var ids []int64
+		var lines []string
+		var lastSeq int64
+		var lastHash []byte
+		reachedCutoff := false
+		for rows.Next() {
+			var id, seq int64
+			var rowHash []byte
+			var createdAt time.Time
+			var line string
+			if err := rows.Scan(&id, &seq, &rowHash, &createdAt, &line); err != nil {
+				rows.Close()
+				return res, err
+			}
+			if !createdAt.Before(cutoff) {
+				reachedCutoff = true
+				break
+			}
+			ids = append(ids, id)
+			lines = append(lines, line)
+			lastSeq, lastHash = seq, rowHash
+		}
+		rows.Close()
+		if len(ids) == 0 {
+			break
+		}
+
+		if store != nil {
+			loc, err := archiveRows(ctx, store, tenantID, "audit_logs", purgedSeq+1, lastSeq, lines)
+			if err != nil {
+				return res, fmt.Errorf("archive audit_logs: %w", err)
+			}
+			res.objects = append(res.objects, loc)
+		}
+		if err := deleteAuditChainPrefix(ctx, tenantID, purgedSeq, lastSeq, lastHash); err != nil {
+			return res, err
+		}
+
+		if res.firstID == 0 {
+			res.firstID = ids[0]
+		}
+		res.lastID = ids[len(ids)-1]
+		res.rows += int64(len(ids))
+		res.throughSeq = lastSeq
+		if reachedCutoff || len(ids) < retentionBatchSize {
+			break
+		}
+	}
+	return res, ctx.Err()
+}
+
+// deleteAuditChainPrefix removes chain rows (fromSeq, throughSeq] and moves the purge
+// marker, under the head lock so it cannot interleave with appends or another purge.
+// The marker is signed when AUDIT_SIGNING_KEY is set, so that VerifyAuditChain can
+// tell a retention purge from rows deleted by hand.
+func deleteAuditChainPrefix(ctx context.Context, tenantID uuid.UUID, fromSeq, throughSeq int64, throughHash []byte) error {
+	priv, err := AuditSigningKey()
+	if err != nil {
+		return err
+	}
+	var keyID *string
+	var signature []byte
+	if priv != nil {
+		id := AuditSigningKeyID(priv.Public().(ed25519.PublicKey))
+		keyID = &id
+		signature = ed25519.Sign(priv, auditPurgeMessage(tenantID, throughSeq, throughHash))
+	}
+
+	tx, err := db.DB.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	var purgedSeq int64
+	if err := tx.QueryRowContext(ctx, `
+		SELECT purged_seq FROM audit_chain_heads WHERE tenant_id = $1 FOR UPDATE
+	`, tenantID).Scan(&purgedSeq); err != nil {
+		return err
+	}
+	if purgedSeq != fromSeq {
+		return fmt.Errorf("audit chain purge raced with another purge")
+	}
+
+	if _, err := tx.ExecContext(ctx, `
+		DELETE FROM audit_logs WHERE tenant_id = $1 AND seq > $2 AND seq <= $3
+	`, tenantID, fromSeq, throughSeq); err != nil {
+		return err
+	}
+	// Checkpoints over purged rows can no longer be checked against them
+	if _, err := tx.ExecContext(ctx, `
+		DELETE FROM audit_checkpoints WHERE tenant_id = $1 AND seq <= $2
+	`, tenantID, throughSeq); err != nil {
+		return err
+	}
+	if _, err := tx.ExecContext(ctx, `
+		UPDATE audit_chain_heads SET purged_seq = $2, purged_hash = $3, purged_key_id = $4, purged_signature = $5
+		WHERE tenant_id = $1
+	`, tenantID, throughSeq, throughHash, keyID, signature); err != nil {
+		return err
+	}
+	return tx.Commit()
+}
+
+// purgePromptCaptures deletes a tenant's captures older than cutoff in batches
+func purgePromptCaptures(ctx context.Context, tenantID uuid.UUID, cutoff time.Time) (int64, error) {
+	var removed int64
+	for ctx.Err() == nil {
+		res, err := db.DB.ExecContext(ctx, `
+			DELETE FROM prompt_captures WHERE id IN (
+				SELECT id FROM prompt_captures WHERE tenant_id = $1 AND created_at < $2 LIMIT $3
+			)
+		`, tenantID, cutoff, retentionBatchSize)
+		if err != nil {
+			return removed, err
+		}
+		n, _ := res.RowsAffected()
+		removed += n
+		if n < retentionBatchSize {
+			break
+		}
+	}
+	return removed, ctx.Err()
+}
+
+// purgeSemanticCache drops a tenant's cached answers created before cutoff
+func purgeSemanticCache(ctx context.Context, rdb *redis.Client, tenantID string, cutoff time.Time) (int64, error) {
+	models, err := rdb.SMembers(ctx, SemanticCachePrefix+tenantID+":models").Result()
+	if err != nil {
+		return 0, err
+	}
+
+	var removed int64
+	max := fmt.Sprintf("(%d", cutoff.Unix())
+	for _, m := range models {
+		indexKey := semanticCacheKey(tenantID, m, "index")
+		ids, err := rdb.ZRangeByScore(ctx, indexKey, &redis.ZRangeBy{Min: "-inf", Max: max}).Result()
+		if err != nil {
+			return removed, err
+		}
+		if len(ids) == 0 {
+			continue
+		}
+		pipe := rdb.TxPipeline()
+		pipe.HDel(ctx, semanticCacheKey(tenantID, m, "entries"), ids...)
+		pipe.ZRem(ctx, indexKey, toInterfaces(ids)...)
+		if _, err := pipe.Exec(ctx); err != nil {
+			return removed, err
+		}
+		removed += int64(len(ids))
+	}
+	return removed, nil
+}
@@ -0,0 +1,286 @@
+package services
+
+import (
+	"database/sql"
+	"fmt"
+
+	"zaps/db"
+
+	"github.com/google/uuid"
+	"github.com/lib/pq"
+)
+
+// ModelAlias maps a tenant-defined name to a concrete provider/model
+type ModelAlias struct {
+	ID        uuid.UUID `json:"id"`
+	Alias     string    `json:"alias"`
+	Provider  string    `json:"provider"`
+	Model     string    `json:"model"`
+	CreatedAt string    `json:"created_at"`
+}
+
+// RoutingRule rewrites the requested model when all of its conditions match
+type RoutingRule struct {
+	ID             uuid.UUID `json:"id"`
+	Name           string    `json:"name"`
+	Priority       int       `json:"priority"`
+	Enabled        bool      `json:"enabled"`
+	MatchModel     string    `json:"match_model"`
+	MinPromptChars *int      `json:"min_prompt_chars,omitempty"`
+	MaxPromptChars *int      `json:"max_prompt_chars,omitempty"`
+	RequiresPII    *bool     `json:"requires_pii,omitempty"`
+	APIKeyIDs      []string  `json:"api_key_ids"`
+	TargetProvider string    `json:"target_provider"`
+	TargetModel    string    `json:"target_model"`
+}
+
+// RoutingInput is the request context rules are evaluated against
+type RoutingInput struct {
+	Model       string
+	PromptChars int
+	PIITypes    map[string]int
+	APIKeyID    string
+}
+
+// RouteResolution is the outcome of alias/rule resolution.
+// Provider is empty when the caller should infer it from the model name.
+type RouteResolution struct {
+	Provider string
+	Model    string
+	Alias    string
+	Rule     string
+}
+
+// Matches reports whether the rule applies to the request
+func (r *RoutingRule) Matches(in RoutingInput) bool {
+	if !r.Enabled {
+		return false
+	}
+	if r.MatchModel != "" && r.MatchModel != "*" && r.MatchModel != in.Model {
+		return false
+	}
+	if r.MinPromptChars != nil && in.PromptChars < *r.MinPromptChars {
+		return false
+	}
+	if r.MaxPromptChars != nil && in.PromptChars > *r.MaxPromptChars {
+		return false
+	}
+	if r.RequiresPII != nil && *r.RequiresPII != (len(in.PIITypes) > 0) {
+		return false
+	}
+	if len(r.APIKeyIDs) > 0 {
+		found := false
+		for _, id := range r.APIKeyIDs {
+			if id == in.APIKeyID {
+				found = true
+				break
+			}
+		}
+		if !found {
+			return false
+		}
+	}
+	return true
+}
+
+// ResolveModel applies the tenant's routing rules and aliases to the requested model
+func ResolveModel(tenantID string, in RoutingInput) (*RouteResolution, error) {
+	res := &RouteResolution{Model: in.Model}
+
+	rules, err := ListRoutingRules(tenantID)
+	if err != nil {
+		return nil, err
+	}
+
+	for _, r := range rules {
+		if r.Matches(in) {
+			res.Rule = r.Name
+			res.Provider = r.TargetProvider
+			res.Model = r.TargetModel
+			break
+		}
+	}
+
+	// Resolve aliases (a rule may target an alias too)
+	alias, err := GetModelAlias(tenantID, res.Model)
+	if err != nil {
+		return nil, err
+	}
+	if alias != nil {
+		res.Alias = alias.Alias
+		res.Provider = alias.Provider
+		res.Model = alias.Model
+	}
+
+	return res, nil
+}
+
+// -- Aliases --
+
+// GetModelAlias returns the alias definition for name, or nil if it is not an alias
+func GetModelAlias(tenantID, name string) (*ModelAlias, error) {
+	var a ModelAlias
+	err := db.DB.QueryRow(`
+		SELECT id, alias, provider, model, created_at
+		FROM model_aliases
+		WHERE tenant_id = $1 AND alias = $2
+	`, tenantID, name).Scan(&a.ID, &a.Alias, &a.Provider, &a.Model, &a.CreatedAt)
+
+	if err == sql.ErrNoRows {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	return &a, nil
+}
+
+// ListModelAliases returns all aliases for a tenant
+func ListModelAliases(tenantID string) ([]ModelAlias, error) {
+	rows, err := db.DB.Query(`
+		SELECT id, alias, provider, model, created_at
+		FROM model_aliases
+		WHERE tenant_id = $1
+		ORDER BY alias ASC
+	`, tenantID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	aliases := []ModelAlias{}
+	for rows.Next() {
+		var a ModelAlias
+		if err := rows.Scan(&a.ID, &a.Alias, &a.Provider, &a.Model, &a.CreatedAt); err != nil {
+			continue
+		}
+		aliases = append(aliases, a)
+	}
+	return aliases, nil
+}
+
+// SaveModelAlias creates or updates an alias
+func SaveModelAlias(tenantID uuid.UUID, a *ModelAlias) error {
+	if a.Alias == "" || a.Provider == "" || a.Model == "" {
+		return fmt.Errorf("alias, provider and model are required")
+	}
+	if a.Alias == a.Model {
+		return fmt.Errorf("alias cannot point to itself")
+	}
+
+	return db.DB.QueryRow(`
+		INSERT INTO model_aliases (tenant_id, alias, provider, model)
+		VALUES ($1, $2, $3, $4)
+		ON CONFLICT (tenant_id, alias)
+		DO UPDATE SET provider = EXCLUDED.provider, model = EXCLUDED.model
+		RETURNING id
+	`, tenantID, a.Alias, a.Provider, a.Model).Scan(&a.ID)
+}
+
+// DeleteModelAlias removes an alias
+func DeleteModelAlias(tenantID uuid.UUID, alias string) (bool, error) {
+	res, err := db.DB.Exec("DELETE FROM model_aliases WHERE tenant_id = $1 AND alias = $2", tenantID, alias)
+	if err != nil {
+		return false, err
+	}
+	n, _ := res.RowsAffected()
+	return n > 0, nil
+}
+
+// -- Rules --
+
+// ListRoutingRules returns a tenant's rules in evaluation order
+func ListRoutingRules(tenantID string) ([]RoutingRule, error) {
+	rows, err := db.DB.Query(`
+		SELECT id, name, priority, enabled, match_model, min_prompt_chars, max_prompt_chars,
+			requires_pii, api_key_ids, COALESCE(target_provider, ''), target_model
+		FROM routing_rules
+		WHERE tenant_id = $1
+		ORDER BY priority ASC, created_at ASC
+	`, tenantID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	rules := []RoutingRule{}
+	for rows.Next() {
+		var r RoutingRule
+		var minChars, maxChars sql.NullInt64
+		var requiresPII sql.NullBool
+		if err := rows.Scan(&r.ID, &r.Name, &r.Priority, &r.Enabled, &r.MatchModel, &minChars, &maxChars,
+			&requiresPII, pq.Array(&r.APIKeyIDs), &r.TargetProvider, &r.TargetModel); err != nil {
+			continue
+		}
+		if minChars.Valid {
+			v := int(minChars.Int64)
+			r.MinPromptChars = &v
+		}
+		if maxChars.Valid {
+			v := int(maxChars.Int64)
+			r.MaxPromptChars = &v
+		}
+		if requiresPII.Valid {
+			v := requiresPII.Bool
+			r.RequiresPII = &v
+		}
+		if r.APIKeyIDs == nil {
+			r.APIKeyIDs = []string{}
+		}
+		rules = append(rules, r)
+	}
+	return rules, nil
+}
+
+// SaveRoutingRule inserts a rule, or updates it when r.ID is set
+func SaveRoutingRule(tenantID uuid.UUID, r *RoutingRule) error {
+	if r.Name == "" || r.TargetModel == "" {
+		return fmt.Errorf("name and target_model are required")
+	}
+	if r.MatchModel == "" {
+		r.MatchModel = "*"
+	}
+	if r.APIKeyIDs == nil {
+		r.APIKeyIDs = []string{}
+	}
+
+	var targetProvider *string
+	if r.TargetProvider != "" {
+		targetProvider = &r.TargetProvider
+	}
+
+	if r.ID == uuid.Nil {
+		return db.DB.QueryRow(`
+			INSERT INTO routing_rules (tenant_id, name, priority, enabled, match_model, min_prompt_chars,
+				max_prompt_chars, requires_pii, api_key_ids, target_provider, target_model)
+			VALUES ($1, $2, $3, $4, $5, $6, $7, $8, $9, $10, $11)
+			RETURNING id
+		`, tenantID, r.Name, r.Priority, r.Enabled, r.MatchModel, r.MinPromptChars, r.MaxPromptChars,
+			r.RequiresPII, pq.Array(r.APIKeyIDs), targetProvider, r.TargetModel).Scan(&r.ID)
+	}
+
+	res, err := db.DB.Exec(`
+		UPDATE routing_rules
+		SET name = $3, priority = $4, enabled = $5, match_model = $6, min_prompt_chars = $7,
+			max_prompt_chars = $8, requires_pii = $9, api_key_ids = $10, target_provider = $11, target_model = $12
+		WHERE id = $1 AND tenant_id = $2
+	`, r.ID, tenantID, r.Name, r.Priority, r.Enabled, r.MatchModel, r.MinPromptChars, r.MaxPromptChars,
+		r.RequiresPII, pq.Array(r.APIKeyIDs), targetProvider, r.TargetModel)
+	if err != nil {
+		return err
+	}
+	if n, _ := res.RowsAffected(); n == 0 {
+		return sql.ErrNoRows
+	}
+	return nil
+}
+
+// DeleteRoutingRule removes a rule
+func DeleteRoutingRule(tenantID uuid.UUID, id string) (bool, error) {
+	res, err := db.DB.Exec("DELETE FROM routing_rules WHERE id = $1 AND tenant_id = $2", id, tenantID)
+	if err != nil {
+		return false, err
+	}
+	n, _ := res.RowsAffected()
+	return n > 0, nil
+}
@@ -0,0 +1,250 @@
+package services
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"log/slog"
+	"os"
+	"strconv"
+	"sync"
+	"time"
+
+	"zaps/db"
+
+	"github.com/google/uuid"
+	"github.com/redis/go-redis/v9"
+)
+
+const (
+	jobLockPrefix = "job:lock:"
+	jobLastPrefix = "job:last:"
+)
+
+// JobFunc performs one run of a job and returns a summary stored in job_runs.result
+type JobFunc func(ctx context.Context) (map[string]interface{}, error)
+
+// Job is a periodic background task
+type Job struct {
+	Name     string
+	Interval time.Duration
+	Timeout  time.Duration // Also the lock TTL; defaults to Interval
+	Run      JobFunc
+}
+
+// JobRun is a row of the job_runs table
+type JobRun struct {
+	ID         int64                  `json:"id"`
+	JobName    string                 `json:"job_name"`
+	InstanceID string                 `json:"instance_id"`
+	Status     string                 `json:"status"`
+	Result     map[string]interface{} `json:"result,omitempty"`
+	Error      *string                `json:"error,omitempty"`
+	StartedAt  time.Time              `json:"started_at"`
+	FinishedAt *time.Time             `json:"finished_at,omitempty"`
+}
+
+// Scheduler runs registered jobs on every replica, but a Redis lock plus a
+// last-run marker ensures each job executes at most once per interval cluster-wide.
+type Scheduler struct {
+	rdb        *redis.Client
+	instanceID string
+	jobs       map[string]Job
+	wg         sync.WaitGroup
+	cancel     context.CancelFunc
+}
+
+// NewScheduler creates a scheduler identified by hostname + random suffix
+func NewScheduler(rdb *redis.Client) *Scheduler {
+	host, _ := os.Hostname()
+	return &Scheduler{
+		rdb:        rdb,
+		instanceID: fmt.Sprintf("%s-%s", host, uuid.New().String()[:8]),
+		jobs:       make(map[string]Job),
+	}
+}
+
+// Register adds a job; it must be called before Start
+func (s *Scheduler) Register(job Job) {
+	if job.Timeout == 0 {
+		job.Timeout = job.Interval
+	}
+	s.jobs[job.Name] = job
+}
+
+// Start launches one ticker goroutine per job
+func (s *Scheduler) Start(ctx context.Context) {
+	ctx, s.cancel = context.WithCancel(ctx)
+
+	for _, job := range s.jobs {
+		s.wg.Add(1)
+		go func(job Job) {
+			defer s.wg.Done()
+
+			// Check more often than the interval so a crashed leader is replaced quickly
+			tick := job.Interval / 4
+			if tick < 10*time.Second {
+				tick = 10 * time.Second
+			}
+			ticker := time.NewTicker(tick)
+			defer ticker.Stop()
+
+			s.tryRun(ctx, job, false)
+			for {
+				select {
+				case <-ctx.Done():
+					return
+				case <-ticker.C:
+					s.tryRun(ctx, job, false)
+				}
+			}
+		}(job)
+	}
+
+	slog.Info("scheduler started", "jobs", len(s.jobs), "instance", s.instanceID)
+}
+
+// Stop cancels all job loops and waits for in-flight runs to finish
+func (s *Scheduler) Stop() {
+	if s.cancel != nil {
+		s.cancel()
+	}
+	s.wg.Wait()
+}
+
+// Trigger runs a job immediately (still subject to the cluster lock)
+func (s *Scheduler) Trigger(ctx context.Context, name string) (bool, error) {
+	job, ok := s.jobs[name]
+	if !ok {
+		return false, fmt.Errorf("unknown job %q", name)
+	}
+	return s.tryRun(ctx, job, true), nil
+}
+
+// JobNames returns the registered job names
+func (s *Scheduler) JobNames() []string {
+	names := make([]string, 0, len(s.jobs))
+	for name := range s.jobs {
+		names = append(names, name)
+	}
+	return names
+}
+
+// releaseLockScript deletes the lock only if we still own it
+var releaseLockScript = redis.NewScript(`
+if redis.call("GET", KEYS[1]) == ARGV[1] then
+	return redis.call("DEL", KEYS[1])
+end
+return 0
+`)
+
+// tryRun acquires the job lock and runs the job if it is due. Returns true if it ran.
+func (s *Scheduler) tryRun(ctx context.Context, job Job, force bool) bool {
+	lockKey := jobLockPrefix + job.Name
+	ok, err := s.rdb.SetNX(ctx, lockKey, s.instanceID, job.Timeout).Result()
+	if err != nil || !ok {
+		return false
+	}
+	defer releaseLockScript.Run(context.Background(), s.rdb, []string{lockKey}, s.instanceID)
+
+	if !force {
+		last, err := s.rdb.Get(ctx, jobLastPrefix+job.Name).Int64()
+		if err == nil && time.Since(time.Unix(last, 0)) < job.Interval {
+			return false
+		}
+	}
+
+	runID, err := startJobRun(job.Name, s.instanceID)
+	if err != nil {
+		slog.Error("job: failed to record run", "job", job.Name, "error", err)
+		return false
+	}
+
+	runCtx, cancel := context.WithTimeout(ctx, job.Timeout)
+	defer cancel()
+
+	result, runErr := safeRun(runCtx, job)
+	finishJobRun(runID, result, runErr)
+
+	s.rdb.Set(context.Background(), jobLastPrefix+job.Name, strconv.FormatInt(time.Now().Unix(), 10), 0)
+
+	if runErr != nil {
+		slog.Error("job failed", "job", job.Name, "error", runErr)
+	} else {
+		slog.Info("job completed", "job", job.Name, "result", result)
+	}
+	return true
+}
+
+func safeRun(ctx context.Context, job Job) (result map[string]interface{}, err error) {
+	defer func() {
+		if r := recover(); r != nil {
+			err = fmt.Errorf("panic: %v", r)
+		}
+	}()
+	return job.Run(ctx)
+}
+
+func startJobRun(name, instanceID string) (int64, error) {
+	var id int64
+	err := db.DB.QueryRow(`
+		INSERT INTO job_runs (job_name, instance_id, status)
+		VALUES ($1, $2, 'running')
+		RETURNING id
+	`, name, instanceID).Scan(&id)
+	return id, err
+}
+
+func finishJobRun(id int64, result map[string]interface{}, runErr error) {
+	status := "succeeded"
+	var errText *string
+	if runErr != nil {
+		status = "failed"
+		msg := runErr.Error()
+		errText = &msg
+	}
+	if result == nil {
+		result = map[string]interface{}{}
+	}
+	data, _ := json.Marshal(result)
+
+	_, err := db.DB.Exec(`
+		UPDATE job_runs SET status = $2, result = $3, error = $4, finished_at = NOW()
+		WHERE id = $1
+	`, id, status, data, errText)
+	if err != nil {
+		slog.Error("failed to record job run", "run_id", id, "error", err)
+	}
+}
+
+// ListJobRuns returns recent runs, optionally for a single job
+func ListJobRuns(jobName string, limit int) ([]JobRun, error) {
+	query := `
+		SELECT id, job_name, instance_id, status, result, error, started_at, finished_at
+		FROM job_runs`
+	args := []interface{}{}
+	if jobName != "" {
+		query += " WHERE job_name = $1"
+		args = append(args, jobName)
+	}
+	query += fmt.Sprintf(" ORDER BY started_at DESC LIMIT $%d", len(args)+1)
+	args = append(args, limit)
+
+	rows, err := db.DB.Query(query, args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	runs := []JobRun{}
+	for rows.Next() {
+		var r JobRun
+		var result []byte
+		if err := rows.Scan(&r.ID, &r.JobName, &r.InstanceID, &r.Status, &result, &r.Error, &r.StartedAt, &r.FinishedAt); err != nil {
+			continue
+		}
+		json.Unmarshal(result, &r.Result)
+		runs = append(runs, r)
+	}
+	return runs, nil
+}
@@ -0,0 +1,318 @@
+package services
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"regexp"
+	"strings"
+	"time"
+
+	"zaps/db"
+
+	"github.com/google/uuid"
+	"github.com/lib/pq"
+	"github.com/redis/go-redis/v9"
+)
+
+const (
+	SemanticCachePrefix     = "semcache:"
+	SemanticCacheMaxEntries = 200 // Per tenant+model; lookups are a brute-force scan
+	DefaultSimilarity       = 0.95
+	DefaultSemanticCacheTTL = 3600
+)
+
+// SemanticCacheSettings is a tenant's semantic cache configuration
+type SemanticCacheSettings struct {
+	Enabled             bool     `json:"enabled"`
+	SimilarityThreshold float64  `json:"similarity_threshold"`
+	TTLSeconds          int      `json:"ttl_seconds"`
+	EnabledModels       []string `json:"enabled_models"`
+}
+
+// SemanticCacheHit is returned when a near-duplicate prompt was found
+type SemanticCacheHit struct {
+	Response   string
+	Similarity float64
+	Model      string
+}
+
+type semanticCacheEntry struct {
+	Embedding []float32 `json:"embedding"`
+	Embedder  string    `json:"embedder"`
+	Response  string    `json:"response"`
+	CreatedAt int64     `json:"created_at"`
+	ExpiresAt int64     `json:"expires_at"`
+}
+
+// ModelEnabled reports whether the cache applies to a given model
+func (s *SemanticCacheSettings) ModelEnabled(model string) bool {
+	if !s.Enabled {
+		return false
+	}
+	for _, m := range s.EnabledModels {
+		if m == model || m == "*" {
+			return true
+		}
+	}
+	return false
+}
+
+// GetSemanticCacheSettings loads a tenant's settings (defaults to disabled)
+func GetSemanticCacheSettings(tenantID string) (*SemanticCacheSettings, error) {
+	s := &SemanticCacheSettings{
+		SimilarityThreshold: DefaultSimilarity,
+		TTLSeconds:          DefaultSemanticCacheTTL,
+		EnabledModels:       []string{},
+	}
+
+	err := db.DB.QueryRow(`
+		SELECT enabled, similarity_threshold, ttl_seconds, enabled_models
+		FROM semantic_cache_settings
+		WHERE tenant_id = $1
+	`, tenantID).Scan(&s.Enabled, &s.SimilarityThreshold, &s.TTLSeconds, pq.Array(&s.EnabledModels))
+
+	if err == sql.ErrNoRows {
+		return s, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	return s, nil
+}
+
+// SaveSemanticCacheSettings upserts a tenant's settings
+func SaveSemanticCacheSettings(tenantID uuid.UUID, s *SemanticCacheSettings) error {
+	if s.SimilarityThreshold <= 0 || s.SimilarityThreshold > 1 {
+		return fmt.Errorf("similarity_threshold must be in (0, 1]")
+	}
+	if s.TTLSeconds <= 0 {
+		s.TTLSeconds = DefaultSemanticCacheTTL
+	}
+	if s.EnabledModels == nil {
+		s.EnabledModels = []string{}
+	}
+
+	_, err := db.DB.Exec(`
+		INSERT INTO semantic_cache_settings (tenant_id, enabled, similarity_threshold, ttl_seconds, enabled_models)
+		VALUES ($1, $2, $3, $4, $5)
+		ON CONFLICT (tenant_id)
+		DO UPDATE SET enabled = EXCLUDED.enabled,
+			similarity_threshold = EXCLUDED.similarity_threshold,
+			ttl_seconds = EXCLUDED.ttl_seconds,
+			enabled_models = EXCLUDED.enabled_models
+	`, tenantID, s.Enabled, s.SimilarityThreshold, s.TTLSeconds, pq.Array(s.EnabledModels))
+	return err
+}
+
+// Secret tokens carry a per-request ID; strip it so equivalent prompts embed the same
+var embeddingTokenRegex = regexp.MustCompile(`<SECRET:([A-Z_]+):\d+>`)
+
+// SemanticCachePrompt builds the text we embed from already-redacted chat messages
+func SemanticCachePrompt(messages []interface{}) string {
+	var sb strings.Builder
+	for _, msg := range messages {
+		m, ok := msg.(map[string]interface{})
+		if !ok {
+			continue
+		}
+		role, _ := m["role"].(string)
+		content, _ := m["content"].(string)
+		sb.WriteString(role)
+		sb.WriteString(": ")
+		sb.WriteString(embeddingTokenRegex.ReplaceAllString(content, "<SECRET:$1>"))
+		sb.WriteString("\n")
+	}
+	return sb.String()
+}
+
+func semanticCacheKey(tenantID, model, suffix string) string {
+	return SemanticCachePrefix + tenantID + ":" + model + ":" + suffix
+}
+
+// LookupSemanticCache returns the cached answer of the most similar prompt above the threshold
+func LookupSemanticCache(ctx context.Context, rdb *redis.Client, tenantID, model, prompt string, threshold float64) (*SemanticCacheHit, error) {
+	vec, err := embedder.Embed(ctx, prompt)
+	if err != nil {
+		return nil, err
+	}
+
+	entries, err := rdb.HGetAll(ctx, semanticCacheKey(tenantID, model, "entries")).Result()
+	if err != nil {
+		return nil, err
+	}
+
+	now := time.Now().Unix()
+	var best *SemanticCacheHit
+	var expired []string
+
+	for id, raw := range entries {
+		var e semanticCacheEntry
+		if err := json.Unmarshal([]byte(raw), &e); err != nil {
+			continue
+		}
+		if e.ExpiresAt < now {
+			expired = append(expired, id)
+			continue
+		}
+		if e.Embedder != embedder.Name() {
+			continue
+		}
+
+		sim := CosineSimilarity(vec, e.Embedding)
+		if sim >= threshold && (best == nil || sim > best.Similarity) {
+			best = &SemanticCacheHit{Response: e.Response, Similarity: sim, Model: model}
+		}
+	}
+
+	if len(expired) > 0 {
+		pipe := rdb.Pipeline()
+		pipe.HDel(ctx, semanticCacheKey(tenantID, model, "entries"), expired...)
+		for _, id := range expired {
+			pipe.ZRem(ctx, semanticCacheKey(tenantID, model, "index"), id)
+		}
+		pipe.Exec(ctx)
+	}
+
+	recordSemanticCacheResult(ctx, rdb, tenantID, model, best != nil)
+	return best, nil
+}
+
+// StoreSemanticCache saves a successful upstream answer for future near-duplicate prompts.
+// Answers that still reference secret tokens are never cached, as rehydrating them for a
+// different request would leak the original values.
+func StoreSemanticCache(ctx context.Context, rdb *redis.Client, tenantID, model, prompt, response string, ttl time.Duration) error {
+	if strings.Contains(response, "<SECRET:") {
+		return nil
+	}
+
+	vec, err := embedder.Embed(ctx, prompt)
+	if err != nil {
+		return err
+	}
+
+	now := time.Now()
+	data, err := json.Marshal(semanticCacheEntry{
+		Embedding: vec,
+		Embedder:  embedder.Name(),
+		Response:  response,
+		CreatedAt: now.Unix(),
+		ExpiresAt: now.Add(ttl).Unix(),
+	})
+	if err != nil {
+		return err
+	}
+
+	id := uuid.New().String()
+	entriesKey := semanticCacheKey(tenantID, model, "entries")
+	indexKey := semanticCacheKey(tenantID, model, "index")
+
+	pipe := rdb.TxPipeline()
+	pipe.HSet(ctx, entriesKey, id, data)
+	pipe.ZAdd(ctx, indexKey, redis.Z{Score: float64(now.Unix()), Member: id})
+	pipe.SAdd(ctx, SemanticCachePrefix+tenantID+":models", model)
+	if _, err := pipe.Exec(ctx); err != nil {
+		return err
+	}
+
+	// Evict oldest entries beyond the cap
+	count, err := rdb.ZCard(ctx, indexKey).Result()
+	if err == nil && count > SemanticCacheMaxEntries {
+		oldest, _ := rdb.ZRange(ctx, indexKey, 0, count-SemanticCacheMaxEntries-1).Result()
+		if len(oldest) > 0 {
+			pipe := rdb.Pipeline()
+			pipe.HDel(ctx, entriesKey, oldest...)
+			pipe.ZRem(ctx, indexKey, toInterfaces(oldest)...)
+			pipe.Exec(ctx)
+		}
+	}
+
+	return nil
+}
+
+// InvalidateSemanticCache drops cached entries for one model, or all models when model is empty
+func InvalidateSemanticCache(ctx context.Context, rdb *redis.Client, tenantID, model string) (int64, error) {
+	modelsKey := SemanticCachePrefix + tenantID + ":models"
+
+	models := []string{model}
+	if model == "" {
+		var err error
+		models, err = rdb.SMembers(ctx, modelsKey).Result()
+		if err != nil {
+			return 0, err
+		}
+	}
+
+	var removed int64
+	for _, m := range models {
+		n, _ := rdb.HLen(ctx, semanticCacheKey(tenantID, m, "entries")).Result()
+		removed += n
+		if err := rdb.Del(ctx, semanticCacheKey(tenantID, m, "entries"), semanticCacheKey(tenantID, m, "index")).Err(); err != nil {
+			return removed, err
+		}
+		rdb.SRem(ctx, modelsKey, m)
+	}
+
+	return removed, nil
+}
+
+// SemanticCacheStats returns hit/miss counters and entry counts per model
+func SemanticCacheStats(ctx context.Context, rdb *redis.Client, tenantID string) (map[string]map[string]interface{}, error) {
+	counters, err := rdb.HGetAll(ctx, SemanticCachePrefix+tenantID+":stats").Result()
+	if err != nil {
+		return nil, err
+	}
+
+	stats := make(map[string]map[string]interface{})
+	get := func(model string) map[string]interface{} {
+		if _, ok := stats[model]; !ok {
+			stats[model] = map[string]interface{}{"hits": int64(0), "misses": int64(0), "entries": int64(0)}
+		}
+		return stats[model]
+	}
+
+	for field, val := range counters {
+		idx := strings.LastIndex(field, ":")
+		if idx < 0 {
+			continue
+		}
+		var n int64
+		fmt.Sscanf(val, "%d", &n)
+		get(field[:idx])[field[idx+1:]] = n
+	}
+
+	models, _ := rdb.SMembers(ctx, SemanticCachePrefix+tenantID+":models").Result()
+	for _, m := range models {
+		n, _ := rdb.HLen(ctx, semanticCacheKey(tenantID, m, "entries")).Result()
+		get(m)["entries"] = n
+	}
+
+	for _, s := range stats {
+		hits, _ := s["hits"].(int64)
+		misses, _ := s["misses"].(int64)
+		rate := 0.0
+		if hits+misses > 0 {
+			rate = float64(hits) / float64(hits+misses)
+		}
+		s["hit_rate"] = rate
+	}
+
+	return stats, nil
+}
+
+func recordSemanticCacheResult(ctx context.Context, rdb *redis.Client, tenantID, model string, hit bool) {
+	field := model + ":misses"
+	if hit {
+		field = model + ":hits"
+	}
+	rdb.HIncrBy(ctx, SemanticCachePrefix+tenantID+":stats", field, 1)
+}
+
+func toInterfaces(s []string) []interface{} {
+	out := make([]interface{}, len(s))
+	for i, v := range s {
+		out[i] = v
+	}
+	return out
+}
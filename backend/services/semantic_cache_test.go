@@ -0,0 +1,85 @@
+package services
+
+import (
+	"context"
+	"testing"
+	"time"
+)
+
+func chatPrompt(messages ...string) string {
+	msgs := make([]interface{}, 0, len(messages))
+	for _, m := range messages {
+		msgs = append(msgs, map[string]interface{}{"role": "user", "content": m})
+	}
+	return SemanticCachePrompt(msgs)
+}
+
+func TestSemanticCacheLocalEmbedder(t *testing.T) {
+	_, rdb := newTestRedis(t)
+	SetEmbedder(NewLocalEmbedder(LocalEmbeddingDims))
+	ctx := context.Background()
+	const tenantID = "11111111-1111-1111-1111-111111111111"
+
+	stored := chatPrompt("Summarize the quarterly revenue report for <SECRET:ORG:4821> in three bullet points.")
+	if err := StoreSemanticCache(ctx, rdb, tenantID, "gpt-4o", stored, "Revenue grew 12%.", time.Hour); err != nil {
+		t.Fatal(err)
+	}
+
+	t.Run("near-duplicate hits", func(t *testing.T) {
+		// Different secret token ID, casing and punctuation
+		prompt := chatPrompt("summarize the quarterly revenue report for <SECRET:ORG:17> in three bullet points")
+		hit, err := LookupSemanticCache(ctx, rdb, tenantID, "gpt-4o", prompt, DefaultSimilarity)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if hit == nil {
+			t.Fatal("expected a cache hit")
+		}
+		if hit.Response != "Revenue grew 12%." || hit.Model != "gpt-4o" || hit.Similarity < DefaultSimilarity {
+			t.Errorf("unexpected hit %+v", hit)
+		}
+	})
+
+	t.Run("different prompt misses", func(t *testing.T) {
+		prompt := chatPrompt("Write a haiku about autumn leaves falling on a quiet pond.")
+		hit, err := LookupSemanticCache(ctx, rdb, tenantID, "gpt-4o", prompt, DefaultSimilarity)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if hit != nil {
+			t.Errorf("expected a miss, got similarity %.3f", hit.Similarity)
+		}
+	})
+
+	t.Run("different model misses", func(t *testing.T) {
+		hit, err := LookupSemanticCache(ctx, rdb, tenantID, "claude-3-5-sonnet", stored, DefaultSimilarity)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if hit != nil {
+			t.Error("expected a miss for another model")
+		}
+	})
+
+	t.Run("responses with secret tokens are not stored", func(t *testing.T) {
+		prompt := chatPrompt("Draft an email to <SECRET:EMAIL:99> confirming the meeting.")
+		if err := StoreSemanticCache(ctx, rdb, tenantID, "gpt-4o", prompt, "Dear <SECRET:EMAIL:99>, see you then.", time.Hour); err != nil {
+			t.Fatal(err)
+		}
+		hit, err := LookupSemanticCache(ctx, rdb, tenantID, "gpt-4o", prompt, DefaultSimilarity)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if hit != nil {
+			t.Errorf("response containing a secret token was cached: %q", hit.Response)
+		}
+	})
+
+	stats, err := SemanticCacheStats(ctx, rdb, tenantID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if s := stats["gpt-4o"]; s["hits"] != int64(1) || s["misses"] != int64(2) || s["entries"] != int64(1) {
+		t.Errorf("unexpected stats %v", s)
+	}
+}
@@ -1,7 +1,7 @@
 package services
 
 import (
-	"fmt"
+	"log/slog"
 	"os"
 
 	"github.com/stripe/stripe-go/v76"
@@ -14,7 +14,7 @@ import (
 func InitStripe() {
 	key := os.Getenv("STRIPE_SECRET_KEY")
 	if key == "" {
-		fmt.Println("⚠️ Stripe not configured (missing STRIPE_SECRET_KEY)")
+		slog.Warn("stripe not configured (missing STRIPE_SECRET_KEY)")
 		// Use a dummy key to prevent crashes if not set, but calls will fail
 		stripe.Key = "sk_test_placeholder"
 	} else {
@@ -0,0 +1,82 @@
+package services
+
+import (
+	"context"
+	"log/slog"
+	"os"
+	"sort"
+
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/exporters/otlp/otlptrace/otlptracehttp"
+	"go.opentelemetry.io/otel/propagation"
+	"go.opentelemetry.io/otel/sdk/resource"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	"go.opentelemetry.io/otel/trace"
+)
+
+// Tracing: spans are created through the global TracerProvider, so tests can install an
+// SDK provider with an in-memory exporter (sdk/trace/tracetest) before exercising handlers.
+// Span attributes carry only identifiers, counts and entity type names, never prompt
+// text, secret values or rehydrated output.
+
+const tracerName = "zaps/gateway"
+
+// InitTracing installs the W3C trace context propagator and, when an OTLP endpoint is
+// configured (OTEL_EXPORTER_OTLP_ENDPOINT or OTEL_EXPORTER_OTLP_TRACES_ENDPOINT), an
+// OTLP/HTTP exporter. Without an endpoint spans are not recorded but incoming
+// traceparent headers are still propagated. The returned func flushes pending spans.
+func InitTracing(ctx context.Context) (func(context.Context) error, error) {
+	otel.SetTextMapPropagator(propagation.NewCompositeTextMapPropagator(
+		propagation.TraceContext{}, propagation.Baggage{},
+	))
+
+	if os.Getenv("OTEL_EXPORTER_OTLP_ENDPOINT") == "" && os.Getenv("OTEL_EXPORTER_OTLP_TRACES_ENDPOINT") == "" {
+		return func(context.Context) error { return nil }, nil
+	}
+
+	exporter, err := otlptracehttp.New(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	// OTEL_SERVICE_NAME / OTEL_RESOURCE_ATTRIBUTES override the default service name
+	res, err := resource.New(ctx,
+		resource.WithTelemetrySDK(),
+		resource.WithAttributes(attribute.String("service.name", "zaps-gateway")),
+		resource.WithFromEnv(),
+	)
+	if err != nil {
+		return nil, err
+	}
+
+	tp := sdktrace.NewTracerProvider(
+		sdktrace.WithBatcher(exporter),
+		sdktrace.WithResource(res),
+	)
+	otel.SetTracerProvider(tp)
+	slog.Info("opentelemetry tracing enabled", "exporter", "otlp")
+
+	return tp.Shutdown, nil
+}
+
+// StartSpan starts a span from the global tracer
+func StartSpan(ctx context.Context, name string, opts ...trace.SpanStartOption) (context.Context, trace.Span) {
+	return otel.Tracer(tracerName).Start(ctx, name, opts...)
+}
+
+// PIITypeAttributes describes detections by entity type only (e.g. pii.types=["EMAIL"],
+// pii.count=3), which is safe to attach to spans
+func PIITypeAttributes(types map[string]int) []attribute.KeyValue {
+	names := make([]string, 0, len(types))
+	total := 0
+	for t, n := range types {
+		names = append(names, t)
+		total += n
+	}
+	sort.Strings(names)
+	return []attribute.KeyValue{
+		attribute.StringSlice("pii.types", names),
+		attribute.Int("pii.count", total),
+	}
+}
@@ -1,7 +1,13 @@
 package services
 
 import (
-	"log"
+	"context"
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"log/slog"
+	"sort"
+	"strings"
 	"time"
 
 	"zaps/db"
@@ -9,58 +15,209 @@ import (
 	"github.com/google/uuid"
 )
 
-// LogRequestUsage logs a request to the hourly usage_logs table
-// It handles the "upsert" logic (insert or increment)
-func LogRequestUsage(tenantID string, latencyMs int64, isError bool, tokenCount int) {
-	go func() {
-		// Parse Tenant ID
-		tID, err := uuid.Parse(tenantID)
+// RequestUsage describes a single proxied request for hourly aggregation
+type RequestUsage struct {
+	Ctx        context.Context `json:"-"` // Request context; links the usage span to the request trace (optional)
+	At         time.Time       // When the request completed; set by LogRequestUsage
+	TenantID   string
+	APIKeyID   string // Empty for dashboard sessions and legacy Redis-only keys
+	Provider   string
+	Model      string
+	StatusCode int
+	LatencyMs  int64
+	IsError    bool
+	Tokens     TokenUsage
+	CostUSD    float64
+	PIIEvents  map[string]int // Detections per entity type (SecretTypes)
+}
+
+// LogRequestUsage queues a request for the hourly usage_logs table and its
+// usage_metrics rollup (see EventWriter)
+func LogRequestUsage(u RequestUsage) {
+	if u.At.IsZero() {
+		u.At = time.Now()
+	}
+	ctx := u.Ctx
+	if ctx == nil {
+		ctx = context.Background()
+	}
+	_, span := StartSpan(ctx, "usage.record")
+	defer span.End()
+
+	u.Ctx = nil // Not kept alive while queued
+	events.enqueueUsage(&u)
+}
+
+// usageLogRow is one usage_logs upsert, summed over a batch
+type usageLogRow struct {
+	tenantID   uuid.UUID
+	apiKeyID   *uuid.UUID
+	hourBucket time.Time
+	requests   int64
+	errors     int64
+	latencyMs  int64 // Sum; stored as a running average
+	tokens     TokenUsage
+	costUSD    float64
+	piiEvents  map[string]int
+}
+
+// writeUsageBatch folds a batch into one row per tenant, key and hour (a multi-row
+// upsert may not touch the same row twice) and writes usage_logs and usage_metrics in
+// one transaction, so a retried batch is never counted twice
+func writeUsageBatch(ctx context.Context, batch []*RequestUsage) error {
+	type logKey struct {
+		tenantID, apiKeyID uuid.UUID
+		hour               int64
+	}
+	logRows := make(map[logKey]*usageLogRow)
+	var valid []*RequestUsage
+
+	for _, u := range batch {
+		tID, err := uuid.Parse(u.TenantID)
 		if err != nil {
-			log.Printf("❌ Usage Log Error: Invalid Tenant ID %s", tenantID)
-			return
+			slog.Error("usage log: invalid tenant ID", "tenant_id", u.TenantID)
+			continue
+		}
+		var kID *uuid.UUID
+		if id, err := uuid.Parse(u.APIKeyID); err == nil {
+			kID = &id
+		}
+		hourBucket := u.At.Truncate(time.Hour)
+
+		k := logKey{tenantID: tID, hour: hourBucket.Unix()}
+		if kID != nil {
+			k.apiKeyID = *kID
 		}
+		row, ok := logRows[k]
+		if !ok {
+			row = &usageLogRow{tenantID: tID, apiKeyID: kID, hourBucket: hourBucket, piiEvents: map[string]int{}}
+			logRows[k] = row
+		}
+		row.requests++
+		if u.IsError {
+			row.errors++
+		}
+		row.latencyMs += u.LatencyMs
+		row.tokens.PromptTokens += u.Tokens.PromptTokens
+		row.tokens.CompletionTokens += u.Tokens.CompletionTokens
+		row.tokens.CachedTokens += u.Tokens.CachedTokens
+		row.costUSD += u.CostUSD
+		for typ, n := range u.PIIEvents {
+			row.piiEvents[typ] += n
+		}
+		valid = append(valid, u)
+	}
+	if len(valid) == 0 {
+		return nil
+	}
 
-		// Calculate hour bucket (truncate to hour)
-		hourBucket := time.Now().Truncate(time.Hour)
+	// Unkeyed requests share one bucket per hour (partial unique index idx_usage_logs_unkeyed)
+	var keyed, unkeyed [][]interface{}
+	rows := make([]*usageLogRow, 0, len(logRows))
+	for _, row := range logRows {
+		rows = append(rows, row)
+	}
+	// A stable order keeps concurrent writers from deadlocking on row locks
+	sort.Slice(rows, func(i, j int) bool {
+		a, b := rows[i], rows[j]
+		if a.tenantID != b.tenantID {
+			return a.tenantID.String() < b.tenantID.String()
+		}
+		if !a.hourBucket.Equal(b.hourBucket) {
+			return a.hourBucket.Before(b.hourBucket)
+		}
+		return uuidString(a.apiKeyID) < uuidString(b.apiKeyID)
+	})
+	for _, row := range rows {
+		piiEvents, _ := json.Marshal(row.piiEvents)
+		values := []interface{}{row.tenantID, row.apiKeyID, row.hourBucket, row.requests, row.errors,
+			row.latencyMs / row.requests, row.tokens.Total(), row.tokens.PromptTokens,
+			row.tokens.CompletionTokens, row.tokens.CachedTokens, row.costUSD, piiEvents}
+		if row.apiKeyID != nil {
+			keyed = append(keyed, values)
+		} else {
+			unkeyed = append(unkeyed, values)
+		}
+	}
 
-		// Upsert into usage_logs
-		// We use ON CONFLICT to increment values if the row exists
-		query := `
+	tx, err := db.DB.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	for _, group := range []struct {
+		conflict string
+		rows     [][]interface{}
+	}{
+		{"(tenant_id, api_key_id, hour_bucket)", keyed},
+		{"(tenant_id, hour_bucket) WHERE api_key_id IS NULL", unkeyed},
+	} {
+		if err := execValues(ctx, tx, `
 			INSERT INTO usage_logs (
-				tenant_id, 
-				hour_bucket, 
-				request_count, 
-				error_count, 
-				avg_latency_ms,
-				total_tokens_processed
+				tenant_id, api_key_id, hour_bucket, request_count, error_count, avg_latency_ms,
+				total_tokens_processed, prompt_tokens, completion_tokens, cached_tokens, cost_usd, pii_events
 			)
-			VALUES ($1, $2, 1, $3, $4, $5)
-			ON CONFLICT (tenant_id, api_key_id, hour_bucket) 
-			WHERE api_key_id IS NULL -- We handle the NULL api_key_id case here (common bucket)
+			VALUES `, `
+			ON CONFLICT `+group.conflict+`
 			DO UPDATE SET
-				request_count = usage_logs.request_count + 1,
+				request_count = usage_logs.request_count + EXCLUDED.request_count,
 				error_count = usage_logs.error_count + EXCLUDED.error_count,
 				total_tokens_processed = usage_logs.total_tokens_processed + EXCLUDED.total_tokens_processed,
-				-- Simple moving average approximation for latency? Or just sum and divide later?
-				-- Schema says "avg_latency_ms INTEGER". 
-				-- To keep it simple, let's just update it to the latest for now, 
-				-- OR better yet, let's change schema to store 'total_latency' and calc avg on read.
-				-- For now, let's just set avg_latency to specific value to avoid complexity, or weighted avg.
-				-- Weighted avg: (old_avg * old_count + new_val) / new_count
-				avg_latency_ms = (usage_logs.avg_latency_ms * usage_logs.request_count + EXCLUDED.avg_latency_ms) / (usage_logs.request_count + 1)
-		`
-
-		// Error count is 1 if isError, else 0
-		errCount := 0
-		if isError {
-			errCount = 1
+				prompt_tokens = usage_logs.prompt_tokens + EXCLUDED.prompt_tokens,
+				completion_tokens = usage_logs.completion_tokens + EXCLUDED.completion_tokens,
+				cached_tokens = usage_logs.cached_tokens + EXCLUDED.cached_tokens,
+				cost_usd = usage_logs.cost_usd + EXCLUDED.cost_usd,
+				pii_events = jsonb_merge_counts(usage_logs.pii_events, EXCLUDED.pii_events),
+				-- Weighted average: (old_avg * old_count + batch_avg * batch_count) / new_count
+				avg_latency_ms = (usage_logs.avg_latency_ms * usage_logs.request_count
+					+ EXCLUDED.avg_latency_ms * EXCLUDED.request_count)
+					/ (usage_logs.request_count + EXCLUDED.request_count)
+		`, group.rows); err != nil {
+			ObserveBackendError(BackendPostgres, "usage_log")
+			return err
 		}
+	}
 
-		// Note: We are assuming api_key_id is NULL for now as we don't strictly track it in proxy yet
-		_, err = db.DB.Exec(query, tID, hourBucket, errCount, latencyMs, tokenCount)
+	if err := upsertUsageMetrics(ctx, tx, valid); err != nil {
+		ObserveBackendError(BackendPostgres, "usage_metrics")
+		return err
+	}
+	return tx.Commit()
+}
 
-		if err != nil {
-			log.Printf("❌ Failed to log usage stats: %v", err)
+// maxQueryParams is Postgres' limit on bind parameters per statement
+const maxQueryParams = 65535
+
+// execValues runs prefix + "($1, ...), (...)" + suffix for rows, in as many
+// statements as the parameter limit requires
+func execValues(ctx context.Context, tx *sql.Tx, prefix, suffix string, rows [][]interface{}) error {
+	if len(rows) == 0 {
+		return nil
+	}
+	cols := len(rows[0])
+	perStmt := maxQueryParams / cols
+	for start := 0; start < len(rows); start += perStmt {
+		end := min(start+perStmt, len(rows))
+		var sb strings.Builder
+		args := make([]interface{}, 0, (end-start)*cols)
+		for i, row := range rows[start:end] {
+			if i > 0 {
+				sb.WriteString(", ")
+			}
+			sb.WriteByte('(')
+			for j := range row {
+				if j > 0 {
+					sb.WriteString(", ")
+				}
+				fmt.Fprintf(&sb, "$%d", len(args)+j+1)
+			}
+			sb.WriteByte(')')
+			args = append(args, row...)
+		}
+		if _, err := tx.ExecContext(ctx, prefix+sb.String()+suffix, args...); err != nil {
+			return err
 		}
-	}()
+	}
+	return nil
 }